@@ -0,0 +1,329 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bench drives read, write and list workloads against a Cloud Storage
+// bucket and reports their latency and throughput, so the backends of the
+// fake server can be compared, and regressions caught.
+//
+// Workloads run through the Go client library, so the same configuration can
+// target the fake server (using the client returned by Server.Client) or a
+// bucket in Cloud Storage. The bench subcommand of cmd/fake-gcs-server is a
+// thin wrapper around Run and Report.String.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Names of the operations of workloads.
+const (
+	OpRead  = "read"
+	OpWrite = "write"
+	OpList  = "list"
+)
+
+// Config describes a workload.
+type Config struct {
+	// Prefix of the objects touched by the workload. The default is
+	// "bench/".
+	Prefix string
+
+	// Number of objects in the key space of the workload. They're written
+	// before the workload starts, so reads never miss. The default is 100.
+	Objects int
+
+	// Size of the objects written by the workload, in bytes. The default is
+	// 1024.
+	ObjectSize int
+
+	// Number of goroutines issuing operations concurrently. The default is
+	// 1.
+	Workers int
+
+	// Relative weights of the operations in the workload. They can't be
+	// negative, and when all of them are zero, the workload is made only of
+	// reads.
+	ReadWeight  int
+	WriteWeight int
+	ListWeight  int
+
+	// The workload stops when either Operations operations were issued or
+	// Duration has elapsed. At least one of them must be set.
+	Operations int
+	Duration   time.Duration
+
+	// Seed of the random choice of operations and objects, for reproducible
+	// workloads.
+	Seed int64
+}
+
+func (c Config) withDefaults() Config {
+	if c.Prefix == "" {
+		c.Prefix = "bench/"
+	}
+	if c.Objects <= 0 {
+		c.Objects = 100
+	}
+	if c.ObjectSize <= 0 {
+		c.ObjectSize = 1024
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.ReadWeight == 0 && c.WriteWeight == 0 && c.ListWeight == 0 {
+		c.ReadWeight = 1
+	}
+	return c
+}
+
+func (c Config) validate() error {
+	if c.Operations <= 0 && c.Duration <= 0 {
+		return errors.New("bench: either Operations or Duration must be set")
+	}
+	if c.ReadWeight < 0 || c.WriteWeight < 0 || c.ListWeight < 0 {
+		return errors.New("bench: weights of operations can't be negative")
+	}
+	if c.ReadWeight+c.WriteWeight+c.ListWeight <= 0 {
+		return errors.New("bench: the sum of the weights of operations must be positive")
+	}
+	return nil
+}
+
+// OpStats are the statistics of an operation in a workload. Latencies only
+// account for successful operations.
+type OpStats struct {
+	Count  int
+	Errors int
+	Bytes  int64
+	Mean   time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+
+	latencies []time.Duration
+}
+
+// Report is the outcome of a workload.
+type Report struct {
+	Elapsed time.Duration
+	Ops     map[string]*OpStats
+}
+
+// Throughput returns the number of operations per second in the workload,
+// including failed operations.
+func (r Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.count()) / r.Elapsed.Seconds()
+}
+
+// String formats the report as a table, with a line per operation.
+func (r Report) String() string {
+	var names []string
+	for name := range r.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6s %8s %7s %10s %10s %10s %10s %10s %12s\n", "op", "count", "errors", "mean", "p50", "p90", "p99", "max", "MB/s")
+	for _, name := range names {
+		stats := r.Ops[name]
+		var mbps float64
+		if r.Elapsed > 0 {
+			mbps = float64(stats.Bytes) / (1 << 20) / r.Elapsed.Seconds()
+		}
+		fmt.Fprintf(&b, "%-6s %8d %7d %10s %10s %10s %10s %10s %12.2f\n", name, stats.Count, stats.Errors,
+			stats.Mean, stats.P50, stats.P90, stats.P99, stats.Max, mbps)
+	}
+	fmt.Fprintf(&b, "%d ops in %s (%.1f ops/s)\n", r.count(), r.Elapsed.Round(time.Millisecond), r.Throughput())
+	return b.String()
+}
+
+func (r Report) count() int {
+	var count int
+	for _, stats := range r.Ops {
+		count += stats.Count
+	}
+	return count
+}
+
+// Run writes the key space of the workload to the bucket and then runs the
+// workload. Failed operations are counted in the report, they don't stop the
+// workload; errors are returned only when the configuration is invalid or
+// the key space can't be written.
+func Run(ctx context.Context, bucket *storage.BucketHandle, config Config) (Report, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return Report{}, err
+	}
+	content := bytes.Repeat([]byte("x"), config.ObjectSize)
+	for i := 0; i < config.Objects; i++ {
+		if err := writeObject(ctx, bucket.Object(objectName(config, i)), content); err != nil {
+			return Report{}, fmt.Errorf("bench: failed to write key space: %v", err)
+		}
+	}
+
+	if config.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+	var (
+		mtx    sync.Mutex
+		issued int
+		wg     sync.WaitGroup
+	)
+	results := make([]map[string]*OpStats, config.Workers)
+	start := time.Now()
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(config.Seed + int64(worker)))
+			stats := make(map[string]*OpStats)
+			results[worker] = stats
+			for ctx.Err() == nil {
+				if config.Operations > 0 {
+					mtx.Lock()
+					if issued >= config.Operations {
+						mtx.Unlock()
+						return
+					}
+					issued++
+					mtx.Unlock()
+				}
+				op := pickOperation(config, rnd)
+				opStart := time.Now()
+				n, err := runOperation(ctx, bucket, config, op, rnd.Intn(config.Objects), content)
+				latency := time.Since(opStart)
+				if ctx.Err() != nil && err != nil {
+					// Operations cut by the end of the workload are left out.
+					return
+				}
+				s, ok := stats[op]
+				if !ok {
+					s = &OpStats{}
+					stats[op] = s
+				}
+				s.Count++
+				if err != nil {
+					s.Errors++
+					continue
+				}
+				s.Bytes += n
+				s.latencies = append(s.latencies, latency)
+			}
+		}(i)
+	}
+	wg.Wait()
+	report := Report{Elapsed: time.Since(start), Ops: make(map[string]*OpStats)}
+	for _, stats := range results {
+		for op, s := range stats {
+			merged, ok := report.Ops[op]
+			if !ok {
+				merged = &OpStats{}
+				report.Ops[op] = merged
+			}
+			merged.Count += s.Count
+			merged.Errors += s.Errors
+			merged.Bytes += s.Bytes
+			merged.latencies = append(merged.latencies, s.latencies...)
+		}
+	}
+	for _, stats := range report.Ops {
+		stats.summarize()
+	}
+	return report, nil
+}
+
+func (s *OpStats) summarize() {
+	if len(s.latencies) == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	var total time.Duration
+	for _, latency := range s.latencies {
+		total += latency
+	}
+	s.Mean = total / time.Duration(len(s.latencies))
+	s.P50 = percentile(s.latencies, 50)
+	s.P90 = percentile(s.latencies, 90)
+	s.P99 = percentile(s.latencies, 99)
+	s.Max = s.latencies[len(s.latencies)-1]
+}
+
+// percentile returns the p-th percentile of the sorted latencies, using the
+// nearest-rank method.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	rank := (p*len(latencies) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
+
+func pickOperation(config Config, rnd *rand.Rand) string {
+	n := rnd.Intn(config.ReadWeight + config.WriteWeight + config.ListWeight)
+	switch {
+	case n < config.ReadWeight:
+		return OpRead
+	case n < config.ReadWeight+config.WriteWeight:
+		return OpWrite
+	default:
+		return OpList
+	}
+}
+
+func runOperation(ctx context.Context, bucket *storage.BucketHandle, config Config, op string, i int, content []byte) (int64, error) {
+	switch op {
+	case OpRead:
+		r, err := bucket.Object(objectName(config, i)).NewReader(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		return io.Copy(ioutil.Discard, r)
+	case OpWrite:
+		return int64(len(content)), writeObject(ctx, bucket.Object(objectName(config, i)), content)
+	default:
+		it := bucket.Objects(ctx, &storage.Query{Prefix: config.Prefix})
+		for {
+			_, err := it.Next()
+			if err == iterator.Done {
+				return 0, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func objectName(config Config, i int) string {
+	return fmt.Sprintf("%sobject-%06d", config.Prefix, i)
+}
+
+func writeObject(ctx context.Context, obj *storage.ObjectHandle, content []byte) error {
+	w := obj.NewWriter(ctx)
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
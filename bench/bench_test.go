@@ -0,0 +1,112 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestRunBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakestorage-bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var tests = []struct {
+		name    string
+		options fakestorage.Options
+	}{
+		{"memory", fakestorage.Options{NoListener: true}},
+		{"filesystem", fakestorage.Options{NoListener: true, StorageRoot: dir}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := fakestorage.NewServerWithOptions(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			if err := server.CreateBucket("bench-bucket"); err != nil {
+				t.Fatal(err)
+			}
+			report, err := Run(context.Background(), server.Client().Bucket("bench-bucket"), Config{
+				Objects:     10,
+				ObjectSize:  100,
+				Workers:     4,
+				ReadWeight:  2,
+				WriteWeight: 1,
+				ListWeight:  1,
+				Operations:  200,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var count int
+			for op, stats := range report.Ops {
+				count += stats.Count
+				if stats.Errors != 0 {
+					t.Errorf("unexpected errors for %s: %d", op, stats.Errors)
+				}
+				if stats.P50 > stats.P99 || stats.P99 > stats.Max {
+					t.Errorf("inconsistent latencies for %s: %+v", op, stats)
+				}
+			}
+			if count != 200 {
+				t.Errorf("wrong number of operations\nwant %d\ngot  %d", 200, count)
+			}
+			if stats := report.Ops[OpRead]; stats == nil || stats.Bytes != int64(stats.Count*100) {
+				t.Errorf("wrong stats for reads: %+v", stats)
+			}
+			t.Logf("\n%s", report)
+		})
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("bench-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Run(context.Background(), server.Client().Bucket("bench-bucket"), Config{
+		Objects:  5,
+		Duration: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Ops[OpRead] == nil || report.Ops[OpRead].Count == 0 {
+		t.Errorf("no reads in the report: %+v", report.Ops)
+	}
+	if len(report.Ops) != 1 {
+		t.Errorf("unexpected operations in a read-only workload: %+v", report.Ops)
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config Config
+	}{
+		{"no limit", Config{}},
+		{"negative weight", Config{Operations: 10, ReadWeight: 1, WriteWeight: -1}},
+		{"negative sum", Config{Operations: 10, ReadWeight: -1, ListWeight: -1}},
+	}
+	for _, test := range tests {
+		if _, err := Run(context.Background(), nil, test.config); err == nil {
+			t.Errorf("%s: unexpected <nil> error", test.name)
+		}
+	}
+}
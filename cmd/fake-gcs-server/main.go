@@ -0,0 +1,175 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command fake-gcs-server groups the command line tools of the fake server.
+//
+// The bench subcommand runs a workload against a bucket and prints its latency
+// and throughput, see package bench:
+//
+//	fake-gcs-server bench [flags]
+//
+// The workload targets an in-process fake server by default, with the backend
+// selected by -backend, a fake server running elsewhere with -url, or Cloud
+// Storage, using the application default credentials, with -gcs.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/bench"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "bench":
+		if err := runBench(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fake-gcs-server bench: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s bench [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func runBench(args []string) error {
+	var config bench.Config
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	serverURL := flags.String("url", "", "URL of a running fake server, such as https://127.0.0.1:4443")
+	gcs := flags.Bool("gcs", false, "run the workload against Cloud Storage, using the application default credentials")
+	backend := flags.String("backend", "memory", "backend of the in-process fake server: memory or filesystem")
+	bucketName := flags.String("bucket", "bench-bucket", "bucket used by the workload")
+	flags.StringVar(&config.Prefix, "prefix", "bench/", "prefix of the objects touched by the workload")
+	flags.IntVar(&config.Objects, "objects", 100, "number of objects in the key space")
+	flags.IntVar(&config.ObjectSize, "size", 1024, "size of the objects, in bytes")
+	flags.IntVar(&config.Workers, "workers", 1, "number of concurrent workers")
+	flags.IntVar(&config.ReadWeight, "read", 1, "relative weight of reads")
+	flags.IntVar(&config.WriteWeight, "write", 0, "relative weight of writes")
+	flags.IntVar(&config.ListWeight, "list", 0, "relative weight of listings")
+	flags.IntVar(&config.Operations, "ops", 0, "number of operations in the workload")
+	flags.DurationVar(&config.Duration, "duration", 0, "duration of the workload")
+	flags.Int64Var(&config.Seed, "seed", 0, "seed of the random choices of the workload")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	var client *storage.Client
+	var err error
+	switch {
+	case *serverURL != "" && *gcs:
+		return errors.New("-url and -gcs are mutually exclusive")
+	case *gcs:
+		client, err = storage.NewClient(ctx)
+	case *serverURL != "":
+		client, err = remoteFakeClient(ctx, *serverURL)
+		if err == nil {
+			err = createBucket(ctx, client, *bucketName)
+		}
+	default:
+		var server *fakestorage.Server
+		var cleanup func()
+		server, cleanup, err = inProcessServer(*backend)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if err := server.CreateBucket(*bucketName); err != nil {
+			return err
+		}
+		client = server.Client()
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	report, err := bench.Run(ctx, client.Bucket(*bucketName), config)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
+
+// remoteFakeClient returns a client that sends all requests to the fake
+// server at the given URL, without verifying its certificate.
+func remoteFakeClient(ctx context.Context, serverURL string) (*storage.Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q: only https is supported", serverURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	// #nosec
+	tlsConfig := tls.Config{InsecureSkipVerify: true}
+	transport := &http.Transport{
+		TLSClientConfig: &tlsConfig,
+		DialTLS: func(string, string) (net.Conn, error) {
+			return tls.Dial("tcp", addr, &tlsConfig)
+		},
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+}
+
+// createBucket creates the bucket of the workload in a fake server, unless
+// it already exists.
+func createBucket(ctx context.Context, client *storage.Client, name string) error {
+	err := client.Bucket(name).Create(ctx, "fake-project", nil)
+	if gErr, ok := err.(*googleapi.Error); ok && gErr.Code == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// inProcessServer starts a fake server with the given backend. The returned
+// function stops it and removes its files.
+func inProcessServer(backend string) (*fakestorage.Server, func(), error) {
+	options := fakestorage.Options{NoListener: true}
+	cleanup := func() {}
+	switch backend {
+	case "memory":
+	case "filesystem":
+		dir, err := ioutil.TempDir("", "fake-gcs-bench")
+		if err != nil {
+			return nil, nil, err
+		}
+		options.StorageRoot = dir
+		cleanup = func() { os.RemoveAll(dir) }
+	default:
+		return nil, nil, fmt.Errorf("invalid backend %q", backend)
+	}
+	server, err := fakestorage.NewServerWithOptions(options)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return server, func() {
+		server.Stop()
+		cleanup()
+	}, nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conformance runs a matrix of operations against a Cloud Storage
+// bucket and records their outcomes in a normalized form, so the results
+// obtained from the fake server can be compared with the results obtained
+// from the real service.
+//
+// The tests in this package always run the matrix against the fake server.
+// When the environment variable FAKE_GCS_CONFORMANCE_BUCKET is set, they also
+// run it against that bucket in Cloud Storage, using the application default
+// credentials, and report every difference between the two runs. When gsutil
+// is installed, they also drive it against the fake server.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// Result is the normalized outcome of an operation. Values that are expected
+// to differ between servers, like generations and timestamps, are left out.
+type Result struct {
+	Operation string
+	Output    string
+	Err       string
+}
+
+func (r Result) String() string {
+	if r.Err != "" {
+		return fmt.Sprintf("%s: error %s", r.Operation, r.Err)
+	}
+	return fmt.Sprintf("%s: %s", r.Operation, r.Output)
+}
+
+// Operation is an entry in the matrix. Operations run in order against the
+// same bucket, and they only touch objects whose names start with prefix.
+type Operation struct {
+	Name string
+	Run  func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error)
+}
+
+// Operations is the matrix of operations executed by Run.
+var Operations = []Operation{
+	{"write object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return writeObject(ctx, bucket.Object(prefix+"dir/object.txt"), "some content", "text/plain")
+	}},
+	{"write nested object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return writeObject(ctx, bucket.Object(prefix+"dir/sub/object.txt"), "other content", "text/plain")
+	}},
+	{"read object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return readObject(ctx, bucket.Object(prefix+"dir/object.txt"), 0, -1)
+	}},
+	{"read range", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return readObject(ctx, bucket.Object(prefix+"dir/object.txt"), 5, 3)
+	}},
+	{"object attrs", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		attrs, err := bucket.Object(prefix + "dir/object.txt").Attrs(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatAttrs(attrs), nil
+	}},
+	{"overwrite object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return writeObject(ctx, bucket.Object(prefix+"dir/object.txt"), "new content", "application/octet-stream")
+	}},
+	{"write object if it doesn't exist", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		obj := bucket.Object(prefix + "dir/object.txt").If(storage.Conditions{DoesNotExist: true})
+		return writeObject(ctx, obj, "conditional content", "text/plain")
+	}},
+	{"update metadata", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		attrs, err := bucket.Object(prefix+"dir/object.txt").Update(ctx, storage.ObjectAttrsToUpdate{
+			ContentType:  "text/csv",
+			CacheControl: "no-cache",
+		})
+		if err != nil {
+			return "", err
+		}
+		return formatAttrs(attrs), nil
+	}},
+	{"copy object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		src := bucket.Object(prefix + "dir/object.txt")
+		attrs, err := bucket.Object(prefix + "copy.txt").CopierFrom(src).Run(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatAttrs(attrs), nil
+	}},
+	{"list objects", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return listObjects(ctx, bucket, &storage.Query{Prefix: prefix})
+	}},
+	{"list objects with delimiter", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return listObjects(ctx, bucket, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	}},
+	{"list objects with prefix and delimiter", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return listObjects(ctx, bucket, &storage.Query{Prefix: prefix + "dir/", Delimiter: "/"})
+	}},
+	{"delete object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return "deleted", bucket.Object(prefix + "dir/object.txt").Delete(ctx)
+	}},
+	{"read deleted object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return readObject(ctx, bucket.Object(prefix+"dir/object.txt"), 0, -1)
+	}},
+	{"delete missing object", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		return "deleted", bucket.Object(prefix + "dir/object.txt").Delete(ctx)
+	}},
+	{"cleanup", func(ctx context.Context, bucket *storage.BucketHandle, prefix string) (string, error) {
+		for _, name := range []string{"dir/sub/object.txt", "copy.txt"} {
+			if err := bucket.Object(prefix + name).Delete(ctx); err != nil {
+				return "", err
+			}
+		}
+		return listObjects(ctx, bucket, &storage.Query{Prefix: prefix})
+	}},
+}
+
+// Run executes all operations against the bucket, in order, and returns
+// their results.
+func Run(ctx context.Context, bucket *storage.BucketHandle, prefix string) []Result {
+	results := make([]Result, len(Operations))
+	for i, op := range Operations {
+		output, err := op.Run(ctx, bucket, prefix)
+		results[i] = Result{Operation: op.Name, Output: output, Err: normalizeError(err)}
+		if err != nil {
+			results[i].Output = ""
+		}
+	}
+	return results
+}
+
+// Diff compares two sets of results returned by Run, returning a description
+// of each difference.
+func Diff(want, got []Result) []string {
+	var diffs []string
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			diffs = append(diffs, fmt.Sprintf("missing result: %s", want[i]))
+		case i >= len(want):
+			diffs = append(diffs, fmt.Sprintf("unexpected result: %s", got[i]))
+		case want[i] != got[i]:
+			diffs = append(diffs, fmt.Sprintf("%s\n\twant %s\n\tgot  %s", want[i].Operation, want[i], got[i]))
+		}
+	}
+	return diffs
+}
+
+func normalizeError(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *googleapi.Error:
+		return fmt.Sprintf("http %d", e.Code)
+	}
+	if err == storage.ErrObjectNotExist {
+		return "object doesn't exist"
+	}
+	return err.Error()
+}
+
+func writeObject(ctx context.Context, obj *storage.ObjectHandle, content, contentType string) (string, error) {
+	w := obj.NewWriter(ctx)
+	w.ContentType = contentType
+	_, err := w.Write([]byte(content))
+	if err != nil {
+		w.Close()
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	return formatAttrs(w.Attrs()), nil
+}
+
+func readObject(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) (string, error) {
+	r, err := obj.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("content=%q size=%d", data, r.Attrs.Size), nil
+}
+
+func listObjects(ctx context.Context, bucket *storage.BucketHandle, query *storage.Query) (string, error) {
+	var entries []string
+	it := bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if attrs.Prefix != "" {
+			entries = append(entries, "prefix:"+strings.TrimPrefix(attrs.Prefix, query.Prefix))
+		} else {
+			entries = append(entries, "object:"+strings.TrimPrefix(attrs.Name, query.Prefix))
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ","), nil
+}
+
+func formatAttrs(attrs *storage.ObjectAttrs) string {
+	return fmt.Sprintf("size=%d contentType=%q cacheControl=%q md5=%x crc32c=%d",
+		attrs.Size, attrs.ContentType, attrs.CacheControl, attrs.MD5, attrs.CRC32C)
+}
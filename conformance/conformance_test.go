@@ -0,0 +1,101 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+const bucketEnvVar = "FAKE_GCS_CONFORMANCE_BUCKET"
+
+func runFake(t *testing.T) []Result {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("conformance-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	return Run(context.Background(), server.Client().Bucket("conformance-bucket"), "conformance/")
+}
+
+// expectedResults are the results the matrix is expected to produce in Cloud
+// Storage. They were written from the documented behavior of the service,
+// not captured from it: TestRealServer checks them against a real bucket
+// when FAKE_GCS_CONFORMANCE_BUCKET is set.
+var expectedResults = []Result{
+	{Operation: "write object", Output: `size=12 contentType="text/plain" cacheControl="" md5=9893532233caff98cd083a116b013c0b crc32c=4062444435`},
+	{Operation: "write nested object", Output: `size=13 contentType="text/plain" cacheControl="" md5=0c84751f0ca9c6886bb09f2dd1a66faa crc32c=4138499661`},
+	{Operation: "read object", Output: `content="some content" size=12`},
+	{Operation: "read range", Output: `content="con" size=12`},
+	{Operation: "object attrs", Output: `size=12 contentType="text/plain" cacheControl="" md5=9893532233caff98cd083a116b013c0b crc32c=4062444435`},
+	{Operation: "overwrite object", Output: `size=11 contentType="application/octet-stream" cacheControl="" md5=96c15c2bb2921193bf290df8cd85e2ba crc32c=653056366`},
+	{Operation: "write object if it doesn't exist", Err: "http 412"},
+	{Operation: "update metadata", Output: `size=11 contentType="text/csv" cacheControl="no-cache" md5=96c15c2bb2921193bf290df8cd85e2ba crc32c=653056366`},
+	{Operation: "copy object", Output: `size=11 contentType="text/csv" cacheControl="no-cache" md5=96c15c2bb2921193bf290df8cd85e2ba crc32c=653056366`},
+	{Operation: "list objects", Output: "object:copy.txt,object:dir/object.txt,object:dir/sub/object.txt"},
+	{Operation: "list objects with delimiter", Output: "object:copy.txt,prefix:dir/"},
+	{Operation: "list objects with prefix and delimiter", Output: "object:object.txt,prefix:sub/"},
+	{Operation: "delete object", Output: "deleted"},
+	{Operation: "read deleted object", Err: "object doesn't exist"},
+	{Operation: "delete missing object", Err: "object doesn't exist"},
+	{Operation: "cleanup", Output: ""},
+}
+
+// knownDifferences lists the operations where the fake server is known to
+// differ from Cloud Storage. Fixing one of them should remove it from the
+// list, so the test starts guarding the new behavior.
+var knownDifferences = map[string]string{}
+
+func TestFakeServer(t *testing.T) {
+	results := runFake(t)
+	for i, result := range results {
+		if i >= len(expectedResults) {
+			t.Errorf("unexpected result: %s", result)
+			continue
+		}
+		expected := expectedResults[i]
+		reason, known := knownDifferences[expected.Operation]
+		switch {
+		case result == expected && known:
+			t.Errorf("%s: result matches the expected result, remove it from the known differences (%s)", expected.Operation, reason)
+		case result != expected && !known:
+			t.Errorf("%s\nwant %s\ngot  %s", expected.Operation, expected, result)
+		}
+	}
+	if len(results) < len(expectedResults) {
+		t.Errorf("wrong number of results\nwant %d\ngot  %d", len(expectedResults), len(results))
+	}
+}
+
+func TestRealServer(t *testing.T) {
+	bucketName := os.Getenv(bucketEnvVar)
+	if bucketName == "" {
+		t.Skipf("%s not set", bucketEnvVar)
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	prefix := fmt.Sprintf("fake-gcs-conformance/%d/", time.Now().UnixNano())
+	gcsResults := Run(ctx, client.Bucket(bucketName), prefix)
+	if diffs := Diff(expectedResults, gcsResults); len(diffs) > 0 {
+		t.Errorf("expected results differ from Cloud Storage:\n%s", strings.Join(diffs, "\n"))
+	}
+	if diffs := Diff(gcsResults, runFake(t)); len(diffs) > 0 {
+		t.Errorf("fake server differs from Cloud Storage:\n%s", strings.Join(diffs, "\n"))
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogger writes a line for each request processed by the server.
+type accessLogger struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (l *accessLogger) log(start time.Time, requestID string, r *http.Request, status int) {
+	if l == nil || l.w == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	fmt.Fprintf(l.w, "%s request_id=%s method=%s path=%q status=%d duration=%s\n",
+		start.UTC().Format(time.RFC3339), requestID, r.Method, r.URL.RequestURI(), status, time.Since(start))
+}
+
+func (l *accessLogger) logStart(url string) {
+	if l == nil || l.w == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	fmt.Fprintf(l.w, "%s server listening on %s\n", time.Now().UTC().Format(time.RFC3339), url)
+}
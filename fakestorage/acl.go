@@ -0,0 +1,246 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// projectTeams are the teams of project entities, as in project-owners-123.
+var projectTeams = []string{"owners", "editors", "viewers"}
+
+// expandACLRule fills the fields derived from the entity of the rule, like
+// the JSON API does: the email of users and groups, the ID of users
+// identified by ID, the domain of domain entities and the project team of
+// project entities.
+func expandACLRule(rule storage.ACLRule) storage.ACLRule {
+	entity := string(rule.Entity)
+	expanded := storage.ACLRule{Entity: rule.Entity, Role: rule.Role}
+	switch {
+	case strings.HasPrefix(entity, "user-"), strings.HasPrefix(entity, "group-"):
+		id := entity[strings.Index(entity, "-")+1:]
+		if strings.Contains(id, "@") {
+			expanded.Email = id
+		} else {
+			expanded.EntityID = id
+		}
+	case strings.HasPrefix(entity, "domain-"):
+		expanded.Domain = strings.TrimPrefix(entity, "domain-")
+	case strings.HasPrefix(entity, "project-"):
+		for _, team := range projectTeams {
+			prefix := "project-" + team + "-"
+			if strings.HasPrefix(entity, prefix) {
+				expanded.ProjectTeam = &storage.ProjectTeam{ProjectNumber: strings.TrimPrefix(entity, prefix), Team: team}
+			}
+		}
+	}
+	return expanded
+}
+
+// validateACLRule checks the entity and role of a rule of an object ACL.
+func validateACLRule(rule storage.ACLRule) error {
+	if rule.Role != storage.RoleOwner && rule.Role != storage.RoleReader {
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid role %q, object ACLs support OWNER and READER.", rule.Role)}
+	}
+	entity := string(rule.Entity)
+	switch {
+	case rule.Entity == storage.AllUsers, rule.Entity == storage.AllAuthenticatedUsers:
+		return nil
+	case strings.HasPrefix(entity, "user-") && len(entity) > len("user-"),
+		strings.HasPrefix(entity, "group-") && len(entity) > len("group-"),
+		strings.HasPrefix(entity, "domain-") && len(entity) > len("domain-"):
+		return nil
+	}
+	if team := expandACLRule(rule).ProjectTeam; team != nil && team.ProjectNumber != "" {
+		return nil
+	}
+	return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid entity %q.", entity)}
+}
+
+func toBackendACL(acl []storage.ACLRule) []backend.ACLRule {
+	var rules []backend.ACLRule
+	for _, rule := range acl {
+		rules = append(rules, backend.ACLRule{Entity: string(rule.Entity), Role: string(rule.Role)})
+	}
+	return rules
+}
+
+func fromBackendACL(rules []backend.ACLRule) []storage.ACLRule {
+	var acl []storage.ACLRule
+	for _, rule := range rules {
+		acl = append(acl, expandACLRule(storage.ACLRule{Entity: storage.ACLEntity(rule.Entity), Role: storage.ACLRole(rule.Role)}))
+	}
+	return acl
+}
+
+type projectTeamResponse struct {
+	ProjectNumber string `json:"projectNumber"`
+	Team          string `json:"team"`
+}
+
+type objectAccessControlResponse struct {
+	Kind        string               `json:"kind"`
+	ID          string               `json:"id"`
+	Bucket      string               `json:"bucket"`
+	Object      string               `json:"object"`
+	Generation  int64                `json:"generation,string"`
+	Entity      string               `json:"entity"`
+	Role        string               `json:"role"`
+	EntityID    string               `json:"entityId,omitempty"`
+	Email       string               `json:"email,omitempty"`
+	Domain      string               `json:"domain,omitempty"`
+	ProjectTeam *projectTeamResponse `json:"projectTeam,omitempty"`
+}
+
+func newObjectAccessControlResponse(obj Object, rule storage.ACLRule) objectAccessControlResponse {
+	resp := objectAccessControlResponse{
+		Kind:       "storage#objectAccessControl",
+		ID:         fmt.Sprintf("%s/%d/%s", obj.id(), obj.Generation, rule.Entity),
+		Bucket:     obj.BucketName,
+		Object:     obj.Name,
+		Generation: obj.Generation,
+		Entity:     string(rule.Entity),
+		Role:       string(rule.Role),
+		EntityID:   rule.EntityID,
+		Email:      rule.Email,
+		Domain:     rule.Domain,
+	}
+	if rule.ProjectTeam != nil {
+		resp.ProjectTeam = &projectTeamResponse{ProjectNumber: rule.ProjectTeam.ProjectNumber, Team: rule.ProjectTeam.Team}
+	}
+	return resp
+}
+
+func newObjectACLResponse(obj Object) []objectAccessControlResponse {
+	var items []objectAccessControlResponse
+	for _, rule := range obj.ACL {
+		items = append(items, newObjectAccessControlResponse(obj, rule))
+	}
+	return items
+}
+
+func writeACLEntryNotFound(w http.ResponseWriter, entity string) {
+	writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: fmt.Sprintf("No such ACL entry for entity %s.", entity)})
+}
+
+func writeObjectNotFound(w http.ResponseWriter) {
+	writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "No such object."})
+}
+
+func (s *Server) listObjectACL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	if err != nil {
+		writeObjectNotFound(w)
+		return
+	}
+	resp := struct {
+		Kind  string                        `json:"kind"`
+		Items []objectAccessControlResponse `json:"items"`
+	}{Kind: "storage#objectAccessControls", Items: newObjectACLResponse(obj)}
+	writeJSON(w, resp)
+}
+
+func (s *Server) getObjectACL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	if err != nil {
+		writeObjectNotFound(w)
+		return
+	}
+	for _, rule := range obj.ACL {
+		if string(rule.Entity) == vars["entity"] {
+			writeJSON(w, newObjectAccessControlResponse(obj, rule))
+			return
+		}
+	}
+	writeACLEntryNotFound(w, vars["entity"])
+}
+
+// setObjectACL handles the insertion of ACL entries, with the entity in the
+// body, and their updates, with the entity in the path. Existing entries for
+// the same entity are replaced.
+func (s *Server) setObjectACL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var data struct {
+		Entity string
+		Role   string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	if entity, ok := vars["entity"]; ok {
+		data.Entity = entity
+	}
+	rule := storage.ACLRule{Entity: storage.ACLEntity(data.Entity), Role: storage.ACLRole(data.Role)}
+	if err := validateACLRule(rule); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	obj, err := s.updateObjectACL(vars["bucketName"], vars["objectName"], func(acl []storage.ACLRule) ([]storage.ACLRule, bool) {
+		updated := append([]storage.ACLRule(nil), acl...)
+		for i, existing := range updated {
+			if existing.Entity == rule.Entity {
+				updated[i] = expandACLRule(rule)
+				return updated, true
+			}
+		}
+		return append(updated, expandACLRule(rule)), true
+	})
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, newObjectAccessControlResponse(obj, expandACLRule(rule)))
+}
+
+func (s *Server) deleteObjectACL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entity := storage.ACLEntity(vars["entity"])
+	_, err := s.updateObjectACL(vars["bucketName"], vars["objectName"], func(acl []storage.ACLRule) ([]storage.ACLRule, bool) {
+		var updated []storage.ACLRule
+		for _, existing := range acl {
+			if existing.Entity != entity {
+				updated = append(updated, existing)
+			}
+		}
+		return updated, len(updated) < len(acl)
+	})
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateObjectACL replaces the ACL of the object with the one returned by
+// update, which reports whether the entity of the request was found. Like
+// other metadata updates, changing the ACL increments the metageneration.
+func (s *Server) updateObjectACL(bucketName, objectName string, update func([]storage.ACLRule) ([]storage.ACLRule, bool)) (Object, error) {
+	if err := s.checkBucketWritable(bucketName, "storage.objects.setIamPolicy"); err != nil {
+		return Object{}, err
+	}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	obj, err := s.GetObject(bucketName, objectName)
+	if err != nil {
+		return obj, &statusError{code: http.StatusNotFound, reason: "notFound", message: "No such object."}
+	}
+	acl, found := update(obj.ACL)
+	if !found {
+		return obj, &statusError{code: http.StatusNotFound, reason: "notFound", message: "No such ACL entry."}
+	}
+	obj.ACL = acl
+	obj.Metageneration++
+	return s.createObject(obj)
+}
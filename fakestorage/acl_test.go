@@ -0,0 +1,128 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestExpandACLRule(t *testing.T) {
+	var tests = []struct {
+		entity   storage.ACLEntity
+		expected storage.ACLRule
+	}{
+		{"project-owners-123", storage.ACLRule{Entity: "project-owners-123", ProjectTeam: &storage.ProjectTeam{ProjectNumber: "123", Team: "owners"}}},
+		{"project-editors-123", storage.ACLRule{Entity: "project-editors-123", ProjectTeam: &storage.ProjectTeam{ProjectNumber: "123", Team: "editors"}}},
+		{"project-viewers-123", storage.ACLRule{Entity: "project-viewers-123", ProjectTeam: &storage.ProjectTeam{ProjectNumber: "123", Team: "viewers"}}},
+		{"domain-example.com", storage.ACLRule{Entity: "domain-example.com", Domain: "example.com"}},
+		{"user-someone@example.com", storage.ACLRule{Entity: "user-someone@example.com", Email: "someone@example.com"}},
+		{"group-team@example.com", storage.ACLRule{Entity: "group-team@example.com", Email: "team@example.com"}},
+		{"user-00b4903a97", storage.ACLRule{Entity: "user-00b4903a97", EntityID: "00b4903a97"}},
+		{storage.AllUsers, storage.ACLRule{Entity: storage.AllUsers}},
+		{storage.AllAuthenticatedUsers, storage.ACLRule{Entity: storage.AllAuthenticatedUsers}},
+	}
+	for _, test := range tests {
+		rule := expandACLRule(storage.ACLRule{Entity: test.entity})
+		if !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("%s: wrong expanded rule\nwant %+v\ngot  %+v", test.entity, test.expected, rule)
+		}
+	}
+}
+
+func TestServerObjectACL(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "some/object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		acl := server.Client().Bucket("some-bucket").Object("some/object.txt").ACL()
+		for _, entity := range []storage.ACLEntity{"project-owners-123", "domain-example.com", storage.AllAuthenticatedUsers} {
+			if err := acl.Set(ctx, entity, storage.RoleReader); err != nil {
+				t.Fatalf("%s: %v", entity, err)
+			}
+		}
+		if err := acl.Set(ctx, "project-owners-123", storage.RoleOwner); err != nil {
+			t.Fatal(err)
+		}
+		if err := acl.Delete(ctx, "domain-example.com"); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := acl.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []storage.ACLRule{
+			{Entity: "project-owners-123", Role: storage.RoleOwner, ProjectTeam: &storage.ProjectTeam{ProjectNumber: "123", Team: "owners"}},
+			{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleReader},
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Errorf("wrong ACL\nwant %+v\ngot  %+v", expected, rules)
+		}
+
+		obj, err := server.GetObject("some-bucket", "some/object.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(obj.ACL, expected) {
+			t.Errorf("wrong ACL of the object\nwant %+v\ngot  %+v", expected, obj.ACL)
+		}
+		if obj.Metageneration != 6 {
+			t.Errorf("wrong metageneration\nwant %d\ngot  %d", 6, obj.Metageneration)
+		}
+
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket/o/some%2Fobject.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var data struct {
+			ACL []objectAccessControlResponse
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.ACL) != 2 || data.ACL[0].ProjectTeam == nil || data.ACL[0].ProjectTeam.Team != "owners" {
+			t.Errorf("wrong ACL in the object resource: %+v", data.ACL)
+		}
+	})
+}
+
+func TestServerObjectACLErrors(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		var tests = []struct {
+			name           string
+			method         string
+			path           string
+			body           string
+			expectedStatus int
+		}{
+			{"invalid entity", http.MethodPost, "/o/object.txt/acl", `{"entity":"project-admins-123","role":"READER"}`, http.StatusBadRequest},
+			{"invalid role", http.MethodPost, "/o/object.txt/acl", `{"entity":"allUsers","role":"WRITER"}`, http.StatusBadRequest},
+			{"missing object", http.MethodPost, "/o/missing.txt/acl", `{"entity":"allUsers","role":"READER"}`, http.StatusNotFound},
+			{"missing entry", http.MethodGet, "/o/object.txt/acl/allUsers", "", http.StatusNotFound},
+			{"delete missing entry", http.MethodDelete, "/o/object.txt/acl/allUsers", "", http.StatusNotFound},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(test.method, "https://www.googleapis.com/storage/v1/b/some-bucket"+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,444 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of Anywhere Caches.
+const (
+	anywhereCacheRunning  = "running"
+	anywhereCachePaused   = "paused"
+	anywhereCacheDisabled = "disabled"
+)
+
+// Admission policies of Anywhere Caches.
+const (
+	admitOnFirstMiss  = "admit-on-first-miss"
+	admitOnSecondMiss = "admit-on-second-miss"
+)
+
+const (
+	defaultAnywhereCacheTTL = 24 * time.Hour
+	minAnywhereCacheTTL     = time.Hour
+	maxAnywhereCacheTTL     = 7 * 24 * time.Hour
+)
+
+// anywhereCache is a zonal read cache of a bucket. Caches are not stored in
+// the backend, and only simulate admission: reads of objects through the API
+// count as hits once the object is admitted to the cache, according to the
+// admission policy, and until the TTL of the cache expires.
+type anywhereCache struct {
+	bucket          string
+	zone            string
+	state           string
+	ttl             time.Duration
+	admissionPolicy string
+	createTime      time.Time
+	updateTime      time.Time
+
+	hits     int
+	misses   int
+	missed   map[string]int
+	admitted map[string]time.Time
+}
+
+// read records a read of the object with the given ID, and reports whether
+// it was served from the cache.
+func (c *anywhereCache) read(id string, now time.Time) bool {
+	if admittedAt, ok := c.admitted[id]; ok && now.Sub(admittedAt) < c.ttl {
+		c.hits++
+		return true
+	}
+	delete(c.admitted, id)
+	c.misses++
+	c.missed[id]++
+	if c.admissionPolicy == admitOnFirstMiss || c.missed[id] >= 2 {
+		delete(c.missed, id)
+		c.admitted[id] = now
+	}
+	return false
+}
+
+type operation struct {
+	resp      operationResponse
+	createdAt time.Time
+}
+
+type anywhereCacheState struct {
+	mtx        sync.Mutex
+	caches     map[string]map[string]*anywhereCache
+	operations map[string]map[string]operation
+}
+
+func (st *anywhereCacheState) bucketCaches(bucketName string) []*anywhereCache {
+	caches := make([]*anywhereCache, 0, len(st.caches[bucketName]))
+	for _, cache := range st.caches[bucketName] {
+		caches = append(caches, cache)
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].zone < caches[j].zone
+	})
+	return caches
+}
+
+// AnywhereCacheStats are the statistics of the simulated admission of an
+// Anywhere Cache.
+type AnywhereCacheStats struct {
+	Zone            string `json:"zone"`
+	State           string `json:"state"`
+	Hits            int    `json:"hits"`
+	Misses          int    `json:"misses"`
+	AdmittedObjects int    `json:"admittedObjects"`
+}
+
+// AnywhereCacheStats returns the statistics of the Anywhere Caches of the
+// given bucket, sorted by zone. Reads of objects through the API are served
+// by all running caches of their bucket.
+//
+// The same statistics are available with a GET request to
+// /_internal/anywhereCaches/<bucket>.
+func (s *Server) AnywhereCacheStats(bucketName string) []AnywhereCacheStats {
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	stats := []AnywhereCacheStats{}
+	for _, cache := range s.anywhereCaches.bucketCaches(bucketName) {
+		stats = append(stats, AnywhereCacheStats{
+			Zone:            cache.zone,
+			State:           cache.state,
+			Hits:            cache.hits,
+			Misses:          cache.misses,
+			AdmittedObjects: len(cache.admitted),
+		})
+	}
+	return stats
+}
+
+// recordCacheRead records a read of obj in the running caches of its bucket.
+func (s *Server) recordCacheRead(obj Object) {
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	id := fmt.Sprintf("%s#%d", obj.id(), obj.Generation)
+	now := time.Now()
+	for _, cache := range s.anywhereCaches.caches[obj.BucketName] {
+		if cache.state == anywhereCacheRunning {
+			cache.read(id, now)
+		}
+	}
+}
+
+type anywhereCacheResponse struct {
+	Kind            string `json:"kind"`
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Bucket          string `json:"bucket"`
+	AnywhereCacheID string `json:"anywhereCacheId"`
+	Zone            string `json:"zone"`
+	State           string `json:"state"`
+	TTL             string `json:"ttl"`
+	AdmissionPolicy string `json:"admissionPolicy"`
+	CreateTime      string `json:"createTime"`
+	UpdateTime      string `json:"updateTime"`
+	PendingUpdate   bool   `json:"pendingUpdate"`
+}
+
+func newAnywhereCacheResponse(cache *anywhereCache) anywhereCacheResponse {
+	return anywhereCacheResponse{
+		Kind:            "storage#anywhereCache",
+		ID:              cache.bucket + "/" + cache.zone,
+		Name:            fmt.Sprintf("projects/_/buckets/%s/anywhereCaches/%s", cache.bucket, cache.zone),
+		Bucket:          cache.bucket,
+		AnywhereCacheID: cache.zone,
+		Zone:            cache.zone,
+		State:           cache.state,
+		TTL:             fmt.Sprintf("%ds", int64(cache.ttl/time.Second)),
+		AdmissionPolicy: cache.admissionPolicy,
+		CreateTime:      formatTime(cache.createTime),
+		UpdateTime:      formatTime(cache.updateTime),
+	}
+}
+
+type anywhereCacheListResponse struct {
+	Kind  string                  `json:"kind"`
+	Items []anywhereCacheResponse `json:"items"`
+}
+
+// operationResponse is a long-running operation. Operations on Anywhere
+// Caches complete immediately, so they're always done.
+type operationResponse struct {
+	Kind     string                 `json:"kind"`
+	Name     string                 `json:"name"`
+	Done     bool                   `json:"done"`
+	Metadata map[string]interface{} `json:"metadata"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type operationListResponse struct {
+	Kind       string              `json:"kind"`
+	Operations []operationResponse `json:"operations"`
+}
+
+// anywhereCacheRequest is the body of insert and update requests.
+type anywhereCacheRequest struct {
+	Zone            string
+	TTL             string
+	AdmissionPolicy string
+}
+
+// apply validates the fields of the request and applies them to the cache.
+func (req anywhereCacheRequest) apply(cache *anywhereCache) error {
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl < minAnywhereCacheTTL || ttl > maxAnywhereCacheTTL {
+			return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid TTL %q, it must be between 1 hour and 7 days", req.TTL)}
+		}
+		cache.ttl = ttl
+	}
+	switch req.AdmissionPolicy {
+	case "":
+	case admitOnFirstMiss, admitOnSecondMiss:
+		cache.admissionPolicy = req.AdmissionPolicy
+	default:
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid admission policy %q", req.AdmissionPolicy)}
+	}
+	return nil
+}
+
+// newOperation registers a completed operation on the cache. Callers must
+// hold the lock of the cache state.
+func (s *Server) newOperation(cache *anywhereCache, kind string) (operationResponse, error) {
+	id, err := s.ids.operationID()
+	if err != nil {
+		return operationResponse{}, err
+	}
+	now := time.Now()
+	resp := operationResponse{
+		Kind: "storage#operation",
+		Name: fmt.Sprintf("projects/_/buckets/%s/operations/%s", cache.bucket, id),
+		Done: true,
+		Metadata: map[string]interface{}{
+			"@type": fmt.Sprintf("type.googleapis.com/google.storage.control.v2.%sAnywhereCacheMetadata", kind),
+			"commonMetadata": map[string]interface{}{
+				"createTime":      formatTime(now),
+				"endTime":         formatTime(now),
+				"updateTime":      formatTime(now),
+				"type":            kind + "AnywhereCache",
+				"progressPercent": 100,
+			},
+			"anywhereCacheId": cache.zone,
+			"zone":            cache.zone,
+		},
+		Response: map[string]interface{}{
+			"@type": "type.googleapis.com/google.storage.control.v2.AnywhereCache",
+			"cache": newAnywhereCacheResponse(cache),
+		},
+	}
+	if s.anywhereCaches.operations == nil {
+		s.anywhereCaches.operations = make(map[string]map[string]operation)
+	}
+	if s.anywhereCaches.operations[cache.bucket] == nil {
+		s.anywhereCaches.operations[cache.bucket] = make(map[string]operation)
+	}
+	s.anywhereCaches.operations[cache.bucket][id] = operation{resp: resp, createdAt: now}
+	return resp, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) insertAnywhereCache(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The specified bucket does not exist."})
+		return
+	}
+	var req anywhereCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	if req.Zone == "" {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "required", message: "Required field: zone"})
+		return
+	}
+	now := time.Now()
+	cache := &anywhereCache{
+		bucket:          bucketName,
+		zone:            req.Zone,
+		state:           anywhereCacheRunning,
+		ttl:             defaultAnywhereCacheTTL,
+		admissionPolicy: admitOnFirstMiss,
+		createTime:      now,
+		updateTime:      now,
+		missed:          make(map[string]int),
+		admitted:        make(map[string]time.Time),
+	}
+	if err := req.apply(cache); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	if _, ok := s.anywhereCaches.caches[bucketName][req.Zone]; ok {
+		writeStatusError(w, &statusError{code: http.StatusConflict, reason: "conflict", message: fmt.Sprintf("An Anywhere Cache already exists in zone %s", req.Zone)})
+		return
+	}
+	op, err := s.newOperation(cache, "Create")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.anywhereCaches.caches == nil {
+		s.anywhereCaches.caches = make(map[string]map[string]*anywhereCache)
+	}
+	if s.anywhereCaches.caches[bucketName] == nil {
+		s.anywhereCaches.caches[bucketName] = make(map[string]*anywhereCache)
+	}
+	s.anywhereCaches.caches[bucketName][req.Zone] = cache
+	writeJSON(w, op)
+}
+
+func (s *Server) listAnywhereCaches(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The specified bucket does not exist."})
+		return
+	}
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	resp := anywhereCacheListResponse{Kind: "storage#anywhereCaches", Items: []anywhereCacheResponse{}}
+	for _, cache := range s.anywhereCaches.bucketCaches(bucketName) {
+		resp.Items = append(resp.Items, newAnywhereCacheResponse(cache))
+	}
+	writeJSON(w, resp)
+}
+
+// withAnywhereCache locks the cache state and calls fn with the cache
+// targeted by the request, or writes a 404 if it doesn't exist.
+func (s *Server) withAnywhereCache(w http.ResponseWriter, r *http.Request, fn func(*anywhereCache)) {
+	vars := mux.Vars(r)
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	cache, ok := s.anywhereCaches.caches[vars["bucketName"]][vars["anywhereCacheId"]]
+	if !ok {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The specified Anywhere Cache does not exist."})
+		return
+	}
+	fn(cache)
+}
+
+func (s *Server) getAnywhereCache(w http.ResponseWriter, r *http.Request) {
+	s.withAnywhereCache(w, r, func(cache *anywhereCache) {
+		writeJSON(w, newAnywhereCacheResponse(cache))
+	})
+}
+
+func (s *Server) updateAnywhereCache(w http.ResponseWriter, r *http.Request) {
+	var req anywhereCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	s.withAnywhereCache(w, r, func(cache *anywhereCache) {
+		if cache.state == anywhereCacheDisabled {
+			writeStatusError(w, &statusError{code: http.StatusPreconditionFailed, reason: "failedPrecondition", message: "Disabled Anywhere Caches can't be updated."})
+			return
+		}
+		updated := *cache
+		if err := req.apply(&updated); err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		updated.updateTime = time.Now()
+		*cache = updated
+		op, err := s.newOperation(cache, "Update")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, op)
+	})
+}
+
+// anywhereCacheTransitions maps each state change to the states it's
+// allowed from.
+var anywhereCacheTransitions = map[string][]string{
+	anywhereCachePaused:   {anywhereCacheRunning},
+	anywhereCacheRunning:  {anywhereCachePaused, anywhereCacheDisabled},
+	anywhereCacheDisabled: {anywhereCacheRunning, anywhereCachePaused},
+}
+
+func (s *Server) setAnywhereCacheState(state string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.withAnywhereCache(w, r, func(cache *anywhereCache) {
+			allowed := false
+			for _, from := range anywhereCacheTransitions[state] {
+				allowed = allowed || cache.state == from
+			}
+			if !allowed {
+				writeStatusError(w, &statusError{
+					code:    http.StatusPreconditionFailed,
+					reason:  "failedPrecondition",
+					message: fmt.Sprintf("The Anywhere Cache can't transition from %s to %s.", cache.state, state),
+				})
+				return
+			}
+			cache.state = state
+			cache.updateTime = time.Now()
+			if state == anywhereCacheDisabled {
+				cache.missed = make(map[string]int)
+				cache.admitted = make(map[string]time.Time)
+			}
+			writeJSON(w, newAnywhereCacheResponse(cache))
+		})
+	}
+}
+
+func (s *Server) getOperation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	op, ok := s.anywhereCaches.operations[vars["bucketName"]][vars["operationId"]]
+	if !ok {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The specified operation does not exist."})
+		return
+	}
+	writeJSON(w, op.resp)
+}
+
+func (s *Server) listOperations(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketName"]
+	s.anywhereCaches.mtx.Lock()
+	defer s.anywhereCaches.mtx.Unlock()
+	ops := make([]operation, 0, len(s.anywhereCaches.operations[bucketName]))
+	for _, op := range s.anywhereCaches.operations[bucketName] {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].createdAt.Equal(ops[j].createdAt) {
+			return ops[i].resp.Name < ops[j].resp.Name
+		}
+		return ops[i].createdAt.Before(ops[j].createdAt)
+	})
+	resp := operationListResponse{Kind: "storage#operations", Operations: []operationResponse{}}
+	for _, op := range ops {
+		resp.Operations = append(resp.Operations, op.resp)
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) getAnywhereCacheStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.AnywhereCacheStats(mux.Vars(r)["bucketName"]))
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerAnywhereCaches(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		do := func(method, url, body string, expectedStatus int, v interface{}) {
+			t.Helper()
+			req, err := http.NewRequest(method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != expectedStatus {
+				t.Fatalf("%s %s: wrong status code\nwant %d\ngot  %d", method, url, expectedStatus, resp.StatusCode)
+			}
+			if v != nil {
+				if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		const cachesURL = "https://www.googleapis.com/storage/v1/b/some-bucket/anywhereCaches"
+
+		var op operationResponse
+		do(http.MethodPost, cachesURL, `{"zone":"us-central1-a","admissionPolicy":"admit-on-second-miss","ttl":"7200s"}`, http.StatusOK, &op)
+		if !op.Done {
+			t.Error("operation not done")
+		}
+		do(http.MethodPost, cachesURL, `{"zone":"us-central1-a"}`, http.StatusConflict, nil)
+		do(http.MethodPost, cachesURL, `{"zone":"us-central1-b","ttl":"60s"}`, http.StatusBadRequest, nil)
+		var polled operationResponse
+		do(http.MethodGet, "https://www.googleapis.com/storage/v1/b/"+strings.TrimPrefix(op.Name, "projects/_/buckets/"), "", http.StatusOK, &polled)
+		if polled.Name != op.Name {
+			t.Errorf("wrong operation\nwant %q\ngot  %q", op.Name, polled.Name)
+		}
+
+		var cache anywhereCacheResponse
+		do(http.MethodGet, cachesURL+"/us-central1-a", "", http.StatusOK, &cache)
+		if cache.State != "running" || cache.TTL != "7200s" || cache.AdmissionPolicy != "admit-on-second-miss" {
+			t.Errorf("wrong cache: %+v", cache)
+		}
+
+		for i := 0; i < 3; i++ {
+			do(http.MethodGet, "https://storage.googleapis.com/some-bucket/object.txt", "", http.StatusOK, nil)
+		}
+		expectedStats := []AnywhereCacheStats{{Zone: "us-central1-a", State: "running", Hits: 1, Misses: 2, AdmittedObjects: 1}}
+		if stats := server.AnywhereCacheStats("some-bucket"); !reflect.DeepEqual(stats, expectedStats) {
+			t.Errorf("wrong stats\nwant %+v\ngot  %+v", expectedStats, stats)
+		}
+
+		do(http.MethodPost, cachesURL+"/us-central1-a/pause", "", http.StatusOK, &cache)
+		if cache.State != "paused" {
+			t.Errorf("wrong state after pause: %q", cache.State)
+		}
+		do(http.MethodPost, cachesURL+"/us-central1-a/pause", "", http.StatusPreconditionFailed, nil)
+		do(http.MethodGet, "https://storage.googleapis.com/some-bucket/object.txt", "", http.StatusOK, nil)
+		do(http.MethodPost, cachesURL+"/us-central1-a/resume", "", http.StatusOK, &cache)
+		do(http.MethodPost, cachesURL+"/us-central1-a/disable", "", http.StatusOK, &cache)
+		if cache.State != "disabled" {
+			t.Errorf("wrong state after disable: %q", cache.State)
+		}
+		var stats []AnywhereCacheStats
+		do(http.MethodGet, "https://www.googleapis.com/_internal/anywhereCaches/some-bucket", "", http.StatusOK, &stats)
+		expectedStats = []AnywhereCacheStats{{Zone: "us-central1-a", State: "disabled", Hits: 1, Misses: 2}}
+		if !reflect.DeepEqual(stats, expectedStats) {
+			t.Errorf("wrong stats\nwant %+v\ngot  %+v", expectedStats, stats)
+		}
+
+		var list anywhereCacheListResponse
+		do(http.MethodGet, cachesURL, "", http.StatusOK, &list)
+		if len(list.Items) != 1 || list.Items[0].Zone != "us-central1-a" {
+			t.Errorf("wrong list of caches: %+v", list.Items)
+		}
+		do(http.MethodGet, cachesURL+"/us-east1-b", "", http.StatusNotFound, nil)
+	})
+}
@@ -0,0 +1,431 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultAuditLogProject is the project used in the names of audit logs when
+// Options.AuditLogProject is not set.
+const defaultAuditLogProject = "fake-project"
+
+// auditMethods maps the routes of the API to the method names in audit logs.
+// Routes are identified by the HTTP method and the path template.
+var auditMethods = map[string]string{
+	"GET /storage/v1/b":                                         "storage.buckets.list",
+	"POST /storage/v1/b":                                        "storage.buckets.create",
+	"GET /storage/v1/b/{bucketName}":                            "storage.buckets.get",
+	"PATCH /storage/v1/b/{bucketName}":                          "storage.buckets.patch",
+	"GET /storage/v1/b/{bucketName}/storageLayout":              "storage.buckets.getStorageLayout",
+	"GET /storage/v1/b/{bucketName}/o":                          "storage.objects.list",
+	"POST /storage/v1/b/{bucketName}/o":                         "storage.objects.create",
+	"POST /upload/storage/v1/b/{bucketName}/o":                  "storage.objects.create",
+	"PUT /upload/resumable/{uploadId}":                          "storage.objects.create",
+	"POST /upload/resumable/{uploadId}":                         "storage.objects.create",
+	"PUT /{bucketName}/{objectName:.+}":                         "storage.objects.create",
+	"PUT /{objectName:.+}":                                      "storage.objects.create",
+	"POST /storage/v1/b/{bucketName}/o/{objectName:.+}/compose": "storage.objects.compose",
+	"GET /storage/v1/b/{bucketName}/o/{objectName:.+}":          "storage.objects.get",
+	"PATCH /storage/v1/b/{bucketName}/o/{objectName:.+}":        "storage.objects.patch",
+	"DELETE /storage/v1/b/{bucketName}/o/{objectName:.+}":       "storage.objects.delete",
+	"GET /download/storage/v1/b/{bucketName}/o/{objectName:.+}": "storage.objects.get",
+	"GET /{bucketName}/{objectName:.+}":                         "storage.objects.get",
+	"GET /{objectName:.+}":                                      "storage.objects.get",
+
+	"GET /storage/v1/b/{bucketName}/anywhereCaches":                            "storage.anywhereCaches.list",
+	"POST /storage/v1/b/{bucketName}/anywhereCaches":                           "storage.anywhereCaches.insert",
+	"GET /storage/v1/b/{bucketName}/anywhereCaches/{anywhereCacheId}":          "storage.anywhereCaches.get",
+	"PATCH /storage/v1/b/{bucketName}/anywhereCaches/{anywhereCacheId}":        "storage.anywhereCaches.update",
+	"POST /storage/v1/b/{bucketName}/anywhereCaches/{anywhereCacheId}/pause":   "storage.anywhereCaches.pause",
+	"POST /storage/v1/b/{bucketName}/anywhereCaches/{anywhereCacheId}/resume":  "storage.anywhereCaches.resume",
+	"POST /storage/v1/b/{bucketName}/anywhereCaches/{anywhereCacheId}/disable": "storage.anywhereCaches.disable",
+}
+
+// adminActivityMethods are the methods logged to the Admin Activity audit
+// log. Other methods are logged to the Data Access audit log.
+var adminActivityMethods = map[string]bool{
+	"storage.buckets.create":         true,
+	"storage.buckets.patch":          true,
+	"storage.anywhereCaches.insert":  true,
+	"storage.anywhereCaches.update":  true,
+	"storage.anywhereCaches.pause":   true,
+	"storage.anywhereCaches.resume":  true,
+	"storage.anywhereCaches.disable": true,
+}
+
+// auditWebhookQueueSize is the number of audit log entries that can wait for
+// delivery to the webhook before requests start waiting for it.
+const auditWebhookQueueSize = 1024
+
+// auditLogger writes Cloud Audit Logs entries for API requests, in the JSON
+// format of Cloud Logging, to a writer (one entry per line) and to a webhook
+// (one POST request per entry).
+//
+// Entries are POSTed to the webhook in the background while the server is
+// running, so a slow webhook doesn't delay the requests being logged.
+type auditLogger struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	webhook string
+	project string
+	client  *http.Client
+
+	// queueMtx guards queue: senders hold it for reading, while the
+	// worker is started and stopped with it held for writing.
+	queueMtx sync.RWMutex
+	queue    chan []byte
+	done     chan struct{}
+}
+
+func newAuditLogger(options Options) *auditLogger {
+	project := options.AuditLogProject
+	if project == "" {
+		project = defaultAuditLogProject
+	}
+	return &auditLogger{
+		w:       options.AuditLog,
+		webhook: options.AuditLogWebhook,
+		project: project,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (l *auditLogger) enabled() bool {
+	return l.w != nil || l.webhook != ""
+}
+
+// AuditLogEntry is an entry of the audit logs written by the server. It
+// follows the format of the log entries of Cloud Audit Logs for Cloud
+// Storage.
+type AuditLogEntry struct {
+	LogName          string           `json:"logName"`
+	InsertID         string           `json:"insertId"`
+	Timestamp        string           `json:"timestamp"`
+	ReceiveTimestamp string           `json:"receiveTimestamp"`
+	Severity         string           `json:"severity"`
+	Resource         AuditLogResource `json:"resource"`
+	ProtoPayload     AuditLogPayload  `json:"protoPayload"`
+}
+
+// AuditLogResource is the monitored resource of an audit log entry.
+type AuditLogResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// AuditLogPayload is the AuditLog payload of an audit log entry.
+type AuditLogPayload struct {
+	Type              string                  `json:"@type"`
+	Status            AuditLogStatus          `json:"status"`
+	RequestMetadata   AuditLogRequestMetadata `json:"requestMetadata"`
+	ServiceName       string                  `json:"serviceName"`
+	MethodName        string                  `json:"methodName"`
+	ResourceName      string                  `json:"resourceName"`
+	AuthorizationInfo []AuditLogAuthorization `json:"authorizationInfo"`
+	ResourceLocation  *AuditLogLocation       `json:"resourceLocation,omitempty"`
+}
+
+// AuditLogStatus is the status of the operation, with the codes of
+// google.rpc.Code. It's empty for successful operations.
+type AuditLogStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// AuditLogRequestMetadata describes the caller of the operation.
+type AuditLogRequestMetadata struct {
+	CallerIP                string `json:"callerIp,omitempty"`
+	CallerSuppliedUserAgent string `json:"callerSuppliedUserAgent,omitempty"`
+}
+
+// AuditLogAuthorization describes the permission checked for the operation.
+type AuditLogAuthorization struct {
+	Resource   string `json:"resource"`
+	Permission string `json:"permission"`
+	Granted    bool   `json:"granted"`
+}
+
+// AuditLogLocation is the location of the resource targeted by the
+// operation.
+type AuditLogLocation struct {
+	CurrentLocations []string `json:"currentLocations"`
+}
+
+// rpcCodes maps HTTP status codes to the codes of google.rpc.Code.
+var rpcCodes = map[int]int{
+	http.StatusBadRequest:                   3,
+	http.StatusUnauthorized:                 16,
+	http.StatusForbidden:                    7,
+	http.StatusNotFound:                     5,
+	http.StatusConflict:                     6,
+	http.StatusPreconditionFailed:           9,
+	http.StatusRequestEntityTooLarge:        3,
+	http.StatusRequestedRangeNotSatisfiable: 11,
+	http.StatusTooManyRequests:              8,
+	http.StatusNotImplemented:               12,
+	http.StatusServiceUnavailable:           14,
+}
+
+// auditResponseWriter records the status of responses for audit logs. It also
+// keeps the body of responses to create operations, as the names of the new
+// resources may be only in the body of the request.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body != nil {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// ReadFrom lets the underlying writer copy the body from src, unless the body
+// is kept for the log entry.
+func (w *auditResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok || w.body != nil {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return rf.ReadFrom(src)
+}
+
+func (s *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.auditLog.enabled() || isInternalRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := auditMethod(r)
+		if method == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bucketName, objectName := requestTarget(r)
+		if buckets := s.requestBuckets(r); bucketName == "" && len(buckets) > 0 {
+			bucketName = buckets[0]
+		}
+		rw := &auditResponseWriter{ResponseWriter: w}
+		if strings.HasSuffix(method, ".create") {
+			rw.body = new(bytes.Buffer)
+		}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if rw.body != nil && rw.status < http.StatusBadRequest {
+			var created struct {
+				Bucket string `json:"bucket"`
+				Name   string `json:"name"`
+			}
+			if json.Unmarshal(rw.body.Bytes(), &created) == nil {
+				if method == "storage.buckets.create" {
+					bucketName = created.Name
+				} else if created.Name != "" {
+					bucketName, objectName = created.Bucket, created.Name
+				}
+			}
+		}
+		var location string
+		if bucket, err := s.backend.GetBucket(bucketName); err == nil {
+			location = strings.ToLower(bucketLocation(bucket.Location))
+		}
+		s.auditLog.log(s.newAuditLogEntry(r, method, bucketName, objectName, location, rw.status))
+	})
+}
+
+func auditMethod(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	if method, ok := auditMethods[r.Method+" "+template]; ok {
+		return method
+	}
+	if strings.Contains(template, "/rewriteTo/") {
+		return "storage.objects.rewrite"
+	}
+	return ""
+}
+
+func (s *Server) newAuditLogEntry(r *http.Request, method, bucketName, objectName, location string, status int) AuditLogEntry {
+	now := formatTime(time.Now())
+	logName := "data_access"
+	if adminActivityMethods[method] {
+		logName = "activity"
+	}
+	resourceName := "projects/_/buckets/" + bucketName
+	if objectName != "" {
+		resourceName += "/objects/" + objectName
+	}
+	entry := AuditLogEntry{
+		LogName:          "projects/" + s.auditLog.project + "/logs/cloudaudit.googleapis.com%2F" + logName,
+		InsertID:         requestIDFromContext(r.Context()),
+		Timestamp:        now,
+		ReceiveTimestamp: now,
+		Severity:         "INFO",
+		Resource: AuditLogResource{
+			Type: "gcs_bucket",
+			Labels: map[string]string{
+				"bucket_name": bucketName,
+				"project_id":  s.auditLog.project,
+				"location":    location,
+			},
+		},
+		ProtoPayload: AuditLogPayload{
+			Type: "type.googleapis.com/google.cloud.audit.AuditLog",
+			RequestMetadata: AuditLogRequestMetadata{
+				CallerIP:                callerIP(r),
+				CallerSuppliedUserAgent: r.UserAgent(),
+			},
+			ServiceName:  "storage.googleapis.com",
+			MethodName:   method,
+			ResourceName: resourceName,
+			AuthorizationInfo: []AuditLogAuthorization{
+				{Resource: resourceName, Permission: auditPermission(method), Granted: status != http.StatusForbidden},
+			},
+		},
+	}
+	if location != "" {
+		entry.ProtoPayload.ResourceLocation = &AuditLogLocation{CurrentLocations: []string{location}}
+	}
+	if status >= http.StatusBadRequest {
+		entry.Severity = "ERROR"
+		code, ok := rpcCodes[status]
+		if !ok {
+			code = 13
+		}
+		entry.ProtoPayload.Status = AuditLogStatus{Code: code, Message: http.StatusText(status)}
+	}
+	return entry
+}
+
+// auditPermission returns the IAM permission checked for the given method.
+func auditPermission(method string) string {
+	switch method {
+	case "storage.objects.compose", "storage.objects.rewrite":
+		return "storage.objects.create"
+	case "storage.objects.patch":
+		return "storage.objects.update"
+	case "storage.buckets.patch":
+		return "storage.buckets.update"
+	case "storage.buckets.getStorageLayout":
+		return "storage.objects.list"
+	case "storage.anywhereCaches.pause", "storage.anywhereCaches.resume", "storage.anywhereCaches.disable":
+		return "storage.anywhereCaches.update"
+	}
+	return method
+}
+
+func callerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *auditLogger) log(entry AuditLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if l.w != nil {
+		l.mtx.Lock()
+		l.w.Write(append(data, '\n'))
+		l.mtx.Unlock()
+	}
+	if l.webhook != "" {
+		l.queueMtx.RLock()
+		defer l.queueMtx.RUnlock()
+		if l.queue == nil {
+			l.post(data)
+			return
+		}
+		l.queue <- data
+	}
+}
+
+// start starts the delivery of entries to the webhook in the background.
+// Until then, and after stop, entries are delivered by the caller of log.
+func (l *auditLogger) start() {
+	if l.webhook == "" {
+		return
+	}
+	l.queueMtx.Lock()
+	defer l.queueMtx.Unlock()
+	if l.queue != nil {
+		return
+	}
+	queue := make(chan []byte, auditWebhookQueueSize)
+	done := make(chan struct{})
+	l.queue = queue
+	l.done = done
+	go func() {
+		defer close(done)
+		for data := range queue {
+			l.post(data)
+		}
+	}()
+}
+
+// stop stops the background delivery of entries, after delivering the
+// entries already queued.
+func (l *auditLogger) stop() {
+	l.queueMtx.Lock()
+	defer l.queueMtx.Unlock()
+	if l.queue == nil {
+		return
+	}
+	close(l.queue)
+	<-l.done
+	l.queue = nil
+	l.done = nil
+}
+
+func (l *auditLogger) post(data []byte) {
+	resp, err := l.client.Post(l.webhook, "application/json", bytes.NewReader(data))
+	if err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	server, err := NewServerWithOptions(Options{NoListener: true, AuditLog: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	ctx := context.Background()
+	client := server.Client()
+	if err := client.Bucket("some-bucket").Create(ctx, "", &storage.BucketAttrs{Location: "EU"}); err != nil {
+		t.Fatal(err)
+	}
+	writeObjectContent(t, client.Bucket("some-bucket").Object("object.txt"), "some content")
+	readObjectContent(t, client.Bucket("some-bucket").Object("object.txt"))
+	if _, err := client.Bucket("some-bucket").Object("missing.txt").Attrs(ctx); err != storage.ErrObjectNotExist {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := server.HTTPClient().Get("https://www.googleapis.com/_internal/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var entries []AuditLogEntry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry AuditLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	var tests = []struct {
+		method       string
+		logName      string
+		resourceName string
+		severity     string
+	}{
+		{"storage.buckets.create", "projects/fake-project/logs/cloudaudit.googleapis.com%2Factivity", "projects/_/buckets/some-bucket", "INFO"},
+		{"storage.objects.create", "projects/fake-project/logs/cloudaudit.googleapis.com%2Fdata_access", "projects/_/buckets/some-bucket/objects/object.txt", "INFO"},
+		{"storage.objects.get", "projects/fake-project/logs/cloudaudit.googleapis.com%2Fdata_access", "projects/_/buckets/some-bucket/objects/object.txt", "INFO"},
+		{"storage.objects.get", "projects/fake-project/logs/cloudaudit.googleapis.com%2Fdata_access", "projects/_/buckets/some-bucket/objects/missing.txt", "ERROR"},
+	}
+	if len(entries) != len(tests) {
+		t.Fatalf("wrong number of entries\nwant %d\ngot  %d: %+v", len(tests), len(entries), entries)
+	}
+	for i, test := range tests {
+		entry := entries[i]
+		if entry.ProtoPayload.MethodName != test.method {
+			t.Errorf("wrong method name for entry %d\nwant %q\ngot  %q", i, test.method, entry.ProtoPayload.MethodName)
+		}
+		if entry.LogName != test.logName {
+			t.Errorf("wrong log name for entry %d\nwant %q\ngot  %q", i, test.logName, entry.LogName)
+		}
+		if entry.ProtoPayload.ResourceName != test.resourceName {
+			t.Errorf("wrong resource name for entry %d\nwant %q\ngot  %q", i, test.resourceName, entry.ProtoPayload.ResourceName)
+		}
+		if entry.Severity != test.severity {
+			t.Errorf("wrong severity for entry %d\nwant %q\ngot  %q", i, test.severity, entry.Severity)
+		}
+		if entry.InsertID == "" {
+			t.Errorf("missing insert ID for entry %d", i)
+		}
+		if entry.Resource.Type != "gcs_bucket" || entry.Resource.Labels["bucket_name"] != "some-bucket" {
+			t.Errorf("wrong resource for entry %d: %+v", i, entry.Resource)
+		}
+	}
+	if status := entries[3].ProtoPayload.Status; status.Code != 5 {
+		t.Errorf("wrong status code for missing object\nwant %d\ngot  %d", 5, status.Code)
+	}
+	if location := entries[1].Resource.Labels["location"]; location != "eu" {
+		t.Errorf("wrong location\nwant %q\ngot  %q", "eu", location)
+	}
+}
+
+func TestServerAuditLogWebhook(t *testing.T) {
+	var mtx sync.Mutex
+	var entries []AuditLogEntry
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		data, _ := ioutil.ReadAll(r.Body)
+		var entry AuditLogEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Errorf("invalid entry %q: %v", data, err)
+		}
+		mtx.Lock()
+		entries = append(entries, entry)
+		mtx.Unlock()
+	}))
+	defer webhook.Close()
+	server, err := NewServerWithOptions(Options{
+		NoListener:      true,
+		AuditLogWebhook: webhook.URL,
+		AuditLogProject: "my-project",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := server.Client().Bucket("some-bucket").Attrs(ctx); err != nil {
+		t.Fatalf("request blocked by the webhook: %v", err)
+	}
+	close(release)
+	server.Stop()
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(entries) != 1 {
+		t.Fatalf("wrong number of entries\nwant 1\ngot  %d", len(entries))
+	}
+	if entries[0].ProtoPayload.MethodName != "storage.buckets.get" {
+		t.Errorf("wrong method name\nwant %q\ngot  %q", "storage.buckets.get", entries[0].ProtoPayload.MethodName)
+	}
+	expectedLogName := "projects/my-project/logs/cloudaudit.googleapis.com%2Fdata_access"
+	if entries[0].LogName != expectedLogName {
+		t.Errorf("wrong log name\nwant %q\ngot  %q", expectedLogName, entries[0].LogName)
+	}
+}
+
+func TestAuditResponseWriterFlush(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	var w http.ResponseWriter = &auditResponseWriter{ResponseWriter: recorder}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("auditResponseWriter doesn't implement http.Flusher")
+	}
+	w.Write([]byte("some content"))
+	flusher.Flush()
+	if !recorder.Flushed {
+		t.Error("response not flushed")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+// BackendFaultKind is the kind of a simulated failure of the storage backend.
+type BackendFaultKind string
+
+// Kinds of failures of the storage backend.
+const (
+	// BackendDiskFull makes writes fail with ENOSPC.
+	BackendDiskFull BackendFaultKind = backend.FaultDiskFull
+
+	// BackendPermissionDenied makes reads and writes fail with EACCES.
+	BackendPermissionDenied BackendFaultKind = backend.FaultPermissionDenied
+
+	// BackendCorruptedMetadata makes reads fail as if the metadata of
+	// objects and buckets couldn't be decoded.
+	BackendCorruptedMetadata BackendFaultKind = backend.FaultCorruptedMetadata
+)
+
+// BackendFault is a simulated failure of the storage backend of the server,
+// as opposed to the failures of the HTTP layer simulated with SetScenario or
+// SimulateOutage: requests go through the regular handlers, which get the
+// error from the backend, so faults exercise the error handling of the
+// server itself. API requests hitting a fault fail with 500, with the message
+// of the storage error.
+type BackendFault struct {
+	Kind BackendFaultKind `json:"kind"`
+
+	// Operation is the name of the backend operation that fails: one of
+	// CreateBucket, UpdateBucket, ListBuckets, GetBucket, CreateObject,
+	// ListObjects, GetObject, DeleteObject, CreateNoncurrentObject,
+	// ListNoncurrentObjects, GetNoncurrentObject and
+	// DeleteNoncurrentObject. Empty matches any operation affected by the
+	// kind of fault.
+	Operation string `json:"operation,omitempty"`
+
+	// Bucket is the name of the bucket affected by the fault. Empty matches
+	// any bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Times is the number of failures before the fault is cleared. Zero
+	// means that the fault lasts until ClearBackendFaults is called.
+	Times int `json:"times,omitempty"`
+}
+
+// InjectBackendFault makes the operations of the storage backend matching the
+// fault fail.
+//
+// The same can be done with a PUT request to /_internal/backendFaults, with
+// the fault in the JSON body, such as {"kind": "disk-full", "bucket":
+// "some-bucket"}. A DELETE request to the same path clears all faults.
+func (s *Server) InjectBackendFault(fault BackendFault) error {
+	if !backend.ValidFaultKind(string(fault.Kind)) {
+		return fmt.Errorf("invalid kind of backend fault %q", fault.Kind)
+	}
+	if fault.Times < 0 {
+		return errors.New("invalid negative times")
+	}
+	s.faults.Inject(backend.Fault{
+		Kind:       string(fault.Kind),
+		Operation:  fault.Operation,
+		BucketName: fault.Bucket,
+		Times:      fault.Times,
+	})
+	return nil
+}
+
+// ClearBackendFaults removes all the faults injected in the storage backend.
+func (s *Server) ClearBackendFaults() {
+	s.faults.Clear()
+}
+
+// backendFaultError returns the API error for an error of the backend caused
+// by an injected fault, or nil for other errors. Handlers that report
+// backend errors as missing resources use it to report faults as internal
+// errors.
+func backendFaultError(err error) *statusError {
+	var faultErr *backend.FaultError
+	if !errors.As(err, &faultErr) {
+		return nil
+	}
+	return &statusError{code: http.StatusInternalServerError, reason: "backendError", message: faultErr.Error(), err: faultErr}
+}
+
+func (s *Server) injectBackendFaultByPut(w http.ResponseWriter, r *http.Request) {
+	var fault BackendFault
+	if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.InjectBackendFault(fault); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearBackendFaultsByDelete(w http.ResponseWriter, r *http.Request) {
+	s.ClearBackendFaults()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerBackendFaults(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		defer server.ClearBackendFaults()
+		var tests = []struct {
+			name           string
+			fault          BackendFault
+			method         string
+			path           string
+			body           string
+			expectedStatus int
+		}{
+			{
+				"disk full on upload",
+				BackendFault{Kind: BackendDiskFull},
+				http.MethodPost,
+				"/upload/storage/v1/b/some-bucket/o?uploadType=media&name=other.txt",
+				"content",
+				http.StatusInternalServerError,
+			},
+			{
+				"disk full doesn't affect reads",
+				BackendFault{Kind: BackendDiskFull},
+				http.MethodGet,
+				"/storage/v1/b/some-bucket/o/object.txt",
+				"",
+				http.StatusOK,
+			},
+			{
+				"corrupted metadata on get",
+				BackendFault{Kind: BackendCorruptedMetadata, Operation: "GetObject"},
+				http.MethodGet,
+				"/storage/v1/b/some-bucket/o/object.txt",
+				"",
+				http.StatusInternalServerError,
+			},
+			{
+				"corrupted metadata on list",
+				BackendFault{Kind: BackendCorruptedMetadata, Operation: "ListObjects"},
+				http.MethodGet,
+				"/storage/v1/b/some-bucket/o",
+				"",
+				http.StatusInternalServerError,
+			},
+			{
+				"permission denied on another bucket",
+				BackendFault{Kind: BackendPermissionDenied, Bucket: "other-bucket"},
+				http.MethodGet,
+				"/storage/v1/b/some-bucket/o/object.txt",
+				"",
+				http.StatusOK,
+			},
+		}
+		for _, test := range tests {
+			server.ClearBackendFaults()
+			if err := server.InjectBackendFault(test.fault); err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(test.method, "https://www.googleapis.com"+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data errorResponse
+			json.NewDecoder(resp.Body).Decode(&data)
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus == http.StatusInternalServerError && data.Error.Code != http.StatusInternalServerError {
+				t.Errorf("%s: wrong error code in the body\nwant %d\ngot  %d", test.name, http.StatusInternalServerError, data.Error.Code)
+			}
+		}
+	})
+}
+
+func TestServerBackendFaultsTimes(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		defer server.ClearBackendFaults()
+		err := server.InjectBackendFault(BackendFault{Kind: BackendPermissionDenied, Operation: "GetObject", Times: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expectedStatus := range []int{http.StatusInternalServerError, http.StatusOK} {
+			resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket/o/object.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", expectedStatus, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestServerBackendFaultsInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt"}})
+	defer server.Stop()
+	const faultsURL = "https://www.googleapis.com/_internal/backendFaults"
+	do := func(method, body string, expectedStatus int) {
+		t.Helper()
+		req, err := http.NewRequest(method, faultsURL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, body, expectedStatus, resp.StatusCode)
+		}
+	}
+	do(http.MethodPut, `{"kind":"exploded-disk"}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"kind":"disk-full","times":-1}`, http.StatusBadRequest)
+	do(http.MethodPut, `not json`, http.StatusBadRequest)
+	do(http.MethodPut, `{"kind":"permission-denied","bucket":"some-bucket"}`, http.StatusNoContent)
+
+	_, err := server.GetObject("some-bucket", "object.txt")
+	if err == nil {
+		t.Error("unexpected <nil> error with permission denied")
+	}
+	do(http.MethodDelete, "", http.StatusNoContent)
+	_, err = server.GetObject("some-bucket", "object.txt")
+	if err != nil {
+		t.Errorf("unexpected error after clearing faults: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BillingEntry records the project billed for an operation on a requester
+// pays bucket.
+type BillingEntry struct {
+	Time        time.Time `json:"time"`
+	UserProject string    `json:"userProject"`
+	Bucket      string    `json:"bucket"`
+	Object      string    `json:"object,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+}
+
+// BillingReport is the tally of the operations billed to each project.
+type BillingReport struct {
+	// Entries are the most recent billed operations, in the order they
+	// were received. Up to 10000 entries are kept, older entries are
+	// only accounted for in Totals and DroppedEntries.
+	Entries []BillingEntry `json:"entries"`
+
+	// Totals maps each project to the number of operations billed to it.
+	Totals map[string]int `json:"totals"`
+
+	// DroppedEntries is the number of billed operations left out of
+	// Entries.
+	DroppedEntries int `json:"droppedEntries,omitempty"`
+}
+
+// maxBillingEntries is the number of entries kept in the billing report.
+const maxBillingEntries = 10000
+
+type billingLedger struct {
+	mtx     sync.Mutex
+	entries []BillingEntry
+	totals  map[string]int
+	dropped int
+}
+
+func (l *billingLedger) add(entries []BillingEntry) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.totals == nil {
+		l.totals = make(map[string]int)
+	}
+	for _, entry := range entries {
+		l.totals[entry.UserProject]++
+	}
+	l.entries = append(l.entries, entries...)
+	if excess := len(l.entries) - maxBillingEntries; excess > 0 {
+		l.entries = append([]BillingEntry(nil), l.entries[excess:]...)
+		l.dropped += excess
+	}
+}
+
+// BillingReport returns the projects billed for operations on requester pays
+// buckets since the server started, or since the last call to
+// ResetBillingReport. The project billed for a request is the one in its
+// userProject parameter, and requests to requester pays buckets without it
+// are rejected, like in Cloud Storage.
+//
+// The report is also available through a GET request to /_internal/billing,
+// and a DELETE request to the same path resets it.
+func (s *Server) BillingReport() BillingReport {
+	s.billing.mtx.Lock()
+	defer s.billing.mtx.Unlock()
+	report := BillingReport{
+		Entries:        make([]BillingEntry, len(s.billing.entries)),
+		Totals:         make(map[string]int, len(s.billing.totals)),
+		DroppedEntries: s.billing.dropped,
+	}
+	copy(report.Entries, s.billing.entries)
+	for project, total := range s.billing.totals {
+		report.Totals[project] = total
+	}
+	return report
+}
+
+// ResetBillingReport discards the entries and totals of the billing report.
+func (s *Server) ResetBillingReport() {
+	s.billing.mtx.Lock()
+	defer s.billing.mtx.Unlock()
+	s.billing.entries = nil
+	s.billing.totals = nil
+	s.billing.dropped = 0
+}
+
+func (s *Server) billingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userProject := r.URL.Query().Get("userProject")
+		if userProject == "" {
+			userProject = r.Header.Get("X-Goog-User-Project")
+		}
+		var entries []BillingEntry
+		for _, bucketName := range s.requestBuckets(r) {
+			bucket, err := s.backend.GetBucket(bucketName)
+			if err != nil || !bucket.RequesterPays {
+				continue
+			}
+			if userProject == "" {
+				writeStatusError(w, &statusError{
+					code:    http.StatusBadRequest,
+					reason:  "required",
+					message: "Bucket is a requester pays bucket but no user project provided.",
+				})
+				return
+			}
+			_, objectName := requestTarget(r)
+			if vars := mux.Vars(r); bucketName == vars["destinationBucket"] && bucketName != vars["sourceBucket"] {
+				objectName = vars["destinationObject"]
+			}
+			entries = append(entries, BillingEntry{
+				Time:        time.Now(),
+				UserProject: userProject,
+				Bucket:      bucketName,
+				Object:      objectName,
+				Method:      r.Method,
+				Path:        r.URL.Path,
+			})
+		}
+		if len(entries) > 0 {
+			s.billing.add(entries)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getBillingReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.BillingReport())
+}
+
+func (s *Server) resetBillingReportByDelete(w http.ResponseWriter, r *http.Request) {
+	s.ResetBillingReport()
+	w.WriteHeader(http.StatusNoContent)
+}
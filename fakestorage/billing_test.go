@@ -0,0 +1,118 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientRequesterPaysBilling(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "paid-bucket", RequesterPays: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "paid-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "free-bucket", Name: "object.txt", Content: []byte("other content")}); err != nil {
+			t.Fatal(err)
+		}
+		client := server.Client()
+
+		_, err := client.Bucket("paid-bucket").Object("object.txt").Attrs(ctx)
+		if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error without user project\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+		if _, err := client.Bucket("paid-bucket").UserProject("project-a").Object("object.txt").Attrs(ctx); err != nil {
+			t.Fatal(err)
+		}
+		bucket := client.Bucket("paid-bucket").UserProject("project-b")
+		if content := readObjectContent(t, bucket.Object("object.txt")); content != "some content" {
+			t.Errorf("wrong content\nwant %q\ngot  %q", "some content", content)
+		}
+		writeObjectContent(t, bucket.Object("new.txt"), "new content")
+		if _, err := client.Bucket("free-bucket").Object("object.txt").Attrs(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		report := server.BillingReport()
+		expectedTotals := map[string]int{"project-a": 1, "project-b": 2}
+		if !reflect.DeepEqual(report.Totals, expectedTotals) {
+			t.Errorf("wrong totals\nwant %v\ngot  %v", expectedTotals, report.Totals)
+		}
+		for _, entry := range report.Entries {
+			if entry.Bucket != "paid-bucket" {
+				t.Errorf("wrong bucket billed: %+v", entry)
+			}
+		}
+		if last := report.Entries[len(report.Entries)-1]; last.Path != "/upload/storage/v1/b/paid-bucket/o" || last.Method != http.MethodPost {
+			t.Errorf("wrong entry for upload: %+v", last)
+		}
+
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/_internal/billing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var httpReport BillingReport
+		err = json.NewDecoder(resp.Body).Decode(&httpReport)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(httpReport.Totals, expectedTotals) {
+			t.Errorf("wrong totals from the admin endpoint\nwant %v\ngot  %v", expectedTotals, httpReport.Totals)
+		}
+
+		server.ResetBillingReport()
+		if report := server.BillingReport(); len(report.Entries) != 0 {
+			t.Errorf("unexpected entries after reset: %+v", report.Entries)
+		}
+	})
+}
+
+func TestServerRequesterPaysBillingCopy(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "paid-bucket", RequesterPays: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "paid-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+		t.Fatal(err)
+	}
+	bucket := server.Client().Bucket("paid-bucket").UserProject("project-a")
+	if _, err := bucket.Object("copy.txt").CopierFrom(bucket.Object("object.txt")).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report := server.BillingReport()
+	if len(report.Entries) != 1 || report.Totals["project-a"] != 1 {
+		t.Errorf("copy within a bucket not billed once: %+v", report)
+	}
+}
+
+func TestBillingLedgerLimit(t *testing.T) {
+	var ledger billingLedger
+	entries := make([]BillingEntry, maxBillingEntries+5)
+	for i := range entries {
+		entries[i] = BillingEntry{UserProject: "project-a", Path: strconv.Itoa(i)}
+	}
+	ledger.add(entries)
+	if len(ledger.entries) != maxBillingEntries {
+		t.Errorf("wrong number of entries kept\nwant %d\ngot  %d", maxBillingEntries, len(ledger.entries))
+	}
+	if ledger.entries[0].Path != "5" {
+		t.Errorf("wrong oldest entry kept\nwant %q\ngot  %q", "5", ledger.entries[0].Path)
+	}
+	if ledger.dropped != 5 || ledger.totals["project-a"] != maxBillingEntries+5 {
+		t.Errorf("wrong dropped entries or totals: %d, %v", ledger.dropped, ledger.totals)
+	}
+}
@@ -5,28 +5,117 @@
 package fakestorage
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fsouza/fake-gcs-server/internal/backend"
 	"github.com/gorilla/mux"
 )
 
+// CreateBucketOpts defines the properties of a bucket you can create with
+// CreateBucketWithOpts.
+type CreateBucketOpts struct {
+	Name string
+
+	// DefaultEventBasedHold makes new objects in the bucket carry an
+	// event-based hold.
+	DefaultEventBasedHold bool
+
+	// VersioningEnabled makes the bucket keep noncurrent generations of
+	// objects when they're replaced or deleted.
+	VersioningEnabled bool
+
+	// SoftDeleteRetention is the retention duration of the soft delete
+	// policy of the bucket. Objects permanently deleted from buckets with a
+	// soft delete policy are kept as soft-deleted objects for this long.
+	SoftDeleteRetention time.Duration
+
+	// ReadOnly makes writes to the bucket through the API fail, see
+	// SetBucketReadOnly.
+	ReadOnly bool
+
+	// Location is the location of the bucket, such as "US" or "EUROPE-WEST1".
+	// Defaults to "US". See also SimulateOutage.
+	Location string
+
+	// CustomPlacement is the list of regions of configurable dual-region
+	// buckets, such as ["US-EAST1", "US-WEST1"] in location "US".
+	CustomPlacement []string
+
+	// HierarchicalNamespace enables the hierarchical namespace of the
+	// bucket. It's only reported by the API.
+	HierarchicalNamespace bool
+
+	// RequesterPays makes API requests to the bucket require a userProject,
+	// see BillingReport.
+	RequesterPays bool
+
+	// RPO is the recovery point objective of the bucket, DEFAULT or
+	// ASYNC_TURBO. Turbo replication requires a dual-region location.
+	RPO string
+
+	// UploadDefaults are the defaults of the uploads to the bucket, see
+	// SetBucketUploadDefaults.
+	UploadDefaults *UploadDefaults
+}
+
 // CreateBucket creates a bucket inside the server, so any API calls that
 // require the bucket name will recognize this bucket.
 //
 // If the bucket already exists, this method does nothing.
-func (s *Server) CreateBucket(name string) {
-	err := s.backend.CreateBucket(name)
-	if err != nil {
-		panic(err)
+func (s *Server) CreateBucket(name string) error {
+	return s.CreateBucketWithOpts(CreateBucketOpts{Name: name})
+}
+
+// CreateBucketWithOpts creates a bucket inside the server with the given
+// properties, or returns the error the API would report for them, such as a
+// 400 *googleapi.Error for an invalid RPO.
+//
+// If the bucket already exists, this method does nothing.
+func (s *Server) CreateBucketWithOpts(opts CreateBucketOpts) error {
+	bucket := backend.Bucket{
+		Name:                  opts.Name,
+		TimeCreated:           time.Now(),
+		DefaultEventBasedHold: opts.DefaultEventBasedHold,
+		VersioningEnabled:     opts.VersioningEnabled,
+		SoftDeleteRetention:   opts.SoftDeleteRetention,
+		ReadOnly:              opts.ReadOnly,
+		Location:              bucketLocation(opts.Location),
+		CustomPlacement:       opts.CustomPlacement,
+		HierarchicalNamespace: opts.HierarchicalNamespace,
+		RequesterPays:         opts.RequesterPays,
+		RPO:                   opts.RPO,
+		UploadDefaults:        opts.UploadDefaults.toBackend(),
+	}
+	if err := validateRPO(bucket); err != nil {
+		return err
 	}
+	return toStatusError(s.backend.CreateBucket(bucket))
 }
 
 // createBucketByPost handles a POST request to create a bucket
 func (s *Server) createBucketByPost(w http.ResponseWriter, r *http.Request) {
 	// Minimal version of Bucket from google.golang.org/api/storage/v1
 	var data struct {
-		Name string
+		Name                  string
+		DefaultEventBasedHold bool
+		Versioning            *bucketVersioning
+		SoftDeletePolicy      *bucketSoftDeletePolicy
+		Location              string
+		Labels                map[string]string
+		Lifecycle             *bucketLifecycle
+		Cors                  []backend.CorsRule
+		CustomPlacementConfig *customPlacementConfig
+		HierarchicalNamespace *hierarchicalNamespace
+		Billing               *bucketBilling
+		Rpo                   string
 	}
 
 	// Read the bucket name from the request body JSON
@@ -35,39 +124,259 @@ func (s *Server) createBucketByPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	name := data.Name
+	bucket := backend.Bucket{
+		Name:                  data.Name,
+		TimeCreated:           time.Now(),
+		DefaultEventBasedHold: data.DefaultEventBasedHold,
+		Location:              bucketLocation(data.Location),
+		Labels:                data.Labels,
+		CorsRules:             data.Cors,
+		RPO:                   data.Rpo,
+	}
+	if data.Lifecycle != nil {
+		bucket.LifecycleRules = data.Lifecycle.Rule
+	}
+	if data.CustomPlacementConfig != nil {
+		bucket.CustomPlacement = data.CustomPlacementConfig.DataLocations
+	}
+	if data.HierarchicalNamespace != nil {
+		bucket.HierarchicalNamespace = data.HierarchicalNamespace.Enabled
+	}
+	if data.Billing != nil {
+		bucket.RequesterPays = data.Billing.RequesterPays
+	}
+	if data.Versioning != nil {
+		bucket.VersioningEnabled = data.Versioning.Enabled
+	}
+	if data.SoftDeletePolicy != nil {
+		bucket.SoftDeleteRetention = data.SoftDeletePolicy.retention()
+	}
+	if err := validateRPO(bucket); err != nil {
+		writeStatusError(w, err)
+		return
+	}
 
 	// Create the named bucket
-	if err := s.backend.CreateBucket(name); err != nil {
+	if err := s.backend.CreateBucket(bucket); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Return the created bucket:
-	resp := newBucketResponse(name)
+	bucket, err := s.backend.GetBucket(bucket.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := newBucketResponse(bucket)
+	s.addBucketUsage(&resp)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// defaultMaxResults is the default page size of listings in the JSON API.
+const defaultMaxResults = 1000
+
+// listBuckets handles a GET request to list buckets. It supports the prefix,
+// maxResults and pageToken parameters. Page tokens are opaque to clients, and
+// encode the name of the last bucket in the previous page.
 func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
-	bucketNames, err := s.backend.ListBuckets()
+	query := r.URL.Query()
+	maxResults := defaultMaxResults
+	if value := query.Get("maxResults"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid maxResults", http.StatusBadRequest)
+			return
+		}
+		if n < maxResults {
+			maxResults = n
+		}
+	}
+	var startAfter string
+	if token := query.Get("pageToken"); token != "" {
+		decoded, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "invalid pageToken", http.StatusBadRequest)
+			return
+		}
+		startAfter = string(decoded)
+	}
+	allBuckets, err := s.backend.ListBuckets()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	resp := newListBucketsResponse(bucketNames)
+	sort.Slice(allBuckets, func(i, j int) bool {
+		return allBuckets[i].Name < allBuckets[j].Name
+	})
+	prefix := query.Get("prefix")
+	var buckets []backend.Bucket
+	var nextPageToken string
+	for _, bucket := range allBuckets {
+		if !strings.HasPrefix(bucket.Name, prefix) || bucket.Name <= startAfter {
+			continue
+		}
+		if len(buckets) == maxResults {
+			nextPageToken = base64.URLEncoding.EncodeToString([]byte(buckets[len(buckets)-1].Name))
+			break
+		}
+		buckets = append(buckets, bucket)
+	}
+	resp := newListBucketsResponse(buckets)
+	for i, item := range resp.Items {
+		bucketResp := item.(bucketResponse)
+		s.addBucketUsage(&bucketResp)
+		resp.Items[i] = bucketResp
+	}
+	resp.NextPageToken = nextPageToken
 	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) getBucket(w http.ResponseWriter, r *http.Request) {
 	bucketName := mux.Vars(r)["bucketName"]
 	encoder := json.NewEncoder(w)
-	if err := s.backend.GetBucket(bucketName); err != nil {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		if fault := backendFaultError(err); fault != nil {
+			writeStatusError(w, fault)
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		err := newErrorResponse(http.StatusNotFound, "Not found", nil)
 		encoder.Encode(err)
 		return
 	}
-	resp := newBucketResponse(bucketName)
+	resp := newBucketResponse(bucket)
+	s.addBucketUsage(&resp)
 	w.WriteHeader(http.StatusOK)
 	encoder.Encode(resp)
 }
+
+// patchBucket handles a PATCH request to update the attributes of a bucket.
+// Fields omitted in the request are preserved.
+func (s *Server) patchBucket(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketName"]
+	encoder := json.NewEncoder(w)
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		if fault := backendFaultError(err); fault != nil {
+			writeStatusError(w, fault)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		err := newErrorResponse(http.StatusNotFound, "Not found", nil)
+		encoder.Encode(err)
+		return
+	}
+	if err := s.checkBucketWritable(bucketName, "storage.buckets.update"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyBucketPatch(&bucket, fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateRPO(bucket); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if err := s.backend.UpdateBucket(bucket); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := newBucketResponse(bucket)
+	s.addBucketUsage(&resp)
+	encoder.Encode(resp)
+}
+
+// applyBucketPatch applies the fields of a PATCH request to the bucket. Like
+// in the JSON API, omitted fields are preserved, and fields explicitly set to
+// null are cleared. Labels are merged with the existing ones, and labels set
+// to null are removed.
+func applyBucketPatch(bucket *backend.Bucket, fields map[string]json.RawMessage) error {
+	for field, value := range fields {
+		isNull := string(bytes.TrimSpace(value)) == "null"
+		var err error
+		switch field {
+		case "defaultEventBasedHold":
+			bucket.DefaultEventBasedHold = false
+			if !isNull {
+				err = json.Unmarshal(value, &bucket.DefaultEventBasedHold)
+			}
+		case "versioning":
+			var versioning bucketVersioning
+			if !isNull {
+				err = json.Unmarshal(value, &versioning)
+			}
+			bucket.VersioningEnabled = versioning.Enabled
+		case "softDeletePolicy":
+			var policy bucketSoftDeletePolicy
+			if !isNull {
+				err = json.Unmarshal(value, &policy)
+			}
+			bucket.SoftDeleteRetention = policy.retention()
+		case "billing":
+			var billing bucketBilling
+			if !isNull {
+				err = json.Unmarshal(value, &billing)
+			}
+			bucket.RequesterPays = billing.RequesterPays
+		case "labels":
+			err = patchLabels(bucket, value, isNull)
+		case "lifecycle":
+			var lifecycle bucketLifecycle
+			if !isNull {
+				err = json.Unmarshal(value, &lifecycle)
+			}
+			bucket.LifecycleRules = lifecycle.Rule
+		case "cors":
+			var cors []backend.CorsRule
+			if !isNull {
+				err = json.Unmarshal(value, &cors)
+			}
+			bucket.CorsRules = cors
+		case "rpo":
+			bucket.RPO = ""
+			if !isNull {
+				err = json.Unmarshal(value, &bucket.RPO)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for field %q: %v", field, err)
+		}
+	}
+	return nil
+}
+
+func patchLabels(bucket *backend.Bucket, value json.RawMessage, isNull bool) error {
+	if isNull {
+		bucket.Labels = nil
+		return nil
+	}
+	var labels map[string]*string
+	if err := json.Unmarshal(value, &labels); err != nil {
+		return err
+	}
+	// the labels of the stored bucket must not be modified in place.
+	merged := make(map[string]string, len(bucket.Labels)+len(labels))
+	for key, value := range bucket.Labels {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
+		}
+	}
+	bucket.Labels = nil
+	if len(merged) > 0 {
+		bucket.Labels = merged
+	}
+	return nil
+}
@@ -6,11 +6,17 @@ package fakestorage
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -38,7 +44,9 @@ func TestServerClientBucketAttrs(t *testing.T) {
 func TestServerClientBucketAttrsAfterCreateBucket(t *testing.T) {
 	runServersTest(t, nil, func(t *testing.T, server *Server) {
 		const bucketName = "best-bucket-ever"
-		server.CreateBucket(bucketName)
+		if err := server.CreateBucket(bucketName); err != nil {
+			t.Fatal(err)
+		}
 		client := server.Client()
 		attrs, err := client.Bucket(bucketName).Attrs(context.Background())
 		if err != nil {
@@ -107,6 +115,76 @@ func TestServerClientListBuckets(t *testing.T) {
 	})
 }
 
+func TestServerClientListBucketsPagination(t *testing.T) {
+	var objs []Object
+	for _, name := range []string{"app-logs", "app-data", "app-cache", "app-backups", "app-tmp", "other-bucket"} {
+		objs = append(objs, Object{BucketName: name, Name: "some-object.txt"})
+	}
+
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		tests := []struct {
+			testCase      string
+			prefix        string
+			pageSize      int
+			expectedNames []string
+		}{
+			{
+				"prefix and small pages",
+				"app-",
+				2,
+				[]string{"app-backups", "app-cache", "app-data", "app-logs", "app-tmp"},
+			},
+			{
+				"no prefix and exact pages",
+				"",
+				3,
+				[]string{"app-backups", "app-cache", "app-data", "app-logs", "app-tmp", "other-bucket"},
+			},
+			{
+				"no matches",
+				"none-",
+				2,
+				nil,
+			},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.testCase, func(t *testing.T) {
+				it := server.Client().Buckets(context.Background(), "whatever")
+				it.Prefix = test.prefix
+				it.PageInfo().MaxSize = test.pageSize
+				var returnedNames []string
+				b, err := it.Next()
+				for ; err == nil; b, err = it.Next() {
+					returnedNames = append(returnedNames, b.Name)
+				}
+				if err != iterator.Done {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(returnedNames, test.expectedNames) {
+					t.Errorf("wrong names returned\nwant %#v\ngot  %#v", test.expectedNames, returnedNames)
+				}
+			})
+		}
+
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b?project=whatever&maxResults=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var page struct {
+			Items         []bucketResponse
+			NextPageToken string
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 2 || page.NextPageToken == "" {
+			t.Errorf("wrong first page: %d items, next page token %q", len(page.Items), page.NextPageToken)
+		}
+	})
+}
+
 func TestServerClientListObjects(t *testing.T) {
 	objects := []Object{
 		{BucketName: "some-bucket", Name: "img/hi-res/party-01.jpg"},
@@ -147,3 +225,241 @@ func TestServerClientListObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestServerClientBucketDefaultEventBasedHold(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		const bucketName = "compliance-bucket"
+		ctx := context.Background()
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, DefaultEventBasedHold: true}); err != nil {
+			t.Fatal(err)
+		}
+		client := server.Client()
+		bucket := client.Bucket(bucketName)
+		attrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.DefaultEventBasedHold {
+			t.Error("defaultEventBasedHold not returned in the bucket attributes")
+		}
+		writeObject := func(name string) {
+			w := bucket.Object(name).NewWriter(ctx)
+			w.Write([]byte("some content"))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writeObject("held.txt")
+		objAttrs, err := bucket.Object("held.txt").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !objAttrs.EventBasedHold {
+			t.Error("new object doesn't carry an event-based hold")
+		}
+		err = bucket.Object("held.txt").Delete(ctx)
+		if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusForbidden {
+			t.Errorf("wrong error deleting held object: %v", err)
+		}
+
+		attrs, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{DefaultEventBasedHold: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.DefaultEventBasedHold {
+			t.Error("defaultEventBasedHold not disabled")
+		}
+		writeObject("not-held.txt")
+		objAttrs, err = bucket.Object("not-held.txt").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objAttrs.EventBasedHold {
+			t.Error("object created after disabling the default carries an event-based hold")
+		}
+		objAttrs, err = bucket.Object("held.txt").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !objAttrs.EventBasedHold {
+			t.Error("disabling the bucket default released the hold of an existing object")
+		}
+
+		objAttrs, err = bucket.Object("held.txt").Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objAttrs.EventBasedHold {
+			t.Error("event-based hold not released")
+		}
+		if objAttrs.Metageneration != 2 {
+			t.Errorf("wrong metageneration after update\nwant 2\ngot  %d", objAttrs.Metageneration)
+		}
+		if err := bucket.Object("held.txt").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServerClientBucketDefaultEventBasedHoldOverwrite(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		const bucketName = "compliance-bucket"
+		ctx := context.Background()
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, DefaultEventBasedHold: true}); err != nil {
+			t.Fatal(err)
+		}
+		object := server.Client().Bucket(bucketName).Object("object.txt")
+		writeObject := func() {
+			w := object.NewWriter(ctx)
+			w.Write([]byte("some content"))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writeObject()
+		objAttrs, err := object.Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objAttrs.EventBasedHold {
+			t.Error("metadata update of the same generation restored the default event-based hold")
+		}
+		generation := objAttrs.Generation
+
+		writeObject()
+		objAttrs, err = object.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objAttrs.Generation == generation {
+			t.Fatal("object overwritten without creating a new generation")
+		}
+		if !objAttrs.EventBasedHold {
+			t.Error("new generation of an existing object doesn't carry an event-based hold")
+		}
+	})
+}
+
+func TestServerClientBucketPatchSoftDeletePolicy(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		body := strings.NewReader(`{"versioning":{"enabled":true},"softDeletePolicy":{"retentionDurationSeconds":"3600"}}`)
+		req, err := http.NewRequest(http.MethodPatch, "https://www.googleapis.com/storage/v1/b/some-bucket", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var bucketResp bucketResponse
+		if err := json.NewDecoder(resp.Body).Decode(&bucketResp); err != nil {
+			t.Fatal(err)
+		}
+		if bucketResp.Versioning == nil || !bucketResp.Versioning.Enabled {
+			t.Errorf("versioning not enabled: %+v", bucketResp.Versioning)
+		}
+		if bucketResp.SoftDeletePolicy == nil || bucketResp.SoftDeletePolicy.RetentionDurationSeconds != 3600 {
+			t.Errorf("wrong soft delete policy: %+v", bucketResp.SoftDeletePolicy)
+		}
+		bucket, err := server.backend.GetBucket("some-bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket.SoftDeleteRetention != time.Hour {
+			t.Errorf("wrong soft delete retention\nwant %s\ngot  %s", time.Hour, bucket.SoftDeleteRetention)
+		}
+	})
+}
+
+func TestServerBucketPatchNullSemantics(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		client := server.HTTPClient()
+		send := func(method, url, body string) bucketResponse {
+			t.Helper()
+			req, err := http.NewRequest(method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			var bucketResp bucketResponse
+			if err := json.NewDecoder(resp.Body).Decode(&bucketResp); err != nil {
+				t.Fatal(err)
+			}
+			return bucketResp
+		}
+		const bucketURL = "https://www.googleapis.com/storage/v1/b/some-bucket"
+		send(http.MethodPost, "https://www.googleapis.com/storage/v1/b", `{
+			"name": "some-bucket",
+			"labels": {"env": "test", "team": "storage"},
+			"lifecycle": {"rule": [{"action": {"type": "Delete"}, "condition": {"age": 30}}]},
+			"cors": [{"origin": ["*"], "method": ["GET"], "maxAgeSeconds": 3600}]
+		}`)
+
+		resp := send(http.MethodPatch, bucketURL, `{"labels": {"team": null, "owner": "me"}}`)
+		expectedLabels := map[string]string{"env": "test", "owner": "me"}
+		if !reflect.DeepEqual(resp.Labels, expectedLabels) {
+			t.Errorf("wrong labels\nwant %v\ngot  %v", expectedLabels, resp.Labels)
+		}
+		if resp.Lifecycle == nil || len(resp.Lifecycle.Rule) != 1 {
+			t.Errorf("lifecycle not preserved: %+v", resp.Lifecycle)
+		}
+		if len(resp.Cors) != 1 {
+			t.Errorf("cors not preserved: %+v", resp.Cors)
+		}
+
+		resp = send(http.MethodPatch, bucketURL, `{"lifecycle": null, "cors": null}`)
+		if resp.Lifecycle != nil {
+			t.Errorf("lifecycle not cleared: %+v", resp.Lifecycle)
+		}
+		if resp.Cors != nil {
+			t.Errorf("cors not cleared: %+v", resp.Cors)
+		}
+		if !reflect.DeepEqual(resp.Labels, expectedLabels) {
+			t.Errorf("wrong labels\nwant %v\ngot  %v", expectedLabels, resp.Labels)
+		}
+
+		resp = send(http.MethodPatch, bucketURL, `{"labels": null}`)
+		if resp.Labels != nil {
+			t.Errorf("labels not cleared: %v", resp.Labels)
+		}
+	})
+}
+
+func TestServerClientBucketUpdateLabels(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		bucket := server.Client().Bucket("some-bucket")
+		var update storage.BucketAttrsToUpdate
+		update.SetLabel("env", "test")
+		update.SetLabel("team", "storage")
+		if _, err := bucket.Update(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+		update = storage.BucketAttrsToUpdate{}
+		update.DeleteLabel("team")
+		attrs, err := bucket.Update(ctx, update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedLabels := map[string]string{"env": "test"}
+		if !reflect.DeepEqual(attrs.Labels, expectedLabels) {
+			t.Errorf("wrong labels\nwant %v\ngot  %v", expectedLabels, attrs.Labels)
+		}
+	})
+}
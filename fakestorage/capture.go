@@ -0,0 +1,541 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// goldenIgnoredHeaders are the request headers left out of golden files,
+// because their values change from run to run or with every version of the
+// client libraries, regardless of the traffic they send.
+var goldenIgnoredHeaders = map[string]bool{
+	"Accept-Encoding":              true,
+	"Authorization":                true,
+	"Content-Length":               true,
+	"Traceparent":                  true,
+	"User-Agent":                   true,
+	"X-Cloud-Trace-Context":        true,
+	"X-Goog-Api-Client":            true,
+	"X-Goog-Gcs-Idempotency-Token": true,
+}
+
+// goldenBoundary replaces the random boundaries of multipart bodies in golden
+// files.
+const goldenBoundary = "BOUNDARY"
+
+// Exchange is a request to the API and the response of the server, as
+// captured between StartCapture and StopCapture.
+type Exchange struct {
+	Start    time.Time
+	Duration time.Duration
+	Request  CapturedRequest
+	Response CapturedResponse
+}
+
+// CapturedRequest is a request in an Exchange. URL is the full URL of the
+// request, including the host used by the client.
+type CapturedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// CapturedResponse is a response in an Exchange.
+type CapturedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Capture is the traffic captured by the server, in the order requests
+// completed.
+type Capture struct {
+	Exchanges []Exchange
+}
+
+// captureState holds the traffic captured by the server.
+type captureState struct {
+	mtx       sync.Mutex
+	active    bool
+	exchanges []Exchange
+}
+
+// StartCapture starts capturing the requests to the API and their responses,
+// discarding the traffic captured before. Requests to the internal endpoints
+// aren't captured. Requests to namespaces are captured by the server that
+// owns them.
+//
+// The same can be done with a PUT request to /_internal/capture. A GET
+// request to the same path returns the traffic captured so far, in HAR
+// format by default, or as a golden file with ?format=golden, and a DELETE
+// request stops the capture. A POST request to /_internal/capture/verify,
+// with a golden file in the body, compares the traffic captured so far with
+// it, failing with 409 and the differences when they don't match.
+func (s *Server) StartCapture() {
+	if s.parent != nil {
+		s.parent.StartCapture()
+		return
+	}
+	s.capture.mtx.Lock()
+	defer s.capture.mtx.Unlock()
+	s.capture.active = true
+	s.capture.exchanges = nil
+}
+
+// StopCapture stops capturing traffic, and returns the traffic captured since
+// StartCapture.
+func (s *Server) StopCapture() *Capture {
+	if s.parent != nil {
+		return s.parent.StopCapture()
+	}
+	s.capture.mtx.Lock()
+	defer s.capture.mtx.Unlock()
+	capture := &Capture{Exchanges: s.capture.exchanges}
+	s.capture.active = false
+	s.capture.exchanges = nil
+	return capture
+}
+
+// capturedTraffic returns the traffic captured so far, without stopping the
+// capture.
+func (s *Server) capturedTraffic() *Capture {
+	if s.parent != nil {
+		return s.parent.capturedTraffic()
+	}
+	s.capture.mtx.Lock()
+	defer s.capture.mtx.Unlock()
+	return &Capture{Exchanges: append([]Exchange(nil), s.capture.exchanges...)}
+}
+
+func (st *captureState) isActive() bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return st.active
+}
+
+func (st *captureState) add(exchange Exchange) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.active {
+		st.exchanges = append(st.exchanges, exchange)
+	}
+}
+
+// captureMiddleware records the requests and responses of the API while a
+// capture is active, as sent on the wire.
+func (s *Server) captureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) || !s.capture.isActive() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		scheme := "https"
+		if isPlainHTTPRequest(r) {
+			scheme = "http"
+		}
+		request := CapturedRequest{
+			Method: r.Method,
+			URL:    scheme + "://" + r.Host + r.URL.RequestURI(),
+			Header: r.Header.Clone(),
+			Body:   body,
+		}
+		cw := &captureResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+		s.capture.add(Exchange{
+			Start:    start,
+			Duration: time.Since(start),
+			Request:  request,
+			Response: CapturedResponse{Status: cw.status, Header: cw.header, Body: cw.body.Bytes()},
+		})
+	})
+}
+
+// captureResponseWriter keeps a copy of the response written to the client.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// har is the HTTP Archive format, version 1.2, with the fields filled by the
+// server.
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	values := []harNameValue{}
+	for _, name := range sortedHeaderNames(header) {
+		for _, value := range header[name] {
+			values = append(values, harNameValue{Name: name, Value: value})
+		}
+	}
+	return values
+}
+
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteHAR writes the captured traffic in the HTTP Archive (HAR) format,
+// version 1.2. Binary response bodies are base64-encoded.
+func (c *Capture) WriteHAR(w io.Writer) error {
+	doc := har{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "fake-gcs-server", Version: "1"},
+		Entries: []harEntry{},
+	}}
+	for _, exchange := range c.Exchanges {
+		millis := float64(exchange.Duration) / float64(time.Millisecond)
+		entry := harEntry{
+			StartedDateTime: exchange.Start.UTC().Format(time.RFC3339Nano),
+			Time:            millis,
+			Request: harRequest{
+				Method:      exchange.Request.Method,
+				URL:         exchange.Request.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(exchange.Request.Header),
+				QueryString: []harNameValue{},
+				HeadersSize: -1,
+				BodySize:    len(exchange.Request.Body),
+			},
+			Response: harResponse{
+				Status:      exchange.Response.Status,
+				StatusText:  http.StatusText(exchange.Response.Status),
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(exchange.Response.Header),
+				Content: harContent{
+					Size:     len(exchange.Response.Body),
+					MimeType: exchange.Response.Header.Get("Content-Type"),
+				},
+				HeadersSize: -1,
+				BodySize:    len(exchange.Response.Body),
+			},
+			Timings: harTimings{Wait: millis},
+		}
+		if u, err := url.Parse(exchange.Request.URL); err == nil {
+			query := u.Query()
+			for _, name := range sortedHeaderNames(http.Header(query)) {
+				for _, value := range query[name] {
+					entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+				}
+			}
+		}
+		if len(exchange.Request.Body) > 0 {
+			entry.Request.PostData = &harPostData{
+				MimeType: exchange.Request.Header.Get("Content-Type"),
+				Text:     string(exchange.Request.Body),
+			}
+		}
+		if body := exchange.Response.Body; utf8.Valid(body) {
+			entry.Response.Content.Text = string(body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			entry.Response.Content.Encoding = "base64"
+		}
+		doc.Log.Entries = append(doc.Log.Entries, entry)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// WriteGolden writes the requests of the captured traffic in a stable text
+// format, meant to be checked in as a golden file and compared later with
+// VerifyGolden. Each exchange starts with a "### <n>" line, followed by the
+// method, the URL path with the query parameters sorted, the request headers
+// and body, and a "--> <status>" line with the status of the response.
+//
+// Headers whose values change from run to run, such as Authorization and
+// User-Agent, are left out, and the boundaries of multipart bodies are
+// replaced with BOUNDARY. Response bodies aren't included, as they're
+// produced by the server. Use Options.DeterministicIDs so the IDs of
+// resumable uploads are the same in every run.
+func (c *Capture) WriteGolden(w io.Writer) error {
+	for i, exchange := range c.Exchanges {
+		if _, err := io.WriteString(w, goldenExchange(i+1, exchange)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyGolden compares the captured traffic with a golden file written by
+// WriteGolden, returning an error describing the differences when they don't
+// match.
+func (c *Capture) VerifyGolden(golden []byte) error {
+	expected := splitGolden(string(golden))
+	var diffs []string
+	for i, exchange := range c.Exchanges {
+		got := goldenExchange(i+1, exchange)
+		if i >= len(expected) {
+			diffs = append(diffs, fmt.Sprintf("unexpected exchange %d: %s", i+1, goldenRequestLine(got)))
+			continue
+		}
+		if got != expected[i] {
+			diffs = append(diffs, goldenDiff(i+1, expected[i], got))
+		}
+	}
+	for i := len(c.Exchanges); i < len(expected); i++ {
+		diffs = append(diffs, fmt.Sprintf("missing exchange %d: %s", i+1, goldenRequestLine(expected[i])))
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("traffic doesn't match the golden file:\n%s", strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+func goldenExchange(n int, exchange Exchange) string {
+	req := exchange.Request
+	header := req.Header.Clone()
+	body := string(req.Body)
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		boundary := params["boundary"]
+		header.Set("Content-Type", strings.Replace(header.Get("Content-Type"), boundary, goldenBoundary, 1))
+		body = strings.Replace(body, boundary, goldenBoundary, -1)
+	}
+	if !utf8.ValidString(body) {
+		body = fmt.Sprintf("<%d bytes>", len(req.Body))
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "### %d\n%s %s\n", n, req.Method, goldenURL(req.URL))
+	for _, name := range sortedHeaderNames(header) {
+		if goldenIgnoredHeaders[name] {
+			continue
+		}
+		for _, value := range header[name] {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	buf.WriteString("\n")
+	if body != "" {
+		buf.WriteString(body)
+		if !strings.HasSuffix(body, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&buf, "--> %d\n", exchange.Response.Status)
+	return buf.String()
+}
+
+// goldenURL returns the path of the URL with the query parameters sorted,
+// leaving out the host, which depends on the address of the server.
+func goldenURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	return u.EscapedPath() + "?" + u.Query().Encode()
+}
+
+// splitGolden splits a golden file in the text of its exchanges.
+func splitGolden(golden string) []string {
+	var exchanges []string
+	for _, line := range strings.SplitAfter(golden, "\n") {
+		if strings.HasPrefix(line, "### ") || len(exchanges) == 0 {
+			exchanges = append(exchanges, line)
+			continue
+		}
+		exchanges[len(exchanges)-1] += line
+	}
+	if len(exchanges) == 1 && strings.TrimSpace(exchanges[0]) == "" {
+		return nil
+	}
+	return exchanges
+}
+
+// goldenDiff describes the first line that differs between two exchanges.
+func goldenDiff(n int, want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var wantLine, gotLine string
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if wantLine != gotLine {
+			return fmt.Sprintf("exchange %d: %s\n  want %q\n  got  %q", n, goldenRequestLine(got), wantLine, gotLine)
+		}
+	}
+	return fmt.Sprintf("exchange %d: %s", n, goldenRequestLine(got))
+}
+
+// goldenRequestLine returns the line with the method and the URL of the text
+// of an exchange.
+func goldenRequestLine(text string) string {
+	lines := strings.SplitN(text, "\n", 3)
+	if len(lines) < 2 {
+		return ""
+	}
+	return lines[1]
+}
+
+func (s *Server) startCaptureByPut(w http.ResponseWriter, r *http.Request) {
+	s.StartCapture()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) stopCaptureByDelete(w http.ResponseWriter, r *http.Request) {
+	s.StopCapture()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getCapture(w http.ResponseWriter, r *http.Request) {
+	capture := s.capturedTraffic()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "har":
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		capture.WriteHAR(w)
+	case "golden":
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		capture.WriteGolden(w)
+	default:
+		http.Error(w, "invalid format "+strconv.Quote(format), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) verifyCaptureByPost(w http.ResponseWriter, r *http.Request) {
+	golden, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.capturedTraffic().VerifyGolden(golden); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
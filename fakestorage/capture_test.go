@@ -0,0 +1,168 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerCaptureHAR(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		server.StartCapture()
+		ctx := context.Background()
+		w := server.Client().Bucket("some-bucket").Object("object.txt").NewWriter(ctx)
+		w.ContentType = "text/plain"
+		w.Write([]byte("some content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Client().Bucket("some-bucket").Object("missing.txt").Attrs(ctx); err == nil {
+			t.Fatal("unexpected <nil> error getting missing object")
+		}
+		capture := server.StopCapture()
+		if len(capture.Exchanges) != 2 {
+			t.Fatalf("wrong number of exchanges\nwant 2\ngot  %d", len(capture.Exchanges))
+		}
+		upload := capture.Exchanges[0]
+		if upload.Request.Method != http.MethodPost || !strings.Contains(string(upload.Request.Body), "some content") {
+			t.Errorf("wrong upload request: %s %s", upload.Request.Method, upload.Request.Body)
+		}
+		if missing := capture.Exchanges[1]; missing.Response.Status != http.StatusNotFound {
+			t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotFound, missing.Response.Status)
+		}
+
+		var buf bytes.Buffer
+		if err := capture.WriteHAR(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Log struct {
+				Version string
+				Entries []struct {
+					Request struct {
+						Method      string
+						URL         string
+						QueryString []struct{ Name, Value string }
+					}
+					Response struct {
+						Status  int
+						Content struct{ Text string }
+					}
+				}
+			}
+		}
+		if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Log.Version != "1.2" || len(doc.Log.Entries) != 2 {
+			t.Fatalf("wrong HAR document: %s", buf.String())
+		}
+		entry := doc.Log.Entries[1]
+		if !strings.HasSuffix(entry.Request.URL, "/storage/v1/b/some-bucket/o/missing.txt?alt=json&prettyPrint=false&projection=full") {
+			t.Errorf("wrong url in HAR entry: %q", entry.Request.URL)
+		}
+		if entry.Response.Status != http.StatusNotFound || entry.Response.Content.Text == "" {
+			t.Errorf("wrong response in HAR entry: %+v", entry.Response)
+		}
+
+		// traffic isn't captured after stopping the capture.
+		server.Client().Bucket("some-bucket").Object("object.txt").Attrs(ctx)
+		if capture := server.StopCapture(); len(capture.Exchanges) != 0 {
+			t.Errorf("unexpected exchanges captured after stopping the capture: %d", len(capture.Exchanges))
+		}
+	})
+}
+
+func TestServerCaptureGolden(t *testing.T) {
+	record := func(objectName string) *Capture {
+		server, err := NewServerWithOptions(Options{NoListener: true, DeterministicIDs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		server.StartCapture()
+		w := server.Client().Bucket("some-bucket").Object(objectName).NewWriter(context.Background())
+		w.ContentType = "text/plain"
+		w.Metadata = map[string]string{"team": "storage"}
+		w.Write([]byte("some content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return server.StopCapture()
+	}
+	var golden bytes.Buffer
+	if err := record("object.txt").WriteGolden(&golden); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(golden.String(), "### 1\nPOST /upload/storage/v1/b/some-bucket/o?alt=json&") {
+		t.Errorf("wrong golden file:\n%s", golden.String())
+	}
+	if strings.Contains(golden.String(), "User-Agent") || !strings.Contains(golden.String(), "boundary="+goldenBoundary) {
+		t.Errorf("golden file isn't normalized:\n%s", golden.String())
+	}
+	if err := record("object.txt").VerifyGolden(golden.Bytes()); err != nil {
+		t.Errorf("unexpected error verifying the same traffic: %v", err)
+	}
+	err := record("other.txt").VerifyGolden(golden.Bytes())
+	if err == nil || !strings.Contains(err.Error(), "exchange 1") {
+		t.Errorf("wrong error verifying different traffic: %v", err)
+	}
+	if err := (&Capture{}).VerifyGolden(golden.Bytes()); err == nil || !strings.Contains(err.Error(), "missing exchange 1") {
+		t.Errorf("wrong error verifying missing traffic: %v", err)
+	}
+}
+
+func TestServerCaptureInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}})
+	defer server.Stop()
+	const captureURL = "https://www.googleapis.com/_internal/capture"
+	do := func(method, url, body string, expectedStatus int) []byte {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, url, expectedStatus, resp.StatusCode)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	do(http.MethodPut, captureURL, "", http.StatusNoContent)
+	do(http.MethodGet, "https://storage.googleapis.com/some-bucket/object.txt", "", http.StatusOK)
+	golden := do(http.MethodGet, captureURL+"?format=golden", "", http.StatusOK)
+	expectedGolden := "### 1\nGET /some-bucket/object.txt\n\n--> 200\n"
+	if string(golden) != expectedGolden {
+		t.Errorf("wrong golden file\nwant %q\ngot  %q", expectedGolden, golden)
+	}
+	har := do(http.MethodGet, captureURL, "", http.StatusOK)
+	if !strings.Contains(string(har), `"url": "https://storage.googleapis.com/some-bucket/object.txt"`) {
+		t.Errorf("wrong HAR document: %s", har)
+	}
+	do(http.MethodGet, captureURL+"?format=xml", "", http.StatusBadRequest)
+	do(http.MethodPost, captureURL+"/verify", string(golden), http.StatusNoContent)
+	do(http.MethodPost, captureURL+"/verify", "### 1\nGET /some-bucket/other.txt\n\n--> 200\n", http.StatusConflict)
+	do(http.MethodDelete, captureURL, "", http.StatusNoContent)
+}
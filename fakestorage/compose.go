@@ -0,0 +1,196 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxComposeSources is the maximum number of source objects in a
+	// compose request.
+	maxComposeSources = 32
+
+	// maxComponentCount is the maximum number of components of a composite
+	// object.
+	maxComponentCount = 1024
+)
+
+type composeSourceObject struct {
+	Name                string `json:"name"`
+	Generation          int64  `json:"generation,string"`
+	ObjectPreconditions *struct {
+		IfGenerationMatch *int64 `json:"ifGenerationMatch,string"`
+	} `json:"objectPreconditions"`
+}
+
+type composeRequest struct {
+	SourceObjects []composeSourceObject `json:"sourceObjects"`
+	Destination   *multipartMetadata    `json:"destination"`
+}
+
+// composeObject concatenates the content of the source objects into the
+// destination object, in the order they're listed in the request.
+//
+// Like in Cloud Storage, composite objects have a component count and no MD5
+// hash, only a CRC32C checksum, which is combined from the checksums of the
+// source objects.
+func (s *Server) composeObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucketName := vars["bucketName"]
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: err.Error()})
+		return
+	}
+	var req composeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	if len(req.SourceObjects) == 0 {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "required", message: "Required field: sourceObjects"})
+		return
+	}
+	if len(req.SourceObjects) > maxComposeSources {
+		writeStatusError(w, &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("The number of source components provided (%d) exceeds the maximum (%d)", len(req.SourceObjects), maxComposeSources),
+		})
+		return
+	}
+	var content []byte
+	var componentCount int
+	var crc uint32
+	for _, src := range req.SourceObjects {
+		obj, err := s.GetObject(bucketName, src.Name)
+		if err != nil || (src.Generation != 0 && src.Generation != obj.Generation) {
+			writeStatusError(w, &statusError{
+				code:    http.StatusNotFound,
+				reason:  "notFound",
+				message: fmt.Sprintf("Object %s/%s not found", bucketName, src.Name),
+			})
+			return
+		}
+		if p := src.ObjectPreconditions; p != nil && p.IfGenerationMatch != nil && *p.IfGenerationMatch != obj.Generation {
+			writeStatusError(w, &statusError{
+				code:    http.StatusPreconditionFailed,
+				reason:  "conditionNotMet",
+				message: fmt.Sprintf("The precondition of source object %s did not hold.", src.Name),
+			})
+			return
+		}
+		crc = crc32cCombine(crc, objectCrc32c(obj), int64(len(obj.Content)))
+		content = append(content, obj.Content...)
+		componentCount += componentsOf(obj)
+	}
+	if componentCount > maxComponentCount {
+		writeStatusError(w, &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("The number of components in the composite object (%d) exceeds the maximum (%d)", componentCount, maxComponentCount),
+		})
+		return
+	}
+	dst := Object{BucketName: bucketName}
+	if req.Destination != nil {
+		req.Destination.apply(&dst)
+	}
+	dst.Name = vars["objectName"]
+	dst.Content = content
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc)
+	dst.Crc32c = encodedChecksum(checksum)
+	dst.ComponentCount = componentCount
+	dst, err = s.writeObject(dst, conds)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(newObjectResponse(dst))
+}
+
+// componentsOf returns the number of components of an object: its component
+// count for composite objects, and one for other objects.
+func componentsOf(obj Object) int {
+	if obj.ComponentCount > 0 {
+		return obj.ComponentCount
+	}
+	return 1
+}
+
+// objectCrc32c returns the CRC32C checksum of the object, computing it from
+// the content when the object doesn't have a valid checksum.
+func objectCrc32c(obj Object) uint32 {
+	if decoded, err := base64.StdEncoding.DecodeString(obj.Crc32c); err == nil && len(decoded) == 4 {
+		return binary.BigEndian.Uint32(decoded)
+	}
+	return crc32.Checksum(obj.Content, crc32cTable)
+}
+
+// crc32cCombine returns the CRC32C checksum of the concatenation of two
+// blocks of data, given the checksums of each block and the length of the
+// second one, like zlib's crc32_combine.
+func crc32cCombine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1 ^ crc2
+	}
+	var even, odd [32]uint32
+	// odd is the operator for one zero bit.
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd) // two zero bits
+	gf2MatrixSquare(&odd, &even) // four zero bits
+	// apply len2 zero bytes to crc1, the first squaring puts the operator
+	// for one zero byte (eight zero bits) in even.
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientComposeObject(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "parts/part-1", Content: []byte("some ")},
+		{BucketName: "some-bucket", Name: "parts/part-2", Content: []byte("nice ")},
+		{BucketName: "some-bucket", Name: "parts/part-3", Content: []byte("content")},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		const content = "some nice content"
+		bucket := server.Client().Bucket("some-bucket")
+		composer := bucket.Object("composed.txt").ComposerFrom(
+			bucket.Object("parts/part-1"),
+			bucket.Object("parts/part-2"),
+			bucket.Object("parts/part-3"),
+		)
+		composer.ContentType = "text/plain"
+		attrs, err := composer.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Size != int64(len(content)) {
+			t.Errorf("wrong size returned\nwant %d\ngot  %d", len(content), attrs.Size)
+		}
+		if attrs.ContentType != "text/plain" {
+			t.Errorf("wrong content type returned\nwant %q\ngot  %q", "text/plain", attrs.ContentType)
+		}
+		obj, err := server.GetObject("some-bucket", "composed.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, obj.Content)
+		}
+		checkChecksum(t, []byte(content), obj)
+	})
+}
+
+func TestServerClientComposeObjectErrors(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "parts/part-1", Content: []byte("some "), Generation: 1234},
+		{BucketName: "some-bucket", Name: "composed.txt", Content: []byte("existing")},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		bucket := server.Client().Bucket("some-bucket")
+		tests := []struct {
+			name           string
+			composer       *storage.Composer
+			expectedStatus int
+		}{
+			{
+				"missing source",
+				bucket.Object("other.txt").ComposerFrom(bucket.Object("parts/part-1"), bucket.Object("parts/missing")),
+				http.StatusNotFound,
+			},
+			{
+				"source generation mismatch",
+				bucket.Object("other.txt").ComposerFrom(bucket.Object("parts/part-1").Generation(1)),
+				http.StatusNotFound,
+			},
+			{
+				"destination precondition",
+				bucket.Object("composed.txt").If(storage.Conditions{DoesNotExist: true}).ComposerFrom(bucket.Object("parts/part-1")),
+				http.StatusPreconditionFailed,
+			},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				_, err := test.composer.Run(context.Background())
+				if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != test.expectedStatus {
+					t.Errorf("wrong error returned\nwant status %d\ngot  %v", test.expectedStatus, err)
+				}
+			})
+		}
+	})
+}
+
+func TestServerClientParallelCompositeUpload(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("some-bucket")
+		parts := []string{"first part, ", "second part, ", "third part"}
+		var sources []*storage.ObjectHandle
+		for i, part := range parts {
+			obj := bucket.Object(fmt.Sprintf("tmp/parallel_composite_uploads/component-%d", i))
+			w := obj.NewWriter(ctx)
+			w.Write([]byte(part))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, obj.If(storage.Conditions{GenerationMatch: w.Attrs().Generation}))
+		}
+		dst := bucket.Object("composed.txt").If(storage.Conditions{DoesNotExist: true})
+		_, err := dst.ComposerFrom(sources...).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, src := range sources {
+			if err := src.Delete(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r, err := bucket.Object("composed.txt").NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := strings.Join(parts, "")
+		if string(data) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, data)
+		}
+		objs, _, err := server.ListObjects("some-bucket", "tmp/", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 0 {
+			t.Errorf("components left after deletion: %d", len(objs))
+		}
+
+		attrs := getObjectJSON(t, server, "some-bucket", "composed.txt")
+		if attrs.ComponentCount != 3 {
+			t.Errorf("wrong component count\nwant 3\ngot  %d", attrs.ComponentCount)
+		}
+		if attrs.Md5Hash != "" {
+			t.Errorf("unexpected md5 hash in composite object: %q", attrs.Md5Hash)
+		}
+		if expected := encodedCrc32cChecksum([]byte(content)); attrs.Crc32c != expected {
+			t.Errorf("wrong crc32c\nwant %q\ngot  %q", expected, attrs.Crc32c)
+		}
+
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "suffix.txt", Content: []byte("!")}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = bucket.Object("nested.txt").ComposerFrom(bucket.Object("composed.txt"), bucket.Object("suffix.txt")).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs := getObjectJSON(t, server, "some-bucket", "nested.txt"); attrs.ComponentCount != 4 {
+			t.Errorf("wrong component count for nested composite\nwant 4\ngot  %d", attrs.ComponentCount)
+		}
+	})
+}
+
+func TestServerClientComposeObjectTooManySources(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "part", Content: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("some-bucket")
+		var sources []*storage.ObjectHandle
+		for i := 0; i <= maxComposeSources; i++ {
+			sources = append(sources, bucket.Object("part"))
+		}
+		_, err := bucket.Object("composed.txt").ComposerFrom(sources...).Run(context.Background())
+		if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error returned\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+	})
+}
+
+func TestServerClientComposeObjectTooManyComponents(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "composite-1", Content: []byte("a"), ComponentCount: 600},
+		{BucketName: "some-bucket", Name: "composite-2", Content: []byte("b"), ComponentCount: 500},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		bucket := server.Client().Bucket("some-bucket")
+		_, err := bucket.Object("composed.txt").ComposerFrom(bucket.Object("composite-1"), bucket.Object("composite-2")).Run(context.Background())
+		if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error returned\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+		if _, err := server.GetObject("some-bucket", "composed.txt"); err == nil {
+			t.Error("unexpected composed object after failed compose")
+		}
+	})
+}
+
+func TestServerClientComposeObjectDownloadHeaders(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "part-1", Content: []byte("some ")},
+		{BucketName: "some-bucket", Name: "part-2", Content: []byte("content")},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		bucket := server.Client().Bucket("some-bucket")
+		_, err := bucket.Object("composed.txt").ComposerFrom(bucket.Object("part-1"), bucket.Object("part-2")).Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/some-bucket/composed.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if count := resp.Header.Get("X-Goog-Component-Count"); count != "2" {
+			t.Errorf("wrong component count header\nwant %q\ngot  %q", "2", count)
+		}
+		expectedHash := []string{"crc32c=" + encodedCrc32cChecksum([]byte("some content"))}
+		if hash := resp.Header["X-Goog-Hash"]; !reflect.DeepEqual(hash, expectedHash) {
+			t.Errorf("wrong hash header\nwant %q\ngot  %q", expectedHash, hash)
+		}
+	})
+}
+
+func TestCrc32cCombine(t *testing.T) {
+	tests := []struct {
+		first  string
+		second string
+	}{
+		{"", ""},
+		{"some content", ""},
+		{"", "some content"},
+		{"some ", "content"},
+		{"a", strings.Repeat("some longer content ", 100)},
+	}
+	for _, test := range tests {
+		crc1 := crc32.Checksum([]byte(test.first), crc32cTable)
+		crc2 := crc32.Checksum([]byte(test.second), crc32cTable)
+		expected := crc32.Checksum([]byte(test.first+test.second), crc32cTable)
+		if got := crc32cCombine(crc1, crc2, int64(len(test.second))); got != expected {
+			t.Errorf("wrong checksum for %q + %q\nwant %d\ngot  %d", test.first, test.second, expected, got)
+		}
+	}
+}
+
+func getObjectJSON(t *testing.T, server *Server, bucketName, objectName string) objectResponse {
+	t.Helper()
+	resp, err := server.HTTPClient().Get(fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", bucketName, objectName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var objResp objectResponse
+	err = json.NewDecoder(resp.Body).Decode(&objResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objResp
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// objectConditions are the generation selector and the preconditions sent by
+// the client. Nil fields were not sent.
+type objectConditions struct {
+	generation               *int64
+	ifGenerationMatch        *int64
+	ifGenerationNotMatch     *int64
+	ifMetagenerationMatch    *int64
+	ifMetagenerationNotMatch *int64
+}
+
+// parseObjectConditions reads the generation and the preconditions from the
+// query string (JSON API) or from the x-goog-if-* headers (XML API).
+func parseObjectConditions(r *http.Request) (objectConditions, error) {
+	var (
+		conds objectConditions
+		err   error
+	)
+	params := []struct {
+		dst    **int64
+		query  string
+		header string
+	}{
+		{&conds.generation, "generation", ""},
+		{&conds.ifGenerationMatch, "ifGenerationMatch", "X-Goog-If-Generation-Match"},
+		{&conds.ifGenerationNotMatch, "ifGenerationNotMatch", ""},
+		{&conds.ifMetagenerationMatch, "ifMetagenerationMatch", "X-Goog-If-Metageneration-Match"},
+		{&conds.ifMetagenerationNotMatch, "ifMetagenerationNotMatch", ""},
+	}
+	for _, p := range params {
+		value := r.URL.Query().Get(p.query)
+		if value == "" && p.header != "" {
+			value = r.Header.Get(p.header)
+		}
+		if value == "" {
+			continue
+		}
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return conds, fmt.Errorf("invalid value for parameter %s: %s", p.query, value)
+		}
+		*p.dst = &n
+	}
+	return conds, nil
+}
+
+// check returns the status code for a request whose preconditions don't
+// match the object, or zero if they all match. notModified is the status used
+// for failed "not match" conditions on reads.
+func (c objectConditions) check(obj Object, notModified int) int {
+	if c.ifGenerationMatch != nil && *c.ifGenerationMatch != obj.Generation {
+		return http.StatusPreconditionFailed
+	}
+	if c.ifMetagenerationMatch != nil && *c.ifMetagenerationMatch != obj.Metageneration {
+		return http.StatusPreconditionFailed
+	}
+	if c.ifGenerationNotMatch != nil && *c.ifGenerationNotMatch == obj.Generation {
+		return notModified
+	}
+	if c.ifMetagenerationNotMatch != nil && *c.ifMetagenerationNotMatch == obj.Metageneration {
+		return notModified
+	}
+	return 0
+}
+
+// parseDestinationConditions reads the preconditions of the destination
+// object of a rewrite. Rewrites also take preconditions on the source
+// object, prefixed by ifSource, which are not supported.
+func parseDestinationConditions(r *http.Request) (objectConditions, error) {
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		return conds, &statusError{code: http.StatusBadRequest, reason: "invalid", message: err.Error()}
+	}
+	conds.generation = nil
+	return conds, nil
+}
+
+// checkWrite returns an error when the preconditions of a write don't match
+// the existing object. exists is false when there's no live object, in which
+// case only ifGenerationMatch=0 matches.
+func (c objectConditions) checkWrite(existing Object, exists bool) error {
+	failed := false
+	if !exists {
+		failed = (c.ifGenerationMatch != nil && *c.ifGenerationMatch != 0) || c.ifMetagenerationMatch != nil
+	} else {
+		failed = c.check(existing, http.StatusPreconditionFailed) != 0
+	}
+	if failed {
+		return &statusError{
+			code:    http.StatusPreconditionFailed,
+			reason:  "conditionNotMet",
+			message: "At least one of the pre-conditions you specified did not hold.",
+		}
+	}
+	return nil
+}
+
+// parseInt64Param parses an optional integer query parameter, returning zero
+// when it's not sent.
+func parseInt64Param(r *http.Request, name string) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("Invalid value for parameter %s: %s", name, value),
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"sync"
+	"time"
+)
+
+// consistencyTracker simulates eventually consistent object listings by
+// remembering recent creations and deletions for a configurable delay.
+type consistencyTracker struct {
+	delay   time.Duration
+	now     func() time.Time
+	mtx     sync.Mutex
+	created map[string]time.Time
+	deleted map[string]deletedObject
+}
+
+type deletedObject struct {
+	obj       Object
+	deletedAt time.Time
+}
+
+func newConsistencyTracker(delay time.Duration) *consistencyTracker {
+	return &consistencyTracker{
+		delay:   delay,
+		now:     time.Now,
+		created: make(map[string]time.Time),
+		deleted: make(map[string]deletedObject),
+	}
+}
+
+func (c *consistencyTracker) enabled() bool {
+	return c.delay > 0
+}
+
+func (c *consistencyTracker) objectCreated(obj Object) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	id := obj.id()
+	delete(c.deleted, id)
+	c.created[id] = c.now()
+}
+
+func (c *consistencyTracker) objectDeleted(obj Object) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	id := obj.id()
+	obj.Content = nil
+	delete(c.created, id)
+	c.deleted[id] = deletedObject{obj: obj, deletedAt: c.now()}
+}
+
+// visibleObjects returns the objects that should be listed for the bucket,
+// hiding recently created objects and including recently deleted ones.
+func (c *consistencyTracker) visibleObjects(bucketName string, objects []Object) []Object {
+	if !c.enabled() {
+		return objects
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.expire()
+	visible := make([]Object, 0, len(objects))
+	for _, obj := range objects {
+		if _, ok := c.created[obj.id()]; !ok {
+			visible = append(visible, obj)
+		}
+	}
+	for _, d := range c.deleted {
+		if d.obj.BucketName == bucketName {
+			visible = append(visible, d.obj)
+		}
+	}
+	return visible
+}
+
+// expire forgets changes older than the delay, as they're fully propagated.
+//
+// Callers must hold mtx.
+func (c *consistencyTracker) expire() {
+	cutoff := c.now().Add(-c.delay)
+	for id, createdAt := range c.created {
+		if !createdAt.After(cutoff) {
+			delete(c.created, id)
+		}
+	}
+	for id, d := range c.deleted {
+		if !d.deletedAt.After(cutoff) {
+			delete(c.deleted, id)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func TestServerClientListObjectsPropagationDelay(t *testing.T) {
+	const bucketName = "some-bucket"
+	objs := []Object{
+		{BucketName: bucketName, Name: "existing.txt"},
+		{BucketName: bucketName, Name: "to-delete.txt"},
+	}
+	server, err := NewServerWithOptions(Options{
+		InitialObjects:          objs,
+		NoListener:              true,
+		ListingPropagationDelay: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	server.consistency.now = func() time.Time { return now }
+	client := server.Client()
+	bucket := client.Bucket(bucketName)
+
+	w := bucket.Object("new.txt").NewWriter(context.Background())
+	w.Write([]byte("new content"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Object("to-delete.txt").Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	listNames := func() []string {
+		var names []string
+		it := bucket.Objects(context.Background(), &storage.Query{})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, attrs.Name)
+		}
+		return names
+	}
+
+	expected := []string{"existing.txt", "to-delete.txt"}
+	if names := listNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("wrong listing before propagation\nwant %v\ngot  %v", expected, names)
+	}
+	if _, err := bucket.Object("new.txt").Attrs(context.Background()); err != nil {
+		t.Errorf("unexpected error reading new object: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	expected = []string{"existing.txt", "new.txt"}
+	if names := listNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("wrong listing after propagation\nwant %v\ngot  %v", expected, names)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"mime"
+	"net/http"
+	"path"
+)
+
+// ContentTypeDetection defines how the server assigns a Content-Type to
+// objects uploaded without one.
+type ContentTypeDetection string
+
+const (
+	// ContentTypeDetectionNone assigns "application/octet-stream", like
+	// Cloud Storage. It's the default.
+	ContentTypeDetectionNone ContentTypeDetection = ""
+
+	// ContentTypeDetectionContent sniffs the type from the content of the
+	// object, with http.DetectContentType.
+	ContentTypeDetectionContent ContentTypeDetection = "content"
+
+	// ContentTypeDetectionExtension maps the extension in the name of the
+	// object to a type, with mime.TypeByExtension. Objects with unknown
+	// extensions get "application/octet-stream".
+	ContentTypeDetectionExtension ContentTypeDetection = "extension"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// setDefaultContentType assigns a Content-Type to objects uploaded without
+// one, according to the ContentTypeDetection option of the server.
+func (s *Server) setDefaultContentType(obj *Object) {
+	if obj.ContentType != "" {
+		return
+	}
+	obj.ContentType = defaultContentType
+	switch s.options.ContentTypeDetection {
+	case ContentTypeDetectionContent:
+		content := obj.Content
+		if obj.isGzipEncoded() {
+			if decompressed, err := obj.decompressedContent(); err == nil {
+				content = decompressed
+			}
+		}
+		obj.ContentType = http.DetectContentType(content)
+	case ContentTypeDetectionExtension:
+		if contentType := mime.TypeByExtension(path.Ext(obj.Name)); contentType != "" {
+			obj.ContentType = contentType
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerContentTypeDetection(t *testing.T) {
+	var tests = []struct {
+		name                string
+		detection           ContentTypeDetection
+		objectName          string
+		content             string
+		contentType         string
+		expectedContentType string
+	}{
+		{"default", ContentTypeDetectionNone, "page.html", "<html></html>", "", "application/octet-stream"},
+		{"explicit type", ContentTypeDetectionContent, "page.html", "<html></html>", "text/plain", "text/plain"},
+		{"content", ContentTypeDetectionContent, "page", "<html></html>", "", "text/html; charset=utf-8"},
+		{"extension", ContentTypeDetectionExtension, "image.png", "some content", "", "image/png"},
+		{"unknown extension", ContentTypeDetectionExtension, "file.unknown-ext", "some content", "", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true, ContentTypeDetection: test.detection})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			if err := server.CreateBucket("some-bucket"); err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name="+test.objectName, strings.NewReader(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			obj, err := server.GetObject("some-bucket", test.objectName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.ContentType != test.expectedContentType {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", test.expectedContentType, obj.ContentType)
+			}
+		})
+	}
+}
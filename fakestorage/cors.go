@@ -0,0 +1,128 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures the CORS headers sent by the API itself, so
+// browser-based applications can call the server directly. They're
+// independent of the CORS configuration of buckets.
+type CORSOptions struct {
+	// Origins allowed to call the API. "*" allows any origin. CORS is
+	// disabled when it's empty.
+	AllowedOrigins []string
+
+	// Methods allowed in preflight requests. The default is every method
+	// used by the API.
+	AllowedMethods []string
+
+	// Headers allowed in preflight requests. By default, the headers
+	// requested by the browser are allowed.
+	AllowedHeaders []string
+
+	// Headers exposed to browsers, in addition to the CORS-safelisted
+	// response headers. The default is defaultCORSExposedHeaders.
+	ExposedHeaders []string
+
+	// How long browsers can cache the result of preflight requests. Not
+	// sent when it's zero.
+	MaxAge time.Duration
+
+	// Whether requests with credentials are allowed. When set, the origin
+	// of the request is sent in Access-Control-Allow-Origin instead of "*".
+	AllowCredentials bool
+}
+
+// PermissiveCORS allows any origin, method and header.
+var PermissiveCORS = CORSOptions{AllowedOrigins: []string{"*"}}
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// defaultCORSExposedHeaders are the response headers read by client
+// libraries, most notably the ones used by resumable uploads.
+var defaultCORSExposedHeaders = []string{
+	"Content-Length",
+	"Content-Range",
+	"Location",
+	"Range",
+	requestIDHeader,
+	"X-Goog-Decompressed-Content-Length",
+	"X-Goog-Generation",
+	"X-Goog-Metageneration",
+	"X-Goog-Hash",
+	"X-Goog-Stored-Content-Encoding",
+	"X-Goog-Stored-Content-Length",
+}
+
+func (o CORSOptions) enabled() bool {
+	return len(o.AllowedOrigins) > 0
+}
+
+func (o CORSOptions) allowedOrigin(origin string) (string, bool) {
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == "*" {
+			if o.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// corsMiddleware answers CORS preflight requests and adds the CORS headers to
+// responses, for requests from allowed origins.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	cors := s.options.CORS
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !cors.enabled() || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowOrigin, ok := cors.allowedOrigin(origin)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", allowOrigin)
+		h.Add("Vary", "Origin")
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			exposed := cors.ExposedHeaders
+			if len(exposed) == 0 {
+				exposed = defaultCORSExposedHeaders
+			}
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+		methods := cors.AllowedMethods
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(cors.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if cors.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
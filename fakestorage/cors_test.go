@@ -0,0 +1,104 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerCORSPreflight(t *testing.T) {
+	var tests = []struct {
+		name                 string
+		cors                 CORSOptions
+		origin               string
+		expectedAllowOrigin  string
+		expectedAllowMethods string
+		expectedAllowHeaders string
+		expectedMaxAge       string
+	}{
+		{"disabled", CORSOptions{}, "http://localhost:3000", "", "", "", ""},
+		{"permissive", PermissiveCORS, "http://localhost:3000", "*", "GET, HEAD, POST, PUT, PATCH, DELETE", "content-type,x-goog-upload-protocol", ""},
+		{
+			"configured",
+			CORSOptions{AllowedOrigins: []string{"http://localhost:3000"}, AllowedMethods: []string{"GET"}, AllowedHeaders: []string{"Content-Type"}, MaxAge: time.Hour},
+			"http://localhost:3000", "http://localhost:3000", "GET", "Content-Type", "3600",
+		},
+		{"origin not allowed", CORSOptions{AllowedOrigins: []string{"http://localhost:3000"}}, "http://example.com", "", "", "", ""},
+		{"credentials", CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}, "http://localhost:3000", "http://localhost:3000", "GET, HEAD, POST, PUT, PATCH, DELETE", "content-type,x-goog-upload-protocol", ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true, CORS: test.cors})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			req, err := http.NewRequest(http.MethodOptions, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "content-type,x-goog-upload-protocol")
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if test.expectedAllowOrigin != "" && resp.StatusCode != http.StatusOK {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			var headers = []struct {
+				name     string
+				expected string
+			}{
+				{"Access-Control-Allow-Origin", test.expectedAllowOrigin},
+				{"Access-Control-Allow-Methods", test.expectedAllowMethods},
+				{"Access-Control-Allow-Headers", test.expectedAllowHeaders},
+				{"Access-Control-Max-Age", test.expectedMaxAge},
+			}
+			for _, header := range headers {
+				if value := resp.Header.Get(header.name); value != header.expected {
+					t.Errorf("wrong %s\nwant %q\ngot  %q", header.name, header.expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestServerCORSResponseHeaders(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		CORS:           PermissiveCORS,
+		InitialObjects: []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	req, err := http.NewRequest(http.MethodGet, "https://www.googleapis.com/storage/v1/b/some-bucket/o/object.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://localhost:3000")
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("wrong Access-Control-Allow-Origin\nwant %q\ngot  %q", "*", origin)
+	}
+	if exposed := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Location") {
+		t.Errorf("Location is not exposed: %q", exposed)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+func bucketNotFoundError() *statusError {
+	return &statusError{
+		code:     http.StatusNotFound,
+		reason:   "notFound",
+		message:  "The specified bucket does not exist.",
+		notExist: storage.ErrBucketNotExist,
+	}
+}
+
+func objectNotFoundError(bucketName, objectName string) *statusError {
+	return &statusError{
+		code:     http.StatusNotFound,
+		reason:   "notFound",
+		message:  fmt.Sprintf("No such object: %s/%s", bucketName, objectName),
+		notExist: storage.ErrObjectNotExist,
+	}
+}
+
+// toStatusError converts an error of the backend to the status error the API
+// would report for it: injected faults and other failures are internal
+// errors. Status errors are returned as is.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if sErr, ok := err.(*statusError); ok {
+		return sErr
+	}
+	if fault := backendFaultError(err); fault != nil {
+		return fault
+	}
+	return &statusError{code: http.StatusInternalServerError, reason: "backendError", message: err.Error(), err: err}
+}
+
+// bucketError converts an error of the backend looking up a bucket to a
+// status error, reporting missing buckets with 404.
+func bucketError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*statusError); ok || backendFaultError(err) != nil {
+		return toStatusError(err)
+	}
+	return bucketNotFoundError()
+}
+
+// objectError converts an error of the backend looking up the given object
+// to a status error, reporting missing buckets and objects with 404.
+func (s *Server) objectError(bucketName, objectName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*statusError); ok || backendFaultError(err) != nil {
+		return toStatusError(err)
+	}
+	if _, bucketErr := s.backend.GetBucket(bucketName); bucketErr != nil {
+		return bucketError(bucketErr)
+	}
+	return objectNotFoundError(bucketName, objectName)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerHelperErrors(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt"}})
+	defer server.Stop()
+	_, getMissingObject := server.GetObject("some-bucket", "missing.txt")
+	_, getObjectMissingBucket := server.GetObject("missing-bucket", "object.txt")
+	_, getMissingGeneration := server.GetObjectWithGeneration("some-bucket", "object.txt", 1)
+	_, _, listMissingBucket := server.ListObjects("missing-bucket", "", "")
+	_, listNoncurrentMissingBucket := server.ListNoncurrentObjects("missing-bucket")
+	_, statsMissingBucket := server.BucketStats("missing-bucket")
+	var tests = []struct {
+		name           string
+		err            error
+		expectedCode   int
+		expectedReason string
+		expectedIs     error
+	}{
+		{"GetObject missing object", getMissingObject, http.StatusNotFound, "notFound", storage.ErrObjectNotExist},
+		{"GetObject missing bucket", getObjectMissingBucket, http.StatusNotFound, "notFound", storage.ErrBucketNotExist},
+		{"GetObjectWithGeneration missing generation", getMissingGeneration, http.StatusNotFound, "notFound", storage.ErrObjectNotExist},
+		{"ListObjects missing bucket", listMissingBucket, http.StatusNotFound, "notFound", storage.ErrBucketNotExist},
+		{"ListNoncurrentObjects missing bucket", listNoncurrentMissingBucket, http.StatusNotFound, "notFound", storage.ErrBucketNotExist},
+		{"BucketStats missing bucket", statsMissingBucket, http.StatusNotFound, "notFound", storage.ErrBucketNotExist},
+		{"SetBucketReadOnly missing bucket", server.SetBucketReadOnly("missing-bucket", true), http.StatusNotFound, "notFound", storage.ErrBucketNotExist},
+		{"CreateFolder without hierarchical namespace", server.CreateFolder("some-bucket", "folder/"), http.StatusBadRequest, "invalid", nil},
+		{"CreateBucketWithOpts invalid rpo", server.CreateBucketWithOpts(CreateBucketOpts{Name: "other-bucket", RPO: "FAST"}), http.StatusBadRequest, "invalid", nil},
+	}
+	for _, test := range tests {
+		var gErr *googleapi.Error
+		if !errors.As(test.err, &gErr) {
+			t.Errorf("%s: wrong error\nwant *googleapi.Error\ngot  %#v", test.name, test.err)
+			continue
+		}
+		if gErr.Code != test.expectedCode {
+			t.Errorf("%s: wrong code\nwant %d\ngot  %d", test.name, test.expectedCode, gErr.Code)
+		}
+		if len(gErr.Errors) != 1 || gErr.Errors[0].Reason != test.expectedReason {
+			t.Errorf("%s: wrong reason\nwant %q\ngot  %+v", test.name, test.expectedReason, gErr.Errors)
+		}
+		if test.expectedIs != nil && !errors.Is(test.err, test.expectedIs) {
+			t.Errorf("%s: error doesn't match %v", test.name, test.expectedIs)
+		}
+	}
+}
+
+// TestServerHelperErrorsMatchClient checks that the errors of the helpers
+// match the errors the Go client returns for the same operations.
+func TestServerHelperErrorsMatchClient(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt"}})
+	defer server.Stop()
+	_, clientErr := server.Client().Bucket("some-bucket").Object("missing.txt").Attrs(context.Background())
+	_, helperErr := server.GetObject("some-bucket", "missing.txt")
+	if !errors.Is(clientErr, storage.ErrObjectNotExist) || !errors.Is(helperErr, storage.ErrObjectNotExist) {
+		t.Errorf("wrong errors for missing object\nclient: %v\nhelper: %v", clientErr, helperErr)
+	}
+}
+
+func TestServerHelperErrorsBackendFault(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt"}})
+	defer server.Stop()
+	if err := server.InjectBackendFault(BackendFault{Kind: BackendPermissionDenied, Operation: "GetObject"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := server.GetObject("some-bucket", "object.txt")
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) || gErr.Code != http.StatusInternalServerError || gErr.Errors[0].Reason != "backendError" {
+		t.Errorf("wrong error for backend fault\nwant 500 backendError\ngot  %#v", err)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		t.Error("backend fault unexpectedly matches storage.ErrObjectNotExist")
+	}
+	if backendFaultError(err) == nil {
+		t.Error("backend fault lost in the status error")
+	}
+}
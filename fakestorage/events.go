@@ -0,0 +1,105 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"sync"
+	"time"
+)
+
+// ObjectEventType is the type of an ObjectEvent. The values match the event
+// types of Cloud Storage notifications.
+type ObjectEventType string
+
+const (
+	// ObjectFinalize is emitted when a new object (or a new generation of an
+	// existing object) is successfully stored.
+	ObjectFinalize ObjectEventType = "OBJECT_FINALIZE"
+
+	// ObjectMetadataUpdate is emitted when the metadata of an existing
+	// object changes.
+	ObjectMetadataUpdate ObjectEventType = "OBJECT_METADATA_UPDATE"
+
+	// ObjectDelete is emitted when an object is deleted, including when it's
+	// replaced by a new generation in a bucket without versioning.
+	ObjectDelete ObjectEventType = "OBJECT_DELETE"
+
+	// ObjectArchive is emitted when the live version of an object becomes a
+	// noncurrent version, in buckets with versioning enabled.
+	ObjectArchive ObjectEventType = "OBJECT_ARCHIVE"
+)
+
+// eventStreamBufferSize is the capacity of each channel returned by
+// EventStream.
+const eventStreamBufferSize = 1024
+
+// ObjectEvent describes a change to an object in the server.
+type ObjectEvent struct {
+	Type   ObjectEventType
+	Object Object
+	Time   time.Time
+}
+
+type eventHub struct {
+	mtx         sync.Mutex
+	subscribers []chan ObjectEvent
+	dropped     int64
+}
+
+// EventStream returns a channel that receives an event for every change to
+// objects in the server, in the order they happen, starting from the moment
+// it's called. Events are sent without blocking: when the buffer of the
+// channel is full, new events are dropped for that channel, and counted in
+// DroppedEvents, so readers should keep up with the changes they cause.
+//
+// Each call returns a new channel, along with a function that stops sending
+// events to it and closes it. Callers must call it once they're done with
+// the channel.
+func (s *Server) EventStream() (<-chan ObjectEvent, func()) {
+	ch := make(chan ObjectEvent, eventStreamBufferSize)
+	s.events.mtx.Lock()
+	s.events.subscribers = append(s.events.subscribers, ch)
+	s.events.mtx.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { s.events.unsubscribe(ch) })
+	}
+}
+
+// DroppedEvents returns the number of events that were dropped because the
+// buffer of a channel returned by EventStream was full.
+func (s *Server) DroppedEvents() int64 {
+	s.events.mtx.Lock()
+	defer s.events.mtx.Unlock()
+	return s.events.dropped
+}
+
+func (h *eventHub) unsubscribe(ch chan ObjectEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, subscriber := range h.subscribers {
+		if subscriber == ch {
+			h.subscribers = append(h.subscribers[:i:i], h.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (h *eventHub) publish(eventType ObjectEventType, obj Object) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+	event := ObjectEvent{Type: eventType, Object: obj, Time: time.Now()}
+	for _, ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			h.dropped++
+		}
+	}
+}
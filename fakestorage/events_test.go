@@ -0,0 +1,106 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerEventStream(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		events, stopEvents := server.EventStream()
+		defer stopEvents()
+		objHandle := server.Client().Bucket("some-bucket").Object("some-object.txt")
+		ctx := context.Background()
+
+		for _, content := range []string{"some content", "other content"} {
+			w := objHandle.NewWriter(ctx)
+			w.Write([]byte(content))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := objHandle.Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = objHandle.Delete(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []struct {
+			eventType ObjectEventType
+			content   string
+		}{
+			{ObjectFinalize, "some content"},
+			{ObjectDelete, "some content"},
+			{ObjectFinalize, "other content"},
+			{ObjectMetadataUpdate, "other content"},
+			{ObjectDelete, "other content"},
+		}
+		for i, e := range expected {
+			var event ObjectEvent
+			select {
+			case event = <-events:
+			default:
+				t.Fatalf("missing event %d: %s", i, e.eventType)
+			}
+			if event.Type != e.eventType {
+				t.Errorf("wrong type for event %d\nwant %s\ngot  %s", i, e.eventType, event.Type)
+			}
+			if event.Object.id() != "some-bucket/some-object.txt" {
+				t.Errorf("wrong object for event %d: %s", i, event.Object.id())
+			}
+			if string(event.Object.Content) != e.content {
+				t.Errorf("wrong content for event %d\nwant %q\ngot  %q", i, e.content, event.Object.Content)
+			}
+			if event.Time.IsZero() {
+				t.Errorf("missing time for event %d", i)
+			}
+		}
+		select {
+		case event := <-events:
+			t.Errorf("unexpected event: %s", event.Type)
+		default:
+		}
+	})
+}
+
+func TestServerEventStreamStop(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	events, stopEvents := server.EventStream()
+	for i := 0; i < eventStreamBufferSize+2; i++ {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: fmt.Sprintf("object-%d.txt", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped := server.DroppedEvents(); dropped != 2 {
+		t.Errorf("wrong number of dropped events\nwant 2\ngot  %d", dropped)
+	}
+	stopEvents()
+	stopEvents()
+	received := 0
+	for range events {
+		received++
+	}
+	if received != eventStreamBufferSize {
+		t.Errorf("wrong number of events received before the channel was closed\nwant %d\ngot  %d", eventStreamBufferSize, received)
+	}
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "other-object.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := server.DroppedEvents(); dropped != 2 {
+		t.Errorf("events counted as dropped after stopping the stream\nwant 2\ngot  %d", dropped)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import "time"
+
+const (
+	minExpiryInterval = 10 * time.Millisecond
+	maxExpiryInterval = time.Minute
+)
+
+// expiryInterval returns how often objects are checked for expiration: a
+// tenth of the TTL, within reasonable bounds.
+func expiryInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 10
+	if interval < minExpiryInterval {
+		return minExpiryInterval
+	}
+	if interval > maxExpiryInterval {
+		return maxExpiryInterval
+	}
+	return interval
+}
+
+// startExpirer starts the background expiration of objects, if the server
+// has an ObjectTTL. Namespaces are handled by the expirer of their parent.
+func (s *Server) startExpirer() {
+	ttl := s.options.ObjectTTL
+	if ttl <= 0 || s.parent != nil {
+		return
+	}
+	s.expirer.start(expiryInterval(ttl), func(time.Time) {
+		s.ExpireObjects()
+	})
+}
+
+// ExpireObjects deletes the objects that are older than the ObjectTTL of the
+// server, in all buckets and namespaces, including noncurrent generations.
+// It's called periodically while the server is running, and can be called
+// directly to expire objects right away. It does nothing when the server
+// doesn't have an ObjectTTL.
+//
+// Expired objects are deleted permanently, regardless of the versioning and
+// soft delete settings of their buckets, and emit ObjectDelete events.
+// Objects under holds or retention are kept until they're released.
+func (s *Server) ExpireObjects() error {
+	ttl := s.options.ObjectTTL
+	if ttl <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-ttl)
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		live, _, err := s.ListObjects(bucket.Name, "", "")
+		if err != nil {
+			return err
+		}
+		noncurrent, err := s.ListNoncurrentObjects(bucket.Name)
+		if err != nil {
+			return err
+		}
+		for _, obj := range append(live, noncurrent...) {
+			if obj.TimeCreated.IsZero() || !obj.TimeCreated.Before(cutoff) || checkObjectHolds(obj) != nil {
+				continue
+			}
+			if err := s.expireObject(obj); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ns := range s.namespaceServers() {
+		if err := ns.ExpireObjects(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireObject deletes the given generation of an object, unless it changed
+// after being listed.
+func (s *Server) expireObject(obj Object) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	current, live, err := s.getObjectGeneration(obj.BucketName, obj.Name, obj.Generation)
+	if err != nil || current.Metageneration != obj.Metageneration {
+		return nil
+	}
+	if live {
+		err = s.backend.DeleteObject(obj.BucketName, obj.Name)
+	} else {
+		err = s.backend.DeleteNoncurrentObject(obj.BucketName, obj.Name, obj.Generation)
+	}
+	if err != nil {
+		return err
+	}
+	if live {
+		s.sizes.liveObjectDeleted(current)
+	} else {
+		s.sizes.noncurrentObjectDeleted(current)
+	}
+	if live && s.consistency.enabled() {
+		s.consistency.objectDeleted(current)
+	}
+	s.events.publish(ObjectDelete, current)
+	return nil
+}
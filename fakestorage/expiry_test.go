@@ -0,0 +1,108 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerExpireObjects(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	server, err := NewServerWithOptions(Options{
+		InitialObjects: []Object{
+			{BucketName: "some-bucket", Name: "old.txt", Content: []byte("old"), TimeCreated: old},
+			{BucketName: "some-bucket", Name: "recent.txt", Content: []byte("recent")},
+			{BucketName: "some-bucket", Name: "held.txt", Content: []byte("held"), TimeCreated: old, EventBasedHold: true},
+		},
+		NoListener: true,
+		ObjectTTL:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "versioned-bucket", VersioningEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "versioned-bucket", Name: "object.txt", Content: []byte("first"), TimeCreated: old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "versioned-bucket", Name: "object.txt", Content: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := server.Namespace("some-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.CreateObject(Object{BucketName: "some-bucket", Name: "old.txt", Content: []byte("old"), TimeCreated: old}); err != nil {
+		t.Fatal(err)
+	}
+	events, stopEvents := server.EventStream()
+	defer stopEvents()
+
+	if err := server.ExpireObjects(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.GetObject("some-bucket", "old.txt"); err == nil {
+		t.Error("old object not expired")
+	}
+	for _, name := range []string{"recent.txt", "held.txt"} {
+		if _, err := server.GetObject("some-bucket", name); err != nil {
+			t.Errorf("object %s expired: %v", name, err)
+		}
+	}
+	if objs, _ := server.ListNoncurrentObjects("versioned-bucket"); len(objs) != 0 {
+		t.Errorf("old noncurrent generation not expired: %v", objs)
+	}
+	if _, err := server.GetObject("versioned-bucket", "object.txt"); err != nil {
+		t.Errorf("recent live generation expired: %v", err)
+	}
+	if _, err := ns.GetObject("some-bucket", "old.txt"); err == nil {
+		t.Error("old object in namespace not expired")
+	}
+
+	var expired []string
+	for len(events) > 0 {
+		event := <-events
+		if event.Type != ObjectDelete {
+			t.Errorf("wrong event type for %s\nwant %s\ngot  %s", event.Object.id(), ObjectDelete, event.Type)
+		}
+		expired = append(expired, event.Object.id())
+	}
+	if len(expired) != 2 {
+		t.Errorf("wrong number of delete events\nwant 2\ngot  %v", expired)
+	}
+}
+
+func TestServerObjectTTLBackground(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, ObjectTTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := server.GetObject("some-bucket", "object.txt"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("object not expired in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Stop()
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := server.GetObject("some-bucket", "object.txt"); err != nil {
+		t.Errorf("object expired after the server was stopped: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fidelityTimeFormat is the format of timestamps in the JSON API: RFC 3339 in
+// UTC, with millisecond precision.
+const fidelityTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// fidelityFieldOrders is the order of the fields of resources in the JSON
+// API, by kind. Fields missing from the list keep their relative order, after
+// the listed ones.
+var fidelityFieldOrders = map[string][]string{
+	"storage#object": {
+		"kind", "id", "selfLink", "mediaLink", "name", "bucket", "generation",
+		"metageneration", "contentType", "contentLanguage", "cacheControl",
+		"storageClass", "size", "md5Hash", "contentEncoding", "crc32c",
+		"componentCount", "etag", "eventBasedHold", "retention", "acl",
+		"timeCreated", "updated", "timeDeleted", "softDeleteTime",
+		"hardDeleteTime", "timeStorageClassUpdated",
+	},
+	"storage#bucket": {
+		"kind", "selfLink", "id", "name", "projectNumber", "metageneration",
+		"location", "storageClass", "etag", "defaultEventBasedHold",
+		"timeCreated", "updated", "versioning", "lifecycle", "labels", "cors",
+		"softDeletePolicy", "billing", "customPlacementConfig",
+		"hierarchicalNamespace", "locationType", "rpo",
+	},
+	"storage#objects": {"kind", "nextPageToken", "prefixes", "items"},
+	"storage#buckets": {"kind", "nextPageToken", "items"},
+}
+
+// fidelityInt64Fields are the int64 fields of the JSON API, which are encoded
+// as strings.
+var fidelityInt64Fields = map[string]bool{
+	"generation":               true,
+	"metageneration":           true,
+	"size":                     true,
+	"projectNumber":            true,
+	"objectSize":               true,
+	"totalBytesRewritten":      true,
+	"retentionDurationSeconds": true,
+}
+
+// fidelityTimeFields are the timestamp fields of the JSON API.
+var fidelityTimeFields = map[string]bool{
+	"timeCreated":             true,
+	"updated":                 true,
+	"timeDeleted":             true,
+	"softDeleteTime":          true,
+	"hardDeleteTime":          true,
+	"timeStorageClassUpdated": true,
+	"retainUntilTime":         true,
+	"effectiveTime":           true,
+	"createTime":              true,
+	"updateTime":              true,
+}
+
+// jsonField is a field of a JSON object, in the order it was decoded.
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+// jsonObject is a JSON object that keeps the order of its fields.
+type jsonObject []jsonField
+
+// decodeOrdered decodes a JSON value, keeping the order of the fields of
+// objects. Numbers are decoded as json.Number, so they're kept as sent.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		var obj jsonObject
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonField{key: key.(string), value: value})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		values := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		_, err = dec.Token()
+		return values, err
+	default:
+		return token, nil
+	}
+}
+
+func encodeOrdered(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case jsonObject:
+		buf.WriteByte('{')
+		for i, field := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(field.key)
+			buf.Write(key)
+			buf.WriteByte(':')
+			encodeOrdered(buf, field.value)
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeOrdered(buf, item)
+		}
+		buf.WriteByte(']')
+	default:
+		data, _ := json.Marshal(v)
+		buf.Write(data)
+	}
+}
+
+// isEmptyJSON reports whether the value is omitted by the JSON API: empty
+// strings, arrays and objects, and nulls. Booleans are always sent.
+func isEmptyJSON(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case jsonObject:
+		return len(v) == 0
+	}
+	return false
+}
+
+// fidelityValue rewrites a decoded value of a response following the
+// serialization conventions of the JSON API.
+func fidelityValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fidelityValue(item)
+		}
+		return v
+	case jsonObject:
+		return fidelityObject(v)
+	}
+	return value
+}
+
+func fidelityObject(obj jsonObject) jsonObject {
+	fields := make(jsonObject, 0, len(obj))
+	var kind string
+	for _, field := range obj {
+		value := fidelityValue(field.value)
+		if isEmptyJSON(value) {
+			continue
+		}
+		switch {
+		case fidelityInt64Fields[field.key]:
+			if n, ok := value.(json.Number); ok {
+				value = n.String()
+			}
+		case fidelityTimeFields[field.key]:
+			if s, ok := value.(string); ok {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					value = t.UTC().Format(fidelityTimeFormat)
+				}
+			}
+		case field.key == "kind":
+			kind, _ = value.(string)
+		}
+		fields = append(fields, jsonField{key: field.key, value: value})
+	}
+	order, ok := fidelityFieldOrders[kind]
+	if !ok {
+		return fields
+	}
+	positions := make(map[string]int, len(order))
+	for i, key := range order {
+		positions[key] = i
+	}
+	sorted := make(jsonObject, 0, len(fields))
+	for _, key := range order {
+		for _, field := range fields {
+			if field.key == key {
+				sorted = append(sorted, field)
+			}
+		}
+	}
+	for _, field := range fields {
+		if _, ok := positions[field.key]; !ok {
+			sorted = append(sorted, field)
+		}
+	}
+	return sorted
+}
+
+// fidelityJSON rewrites a JSON response following the conventions of the
+// JSON API. The body is returned unchanged when it's not valid JSON.
+func fidelityJSON(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		return body
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return body
+	}
+	var buf bytes.Buffer
+	encodeOrdered(&buf, fidelityValue(value))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// fidelityResponseWriter holds the response until the handler is done, so it
+// can be rewritten.
+type fidelityResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *fidelityResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *fidelityResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// isMetadataRequest reports whether the response of the request is a JSON
+// resource of the API, rather than the content of an object.
+func isMetadataRequest(r *http.Request) bool {
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/storage/v1/") && !strings.HasPrefix(path, "/upload/storage/v1/") {
+		return false
+	}
+	return r.URL.Query().Get("alt") != "media"
+}
+
+// fidelityMiddleware serializes the JSON responses of the API with the
+// conventions of the production API, when Options.StrictFidelity is set.
+func (s *Server) fidelityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.options.StrictFidelity || !isMetadataRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &fidelityResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		body := rw.body.Bytes()
+		if strings.Contains(w.Header().Get("Content-Type"), "json") || bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			body = fidelityJSON(body)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(rw.status)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+var fidelityTimePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z$`)
+
+func decodeFixture(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case jsonObject:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// compareFidelity compares a response of the server with a recorded response
+// of the production API. Fields that only exist in one of them are ignored,
+// common fields must be in the same order, with the same JSON types.
+func compareFidelity(t *testing.T, path string, want, got interface{}) {
+	t.Helper()
+	if jsonType(want) != jsonType(got) {
+		t.Errorf("%s: wrong type\nwant %s\ngot  %s", path, jsonType(want), jsonType(got))
+		return
+	}
+	switch want := want.(type) {
+	case jsonObject:
+		got := got.(jsonObject)
+		wantFields := make(map[string]interface{}, len(want))
+		for _, field := range want {
+			wantFields[field.key] = field.value
+		}
+		var wantOrder, gotOrder []string
+		for _, field := range got {
+			if isEmptyJSON(field.value) {
+				t.Errorf("%s.%s: unexpected empty field %v", path, field.key, field.value)
+			}
+			wantValue, ok := wantFields[field.key]
+			if !ok {
+				continue
+			}
+			gotOrder = append(gotOrder, field.key)
+			compareFidelity(t, path+"."+field.key, wantValue, field.value)
+			if fidelityTimeFields[field.key] && !fidelityTimePattern.MatchString(fmt.Sprint(field.value)) {
+				t.Errorf("%s.%s: wrong timestamp format %q", path, field.key, field.value)
+			}
+		}
+		for _, field := range want {
+			for _, key := range gotOrder {
+				if key == field.key {
+					wantOrder = append(wantOrder, key)
+				}
+			}
+		}
+		if fmt.Sprint(wantOrder) != fmt.Sprint(gotOrder) {
+			t.Errorf("%s: wrong field order\nwant %q\ngot  %q", path, wantOrder, gotOrder)
+		}
+	case []interface{}:
+		got := got.([]interface{})
+		if len(want) != len(got) {
+			t.Errorf("%s: wrong length\nwant %d\ngot  %d", path, len(want), len(got))
+			return
+		}
+		for i := range want {
+			compareFidelity(t, fmt.Sprintf("%s[%d]", path, i), want[i], got[i])
+		}
+	}
+}
+
+func TestServerStrictFidelity(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, StrictFidelity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateBucket("empty-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", ContentType: "text/plain", Content: []byte("content")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "some/object.txt", ContentType: "text/plain", Content: []byte("content")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		fixture string
+		path    string
+	}{
+		{"object.json", "/storage/v1/b/some-bucket/o/some%2Fobject.txt"},
+		{"bucket.json", "/storage/v1/b/some-bucket"},
+		{"objects.json", "/storage/v1/b/some-bucket/o?delimiter=/"},
+		{"empty_objects.json", "/storage/v1/b/empty-bucket/o"},
+	}
+	for _, test := range tests {
+		fixture, err := ioutil.ReadFile(filepath.Join("testdata", "fidelity", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareFidelity(t, test.fixture, decodeFixture(t, fixture), decodeFixture(t, body))
+	}
+}
+
+func TestServerStrictFidelityDownload(t *testing.T) {
+	content := []byte(`{"b": "", "a": 1}`)
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		StrictFidelity: true,
+		InitialObjects: []Object{{BucketName: "some-bucket", Name: "data.json", ContentType: "application/json", Content: content}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket/o/data.json?alt=media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("wrong content of JSON object\nwant %q\ngot  %q", content, body)
+	}
+}
+
+func TestFidelityJSON(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected string
+	}{
+		{
+			`{"name":"obj","kind":"storage#object","size":12,"timeCreated":"2019-06-22T17:26:20.758637123Z","contentType":"","eventBasedHold":false}`,
+			`{"kind":"storage#object","name":"obj","size":"12","eventBasedHold":false,"timeCreated":"2019-06-22T17:26:20.758Z"}`,
+		},
+		{
+			`{"kind":"storage#objects","items":[],"prefixes":null}`,
+			`{"kind":"storage#objects"}`,
+		},
+		{
+			`{"done":false,"totalBytesRewritten":1024,"kind":"storage#rewriteResponse"}`,
+			`{"done":false,"totalBytesRewritten":"1024","kind":"storage#rewriteResponse"}`,
+		},
+		{`not json`, `not json`},
+	}
+	for _, test := range tests {
+		got := string(bytes.TrimSpace(fidelityJSON([]byte(test.input))))
+		if got != test.expected {
+			t.Errorf("wrong output for %s\nwant %s\ngot  %s", test.input, test.expected, got)
+		}
+	}
+}
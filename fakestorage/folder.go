@@ -0,0 +1,291 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Folder is a folder of a bucket with hierarchical namespace enabled. In
+// these buckets, folders exist independently of objects: they're created
+// explicitly or along with the objects inside them, and survive the deletion
+// of their objects.
+//
+// Folders are kept in memory only, even when objects are persisted with
+// StorageRoot or PersistenceDir: after a restart, only the folders of objects
+// written again through the server exist, and empty folders are lost.
+type Folder struct {
+	BucketName  string
+	Name        string
+	TimeCreated time.Time
+}
+
+type folderState struct {
+	mtx     sync.Mutex
+	folders map[string]map[string]Folder
+}
+
+// parentFolders returns the names of the folders containing the object or
+// folder with the given name, from the outermost one.
+func parentFolders(name string) []string {
+	var folders []string
+	for i, c := range name {
+		if c == '/' && i < len(name)-1 {
+			folders = append(folders, name[:i+1])
+		}
+	}
+	return folders
+}
+
+func validFolderName(name string) bool {
+	return strings.HasSuffix(name, "/") && !strings.HasPrefix(name, "/") && !strings.Contains(name, "//")
+}
+
+func (st *folderState) get(bucketName, name string) (Folder, bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	folder, ok := st.folders[bucketName][name]
+	return folder, ok
+}
+
+// add creates the given folders, if they don't exist yet.
+func (st *folderState) add(bucketName string, names ...string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.folders == nil {
+		st.folders = make(map[string]map[string]Folder)
+	}
+	folders := st.folders[bucketName]
+	if folders == nil {
+		folders = make(map[string]Folder)
+		st.folders[bucketName] = folders
+	}
+	now := time.Now()
+	for _, name := range names {
+		if _, ok := folders[name]; !ok {
+			folders[name] = Folder{BucketName: bucketName, Name: name, TimeCreated: now}
+		}
+	}
+}
+
+func (st *folderState) remove(bucketName, name string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	delete(st.folders[bucketName], name)
+}
+
+// list returns the folders of the bucket under the given prefix, sorted by
+// name.
+func (st *folderState) list(bucketName, prefix string) []Folder {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	var folders []Folder
+	for name, folder := range st.folders[bucketName] {
+		if strings.HasPrefix(name, prefix) {
+			folders = append(folders, folder)
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders
+}
+
+// folderObjectCreated creates the parent folders of a new object, in buckets
+// with hierarchical namespace enabled.
+func (s *Server) folderObjectCreated(obj Object) {
+	folders := parentFolders(obj.Name)
+	if len(folders) == 0 {
+		return
+	}
+	if bucket, err := s.backend.GetBucket(obj.BucketName); err == nil && bucket.HierarchicalNamespace {
+		s.folders.add(obj.BucketName, folders...)
+	}
+}
+
+// ListFolders returns the folders of the given bucket under the given prefix,
+// sorted by name. Folders are only tracked in buckets with hierarchical
+// namespace enabled.
+func (s *Server) ListFolders(bucketName, prefix string) ([]Folder, error) {
+	if err := s.checkHNSBucket(bucketName); err != nil {
+		return nil, err
+	}
+	return s.folders.list(bucketName, prefix), nil
+}
+
+// CreateFolder creates a folder in a bucket with hierarchical namespace
+// enabled, along with its parent folders. Folder names end with a slash.
+// Folders aren't persisted, see Folder.
+func (s *Server) CreateFolder(bucketName, name string) error {
+	if err := s.checkHNSBucket(bucketName); err != nil {
+		return err
+	}
+	if !validFolderName(name) {
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid folder name %q, folder names must end with a slash.", name)}
+	}
+	s.folders.add(bucketName, append(parentFolders(name), name)...)
+	return nil
+}
+
+// checkHNSBucket returns an error if the given bucket doesn't exist or
+// doesn't have hierarchical namespace enabled.
+func (s *Server) checkHNSBucket(bucketName string) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return bucketError(err)
+	}
+	if !bucket.HierarchicalNamespace {
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: "The bucket does not have hierarchical namespace enabled."}
+	}
+	return nil
+}
+
+// folderPrefixes returns the prefixes of a listing with the given prefix and
+// "/" as delimiter, including the folders without objects.
+func (s *Server) folderPrefixes(bucketName, prefix string, prefixes []string) []string {
+	seen := make(map[string]bool, len(prefixes))
+	for _, p := range prefixes {
+		seen[p] = true
+	}
+	for _, folder := range s.folders.list(bucketName, prefix) {
+		rest := folder.Name[len(prefix):]
+		if rest == "" {
+			continue
+		}
+		p := prefix + rest[:strings.Index(rest, "/")+1]
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+type folderResponse struct {
+	Kind           string `json:"kind"`
+	ID             string `json:"id"`
+	Bucket         string `json:"bucket"`
+	Name           string `json:"name"`
+	Metageneration int64  `json:"metageneration,string"`
+	CreateTime     string `json:"createTime"`
+	UpdateTime     string `json:"updateTime"`
+}
+
+func newFolderResponse(folder Folder) folderResponse {
+	return folderResponse{
+		Kind:           "storage#folder",
+		ID:             folder.BucketName + "/" + folder.Name,
+		Bucket:         folder.BucketName,
+		Name:           folder.Name,
+		Metageneration: 1,
+		CreateTime:     formatTime(folder.TimeCreated),
+		UpdateTime:     formatTime(folder.TimeCreated),
+	}
+}
+
+func (s *Server) insertFolder(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketName"]
+	var data struct {
+		Name string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	if err := s.checkHNSBucket(bucketName); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if err := s.checkBucketWritable(bucketName, "storage.folders.create"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if _, ok := s.folders.get(bucketName, data.Name); ok {
+		writeStatusError(w, &statusError{code: http.StatusConflict, reason: "conflict", message: "The folder you tried to create already exists."})
+		return
+	}
+	if r.URL.Query().Get("recursive") != "true" {
+		parents := parentFolders(data.Name)
+		if len(parents) > 0 {
+			if _, ok := s.folders.get(bucketName, parents[len(parents)-1]); !ok {
+				writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The parent folder does not exist."})
+				return
+			}
+		}
+	}
+	if err := s.CreateFolder(bucketName, data.Name); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	folder, _ := s.folders.get(bucketName, data.Name)
+	writeJSON(w, newFolderResponse(folder))
+}
+
+func (s *Server) getFolder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.checkHNSBucket(vars["bucketName"]); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	folder, ok := s.folders.get(vars["bucketName"], vars["folderName"])
+	if !ok {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The folder does not exist."})
+		return
+	}
+	writeJSON(w, newFolderResponse(folder))
+}
+
+func (s *Server) listFolders(w http.ResponseWriter, r *http.Request) {
+	folders, err := s.ListFolders(mux.Vars(r)["bucketName"], r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	resp := struct {
+		Kind  string           `json:"kind"`
+		Items []folderResponse `json:"items,omitempty"`
+	}{Kind: "storage#folders"}
+	for _, folder := range folders {
+		resp.Items = append(resp.Items, newFolderResponse(folder))
+	}
+	writeJSON(w, resp)
+}
+
+// deleteFolder deletes an empty folder. Like in Cloud Storage, folders with
+// objects or subfolders can't be deleted.
+func (s *Server) deleteFolder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucketName, name := vars["bucketName"], vars["folderName"]
+	if err := s.checkHNSBucket(bucketName); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if err := s.checkBucketWritable(bucketName, "storage.folders.delete"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if _, ok := s.folders.get(bucketName, name); !ok {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The folder does not exist."})
+		return
+	}
+	objs, _, err := s.listObjectsMetadata(bucketName, name, "")
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if len(objs) > 0 || len(s.folders.list(bucketName, name)) > 1 {
+		writeStatusError(w, &statusError{code: http.StatusConflict, reason: "failedPrecondition", message: "The folder you tried to delete is not empty."})
+		return
+	}
+	s.folders.remove(bucketName, name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func listPrefixes(t *testing.T, server *Server, query string) (int, []string) {
+	t.Helper()
+	resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/hns-bucket/o?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Prefixes []string
+	}
+	json.NewDecoder(resp.Body).Decode(&data)
+	return resp.StatusCode, data.Prefixes
+}
+
+func TestServerListIncludeFoldersAsPrefixes(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "hns-bucket", HierarchicalNamespace: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "hns-bucket", Name: "data/2019/file.txt", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "hns-bucket", Name: "logs/today.log", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Client().Bucket("hns-bucket").Object("logs/today.log").Delete(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateFolder("hns-bucket", "data/empty/nested/"); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			query            string
+			expectedStatus   int
+			expectedPrefixes []string
+		}{
+			{"delimiter=/", http.StatusOK, []string{"data/"}},
+			{"delimiter=/&includeFoldersAsPrefixes=true", http.StatusOK, []string{"data/", "logs/"}},
+			{"delimiter=/&prefix=data/&includeFoldersAsPrefixes=true", http.StatusOK, []string{"data/2019/", "data/empty/"}},
+			{"delimiter=/&prefix=data/empty/&includeFoldersAsPrefixes=true", http.StatusOK, []string{"data/empty/nested/"}},
+			{"delimiter=/&prefix=data/empty/nested/&includeFoldersAsPrefixes=true", http.StatusOK, nil},
+			{"includeFoldersAsPrefixes=true", http.StatusBadRequest, nil},
+			{"delimiter=-&includeFoldersAsPrefixes=true", http.StatusBadRequest, nil},
+		}
+		for _, test := range tests {
+			status, prefixes := listPrefixes(t, server, test.query)
+			if status != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.query, test.expectedStatus, status)
+				continue
+			}
+			if !reflect.DeepEqual(prefixes, test.expectedPrefixes) {
+				t.Errorf("%s: wrong prefixes\nwant %q\ngot  %q", test.query, test.expectedPrefixes, prefixes)
+			}
+		}
+
+		if err := server.CreateBucket("flat-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/flat-bucket/o?delimiter=/&includeFoldersAsPrefixes=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wrong status code for flat bucket\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestServerFolders(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "hns-bucket", HierarchicalNamespace: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucket("flat-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "read-only-bucket", HierarchicalNamespace: true, ReadOnly: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateFolder("read-only-bucket", "existing/"); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "hns-bucket", Name: "docs/readme.txt", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			name           string
+			method         string
+			path           string
+			body           string
+			expectedStatus int
+		}{
+			{"insert", http.MethodPost, "/storage/v1/b/hns-bucket/folders", `{"name":"images/"}`, http.StatusOK},
+			{"insert existing", http.MethodPost, "/storage/v1/b/hns-bucket/folders", `{"name":"images/"}`, http.StatusConflict},
+			{"insert without parent", http.MethodPost, "/storage/v1/b/hns-bucket/folders", `{"name":"a/b/"}`, http.StatusNotFound},
+			{"insert recursive", http.MethodPost, "/storage/v1/b/hns-bucket/folders?recursive=true", `{"name":"a/b/"}`, http.StatusOK},
+			{"insert invalid name", http.MethodPost, "/storage/v1/b/hns-bucket/folders", `{"name":"no-slash"}`, http.StatusBadRequest},
+			{"insert in flat bucket", http.MethodPost, "/storage/v1/b/flat-bucket/folders", `{"name":"images/"}`, http.StatusBadRequest},
+			{"get implicit", http.MethodGet, "/storage/v1/b/hns-bucket/folders/docs%2F", "", http.StatusOK},
+			{"get missing", http.MethodGet, "/storage/v1/b/hns-bucket/folders/missing%2F", "", http.StatusNotFound},
+			{"delete with objects", http.MethodDelete, "/storage/v1/b/hns-bucket/folders/docs%2F", "", http.StatusConflict},
+			{"delete with subfolders", http.MethodDelete, "/storage/v1/b/hns-bucket/folders/a%2F", "", http.StatusConflict},
+			{"delete empty", http.MethodDelete, "/storage/v1/b/hns-bucket/folders/a%2Fb%2F", "", http.StatusNoContent},
+			{"delete missing", http.MethodDelete, "/storage/v1/b/hns-bucket/folders/a%2Fb%2F", "", http.StatusNotFound},
+			{"insert in read-only bucket", http.MethodPost, "/storage/v1/b/read-only-bucket/folders", `{"name":"images/"}`, http.StatusForbidden},
+			{"delete in read-only bucket", http.MethodDelete, "/storage/v1/b/read-only-bucket/folders/existing%2F", "", http.StatusForbidden},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(test.method, "https://www.googleapis.com"+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+		}
+
+		folders, err := server.ListFolders("hns-bucket", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, folder := range folders {
+			names = append(names, folder.Name)
+		}
+		expected := []string{"a/", "docs/", "images/"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("wrong folders\nwant %q\ngot  %q", expected, names)
+		}
+	})
+}
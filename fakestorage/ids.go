@@ -0,0 +1,76 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// idGenerator generates the opaque identifiers returned by the server:
+// resumable upload IDs, rewrite tokens, operation IDs and request IDs.
+//
+// In deterministic mode, identifiers are generated from a counter for each
+// kind of identifier instead of random numbers, so a sequence of requests
+// always gets the same identifiers. The format of the identifiers is the
+// same in both modes.
+type idGenerator struct {
+	deterministic bool
+	mtx           sync.Mutex
+	counters      map[string]uint64
+}
+
+func newIDGenerator(deterministic bool) *idGenerator {
+	return &idGenerator{deterministic: deterministic, counters: make(map[string]uint64)}
+}
+
+func (g *idGenerator) generate(kind string, size int) ([]byte, error) {
+	raw := make([]byte, size)
+	if !g.deterministic {
+		_, err := rand.Read(raw)
+		return raw, err
+	}
+	g.mtx.Lock()
+	g.counters[kind]++
+	n := g.counters[kind]
+	g.mtx.Unlock()
+	binary.BigEndian.PutUint64(raw[size-8:], n)
+	return raw, nil
+}
+
+func (g *idGenerator) uploadID() (string, error) {
+	raw, err := g.generate("upload", 16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", raw), nil
+}
+
+func (g *idGenerator) rewriteToken() (string, error) {
+	raw, err := g.generate("rewrite", 16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", raw), nil
+}
+
+func (g *idGenerator) operationID() (string, error) {
+	raw, err := g.generate("operation", 16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", raw), nil
+}
+
+func (g *idGenerator) requestID() (string, error) {
+	raw, err := g.generate("request", 24)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
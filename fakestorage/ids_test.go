@@ -0,0 +1,84 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerDeterministicIDs(t *testing.T) {
+	exchange := func(t *testing.T, deterministic bool) []string {
+		server, err := NewServerWithOptions(Options{
+			InitialObjects:   []Object{{BucketName: "some-bucket", Name: "source.txt", Content: []byte("some content")}},
+			NoListener:       true,
+			DeterministicIDs: deterministic,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+		client := server.HTTPClient()
+		var ids []string
+
+		resp, err := client.Post("https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=upload.txt", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		ids = append(ids, resp.Header.Get(requestIDHeader), resp.Header.Get("Location"))
+
+		resp, err = client.Post("https://www.googleapis.com/storage/v1/b/some-bucket/o/source.txt/rewriteTo/b/some-bucket/o/copy.txt?maxBytesRewrittenPerCall=4", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var rewriteResp rewriteResponse
+		if err := json.NewDecoder(resp.Body).Decode(&rewriteResp); err != nil {
+			t.Fatal(err)
+		}
+		if rewriteResp.RewriteToken == "" {
+			t.Fatal("missing rewrite token")
+		}
+		return append(ids, resp.Header.Get(requestIDHeader), rewriteResp.RewriteToken)
+	}
+
+	first := exchange(t, true)
+	second := exchange(t, true)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("identifiers differ across runs in deterministic mode\nfirst  %q\nsecond %q", first, second)
+	}
+	if first[0] == first[2] {
+		t.Errorf("different requests got the same ID: %q", first[0])
+	}
+	random := exchange(t, false)
+	for i := range random {
+		if random[i] == first[i] {
+			t.Errorf("identifier %d is deterministic without DeterministicIDs: %q", i, random[i])
+		}
+	}
+	if resp := first[1]; !strings.HasSuffix(resp, "/upload/resumable/00000000000000000000000000000001") {
+		t.Errorf("unexpected session URI in deterministic mode: %q", resp)
+	}
+}
+
+func TestServerDeterministicIDsUploadStillWorks(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, DeterministicIDs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first.txt", "second.txt"} {
+		writeObjectContent(t, server.Client().Bucket("some-bucket").Object(name), "some content")
+		if _, err := server.GetObject("some-bucket", name); err != nil {
+			t.Errorf("object %s not stored: %v", name, err)
+		}
+	}
+}
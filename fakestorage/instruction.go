@@ -0,0 +1,135 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InstructionHeader is the request header that controls the behavior of the
+// server for a single request. Its value is a comma-separated list of
+// instructions:
+//
+//   - return-<status>: the request fails with the given HTTP status code,
+//     without being processed, e.g. return-503.
+//   - delay=<duration>: the request is processed after the given delay, in
+//     the format of time.ParseDuration, e.g. delay=2s.
+//
+// Instructions can be combined, so "delay=1s,return-503" fails the request
+// after a second. Requests with unknown instructions fail with 400, so typos
+// don't go unnoticed.
+//
+// Unlike SetScenario or SimulateOutage, instructions don't change the state
+// of the server, so they're safe to use in tests running in parallel against
+// the same server. See InstructionTransport and WithInstruction.
+const InstructionHeader = "X-Fake-Gcs-Instruction"
+
+type instructionKey struct{}
+
+// WithInstruction returns a copy of ctx carrying the given instruction, so
+// requests made with the context by a client using InstructionTransport get
+// the instruction in InstructionHeader.
+func WithInstruction(ctx context.Context, instruction string) context.Context {
+	return context.WithValue(ctx, instructionKey{}, instruction)
+}
+
+// InstructionTransport is an http.RoundTripper that sets InstructionHeader in
+// requests whose context carries an instruction, added by WithInstruction.
+// Requests without an instruction are sent unchanged.
+//
+// For example, to make a single call of a client fail with 503:
+//
+//	transport := &fakestorage.InstructionTransport{Base: server.HTTPClient().Transport}
+//	client, _ := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+//	ctx = fakestorage.WithInstruction(ctx, "return-503")
+//	_, err := client.Bucket("some-bucket").Attrs(ctx)
+type InstructionTransport struct {
+	// Base is the transport used to send requests. Defaults to
+	// http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *InstructionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	instruction, _ := r.Context().Value(instructionKey{}).(string)
+	if instruction == "" {
+		return base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set(InstructionHeader, instruction)
+	return base.RoundTrip(r)
+}
+
+// requestInstructions is the parsed value of InstructionHeader.
+type requestInstructions struct {
+	status int
+	delay  time.Duration
+}
+
+func parseInstructions(value string) (requestInstructions, error) {
+	var instructions requestInstructions
+	for _, instruction := range strings.Split(value, ",") {
+		instruction = strings.TrimSpace(instruction)
+		switch {
+		case instruction == "":
+		case strings.HasPrefix(instruction, "return-"):
+			status, err := strconv.Atoi(strings.TrimPrefix(instruction, "return-"))
+			if err != nil || status < 100 || status > 599 {
+				return instructions, fmt.Errorf("invalid status in instruction %q", instruction)
+			}
+			instructions.status = status
+		case strings.HasPrefix(instruction, "delay="):
+			delay, err := time.ParseDuration(strings.TrimPrefix(instruction, "delay="))
+			if err != nil || delay < 0 {
+				return instructions, fmt.Errorf("invalid duration in instruction %q", instruction)
+			}
+			instructions.delay = delay
+		default:
+			return instructions, fmt.Errorf("unknown instruction %q", instruction)
+		}
+	}
+	return instructions, nil
+}
+
+func (s *Server) instructionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(InstructionHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		instructions, err := parseInstructions(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if instructions.delay > 0 {
+			timer := time.NewTimer(instructions.delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if instructions.status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(instructions.status)
+		json.NewEncoder(w).Encode(newErrorResponse(instructions.status, http.StatusText(instructions.status), nil))
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestServerInstructionHeader(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "some/object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		var tests = []struct {
+			name           string
+			instruction    string
+			expectedStatus int
+			minDuration    time.Duration
+		}{
+			{"no instruction", "", http.StatusOK, 0},
+			{"return 503", "return-503", http.StatusServiceUnavailable, 0},
+			{"return 429", "return-429", http.StatusTooManyRequests, 0},
+			{"delay", "delay=50ms", http.StatusOK, 50 * time.Millisecond},
+			{"delay and return", "delay=50ms, return-500", http.StatusInternalServerError, 50 * time.Millisecond},
+			{"unknown instruction", "explode", http.StatusBadRequest, 0},
+			{"invalid status", "return-abc", http.StatusBadRequest, 0},
+			{"invalid delay", "delay=soon", http.StatusBadRequest, 0},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(http.MethodGet, "https://www.googleapis.com/storage/v1/b/some-bucket/o/some%2Fobject.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.instruction != "" {
+				req.Header.Set(InstructionHeader, test.instruction)
+			}
+			start := time.Now()
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed < test.minDuration {
+				t.Errorf("%s: request answered too early\nwant at least %s\ngot  %s", test.name, test.minDuration, elapsed)
+			}
+		}
+	})
+}
+
+func TestInstructionTransport(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		transport := &InstructionTransport{Base: server.HTTPClient().Transport}
+		client, err := storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: transport}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := WithInstruction(context.Background(), "return-404")
+		_, err = client.Bucket("some-bucket").Object("object.txt").Attrs(ctx)
+		if err != storage.ErrObjectNotExist {
+			t.Errorf("wrong error with instruction\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+		}
+
+		ctx = WithInstruction(context.Background(), "return-403")
+		_, err = client.Bucket("some-bucket").Attrs(ctx)
+		if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusForbidden {
+			t.Errorf("wrong error with instruction\nwant code %d\ngot  %v", http.StatusForbidden, err)
+		}
+
+		if _, err := client.Bucket("some-bucket").Object("object.txt").Attrs(context.Background()); err != nil {
+			t.Errorf("unexpected error without instruction: %v", err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+)
+
+// internalPrefix is the path prefix of the administrative endpoints of the
+// server. They're not part of the GCS API, and are used to control the
+// behavior of the fake server from tests written in other languages.
+const internalPrefix = "/_internal"
+
+func isInternalRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, internalPrefix+"/")
+}
+
+func (s *Server) buildInternalMuxer() {
+	r := s.mux.PathPrefix(internalPrefix).Subrouter()
+	r.Path("/scenario").Methods("PUT").HandlerFunc(s.setScenarioByPut)
+	r.Path("/scenario").Methods("DELETE").HandlerFunc(s.clearScenarioByDelete)
+	r.Path("/stats").Methods("GET").HandlerFunc(s.getStats)
+	r.Path("/stats/{bucketName}").Methods("GET").HandlerFunc(s.getStats)
+	r.Path("/usage/{bucketName}").Methods("GET").HandlerFunc(s.getBucketUsage)
+	r.Path("/resumableUploads").Methods("GET").HandlerFunc(s.listResumableUploads)
+	r.Path("/resumableUploads").Methods("DELETE").HandlerFunc(s.purgeResumableUploadsByDelete)
+	r.Path("/readonly/{bucketName}").Methods("PUT").HandlerFunc(s.setBucketReadOnlyByPut)
+	r.Path("/readonly/{bucketName}").Methods("DELETE").HandlerFunc(s.clearBucketReadOnlyByDelete)
+	r.Path("/uploadDefaults/{bucketName}").Methods("PUT").HandlerFunc(s.setBucketUploadDefaultsByPut)
+	r.Path("/uploadDefaults/{bucketName}").Methods("DELETE").HandlerFunc(s.clearBucketUploadDefaultsByDelete)
+	r.Path("/outages/{location}").Methods("PUT").HandlerFunc(s.simulateOutageByPut)
+	r.Path("/outages/{location}").Methods("DELETE").HandlerFunc(s.endOutageByDelete)
+	r.Path("/anywhereCaches/{bucketName}").Methods("GET").HandlerFunc(s.getAnywhereCacheStats)
+	r.Path("/billing").Methods("GET").HandlerFunc(s.getBillingReport)
+	r.Path("/billing").Methods("DELETE").HandlerFunc(s.resetBillingReportByDelete)
+	r.Path("/lifecycle").Methods("POST").HandlerFunc(s.applyLifecycleRulesByPost)
+	r.Path("/inventoryReports/{id}").Methods("PUT").HandlerFunc(s.createInventoryReportConfigByPut)
+	r.Path("/inventoryReports/{id}").Methods("DELETE").HandlerFunc(s.deleteInventoryReportConfigByDelete)
+	r.Path("/inventoryReports/{id}/run").Methods("POST").HandlerFunc(s.generateInventoryReportByPost)
+	r.Path("/capture").Methods("PUT").HandlerFunc(s.startCaptureByPut)
+	r.Path("/capture").Methods("GET").HandlerFunc(s.getCapture)
+	r.Path("/capture").Methods("DELETE").HandlerFunc(s.stopCaptureByDelete)
+	r.Path("/capture/verify").Methods("POST").HandlerFunc(s.verifyCaptureByPost)
+	r.Path("/backendFaults").Methods("PUT").HandlerFunc(s.injectBackendFaultByPut)
+	r.Path("/backendFaults").Methods("DELETE").HandlerFunc(s.clearBackendFaultsByDelete)
+	r.Path("/downloadInterruptions").Methods("PUT").HandlerFunc(s.interruptDownloadsByPut)
+	r.Path("/downloadInterruptions").Methods("DELETE").HandlerFunc(s.clearDownloadInterruptionsByDelete)
+	r.Path("/signedURLs/clockSkew").Methods("PUT").HandlerFunc(s.setSignedURLClockSkewByPut)
+	r.Path("/signedURLs/expired/{bucketName}/{objectName:.+}").Methods("PUT").HandlerFunc(s.expireSignedURLsByPut)
+	r.Path("/signedURLs/expired/{bucketName}/{objectName:.+}").Methods("DELETE").HandlerFunc(s.clearExpiredSignedURLsByDelete)
+}
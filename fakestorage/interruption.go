@@ -0,0 +1,202 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// InterruptionMode is the way a download is interrupted.
+type InterruptionMode string
+
+// Modes of interruption of downloads.
+const (
+	// InterruptionTruncate closes the connection, so the client gets fewer
+	// bytes than announced in the Content-Length header.
+	InterruptionTruncate InterruptionMode = "truncate"
+
+	// InterruptionStall stops sending data for the duration of the stall,
+	// and then sends the rest of the content, unless the client gave up.
+	InterruptionStall InterruptionMode = "stall"
+)
+
+// DownloadInterruption describes the interruption of media downloads in the
+// middle of the response, used for testing the logic of clients that resume
+// downloads from the last received offset.
+type DownloadInterruption struct {
+	// Bucket and Object restrict the interruption to the downloads of the
+	// given object, or of any object of the given bucket when Object is
+	// empty. Both empty match all downloads.
+	Bucket string `json:"bucket,omitempty"`
+	Object string `json:"object,omitempty"`
+
+	// Mode is InterruptionTruncate or InterruptionStall. It defaults to
+	// InterruptionTruncate.
+	Mode InterruptionMode `json:"mode,omitempty"`
+
+	// AfterBytes is the number of bytes of the response sent before the
+	// interruption. Range requests count from the start of the range.
+	AfterBytes int64 `json:"afterBytes"`
+
+	// Stall is for how long the response stalls in InterruptionStall mode.
+	Stall time.Duration `json:"-"`
+
+	// Probability is the probability that a matching download is
+	// interrupted, between 0 and 1. Zero means that all matching downloads
+	// are interrupted.
+	Probability float64 `json:"probability,omitempty"`
+
+	// Times is the number of downloads interrupted before the interruption
+	// is cleared, so 1 interrupts a single download. Zero means that the
+	// interruption lasts until ClearDownloadInterruptions is called.
+	Times int `json:"times,omitempty"`
+}
+
+func (i *DownloadInterruption) validate() error {
+	if i.Mode != "" && i.Mode != InterruptionTruncate && i.Mode != InterruptionStall {
+		return fmt.Errorf("invalid interruption mode %q", i.Mode)
+	}
+	if i.Mode == InterruptionStall && i.Stall <= 0 {
+		return errors.New("stalled downloads require a positive stall duration")
+	}
+	if i.AfterBytes < 0 || i.Times < 0 {
+		return errors.New("invalid negative afterBytes or times")
+	}
+	if i.Probability < 0 || i.Probability > 1 {
+		return errors.New("probability must be between 0 and 1")
+	}
+	return nil
+}
+
+func (i *DownloadInterruption) matches(obj Object) bool {
+	if i.Bucket != "" && i.Bucket != obj.BucketName {
+		return false
+	}
+	return i.Object == "" || i.Object == obj.Name
+}
+
+// interruptionState holds the download interruptions of the server.
+type interruptionState struct {
+	mtx           sync.Mutex
+	interruptions []*DownloadInterruption
+}
+
+// InterruptDownloads makes the media downloads matching the interruption
+// fail (or stall) after the given number of bytes. Interruptions are matched
+// in the order they were added.
+//
+// The same can be done with a PUT request to
+// /_internal/downloadInterruptions, with the interruption in the JSON body,
+// such as {"object": "file.txt", "afterBytes": 1024, "times": 1}, and the
+// stall as a duration string, as in {"mode": "stall", "stall": "5s"}. A DELETE
+// request to the same path clears all interruptions.
+func (s *Server) InterruptDownloads(interruption DownloadInterruption) error {
+	if err := interruption.validate(); err != nil {
+		return err
+	}
+	if interruption.Mode == "" {
+		interruption.Mode = InterruptionTruncate
+	}
+	s.interruptions.mtx.Lock()
+	defer s.interruptions.mtx.Unlock()
+	s.interruptions.interruptions = append(s.interruptions.interruptions, &interruption)
+	return nil
+}
+
+// ClearDownloadInterruptions removes all download interruptions.
+func (s *Server) ClearDownloadInterruptions() {
+	s.interruptions.mtx.Lock()
+	defer s.interruptions.mtx.Unlock()
+	s.interruptions.interruptions = nil
+}
+
+// next returns the interruption applied to a download of the given object,
+// or nil if the download isn't interrupted.
+func (st *interruptionState) next(obj Object) *DownloadInterruption {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	for i, interruption := range st.interruptions {
+		if !interruption.matches(obj) {
+			continue
+		}
+		if interruption.Probability > 0 && rand.Float64() >= interruption.Probability {
+			return nil
+		}
+		applied := *interruption
+		if interruption.Times > 0 {
+			interruption.Times--
+			if interruption.Times == 0 {
+				st.interruptions = append(st.interruptions[:i:i], st.interruptions[i+1:]...)
+			}
+		}
+		return &applied
+	}
+	return nil
+}
+
+// copyDownload sends length bytes of the content of the object, applying the
+// first matching download interruption.
+func (s *Server) copyDownload(w http.ResponseWriter, r *http.Request, obj Object, body io.Reader, length int64) {
+	interruption := s.interruptions.next(obj)
+	if interruption == nil || interruption.AfterBytes >= length {
+		io.CopyN(w, body, length)
+		return
+	}
+	if _, err := io.CopyN(w, body, interruption.AfterBytes); err != nil {
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	if interruption.Mode == InterruptionTruncate {
+		// returning before writing Content-Length bytes makes the
+		// net/http server close the connection.
+		return
+	}
+	timer := time.NewTimer(interruption.Stall)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		io.CopyN(w, body, length-interruption.AfterBytes)
+	case <-r.Context().Done():
+	}
+}
+
+func (s *Server) interruptDownloadsByPut(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		DownloadInterruption
+		Stall string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interruption := data.DownloadInterruption
+	if data.Stall != "" {
+		var err error
+		interruption.Stall, err = time.ParseDuration(data.Stall)
+		if err != nil {
+			http.Error(w, "invalid stall duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.InterruptDownloads(interruption); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearDownloadInterruptionsByDelete(w http.ResponseWriter, r *http.Request) {
+	s.ClearDownloadInterruptions()
+	w.WriteHeader(http.StatusNoContent)
+}
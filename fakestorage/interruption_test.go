@@ -0,0 +1,188 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerDownloadInterruptionTruncate(t *testing.T) {
+	content := []byte("some nice content that gets interrupted")
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "object.txt", Content: content},
+		{BucketName: "some-bucket", Name: "other.txt", Content: content},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		defer server.ClearDownloadInterruptions()
+		err := server.InterruptDownloads(DownloadInterruption{Bucket: "some-bucket", Object: "object.txt", AfterBytes: 10, Times: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := server.Client()
+
+		data, err := readObject(client.Bucket("some-bucket").Object("other.txt"))
+		if err != nil {
+			t.Fatalf("unexpected error reading object that doesn't match: %v", err)
+		}
+		if string(data) != string(content) {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, data)
+		}
+
+		data, err = readObject(client.Bucket("some-bucket").Object("object.txt"))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("wrong error for interrupted download\nwant %v\ngot  %v", io.ErrUnexpectedEOF, err)
+		}
+		if string(data) != string(content[:10]) {
+			t.Errorf("wrong content before the interruption\nwant %q\ngot  %q", content[:10], data)
+		}
+
+		// resuming from the offset succeeds, as the interruption happened
+		// only once.
+		reader, err := client.Bucket("some-bucket").Object("object.txt").NewRangeReader(context.Background(), int64(len(data)), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		rest, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data) + string(rest); got != string(content) {
+			t.Errorf("wrong resumed content\nwant %q\ngot  %q", content, got)
+		}
+	})
+}
+
+func TestServerDownloadInterruptionStall(t *testing.T) {
+	content := []byte("some nice content that stalls")
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: content}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		defer server.ClearDownloadInterruptions()
+		const stall = 50 * time.Millisecond
+		err := server.InterruptDownloads(DownloadInterruption{Mode: InterruptionStall, AfterBytes: 4, Stall: stall})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		data, err := readObject(server.Client().Bucket("some-bucket").Object("object.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < stall {
+			t.Errorf("download didn't stall\nwant at least %s\ngot  %s", stall, elapsed)
+		}
+		if string(data) != string(content) {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, data)
+		}
+	})
+}
+
+func TestServerDownloadInterruptionStallFlushesWithAuditLog(t *testing.T) {
+	content := []byte("some nice content that stalls")
+	server, err := NewServerWithOptions(Options{
+		InitialObjects: []Object{{BucketName: "some-bucket", Name: "object.txt", Content: content}},
+		AuditLog:       ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	err = server.InterruptDownloads(DownloadInterruption{Mode: InterruptionStall, AfterBytes: 4, Stall: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/some-bucket/object.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan []byte, 1)
+	go func() {
+		resp, err := server.HTTPClient().Do(req.WithContext(ctx))
+		if err != nil {
+			read <- nil
+			return
+		}
+		defer resp.Body.Close()
+		data := make([]byte, 4)
+		n, _ := io.ReadFull(resp.Body, data)
+		read <- data[:n]
+	}()
+	select {
+	case data := <-read:
+		if string(data) != string(content[:4]) {
+			t.Errorf("wrong content before the stall\nwant %q\ngot  %q", content[:4], data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("content before the stall not flushed to the client")
+	}
+	cancel()
+}
+
+func TestServerDownloadInterruptionsInternal(t *testing.T) {
+	content := []byte("some nice content")
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt", Content: content}})
+	defer server.Stop()
+	const interruptionsURL = "https://www.googleapis.com/_internal/downloadInterruptions"
+	do := func(method, body string, expectedStatus int) {
+		t.Helper()
+		req, err := http.NewRequest(method, interruptionsURL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, body, expectedStatus, resp.StatusCode)
+		}
+	}
+	do(http.MethodPut, `{"mode":"explode"}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"mode":"stall"}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"mode":"stall","stall":"soon"}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"afterBytes":-1}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"probability":1.5}`, http.StatusBadRequest)
+	do(http.MethodPut, `{"object":"object.txt","afterBytes":5}`, http.StatusNoContent)
+
+	download := func() ([]byte, error) {
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/some-bucket/object.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := download()
+		if err != io.ErrUnexpectedEOF || string(data) != string(content[:5]) {
+			t.Errorf("wrong result of interrupted download\nwant %q, %v\ngot  %q, %v", content[:5], io.ErrUnexpectedEOF, data, err)
+		}
+	}
+	do(http.MethodDelete, "", http.StatusNoContent)
+	data, err := download()
+	if err != nil || string(data) != string(content) {
+		t.Errorf("wrong result after clearing interruptions\nwant %q, <nil>\ngot  %q, %v", content, data, err)
+	}
+}
+
+func readObject(obj *storage.ObjectHandle) ([]byte, error) {
+	reader, err := obj.NewReader(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,399 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// inventorySnapshotFormat is the format of the snapshot time in the names of
+// inventory report files.
+const inventorySnapshotFormat = "2006-01-02T15:04:05"
+
+// defaultInventoryFields are the metadata fields included in inventory
+// reports when the config doesn't select any.
+var defaultInventoryFields = []string{"bucket", "name", "size", "storageClass", "timeCreated"}
+
+// inventoryFields are the metadata fields supported in inventory reports,
+// with the function returning their value for an object in a bucket at the
+// given location.
+var inventoryFields = map[string]func(obj Object, location string) string{
+	"bucket":                  func(obj Object, _ string) string { return obj.BucketName },
+	"name":                    func(obj Object, _ string) string { return obj.Name },
+	"location":                func(_ Object, location string) string { return location },
+	"size":                    func(obj Object, _ string) string { return strconv.FormatInt(obj.size(), 10) },
+	"timeCreated":             func(obj Object, _ string) string { return formatTime(obj.TimeCreated) },
+	"storageClass":            func(obj Object, _ string) string { return obj.StorageClass },
+	"timeStorageClassUpdated": func(obj Object, _ string) string { return formatTime(obj.TimeStorageClassUpdated) },
+	"crc32c":                  func(obj Object, _ string) string { return obj.Crc32c },
+	"md5Hash":                 func(obj Object, _ string) string { return obj.Md5Hash },
+	"generation":              func(obj Object, _ string) string { return strconv.FormatInt(obj.Generation, 10) },
+	"metageneration":          func(obj Object, _ string) string { return strconv.FormatInt(obj.Metageneration, 10) },
+	"contentType":             func(obj Object, _ string) string { return obj.ContentType },
+	"contentEncoding":         func(obj Object, _ string) string { return obj.ContentEncoding },
+	"contentLanguage":         func(obj Object, _ string) string { return obj.ContentLanguage },
+	"cacheControl":            func(obj Object, _ string) string { return obj.CacheControl },
+	"componentCount":          func(obj Object, _ string) string { return strconv.Itoa(obj.ComponentCount) },
+}
+
+// InventoryReportConfig configures an emulated Storage Insights inventory
+// report, listing the live objects of a bucket in CSV files written to
+// another bucket.
+type InventoryReportConfig struct {
+	// ID identifies the config, and prefixes the names of the report files.
+	ID string `json:"id"`
+
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+
+	// DestinationPath is the prefix of the report files in the destination
+	// bucket, such as "inventory/".
+	DestinationPath string `json:"destinationPath,omitempty"`
+
+	// MetadataFields are the columns of the report, such as "name" and
+	// "size". Defaults to bucket, name, size, storageClass and timeCreated.
+	MetadataFields []string `json:"metadataFields,omitempty"`
+
+	// Format is the format of the report files. Only "csv" is supported,
+	// Parquet reports can't be emulated.
+	Format string `json:"format,omitempty"`
+
+	CSVOptions InventoryCSVOptions `json:"csvOptions"`
+
+	// Frequency makes the report run periodically while the server is
+	// running. Zero means the report only runs on demand, with
+	// GenerateInventoryReport.
+	Frequency time.Duration `json:"-"`
+}
+
+// InventoryCSVOptions defines the format of CSV inventory reports.
+type InventoryCSVOptions struct {
+	// Delimiter is the separator of fields, a single character. Defaults to
+	// a comma.
+	Delimiter string `json:"delimiter,omitempty"`
+
+	// RecordSeparator is the separator of records, "\n" (the default) or
+	// "\r\n".
+	RecordSeparator string `json:"recordSeparator,omitempty"`
+
+	// HeaderRequired includes the names of the fields in the first line of
+	// the report.
+	HeaderRequired bool `json:"headerRequired"`
+}
+
+// InventoryReport describes the files written by a run of an inventory
+// report.
+type InventoryReport struct {
+	ConfigID         string    `json:"configId"`
+	SnapshotTime     time.Time `json:"snapshotTime"`
+	RecordsProcessed int       `json:"recordsProcessed"`
+	ShardNames       []string  `json:"shardNames"`
+	ManifestName     string    `json:"manifestName"`
+}
+
+// inventoryManifest is the manifest written along with the files of an
+// inventory report, in the format of Storage Insights.
+type inventoryManifest struct {
+	ReportConfig          InventoryReportConfig `json:"report_config"`
+	RecordsProcessed      int                   `json:"records_processed"`
+	SnapshotTime          string                `json:"snapshot_time"`
+	ShardCount            int                   `json:"shard_count"`
+	ReportShardsFileNames []string              `json:"report_shards_file_names"`
+}
+
+// inventoryState holds the inventory report configs of the server.
+type inventoryState struct {
+	mtx       sync.Mutex
+	schedules map[string]*inventorySchedule
+}
+
+// inventorySchedule runs a periodic inventory report in the background.
+type inventorySchedule struct {
+	config InventoryReportConfig
+	task   periodicTask
+}
+
+func (c InventoryReportConfig) validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf(format, args...)}
+	}
+	if c.ID == "" || strings.Contains(c.ID, "/") {
+		return invalid("Invalid inventory report config ID %q.", c.ID)
+	}
+	if c.SourceBucket == "" || c.DestinationBucket == "" {
+		return invalid("Inventory report configs require a source and a destination bucket.")
+	}
+	if c.Format != "" && c.Format != "csv" {
+		return invalid("Unsupported inventory report format %q, only csv reports are emulated.", c.Format)
+	}
+	if c.CSVOptions.Delimiter != "" && utf8.RuneCountInString(c.CSVOptions.Delimiter) != 1 {
+		return invalid("Invalid delimiter %q, it must be a single character.", c.CSVOptions.Delimiter)
+	}
+	if sep := c.CSVOptions.RecordSeparator; sep != "" && sep != "\n" && sep != "\r\n" {
+		return invalid("Invalid record separator %q.", sep)
+	}
+	for _, field := range c.MetadataFields {
+		if _, ok := inventoryFields[field]; !ok {
+			return invalid("Unsupported metadata field %q.", field)
+		}
+	}
+	if c.Frequency < 0 {
+		return invalid("Invalid frequency %s.", c.Frequency)
+	}
+	return nil
+}
+
+// CreateInventoryReportConfig adds an inventory report config, replacing the
+// config with the same ID, if any. The source and destination buckets must
+// exist. Configs with a Frequency run periodically from now on, and all
+// configs can run on demand with GenerateInventoryReport.
+//
+// The same can be done with a PUT request to
+// /_internal/inventoryReports/<id>, with the config in the JSON body and the
+// frequency as a duration string, as in {"sourceBucket": "data",
+// "destinationBucket": "reports", "frequency": "1h"}. A DELETE request to the
+// same path removes the config, and a POST request to
+// /_internal/inventoryReports/<id>/run generates the report.
+func (s *Server) CreateInventoryReportConfig(config InventoryReportConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	for _, bucketName := range []string{config.SourceBucket, config.DestinationBucket} {
+		if _, err := s.backend.GetBucket(bucketName); err != nil {
+			return bucketError(err)
+		}
+	}
+	s.inventory.mtx.Lock()
+	defer s.inventory.mtx.Unlock()
+	if previous, ok := s.inventory.schedules[config.ID]; ok {
+		previous.cancel()
+	}
+	if s.inventory.schedules == nil {
+		s.inventory.schedules = make(map[string]*inventorySchedule)
+	}
+	schedule := &inventorySchedule{config: config}
+	s.inventory.schedules[config.ID] = schedule
+	s.startInventorySchedule(schedule)
+	return nil
+}
+
+// DeleteInventoryReportConfig removes an inventory report config. Files
+// already written by the report are kept.
+func (s *Server) DeleteInventoryReportConfig(id string) error {
+	s.inventory.mtx.Lock()
+	defer s.inventory.mtx.Unlock()
+	schedule, ok := s.inventory.schedules[id]
+	if !ok {
+		return inventoryConfigNotFoundError(id)
+	}
+	schedule.cancel()
+	delete(s.inventory.schedules, id)
+	return nil
+}
+
+// GenerateInventoryReport runs the inventory report with the given config
+// ID right away. The report is written to the destination bucket as a
+// single CSV shard and a JSON manifest, named after the config ID and the
+// snapshot time like in Storage Insights:
+// <destinationPath><id>_<snapshotTime>_0.csv and
+// <destinationPath><id>_<snapshotTime>_manifest.json. Writing them emits
+// ObjectFinalize events.
+func (s *Server) GenerateInventoryReport(id string) (InventoryReport, error) {
+	s.inventory.mtx.Lock()
+	schedule, ok := s.inventory.schedules[id]
+	s.inventory.mtx.Unlock()
+	if !ok {
+		return InventoryReport{}, inventoryConfigNotFoundError(id)
+	}
+	return s.generateInventoryReport(schedule.config, time.Now())
+}
+
+func inventoryConfigNotFoundError(id string) error {
+	return &statusError{code: http.StatusNotFound, reason: "notFound", message: fmt.Sprintf("Inventory report config %s not found.", id)}
+}
+
+func (s *Server) generateInventoryReport(config InventoryReportConfig, snapshotTime time.Time) (InventoryReport, error) {
+	snapshotTime = snapshotTime.UTC()
+	report := InventoryReport{ConfigID: config.ID, SnapshotTime: snapshotTime}
+	bucket, err := s.backend.GetBucket(config.SourceBucket)
+	if err != nil {
+		return report, bucketError(err)
+	}
+	objs, _, err := s.listObjectsMetadata(config.SourceBucket, "", "")
+	if err != nil {
+		return report, err
+	}
+	fields := config.MetadataFields
+	if len(fields) == 0 {
+		fields = defaultInventoryFields
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if config.CSVOptions.Delimiter != "" {
+		w.Comma, _ = utf8.DecodeRuneInString(config.CSVOptions.Delimiter)
+	}
+	w.UseCRLF = config.CSVOptions.RecordSeparator == "\r\n"
+	if config.CSVOptions.HeaderRequired {
+		w.Write(fields)
+	}
+	for _, obj := range objs {
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			record[i] = inventoryFields[field](obj, bucket.Location)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return report, err
+	}
+
+	prefix := config.DestinationPath
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	snapshot := snapshotTime.Format(inventorySnapshotFormat)
+	report.RecordsProcessed = len(objs)
+	report.ShardNames = []string{fmt.Sprintf("%s%s_%s_0.csv", prefix, config.ID, snapshot)}
+	report.ManifestName = fmt.Sprintf("%s%s_%s_manifest.json", prefix, config.ID, snapshot)
+	manifest, err := json.Marshal(inventoryManifest{
+		ReportConfig:          config,
+		RecordsProcessed:      report.RecordsProcessed,
+		SnapshotTime:          formatTime(snapshotTime),
+		ShardCount:            len(report.ShardNames),
+		ReportShardsFileNames: report.ShardNames,
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// reports are written like objects uploaded through the API, so the
+	// destination bucket can't be used to bypass its restrictions.
+	reportObjs := []Object{
+		{BucketName: config.DestinationBucket, Name: report.ShardNames[0], ContentType: "text/csv", Content: buf.Bytes()},
+		{BucketName: config.DestinationBucket, Name: report.ManifestName, ContentType: "application/json", Content: manifest},
+	}
+	for _, obj := range reportObjs {
+		obj.Crc32c = encodedCrc32cChecksum(obj.Content)
+		obj.Md5Hash = encodedMd5Hash(obj.Content)
+		if _, err := s.writeObject(obj, objectConditions{}); err != nil {
+			return report, toStatusError(err)
+		}
+	}
+	return report, nil
+}
+
+// InventoryReportConfigs returns the inventory report configs of the
+// server, sorted by ID.
+func (s *Server) InventoryReportConfigs() []InventoryReportConfig {
+	s.inventory.mtx.Lock()
+	defer s.inventory.mtx.Unlock()
+	configs := make([]InventoryReportConfig, 0, len(s.inventory.schedules))
+	for _, schedule := range s.inventory.schedules {
+		configs = append(configs, schedule.config)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].ID < configs[j].ID
+	})
+	return configs
+}
+
+// startInventorySchedule starts the periodic runs of the report, if it has a
+// Frequency and isn't running yet. Callers must hold inventory.mtx.
+func (s *Server) startInventorySchedule(schedule *inventorySchedule) {
+	if schedule.config.Frequency <= 0 {
+		return
+	}
+	schedule.task.start(schedule.config.Frequency, func(now time.Time) {
+		s.generateInventoryReport(schedule.config, now)
+	})
+}
+
+// cancel stops the periodic runs of the report, waiting for the current run
+// to finish.
+func (schedule *inventorySchedule) cancel() {
+	schedule.task.stop()
+}
+
+// startInventoryReports resumes the periodic inventory reports of the server
+// and its namespaces, after the server is started again.
+func (s *Server) startInventoryReports() {
+	s.inventory.mtx.Lock()
+	for _, schedule := range s.inventory.schedules {
+		s.startInventorySchedule(schedule)
+	}
+	s.inventory.mtx.Unlock()
+	for _, ns := range s.namespaceServers() {
+		ns.startInventoryReports()
+	}
+}
+
+// stopInventoryReports stops the periodic inventory reports of the server
+// and its namespaces. Their configs are kept.
+func (s *Server) stopInventoryReports() {
+	s.inventory.mtx.Lock()
+	for _, schedule := range s.inventory.schedules {
+		schedule.cancel()
+	}
+	s.inventory.mtx.Unlock()
+	for _, ns := range s.namespaceServers() {
+		ns.stopInventoryReports()
+	}
+}
+
+func (s *Server) createInventoryReportConfigByPut(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		InventoryReportConfig
+		Frequency string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	config := data.InventoryReportConfig
+	config.ID = mux.Vars(r)["id"]
+	if data.Frequency != "" {
+		var err error
+		config.Frequency, err = time.ParseDuration(data.Frequency)
+		if err != nil {
+			writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: "Invalid frequency."})
+			return
+		}
+	}
+	if err := s.CreateInventoryReportConfig(config); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteInventoryReportConfigByDelete(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeleteInventoryReportConfig(mux.Vars(r)["id"]); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) generateInventoryReportByPost(w http.ResponseWriter, r *http.Request) {
+	report, err := s.GenerateInventoryReport(mux.Vars(r)["id"])
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,272 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerGenerateInventoryReport(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateObject(Object{BucketName: "data-bucket", Name: "a.txt", Content: []byte("some")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "data-bucket", Name: "dir/b.txt", Content: []byte("content"), StorageClass: "NEARLINE"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucket("reports-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		err := server.CreateInventoryReportConfig(InventoryReportConfig{
+			ID:                "daily",
+			SourceBucket:      "data-bucket",
+			DestinationBucket: "reports-bucket",
+			DestinationPath:   "inventory",
+			MetadataFields:    []string{"name", "size", "storageClass"},
+			CSVOptions:        InventoryCSVOptions{Delimiter: ";", HeaderRequired: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, stopEvents := server.EventStream()
+		defer stopEvents()
+		report, err := server.GenerateInventoryReport("daily")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.RecordsProcessed != 2 || len(report.ShardNames) != 1 {
+			t.Fatalf("wrong report: %+v", report)
+		}
+		snapshot := report.SnapshotTime.Format(inventorySnapshotFormat)
+		expectedShard := "inventory/daily_" + snapshot + "_0.csv"
+		if report.ShardNames[0] != expectedShard {
+			t.Errorf("wrong shard name\nwant %q\ngot  %q", expectedShard, report.ShardNames[0])
+		}
+		shard, err := server.GetObject("reports-bucket", expectedShard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedContent := "name;size;storageClass\na.txt;4;STANDARD\ndir/b.txt;7;NEARLINE\n"
+		if string(shard.Content) != expectedContent {
+			t.Errorf("wrong report content\nwant %q\ngot  %q", expectedContent, shard.Content)
+		}
+		if shard.ContentType != "text/csv" {
+			t.Errorf("wrong content type\nwant %q\ngot  %q", "text/csv", shard.ContentType)
+		}
+
+		manifestObj, err := server.GetObject("reports-bucket", report.ManifestName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest struct {
+			RecordsProcessed      int      `json:"records_processed"`
+			ShardCount            int      `json:"shard_count"`
+			ReportShardsFileNames []string `json:"report_shards_file_names"`
+		}
+		if err := json.Unmarshal(manifestObj.Content, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if manifest.RecordsProcessed != 2 || manifest.ShardCount != 1 || len(manifest.ReportShardsFileNames) != 1 || manifest.ReportShardsFileNames[0] != expectedShard {
+			t.Errorf("wrong manifest: %+v", manifest)
+		}
+		if received := drainEvents(events); len(received) != 2 || received[0].Type != ObjectFinalize {
+			t.Errorf("wrong events for the report files: %+v", received)
+		}
+	})
+}
+
+func TestServerGenerateInventoryReportReadOnlyDestination(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "data-bucket", Name: "a.txt", Content: []byte("some")}})
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "reports-bucket", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	err := server.CreateInventoryReportConfig(InventoryReportConfig{ID: "daily", SourceBucket: "data-bucket", DestinationBucket: "reports-bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.GenerateInventoryReport("daily")
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) || gErr.Code != http.StatusForbidden {
+		t.Errorf("wrong error writing report to a read-only bucket\nwant %d\ngot  %v", http.StatusForbidden, err)
+	}
+	objs, _, err := server.ListObjects("reports-bucket", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 0 {
+		t.Errorf("report written to a read-only bucket: %+v", objs)
+	}
+}
+
+func TestServerInventoryReportConfigErrors(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "data-bucket", Name: "a.txt"}})
+	defer server.Stop()
+	var tests = []struct {
+		name         string
+		config       InventoryReportConfig
+		expectedCode int
+	}{
+		{
+			"parquet",
+			InventoryReportConfig{ID: "report", SourceBucket: "data-bucket", DestinationBucket: "data-bucket", Format: "parquet"},
+			http.StatusBadRequest,
+		},
+		{
+			"unknown field",
+			InventoryReportConfig{ID: "report", SourceBucket: "data-bucket", DestinationBucket: "data-bucket", MetadataFields: []string{"owner"}},
+			http.StatusBadRequest,
+		},
+		{
+			"long delimiter",
+			InventoryReportConfig{ID: "report", SourceBucket: "data-bucket", DestinationBucket: "data-bucket", CSVOptions: InventoryCSVOptions{Delimiter: "||"}},
+			http.StatusBadRequest,
+		},
+		{
+			"missing destination",
+			InventoryReportConfig{ID: "report", SourceBucket: "data-bucket", DestinationBucket: "missing-bucket"},
+			http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		err := server.CreateInventoryReportConfig(test.config)
+		var gErr *googleapi.Error
+		if !errors.As(err, &gErr) || gErr.Code != test.expectedCode {
+			t.Errorf("%s: wrong error\nwant %d\ngot  %v", test.name, test.expectedCode, err)
+		}
+	}
+	if _, err := server.GenerateInventoryReport("missing"); err == nil {
+		t.Error("unexpected <nil> error generating report without config")
+	}
+	if err := server.DeleteInventoryReportConfig("missing"); err == nil {
+		t.Error("unexpected <nil> error deleting missing config")
+	}
+}
+
+func TestServerInventoryReportFrequency(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "data-bucket", Name: "a.txt"}})
+	defer server.Stop()
+	err := server.CreateInventoryReportConfig(InventoryReportConfig{
+		ID:                "frequent",
+		SourceBucket:      "data-bucket",
+		DestinationBucket: "data-bucket",
+		DestinationPath:   "reports/",
+		Frequency:         20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		objs, _, err := server.ListObjects("data-bucket", "reports/frequent_", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("periodic inventory report wasn't generated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := server.DeleteInventoryReportConfig("frequent"); err != nil {
+		t.Fatal(err)
+	}
+	if configs := server.InventoryReportConfigs(); len(configs) != 0 {
+		t.Errorf("unexpected configs after deleting them: %+v", configs)
+	}
+}
+
+func TestServerInventoryReportsInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "data-bucket", Name: "a.txt", Content: []byte("content")}})
+	defer server.Stop()
+	if err := server.CreateBucket("reports-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	const reportURL = "https://www.googleapis.com/_internal/inventoryReports/nightly"
+	do := func(method, url, body string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, url, expectedStatus, resp.StatusCode)
+		}
+		return resp
+	}
+	do(http.MethodPut, reportURL, `{"sourceBucket": "data-bucket", "destinationBucket": "reports-bucket", "frequency": "soon"}`, http.StatusBadRequest).Body.Close()
+	do(http.MethodPut, reportURL, `{"sourceBucket": "data-bucket", "destinationBucket": "reports-bucket", "frequency": "24h"}`, http.StatusNoContent).Body.Close()
+	configs := server.InventoryReportConfigs()
+	if len(configs) != 1 || configs[0].ID != "nightly" || configs[0].Frequency != 24*time.Hour {
+		t.Errorf("wrong configs: %+v", configs)
+	}
+
+	resp := do(http.MethodPost, reportURL+"/run", "", http.StatusOK)
+	var report InventoryReport
+	err := json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard, err := server.GetObject("reports-bucket", report.ShardNames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(shard.Content), "data-bucket,a.txt,7,STANDARD,") {
+		t.Errorf("wrong report content: %q", shard.Content)
+	}
+
+	do(http.MethodDelete, reportURL, "", http.StatusNoContent).Body.Close()
+	do(http.MethodPost, reportURL+"/run", "", http.StatusNotFound).Body.Close()
+}
+
+func TestServerDeleteNamespaceStopsInventoryReports(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	ns, err := server.Namespace("some-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.CreateBucket("data-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	err = ns.CreateInventoryReportConfig(InventoryReportConfig{
+		ID:                "frequent",
+		SourceBucket:      "data-bucket",
+		DestinationBucket: "data-bucket",
+		Frequency:         10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.DeleteNamespace("some-namespace"); err != nil {
+		t.Fatal(err)
+	}
+	objs, _, err := ns.ListObjects("data-bucket", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	after, _, err := ns.ListObjects("data-bucket", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(objs) {
+		t.Errorf("inventory reports generated after deleting the namespace\nwant %d objects\ngot  %d", len(objs), len(after))
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// Location types of buckets.
+const (
+	locationTypeRegion      = "region"
+	locationTypeDualRegion  = "dual-region"
+	locationTypeMultiRegion = "multi-region"
+)
+
+var multiRegions = map[string]bool{"US": true, "EU": true, "ASIA": true}
+
+var predefinedDualRegions = map[string]bool{
+	"ASIA1": true,
+	"EUR4":  true,
+	"EUR5":  true,
+	"EUR7":  true,
+	"EUR8":  true,
+	"NAM4":  true,
+}
+
+// bucketLocationType returns the location type of the bucket, as returned by
+// the JSON API.
+func bucketLocationType(bucket backend.Bucket) string {
+	location := bucketLocation(bucket.Location)
+	switch {
+	case multiRegions[location]:
+		if len(bucket.CustomPlacement) > 0 {
+			return locationTypeDualRegion
+		}
+		return locationTypeMultiRegion
+	case predefinedDualRegions[location]:
+		return locationTypeDualRegion
+	default:
+		return locationTypeRegion
+	}
+}
+
+// Recovery point objectives of buckets. Turbo replication (ASYNC_TURBO) is
+// only available for dual-region buckets.
+const (
+	rpoDefault    = "DEFAULT"
+	rpoAsyncTurbo = "ASYNC_TURBO"
+)
+
+// validateRPO checks the recovery point objective of the bucket, returning
+// the same errors as the JSON API.
+func validateRPO(bucket backend.Bucket) error {
+	switch bucket.RPO {
+	case "", rpoDefault:
+		return nil
+	case rpoAsyncTurbo:
+		if bucketLocationType(bucket) != locationTypeDualRegion {
+			return &statusError{code: http.StatusBadRequest, reason: "invalid", message: "The bucket's location does not support turbo replication. Turbo replication is only available for dual-region buckets."}
+		}
+		return nil
+	default:
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid value for rpo: %q. Supported values are DEFAULT and ASYNC_TURBO.", bucket.RPO)}
+	}
+}
+
+// bucketRPO returns the recovery point objective of the bucket, as returned
+// by the JSON API, which omits it for regional buckets.
+func bucketRPO(bucket backend.Bucket) string {
+	if bucketLocationType(bucket) == locationTypeRegion {
+		return ""
+	}
+	if bucket.RPO == "" {
+		return rpoDefault
+	}
+	return bucket.RPO
+}
+
+type customPlacementConfig struct {
+	DataLocations []string `json:"dataLocations"`
+}
+
+type hierarchicalNamespace struct {
+	Enabled bool `json:"enabled"`
+}
+
+type storageLayoutResponse struct {
+	Kind                  string                 `json:"kind"`
+	Bucket                string                 `json:"bucket"`
+	Location              string                 `json:"location"`
+	LocationType          string                 `json:"locationType"`
+	CustomPlacementConfig *customPlacementConfig `json:"customPlacementConfig,omitempty"`
+	HierarchicalNamespace *hierarchicalNamespace `json:"hierarchicalNamespace,omitempty"`
+}
+
+func newStorageLayoutResponse(bucket backend.Bucket) storageLayoutResponse {
+	resp := storageLayoutResponse{
+		Kind:                  "storage#storageLayout",
+		Bucket:                bucket.Name,
+		Location:              bucketLocation(bucket.Location),
+		LocationType:          bucketLocationType(bucket),
+		HierarchicalNamespace: &hierarchicalNamespace{Enabled: bucket.HierarchicalNamespace},
+	}
+	if len(bucket.CustomPlacement) > 0 {
+		resp.CustomPlacementConfig = &customPlacementConfig{DataLocations: bucket.CustomPlacement}
+	}
+	return resp
+}
+
+// getStorageLayout handles the storageLayout request, which clients use to
+// find out the location and namespace of a bucket without the permissions
+// needed to get the bucket.
+func (s *Server) getStorageLayout(w http.ResponseWriter, r *http.Request) {
+	bucket, err := s.backend.GetBucket(mux.Vars(r)["bucketName"])
+	if err != nil {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: "The specified bucket does not exist."})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(newStorageLayoutResponse(bucket))
+}
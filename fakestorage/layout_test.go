@@ -0,0 +1,162 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerStorageLayout(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("default-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "regional-bucket", Location: "europe-west1", HierarchicalNamespace: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "dual-region-bucket", Location: "US", CustomPlacement: []string{"US-EAST1", "US-WEST1"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			bucket   string
+			expected storageLayoutResponse
+		}{
+			{
+				"default-bucket",
+				storageLayoutResponse{Kind: "storage#storageLayout", Bucket: "default-bucket", Location: "US", LocationType: "multi-region", HierarchicalNamespace: &hierarchicalNamespace{}},
+			},
+			{
+				"regional-bucket",
+				storageLayoutResponse{Kind: "storage#storageLayout", Bucket: "regional-bucket", Location: "EUROPE-WEST1", LocationType: "region", HierarchicalNamespace: &hierarchicalNamespace{Enabled: true}},
+			},
+			{
+				"dual-region-bucket",
+				storageLayoutResponse{
+					Kind:                  "storage#storageLayout",
+					Bucket:                "dual-region-bucket",
+					Location:              "US",
+					LocationType:          "dual-region",
+					CustomPlacementConfig: &customPlacementConfig{DataLocations: []string{"US-EAST1", "US-WEST1"}},
+					HierarchicalNamespace: &hierarchicalNamespace{},
+				},
+			},
+		}
+		for _, test := range tests {
+			resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/" + test.bucket + "/storageLayout")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var layout storageLayoutResponse
+			err = json.NewDecoder(resp.Body).Decode(&layout)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(layout, test.expected) {
+				t.Errorf("%s: wrong storage layout\nwant %+v\ngot  %+v", test.bucket, test.expected, layout)
+			}
+		}
+
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/missing-bucket/storageLayout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("wrong status code for missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestServerBucketRPO(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "regional-bucket", Location: "europe-west1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "multi-region-bucket", Location: "EU"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "dual-region-bucket", Location: "NAM4"}); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			name           string
+			method         string
+			path           string
+			body           string
+			expectedStatus int
+			expectedRPO    string
+		}{
+			{"create dual-region with turbo", http.MethodPost, "/storage/v1/b", `{"name":"turbo-bucket","location":"EUR4","rpo":"ASYNC_TURBO"}`, http.StatusOK, "ASYNC_TURBO"},
+			{"create custom dual-region with turbo", http.MethodPost, "/storage/v1/b", `{"name":"custom-bucket","location":"US","customPlacementConfig":{"dataLocations":["US-EAST1","US-WEST1"]},"rpo":"ASYNC_TURBO"}`, http.StatusOK, "ASYNC_TURBO"},
+			{"create regional with turbo", http.MethodPost, "/storage/v1/b", `{"name":"other-bucket","location":"us-east1","rpo":"ASYNC_TURBO"}`, http.StatusBadRequest, ""},
+			{"create with invalid rpo", http.MethodPost, "/storage/v1/b", `{"name":"other-bucket","location":"EUR4","rpo":"FAST"}`, http.StatusBadRequest, ""},
+			{"patch dual-region to turbo", http.MethodPatch, "/storage/v1/b/dual-region-bucket", `{"rpo":"ASYNC_TURBO"}`, http.StatusOK, "ASYNC_TURBO"},
+			{"patch dual-region to default", http.MethodPatch, "/storage/v1/b/dual-region-bucket", `{"rpo":"DEFAULT"}`, http.StatusOK, "DEFAULT"},
+			{"patch dual-region to null", http.MethodPatch, "/storage/v1/b/turbo-bucket", `{"rpo":null}`, http.StatusOK, "DEFAULT"},
+			{"patch multi-region to turbo", http.MethodPatch, "/storage/v1/b/multi-region-bucket", `{"rpo":"ASYNC_TURBO"}`, http.StatusBadRequest, ""},
+			{"patch regional to turbo", http.MethodPatch, "/storage/v1/b/regional-bucket", `{"rpo":"ASYNC_TURBO"}`, http.StatusBadRequest, ""},
+			{"patch with invalid rpo", http.MethodPatch, "/storage/v1/b/dual-region-bucket", `{"rpo":"async_turbo"}`, http.StatusBadRequest, ""},
+			{"patch regional labels", http.MethodPatch, "/storage/v1/b/regional-bucket", `{"labels":{"a":"b"}}`, http.StatusOK, ""},
+			{"patch multi-region labels", http.MethodPatch, "/storage/v1/b/multi-region-bucket", `{"labels":{"a":"b"}}`, http.StatusOK, "DEFAULT"},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(test.method, "https://www.googleapis.com"+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bucket struct {
+				Rpo   string
+				Error *struct {
+					Errors []struct{ Reason string }
+				}
+			}
+			err = json.NewDecoder(resp.Body).Decode(&bucket)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+				continue
+			}
+			if test.expectedStatus != http.StatusOK {
+				if bucket.Error == nil || len(bucket.Error.Errors) == 0 || bucket.Error.Errors[0].Reason != "invalid" {
+					t.Errorf("%s: wrong error\nwant reason %q\ngot  %+v", test.name, "invalid", bucket.Error)
+				}
+				continue
+			}
+			if bucket.Rpo != test.expectedRPO {
+				t.Errorf("%s: wrong rpo\nwant %q\ngot  %q", test.name, test.expectedRPO, bucket.Rpo)
+			}
+		}
+	})
+}
+
+func TestCreateBucketWithOptsInvalidRPO(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "regional-bucket", Location: "us-east1", RPO: "ASYNC_TURBO"})
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) || gErr.Code != http.StatusBadRequest {
+		t.Errorf("wrong error creating regional bucket with turbo replication\nwant 400 *googleapi.Error\ngot  %#v", err)
+	}
+	if _, err := server.backend.GetBucket("regional-bucket"); err == nil {
+		t.Error("unexpected bucket created with invalid rpo")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+const lifecycleSetStorageClass = "SetStorageClass"
+
+// storageClassRanks orders the storage classes from the warmest to the
+// coldest. Lifecycle rules only move objects to colder classes, and the
+// coldest class wins when several rules match. Legacy classes rank as
+// STANDARD.
+var storageClassRanks = map[string]int{
+	"STANDARD": 0,
+	"NEARLINE": 1,
+	"COLDLINE": 2,
+	"ARCHIVE":  3,
+}
+
+// ApplyLifecycleRules applies the SetStorageClass actions of the lifecycle
+// rules of all buckets to the live and noncurrent objects matching their
+// conditions, in all namespaces. Other actions, such as Delete, aren't
+// applied.
+//
+// Objects moved to another storage class keep their generation, get a new
+// metageneration and an updated TimeStorageClassUpdated, and emit
+// ObjectMetadataUpdate events, like in Cloud Storage. The same can be done
+// with a POST request to /_internal/lifecycle.
+func (s *Server) ApplyLifecycleRules() error {
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, bucket := range buckets {
+		var rules []backend.LifecycleRule
+		for _, rule := range bucket.LifecycleRules {
+			if rule.Action.Type == lifecycleSetStorageClass {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		live, _, err := s.ListObjects(bucket.Name, "", "")
+		if err != nil {
+			return err
+		}
+		noncurrent, err := s.ListNoncurrentObjects(bucket.Name)
+		if err != nil {
+			return err
+		}
+		newerVersions := countNewerVersions(live, noncurrent)
+		for i, obj := range append(live, noncurrent...) {
+			isLive := i < len(live)
+			storageClass := lifecycleStorageClass(rules, obj, isLive, newerVersions[generationOf(obj)], now)
+			if storageClass == "" {
+				continue
+			}
+			if err := s.transitionStorageClass(obj, storageClass, isLive); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ns := range s.namespaceServers() {
+		if err := ns.ApplyLifecycleRules(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectGeneration identifies a generation of an object.
+type objectGeneration struct {
+	id         string
+	generation int64
+}
+
+func generationOf(obj Object) objectGeneration {
+	return objectGeneration{id: obj.id(), generation: obj.Generation}
+}
+
+// countNewerVersions returns the number of newer versions of each
+// noncurrent generation of the objects, as in the numNewerVersions condition.
+func countNewerVersions(live, noncurrent []Object) map[objectGeneration]int64 {
+	generations := make(map[string][]int64)
+	for _, obj := range append(live, noncurrent...) {
+		generations[obj.id()] = append(generations[obj.id()], obj.Generation)
+	}
+	counts := make(map[objectGeneration]int64)
+	for _, obj := range noncurrent {
+		for _, generation := range generations[obj.id()] {
+			if generation > obj.Generation {
+				counts[generationOf(obj)]++
+			}
+		}
+	}
+	return counts
+}
+
+// lifecycleStorageClass returns the coldest storage class of the rules
+// matching the object, or an empty string when no rule moves the object to
+// a colder class.
+func lifecycleStorageClass(rules []backend.LifecycleRule, obj Object, isLive bool, newerVersions int64, now time.Time) string {
+	storageClass := ""
+	rank := storageClassRanks[obj.StorageClass]
+	for _, rule := range rules {
+		target := strings.ToUpper(rule.Action.StorageClass)
+		if targetRank, ok := storageClassRanks[target]; !ok || targetRank <= rank {
+			continue
+		}
+		if !lifecycleConditionMatches(rule.Condition, obj, isLive, newerVersions, now) {
+			continue
+		}
+		storageClass = target
+		rank = storageClassRanks[target]
+	}
+	return storageClass
+}
+
+// lifecycleConditionMatches reports whether the object matches all the
+// conditions of a lifecycle rule.
+func lifecycleConditionMatches(cond backend.LifecycleCondition, obj Object, isLive bool, newerVersions int64, now time.Time) bool {
+	day := 24 * time.Hour
+	if cond.Age != nil && int64(now.Sub(obj.TimeCreated)/day) < *cond.Age {
+		return false
+	}
+	if cond.CreatedBefore != "" {
+		date, err := time.Parse("2006-01-02", cond.CreatedBefore)
+		if err != nil || !obj.TimeCreated.Before(date) {
+			return false
+		}
+	}
+	if cond.IsLive != nil && *cond.IsLive != isLive {
+		return false
+	}
+	if len(cond.MatchesStorageClass) > 0 && !containsString(cond.MatchesStorageClass, obj.StorageClass) {
+		return false
+	}
+	if len(cond.MatchesPrefix) > 0 && !matchesAny(cond.MatchesPrefix, obj.Name, strings.HasPrefix) {
+		return false
+	}
+	if len(cond.MatchesSuffix) > 0 && !matchesAny(cond.MatchesSuffix, obj.Name, strings.HasSuffix) {
+		return false
+	}
+	if cond.NumNewerVersions > 0 && newerVersions < cond.NumNewerVersions {
+		return false
+	}
+	if cond.DaysSinceNoncurrentTime > 0 && (isLive || int64(now.Sub(obj.TimeDeleted)/day) < cond.DaysSinceNoncurrentTime) {
+		return false
+	}
+	if cond.NoncurrentTimeBefore != "" {
+		date, err := time.Parse("2006-01-02", cond.NoncurrentTimeBefore)
+		if err != nil || isLive || !obj.TimeDeleted.Before(date) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, name string, match func(string, string) bool) bool {
+	for _, pattern := range patterns {
+		if match(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionStorageClass moves the given generation of an object to another
+// storage class, unless it changed after being listed.
+func (s *Server) transitionStorageClass(obj Object, storageClass string, isLive bool) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	current, live, err := s.getObjectGeneration(obj.BucketName, obj.Name, obj.Generation)
+	if err != nil || live != isLive || current.Metageneration != obj.Metageneration {
+		return nil
+	}
+	current.StorageClass = storageClass
+	current.TimeStorageClassUpdated = time.Now()
+	current.Metageneration++
+	if live {
+		// createObject emits the ObjectMetadataUpdate event, as the
+		// generation doesn't change.
+		_, err = s.createObject(current)
+		return err
+	}
+	if err := s.backend.CreateNoncurrentObject(toBackendObjects([]Object{current})[0]); err != nil {
+		return err
+	}
+	s.sizes.noncurrentObjectStored(current)
+	s.events.publish(ObjectMetadataUpdate, current)
+	return nil
+}
+
+func (s *Server) applyLifecycleRulesByPost(w http.ResponseWriter, r *http.Request) {
+	if err := s.ApplyLifecycleRules(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
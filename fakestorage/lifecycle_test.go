@@ -0,0 +1,253 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setBucketLifecycle(t *testing.T, server *Server, bucketName, lifecycle string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, "https://www.googleapis.com/storage/v1/b/"+bucketName, strings.NewReader(`{"lifecycle":`+lifecycle+`}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code setting the lifecycle\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func drainEvents(events <-chan ObjectEvent) []ObjectEvent {
+	var drained []ObjectEvent
+	for {
+		select {
+		case event := <-events:
+			drained = append(drained, event)
+		default:
+			return drained
+		}
+	}
+}
+
+func TestServerApplyLifecycleRules(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		old := time.Now().Add(-40 * 24 * time.Hour)
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "logs/old.log", TimeCreated: old}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "logs/new.log"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "data/old.bin", TimeCreated: old}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "data/archived.bin", TimeCreated: old, StorageClass: "ARCHIVE"}); err != nil {
+			t.Fatal(err)
+		}
+		setBucketLifecycle(t, server, "some-bucket", `{"rule": [
+			{"action": {"type": "SetStorageClass", "storageClass": "NEARLINE"}, "condition": {"age": 30}},
+			{"action": {"type": "SetStorageClass", "storageClass": "COLDLINE"}, "condition": {"age": 30, "matchesPrefix": ["logs/"]}},
+			{"action": {"type": "Delete"}, "condition": {"age": 1}}
+		]}`)
+		events, stopEvents := server.EventStream()
+		defer stopEvents()
+		before := time.Now()
+		if err := server.ApplyLifecycleRules(); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			name                   string
+			expectedStorageClass   string
+			expectedMetageneration int64
+		}{
+			{"logs/old.log", "COLDLINE", 2},
+			{"logs/new.log", "STANDARD", 1},
+			{"data/old.bin", "NEARLINE", 2},
+			{"data/archived.bin", "ARCHIVE", 1},
+		}
+		for _, test := range tests {
+			obj, err := server.GetObject("some-bucket", test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.StorageClass != test.expectedStorageClass {
+				t.Errorf("%s: wrong storage class\nwant %q\ngot  %q", test.name, test.expectedStorageClass, obj.StorageClass)
+			}
+			if obj.Metageneration != test.expectedMetageneration {
+				t.Errorf("%s: wrong metageneration\nwant %d\ngot  %d", test.name, test.expectedMetageneration, obj.Metageneration)
+			}
+			transitioned := test.expectedMetageneration > 1
+			if updated := obj.TimeStorageClassUpdated; transitioned && updated.Before(before) || !transitioned && !updated.Equal(obj.TimeCreated) {
+				t.Errorf("%s: wrong timeStorageClassUpdated %s", test.name, updated)
+			}
+		}
+
+		received := drainEvents(events)
+		if len(received) != 2 {
+			t.Fatalf("wrong number of events\nwant 2\ngot  %d", len(received))
+		}
+		for _, event := range received {
+			if event.Type != ObjectMetadataUpdate {
+				t.Errorf("wrong type of event\nwant %s\ngot  %s", ObjectMetadataUpdate, event.Type)
+			}
+		}
+
+		// rules are idempotent: objects already in the target class aren't
+		// updated again.
+		if err := server.ApplyLifecycleRules(); err != nil {
+			t.Fatal(err)
+		}
+		if extra := drainEvents(events); len(extra) != 0 {
+			t.Errorf("unexpected events on the second run: %d", len(extra))
+		}
+	})
+}
+
+func TestServerApplyLifecycleRulesNoncurrent(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	setBucketLifecycle(t, server, "some-bucket", `{"rule": [
+		{"action": {"type": "SetStorageClass", "storageClass": "ARCHIVE"}, "condition": {"numNewerVersions": 1, "isLive": false}}
+	]}`)
+	if err := server.ApplyLifecycleRules(); err != nil {
+		t.Fatal(err)
+	}
+	live, err := server.GetObject("some-bucket", "object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.StorageClass != "STANDARD" {
+		t.Errorf("wrong storage class of the live generation\nwant %q\ngot  %q", "STANDARD", live.StorageClass)
+	}
+	noncurrent, err := server.ListNoncurrentObjects("some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(noncurrent) != 1 || noncurrent[0].StorageClass != "ARCHIVE" || noncurrent[0].Metageneration != 2 {
+		t.Errorf("wrong noncurrent generations after applying the rules: %+v", noncurrent)
+	}
+}
+
+func TestServerRewriteStorageClassEvents(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+		events, stopEvents := server.EventStream()
+		defer stopEvents()
+		ctx := context.Background()
+		obj := server.Client().Bucket("some-bucket").Object("object.txt")
+		copier := obj.CopierFrom(obj)
+		copier.StorageClass = "NEARLINE"
+		attrs, err := copier.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.StorageClass != "NEARLINE" {
+			t.Errorf("wrong storage class\nwant %q\ngot  %q", "NEARLINE", attrs.StorageClass)
+		}
+		var types []ObjectEventType
+		for _, event := range drainEvents(events) {
+			types = append(types, event.Type)
+		}
+		expected := []ObjectEventType{ObjectDelete, ObjectFinalize, ObjectMetadataUpdate}
+		if len(types) != len(expected) {
+			t.Fatalf("wrong events\nwant %v\ngot  %v", expected, types)
+		}
+		for i := range expected {
+			if types[i] != expected[i] {
+				t.Errorf("wrong events\nwant %v\ngot  %v", expected, types)
+				break
+			}
+		}
+
+		// copies to other objects keep the storage class, without metadata
+		// updates.
+		dst := server.Client().Bucket("some-bucket").Object("copy.txt")
+		if _, err := dst.CopierFrom(obj).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range drainEvents(events) {
+			if event.Type == ObjectMetadataUpdate {
+				t.Errorf("unexpected metadata update for copy to a new object")
+			}
+		}
+
+		// and so do copies of other objects replacing an existing object
+		// with a different storage class.
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "standard.txt", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+		drainEvents(events)
+		dst = server.Client().Bucket("some-bucket").Object("standard.txt")
+		if _, err := dst.CopierFrom(obj).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range drainEvents(events) {
+			if event.Type == ObjectMetadataUpdate {
+				t.Errorf("unexpected metadata update for copy replacing another object")
+			}
+		}
+
+		var resp struct {
+			TimeStorageClassUpdated string
+		}
+		httpResp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket/o/object.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+		if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.TimeStorageClassUpdated == "" {
+			t.Error("missing timeStorageClassUpdated in the object resource")
+		}
+	})
+}
+
+func TestServerApplyLifecycleRulesInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt", TimeCreated: time.Now().Add(-48 * time.Hour)}})
+	defer server.Stop()
+	setBucketLifecycle(t, server, "some-bucket", `{"rule": [{"action": {"type": "SetStorageClass", "storageClass": "coldline"}, "condition": {"age": 1}}]}`)
+	resp, err := server.HTTPClient().Post("https://www.googleapis.com/_internal/lifecycle", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+	}
+	attrs, err := server.Client().Bucket("some-bucket").Object("object.txt").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.StorageClass != "COLDLINE" {
+		t.Errorf("wrong storage class\nwant %q\ngot  %q", "COLDLINE", attrs.StorageClass)
+	}
+}
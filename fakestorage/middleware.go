@@ -0,0 +1,67 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware wraps the handler of API requests. It can act before calling
+// next, for example to mutate the request or to deny the operation by writing
+// a response without calling next, and after next returns, for example to
+// record metrics.
+//
+// Middlewares run in the order they're registered, before scripted failures
+// from scenarios, and they're not invoked for the internal endpoints under
+// /_internal.
+type Middleware func(next http.Handler) http.Handler
+
+// RequestTarget returns the names of the bucket and the object targeted by an
+// API request. It's meant to be called from middlewares, and any of the names
+// may be empty, depending on the operation.
+func RequestTarget(r *http.Request) (bucketName, objectName string) {
+	return requestTarget(r)
+}
+
+func (s *Server) userMiddleware(mw Middleware) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isInternalRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestBuckets returns the names of the buckets involved in the request,
+// each one once, even when an operation copies objects within a bucket.
+func (s *Server) requestBuckets(r *http.Request) []string {
+	vars := mux.Vars(r)
+	var buckets []string
+	add := func(name string) {
+		for _, bucket := range buckets {
+			if bucket == name {
+				return
+			}
+		}
+		buckets = append(buckets, name)
+	}
+	for _, key := range []string{"bucketName", "sourceBucket", "destinationBucket"} {
+		if name := vars[key]; name != "" {
+			add(name)
+		}
+	}
+	if uploadID := vars["uploadId"]; uploadID != "" {
+		if session, ok := s.uploads.Load(uploadID); ok {
+			add(session.(uploadSession).obj.BucketName)
+		}
+	}
+	return buckets
+}
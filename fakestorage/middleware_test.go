@@ -0,0 +1,95 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerMiddlewares(t *testing.T) {
+	var mtx sync.Mutex
+	var calls []string
+	recordStatus := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			bucketName, objectName := RequestTarget(r)
+			mtx.Lock()
+			calls = append(calls, strings.Join([]string{r.Method, bucketName, objectName, http.StatusText(rec.status)}, " "))
+			mtx.Unlock()
+		})
+	}
+	denyDeletes := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				http.Error(w, "deletes are not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	server, err := NewServerWithOptions(Options{
+		NoListener:  true,
+		Middlewares: []Middleware{recordStatus, denyDeletes},
+		InitialObjects: []Object{
+			{BucketName: "some-bucket", Name: "some-object.txt", Content: []byte("some content")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	objHandle := server.Client().Bucket("some-bucket").Object("some-object.txt")
+
+	_, err = objHandle.Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = objHandle.Delete(context.Background())
+	if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusForbidden {
+		t.Errorf("wrong error returned\nwant 403 error\ngot  %v", err)
+	}
+	if _, err := server.GetObject("some-bucket", "some-object.txt"); err != nil {
+		t.Errorf("object deleted despite the middleware: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodDelete, "https://www.googleapis.com/_internal/scenario", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("middleware applied to internal endpoint: status %d", resp.StatusCode)
+	}
+
+	expectedCalls := []string{
+		"GET some-bucket some-object.txt OK",
+		"DELETE some-bucket some-object.txt Forbidden",
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if strings.Join(calls, "\n") != strings.Join(expectedCalls, "\n") {
+		t.Errorf("wrong calls recorded\nwant %q\ngot  %q", expectedCalls, calls)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -5,18 +5,42 @@
 package fakestorage
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
-
-	"github.com/gorilla/mux"
 )
 
 type muxTransport struct {
-	router *mux.Router
+	handler http.Handler
 }
 
 func (t *muxTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil {
+		// requests received by an http.Server always have a body.
+		r = r.WithContext(r.Context())
+		r.Body = http.NoBody
+	}
 	w := httptest.NewRecorder()
-	t.router.ServeHTTP(w, r)
-	return w.Result(), nil
+	t.handler.ServeHTTP(w, r)
+	resp := w.Result()
+	if r.Method != http.MethodHead && resp.ContentLength > int64(w.Body.Len()) {
+		// the handler stopped before sending the whole body, which makes
+		// the net/http server close the connection.
+		resp.Body = truncatedBody{resp.Body}
+	}
+	return resp, nil
+}
+
+// truncatedBody is the body of a response cut short, which fails with
+// io.ErrUnexpectedEOF instead of ending, like a closed connection.
+type truncatedBody struct {
+	io.ReadCloser
+}
+
+func (b truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
@@ -0,0 +1,164 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// namespaceHeader is the header used by clients to send requests to a
+// namespace of the server.
+const namespaceHeader = "X-Fake-Gcs-Namespace"
+
+// namespacesDir is the directory, within StorageRoot, where the objects of
+// namespaces are stored.
+const namespacesDir = ".namespaces"
+
+// Namespace returns a view of the server that is isolated from the rest of
+// the server: buckets and objects created in a namespace are only visible in
+// that namespace. Namespaces share the listener of the server, so a single
+// server can be reused across tests running in parallel, each one using a
+// different namespace (for example, named after t.Name()).
+//
+// The returned server has its own state (objects, uploads, scenario and event
+// stream), and its Client and HTTPClient send requests to the namespace.
+// Other HTTP clients select the namespace with the X-Fake-Gcs-Namespace
+// header. Namespaces are created on first use, either by this method or by
+// a request with the header. The names "", "." and ".." are invalid.
+func (s *Server) Namespace(name string) (*Server, error) {
+	if s.parent != nil {
+		return s.parent.Namespace(name)
+	}
+	if err := validateNamespace(name); err != nil {
+		return nil, err
+	}
+	s.namespaceMtx.Lock()
+	defer s.namespaceMtx.Unlock()
+	if ns, ok := s.namespaces[name]; ok {
+		return ns, nil
+	}
+	options := s.options
+	options.InitialObjects = nil
+	options.NoListener = true
+	options.AccessLog = nil
+	options.PersistenceDir = ""
+	options.Tenants = TenantOptions{}
+	if options.StorageRoot != "" {
+		options.StorageRoot = s.namespaceRoot(name)
+		err := os.MkdirAll(options.StorageRoot, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ns, err := newServer(options)
+	if err != nil {
+		return nil, err
+	}
+	ns.parent = s
+	ns.auditLog = s.auditLog
+	ns.transport = &namespaceTransport{parent: s, namespace: name}
+	if s.namespaces == nil {
+		s.namespaces = make(map[string]*Server)
+	}
+	s.namespaces[name] = ns
+	return ns, nil
+}
+
+// DeleteNamespace removes a namespace and all of its buckets and objects.
+// The periodic inventory reports of the namespace are stopped.
+func (s *Server) DeleteNamespace(name string) error {
+	if s.parent != nil {
+		return s.parent.DeleteNamespace(name)
+	}
+	if err := validateNamespace(name); err != nil {
+		return err
+	}
+	s.namespaceMtx.Lock()
+	defer s.namespaceMtx.Unlock()
+	if ns, ok := s.namespaces[name]; ok {
+		ns.stopInventoryReports()
+		delete(s.namespaces, name)
+	}
+	if s.options.StorageRoot != "" {
+		return os.RemoveAll(s.namespaceRoot(name))
+	}
+	return nil
+}
+
+// namespaceServers returns the namespaces created in the server.
+func (s *Server) namespaceServers() []*Server {
+	s.namespaceMtx.Lock()
+	defer s.namespaceMtx.Unlock()
+	namespaces := make([]*Server, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// validateNamespace rejects the names of namespaces that would resolve to
+// StorageRoot, or to its parent, once used as a directory name.
+func validateNamespace(name string) error {
+	switch name {
+	case "", ".", "..":
+		return &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid namespace %q.", name)}
+	}
+	return nil
+}
+
+func (s *Server) namespaceRoot(name string) string {
+	return filepath.Join(s.options.StorageRoot, namespacesDir, url.PathEscape(name))
+}
+
+// serveNamespace routes requests to the namespace in the request header, or
+// to the tenant of the request in multi-tenant mode, if any.
+func (s *Server) serveNamespace(w http.ResponseWriter, r *http.Request) {
+	if s.parent != nil {
+		s.serveRouted(w, r)
+		return
+	}
+	name, err := s.requestNamespace(r)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if name == "" {
+		s.serveRouted(w, r)
+		return
+	}
+	ns, err := s.Namespace(name)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	ns.serveRouted(w, r)
+}
+
+// serveRouted dispatches the request to the router of the server, or to the
+// handler of tag bindings, whose paths can't go through the router.
+func (s *Server) serveRouted(w http.ResponseWriter, r *http.Request) {
+	if isTagBindingsRequest(r) {
+		s.serveTagBindings(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// namespaceTransport sends requests to a namespace through the transport of
+// the parent server.
+type namespaceTransport struct {
+	parent    *Server
+	namespace string
+}
+
+func (t *namespaceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(namespaceHeader, t.namespace)
+	return t.parent.transport.RoundTrip(r)
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerNamespaces(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		testServerNamespaces(t, server)
+	})
+}
+
+func TestServerNamespacesFilesystem(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fakestorage-namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	server, err := NewServerWithOptions(Options{StorageRoot: tempDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	testServerNamespaces(t, server)
+	ns, err := server.Namespace(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.CreateObject(Object{BucketName: "some-bucket", Name: "some-object.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	err = server.DeleteNamespace(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err = server.Namespace(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.GetObject("some-bucket", "some-object.txt"); err == nil {
+		t.Error("object found after deleting the namespace")
+	}
+}
+
+func testServerNamespaces(t *testing.T, server *Server) {
+	ctx := context.Background()
+	if err := server.CreateObject(Object{BucketName: "shared-bucket", Name: "root.txt", Content: []byte("root")}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := server.Namespace("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := server.Namespace("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := server.Namespace("first"); again != first {
+		t.Error("Namespace returned a different server for the same name")
+	}
+	if first.URL() != server.URL() {
+		t.Errorf("wrong url for the namespace\nwant %q\ngot  %q", server.URL(), first.URL())
+	}
+
+	for _, ns := range []*Server{first, second} {
+		err = ns.Client().Bucket("shared-bucket").Create(ctx, "whatever", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := ns.Client().Bucket("shared-bucket").Object("object.txt").NewWriter(ctx)
+		w.ChunkSize = googleapi.MinUploadChunkSize
+		w.Write([]byte("content from " + "namespace"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = first.Client().Bucket("shared-bucket").Object("root.txt").Attrs(ctx)
+	if err != storage.ErrObjectNotExist {
+		t.Errorf("wrong error reading object from the root server in a namespace\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+	}
+	if _, err := server.GetObject("shared-bucket", "object.txt"); err == nil {
+		t.Error("object created in a namespace visible in the root server")
+	}
+	err = first.Client().Bucket("shared-bucket").Object("object.txt").Delete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.GetObject("shared-bucket", "object.txt"); err != nil {
+		t.Errorf("object deleted in a namespace missing from another namespace: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://www.googleapis.com/storage/v1/b/shared-bucket/o", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(namespaceHeader, "second")
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var listResp struct {
+		Items []struct{ Name string }
+	}
+	err = json.NewDecoder(resp.Body).Decode(&listResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.Items) != 1 || listResp.Items[0].Name != "object.txt" {
+		t.Errorf("wrong objects listed in the namespace: %+v", listResp.Items)
+	}
+}
+
+func TestServerInvalidNamespaces(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fakestorage-namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	server, err := NewServerWithOptions(Options{StorageRoot: tempDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateObject(Object{BucketName: "shared-bucket", Name: "root.txt", Content: []byte("root")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", ".", ".."} {
+		if _, err := server.Namespace(name); err == nil {
+			t.Errorf("Namespace(%q): unexpected <nil> error", name)
+		}
+		if err := server.DeleteNamespace(name); err == nil {
+			t.Errorf("DeleteNamespace(%q): unexpected <nil> error", name)
+		}
+	}
+	for _, name := range []string{".", ".."} {
+		req, err := http.NewRequest(http.MethodGet, "https://www.googleapis.com/storage/v1/b/shared-bucket/o", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(namespaceHeader, name)
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("namespace %q: wrong status code\nwant %d\ngot  %d", name, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+	if _, err := server.GetObject("shared-bucket", "root.txt"); err != nil {
+		t.Errorf("object of the root server missing: %v", err)
+	}
+}
@@ -5,13 +5,19 @@
 package fakestorage
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/backend"
 	"github.com/gorilla/mux"
 )
@@ -22,8 +28,97 @@ type Object struct {
 	Name       string `json:"name"`
 	Content    []byte `json:"-"`
 	// Crc32c checksum of Content. calculated by server when it's upload methods are used.
-	Crc32c  string `json:"crc32c,omitempty"`
-	Md5Hash string `json:"md5hash,omitempty"`
+	Crc32c          string `json:"crc32c,omitempty"`
+	Md5Hash         string `json:"md5hash,omitempty"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentLanguage string `json:"contentLanguage,omitempty"`
+	CacheControl    string `json:"cacheControl,omitempty"`
+	// ContentEncoding is the encoding of the stored content, such as "gzip".
+	// The content is stored as sent, gzip-encoded objects are decompressed
+	// on download for clients that don't accept gzip.
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// DecompressedSize is the logical size of gzip-encoded objects, assigned
+	// by the server and returned in the X-Goog-Decompressed-Content-Length
+	// header of downloads. The stored size is always len(Content).
+	DecompressedSize int64 `json:"-"`
+	// StorageClass defaults to STANDARD.
+	StorageClass string `json:"storageClass,omitempty"`
+	// Generation is assigned by the server when the object is created, unless
+	// it's already set.
+	Generation int64 `json:"generation,omitempty,string"`
+	// Metageneration defaults to 1.
+	Metageneration int64 `json:"metageneration,omitempty,string"`
+	// EventBasedHold prevents the object from being deleted or overwritten
+	// through the API. New objects carry the hold when their bucket has
+	// DefaultEventBasedHold set.
+	EventBasedHold bool `json:"eventBasedHold,omitempty"`
+	// Retention is the object-level retention configuration. Objects can't be
+	// deleted or overwritten through the API until the retention expires.
+	Retention *ObjectRetention `json:"retention,omitempty"`
+	// ComponentCount is the number of components of composite objects,
+	// created with compose. It's zero for other objects.
+	ComponentCount int `json:"componentCount,omitempty"`
+	// TimeCreated is the time when the generation was created. It's assigned
+	// by the server, unless it's already set.
+	TimeCreated time.Time `json:"-"`
+	// TimeDeleted is the time when a noncurrent generation stopped being
+	// the live version of the object. It's zero for live objects.
+	TimeDeleted time.Time `json:"-"`
+	// SoftDeleteTime and HardDeleteTime are set in soft-deleted objects, to
+	// the time they were deleted and the time they'll be permanently
+	// deleted.
+	SoftDeleteTime time.Time `json:"-"`
+	HardDeleteTime time.Time `json:"-"`
+	// TimeStorageClassUpdated is the time when the storage class of the
+	// object last changed. It defaults to TimeCreated.
+	TimeStorageClassUpdated time.Time `json:"-"`
+	// ACL is the access control list of the object. Only the entity and
+	// the role of rules are stored, the other fields are derived from the
+	// entity, like in Cloud Storage.
+	ACL []storage.ACLRule `json:"-"`
+	// Metadata is the custom metadata of the object, sent in x-goog-meta-*
+	// headers in downloads.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// listedSize is the size of the content of objects listed without it,
+	// see listObjectsMetadata.
+	listedSize int64
+}
+
+// size returns the size of the content of the object, be it loaded or not.
+func (obj Object) size() int64 {
+	if obj.Content == nil {
+		return obj.listedSize
+	}
+	return int64(len(obj.Content))
+}
+
+// Retention modes of objects.
+const (
+	RetentionModeLocked   = "Locked"
+	RetentionModeUnlocked = "Unlocked"
+)
+
+// ObjectRetention is the retention configuration of an object. Locked
+// retention can't be removed nor shortened, while Unlocked retention can be
+// changed with the overrideUnlockedRetention parameter.
+type ObjectRetention struct {
+	Mode            string    `json:"mode"`
+	RetainUntilTime time.Time `json:"retainUntilTime"`
+}
+
+func (r *ObjectRetention) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Mode != RetentionModeLocked && r.Mode != RetentionModeUnlocked {
+		return &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("Invalid retention mode: %q", r.Mode),
+		}
+	}
+	return nil
 }
 
 func (o *Object) id() string {
@@ -37,7 +132,10 @@ func (o objectList) Len() int {
 }
 
 func (o objectList) Less(i int, j int) bool {
-	return o[i].Name < o[j].Name
+	if o[i].Name != o[j].Name {
+		return o[i].Name < o[j].Name
+	}
+	return o[i].Generation < o[j].Generation
 }
 
 func (o *objectList) Swap(i int, j int) {
@@ -49,25 +147,184 @@ func (o *objectList) Swap(i int, j int) {
 //
 // If the bucket within the object doesn't exist, it also creates it. If the
 // object already exists, it overrides the object.
-func (s *Server) CreateObject(obj Object) {
-	err := s.createObject(obj)
+func (s *Server) CreateObject(obj Object) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	_, err := s.createObject(obj)
+	return toStatusError(err)
+}
+
+// withDefaults fills the fields that are assigned by the server when the
+// object is created.
+func (obj Object) withDefaults() Object {
+	if obj.StorageClass == "" {
+		obj.StorageClass = "STANDARD"
+	}
+	if obj.Generation == 0 {
+		obj.Generation = time.Now().UnixNano() / 1000
+	}
+	if obj.Metageneration == 0 {
+		obj.Metageneration = 1
+	}
+	if obj.TimeCreated.IsZero() {
+		obj.TimeCreated = time.Now()
+	}
+	if obj.TimeStorageClassUpdated.IsZero() {
+		obj.TimeStorageClassUpdated = obj.TimeCreated
+	}
+	return obj
+}
+
+// createObject stores the object and returns it with the fields assigned by
+// the server.
+func (s *Server) createObject(obj Object) (Object, error) {
+	obj = obj.withDefaults()
+	existing, getErr := s.backend.GetObject(obj.BucketName, obj.Name)
+	if getErr == nil && existing.Generation == obj.Generation && strings.EqualFold(existing.ContentEncoding, obj.ContentEncoding) {
+		// metadata updates keep the content, and so its decompressed size.
+		obj.DecompressedSize = existing.DecompressedSize
+	} else {
+		obj = obj.withDecompressedSize()
+	}
+	if getErr != nil || existing.Generation != obj.Generation {
+		if bucket, err := s.backend.GetBucket(obj.BucketName); err == nil && bucket.DefaultEventBasedHold {
+			obj.EventBasedHold = true
+		}
+	}
+	if getErr != nil && s.consistency.enabled() {
+		s.consistency.objectCreated(obj)
+	}
+	err := s.backend.CreateObject(toBackendObjects([]Object{obj})[0])
 	if err != nil {
-		panic(err)
+		return obj, err
+	}
+	s.sizes.liveObjectStored(obj)
+	s.folderObjectCreated(obj)
+	switch {
+	case getErr != nil:
+		s.events.publish(ObjectFinalize, obj)
+	case existing.Generation == obj.Generation:
+		s.events.publish(ObjectMetadataUpdate, obj)
+	default:
+		if err := s.replaceObject(fromBackendObjects([]backend.Object{existing})[0]); err != nil {
+			return obj, err
+		}
+		s.events.publish(ObjectFinalize, obj)
+	}
+	return obj, nil
+}
+
+// writeObject stores an object written through the API, enforcing the
+// preconditions sent by the client, holds and quotas.
+func (s *Server) writeObject(obj Object, conds objectConditions) (Object, error) {
+	if err := obj.Retention.validate(); err != nil {
+		return obj, err
+	}
+	if err := s.checkBucketWritable(obj.BucketName, "storage.objects.create"); err != nil {
+		return obj, err
+	}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	existing, err := s.GetObject(obj.BucketName, obj.Name)
+	if err := conds.checkWrite(existing, err == nil); err != nil {
+		return obj, err
+	}
+	if err == nil {
+		if err := checkObjectHolds(existing); err != nil {
+			return obj, err
+		}
+	}
+	if s.quotas.enabled() {
+		if err := s.checkQuotas(obj); err != nil {
+			return obj, err
+		}
+	}
+	return s.createObject(obj)
+}
+
+// checkObjectHolds returns an error if the object can't be deleted or
+// overwritten, be it because of a hold or of its retention configuration.
+func checkObjectHolds(obj Object) error {
+	if obj.EventBasedHold {
+		return &statusError{
+			code:    http.StatusForbidden,
+			reason:  "forbidden",
+			message: fmt.Sprintf("Object '%s' is under active Event-Based hold and cannot be deleted, overwritten or archived until hold is removed.", obj.id()),
+		}
+	}
+	if obj.Retention != nil && time.Now().Before(obj.Retention.RetainUntilTime) {
+		return &statusError{
+			code:    http.StatusForbidden,
+			reason:  "retentionPolicyNotMet",
+			message: fmt.Sprintf("Object '%s' is subject to object retention and cannot be deleted, overwritten or archived until %s", obj.id(), obj.Retention.RetainUntilTime.UTC().Format(time.RFC3339)),
+		}
 	}
+	return nil
 }
 
-func (s *Server) createObject(obj Object) error {
-	return s.backend.CreateObject(toBackendObjects([]Object{obj})[0])
+// checkRetentionUpdate verifies that the retention of an object can be
+// changed from current to updated.
+func checkRetentionUpdate(obj Object, updated *ObjectRetention, override bool) error {
+	current := obj.Retention
+	if current == nil || time.Now().After(current.RetainUntilTime) {
+		return nil
+	}
+	relaxed := updated == nil || updated.RetainUntilTime.Before(current.RetainUntilTime) || updated.Mode != current.Mode
+	if !relaxed {
+		return nil
+	}
+	if current.Mode == RetentionModeUnlocked && override {
+		return nil
+	}
+	message := fmt.Sprintf("Object '%s' has a retention configuration in %s mode that can't be removed or reduced", obj.id(), current.Mode)
+	if current.Mode == RetentionModeUnlocked {
+		message = fmt.Sprintf("Object '%s' has an unlocked retention configuration; overrideUnlockedRetention is required to remove or reduce it", obj.id())
+	}
+	return &statusError{code: http.StatusForbidden, reason: "forbidden", message: message}
 }
 
 // ListObjects returns a sorted list of objects that match the given criteria,
-// or an error if the bucket doesn't exist.
+// or an error matching storage.ErrBucketNotExist if the bucket doesn't exist.
 func (s *Server) ListObjects(bucketName, prefix, delimiter string) ([]Object, []string, error) {
-	backendObjects, err := s.backend.ListObjects(bucketName)
+	backendObjects, prefixes, err := s.backend.ListObjectsWithPrefix(bucketName, prefix, delimiter)
+	if err != nil {
+		return nil, nil, bucketError(err)
+	}
+	return fromBackendObjects(backendObjects), prefixes, nil
+}
+
+// listObjectsMetadata works like ListObjects, without loading the content of
+// the objects when the backend supports it, see backend.MetadataLister. It's
+// meant for listings that only need the size of the objects, see
+// Object.size, and the listed objects must not be stored again.
+func (s *Server) listObjectsMetadata(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	lister, ok := s.backend.(backend.MetadataLister)
+	if !ok {
+		return s.ListObjects(bucketName, prefix, delimiter)
+	}
+	backendObjects, prefixes, err := lister.ListObjectsMetadata(bucketName, prefix, delimiter)
+	if err != nil {
+		return nil, nil, bucketError(err)
+	}
+	return fromBackendObjects(backendObjects), prefixes, nil
+}
+
+// listVisibleObjects lists objects taking into account the listing
+// propagation delay. Prefixes must be computed after applying the delay, so
+// the backend only filters by prefix.
+func (s *Server) listVisibleObjects(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	listed, _, err := s.listObjectsMetadata(bucketName, prefix, "")
 	if err != nil {
 		return nil, nil, err
 	}
-	objects := fromBackendObjects(backendObjects)
+	objects := s.consistency.visibleObjects(bucketName, listed)
+	objs, prefixes := filterObjects(objects, prefix, delimiter)
+	return objs, prefixes, nil
+}
+
+// filterObjects returns the sorted list of objects and prefixes that match
+// the given prefix and delimiter.
+func filterObjects(objects []Object, prefix, delimiter string) ([]Object, []string) {
 	olist := objectList(objects)
 	sort.Sort(&olist)
 	var respObjects []Object
@@ -77,7 +334,7 @@ func (s *Server) ListObjects(bucketName, prefix, delimiter string) ([]Object, []
 			objName := strings.Replace(obj.Name, prefix, "", 1)
 			delimPos := strings.Index(objName, delimiter)
 			if delimiter != "" && delimPos > -1 {
-				prefixes[obj.Name[:len(prefix)+delimPos+1]] = true
+				prefixes[obj.Name[:len(prefix)+delimPos+len(delimiter)]] = true
 			} else {
 				respObjects = append(respObjects, obj)
 			}
@@ -88,19 +345,42 @@ func (s *Server) ListObjects(bucketName, prefix, delimiter string) ([]Object, []
 		respPrefixes = append(respPrefixes, p)
 	}
 	sort.Strings(respPrefixes)
-	return respObjects, respPrefixes, nil
+	return respObjects, respPrefixes
 }
 
 func toBackendObjects(objects []Object) []backend.Object {
 	backendObjects := []backend.Object{}
 	for _, o := range objects {
-		backendObjects = append(backendObjects, backend.Object{
-			BucketName: o.BucketName,
-			Name:       o.Name,
-			Content:    o.Content,
-			Crc32c:     o.Crc32c,
-			Md5Hash:    o.Md5Hash,
-		})
+		obj := backend.Object{
+			BucketName:       o.BucketName,
+			Name:             o.Name,
+			Content:          o.Content,
+			Crc32c:           o.Crc32c,
+			Md5Hash:          o.Md5Hash,
+			ContentType:      o.ContentType,
+			ContentLanguage:  o.ContentLanguage,
+			CacheControl:     o.CacheControl,
+			ContentEncoding:  o.ContentEncoding,
+			DecompressedSize: o.DecompressedSize,
+			StorageClass:     o.StorageClass,
+			Generation:       o.Generation,
+			Metageneration:   o.Metageneration,
+			EventBasedHold:   o.EventBasedHold,
+			ComponentCount:   o.ComponentCount,
+			TimeCreated:      o.TimeCreated,
+			TimeDeleted:      o.TimeDeleted,
+			SoftDeleteTime:   o.SoftDeleteTime,
+			HardDeleteTime:   o.HardDeleteTime,
+			ACL:              toBackendACL(o.ACL),
+			Metadata:         o.Metadata,
+
+			TimeStorageClassUpdated: o.TimeStorageClassUpdated,
+		}
+		if o.Retention != nil {
+			obj.RetentionMode = o.Retention.Mode
+			obj.RetainUntilTime = o.Retention.RetainUntilTime
+		}
+		backendObjects = append(backendObjects, obj)
 	}
 	return backendObjects
 }
@@ -108,23 +388,47 @@ func toBackendObjects(objects []Object) []backend.Object {
 func fromBackendObjects(objects []backend.Object) []Object {
 	backendObjects := []Object{}
 	for _, o := range objects {
-		backendObjects = append(backendObjects, Object{
-			BucketName: o.BucketName,
-			Name:       o.Name,
-			Content:    o.Content,
-			Crc32c:     o.Crc32c,
-			Md5Hash:    o.Md5Hash,
-		})
+		obj := Object{
+			BucketName:       o.BucketName,
+			Name:             o.Name,
+			Content:          o.Content,
+			Crc32c:           o.Crc32c,
+			Md5Hash:          o.Md5Hash,
+			ContentType:      o.ContentType,
+			ContentLanguage:  o.ContentLanguage,
+			CacheControl:     o.CacheControl,
+			ContentEncoding:  o.ContentEncoding,
+			DecompressedSize: o.DecompressedSize,
+			StorageClass:     o.StorageClass,
+			Generation:       o.Generation,
+			Metageneration:   o.Metageneration,
+			EventBasedHold:   o.EventBasedHold,
+			ComponentCount:   o.ComponentCount,
+			TimeCreated:      o.TimeCreated,
+			TimeDeleted:      o.TimeDeleted,
+			SoftDeleteTime:   o.SoftDeleteTime,
+			HardDeleteTime:   o.HardDeleteTime,
+			ACL:              fromBackendACL(o.ACL),
+			Metadata:         o.Metadata,
+			listedSize:       o.Size,
+
+			TimeStorageClassUpdated: o.TimeStorageClassUpdated,
+		}
+		if o.RetentionMode != "" {
+			obj.Retention = &ObjectRetention{Mode: o.RetentionMode, RetainUntilTime: o.RetainUntilTime}
+		}
+		backendObjects = append(backendObjects, obj)
 	}
 	return backendObjects
 }
 
 // GetObject returns the object with the given name in the given bucket, or an
-// error if the object doesn't exist.
+// error matching storage.ErrObjectNotExist if the object doesn't exist
+// (storage.ErrBucketNotExist if the bucket doesn't exist).
 func (s *Server) GetObject(bucketName, objectName string) (Object, error) {
 	backendObj, err := s.backend.GetObject(bucketName, objectName)
 	if err != nil {
-		return Object{}, err
+		return Object{}, s.objectError(bucketName, objectName, err)
 	}
 	obj := fromBackendObjects([]backend.Object{backendObj})[0]
 	return obj, nil
@@ -134,22 +438,80 @@ func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
 	bucketName := mux.Vars(r)["bucketName"]
 	prefix := r.URL.Query().Get("prefix")
 	delimiter := r.URL.Query().Get("delimiter")
-	objs, prefixes, err := s.ListObjects(bucketName, prefix, delimiter)
+	var objs []Object
+	var prefixes []string
+	var err error
+	softDeleted := r.URL.Query().Get("softDeleted") == "true"
+	if softDeleted || r.URL.Query().Get("versions") == "true" {
+		objs, prefixes, err = s.listObjectVersions(bucketName, prefix, delimiter, softDeleted)
+	} else if s.consistency.enabled() {
+		objs, prefixes, err = s.listVisibleObjects(bucketName, prefix, delimiter)
+	} else {
+		objs, prefixes, err = s.listObjectsMetadata(bucketName, prefix, delimiter)
+	}
 	encoder := json.NewEncoder(w)
 	if err != nil {
+		if fault := backendFaultError(err); fault != nil {
+			writeStatusError(w, fault)
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		errResp := newErrorResponse(http.StatusNotFound, "Not Found", nil)
 		encoder.Encode(errResp)
 		return
 	}
+	if r.URL.Query().Get("includeFoldersAsPrefixes") == "true" {
+		if delimiter != "/" {
+			writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: "includeFoldersAsPrefixes is only supported when delimiter is '/'."})
+			return
+		}
+		if err := s.checkHNSBucket(bucketName); err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		prefixes = s.folderPrefixes(bucketName, prefix, prefixes)
+	}
 	encoder.Encode(newListObjectsResponse(objs, prefixes))
 }
 
+// getObject dispatches on the alt parameter, like the JSON API does: the
+// metadata is returned by default, and the content when alt=media.
 func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
+	switch alt := r.URL.Query().Get("alt"); alt {
+	case "", "json":
+		s.getObjectMetadata(w, r)
+	case "media":
+		s.downloadObject(w, r)
+	default:
+		message := fmt.Sprintf("Invalid value for parameter 'alt': %s", alt)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(newErrorResponse(http.StatusBadRequest, message, []apiError{
+			{Domain: "global", Reason: "invalidParameter", Message: message},
+		}))
+	}
+}
+
+func (s *Server) getObjectMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	generation, err := parseInt64Param(r, "generation")
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	encoder := json.NewEncoder(w)
-	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	var obj Object
+	if r.URL.Query().Get("softDeleted") == "true" {
+		obj, err = s.getSoftDeletedObject(vars["bucketName"], vars["objectName"], generation)
+	} else {
+		obj, _, err = s.getObjectGeneration(vars["bucketName"], vars["objectName"], generation)
+	}
 	if err != nil {
+		if fault := backendFaultError(err); fault != nil {
+			writeStatusError(w, fault)
+			return
+		}
 		errResp := newErrorResponse(http.StatusNotFound, "Not Found", nil)
 		w.WriteHeader(http.StatusNotFound)
 		encoder.Encode(errResp)
@@ -159,73 +521,549 @@ func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(newObjectResponse(obj))
 }
 
+// deleteObject handles a DELETE request for an object. Without the
+// generation parameter it deletes the live object, which becomes noncurrent
+// in buckets with versioning enabled. With the generation parameter it
+// permanently deletes that generation, be it live or noncurrent.
+//
+// Like in Cloud Storage, the request fails with 404 when the generation
+// doesn't exist, and with 412 when it exists but the preconditions don't
+// match it.
 func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	err := s.backend.DeleteObject(vars["bucketName"], vars["objectName"])
+	if err := s.checkBucketWritable(vars["bucketName"], "storage.objects.delete"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: err.Error()})
+		return
+	}
+	var generation int64
+	if conds.generation != nil {
+		generation = *conds.generation
+	}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	obj, live, err := s.getObjectGeneration(vars["bucketName"], vars["objectName"], generation)
 	if err != nil {
 		errResp := newErrorResponse(http.StatusNotFound, "Not Found", nil)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(errResp)
 		return
 	}
+	if err := conds.checkWrite(obj, true); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if err := checkObjectHolds(obj); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	switch {
+	case !live:
+		err = s.backend.DeleteNoncurrentObject(obj.BucketName, obj.Name, obj.Generation)
+		if err == nil {
+			s.sizes.noncurrentObjectDeleted(obj)
+			err = s.discardObject(obj)
+		}
+	case conds.generation != nil:
+		err = s.backend.DeleteObject(obj.BucketName, obj.Name)
+		if err == nil {
+			s.sizes.liveObjectDeleted(obj)
+			err = s.discardObject(obj)
+		}
+	default:
+		err = s.backend.DeleteObject(obj.BucketName, obj.Name)
+		if err == nil {
+			s.sizes.liveObjectDeleted(obj)
+			err = s.replaceObject(obj)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if live && s.consistency.enabled() {
+		s.consistency.objectDeleted(obj)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// patchObject handles a PATCH request to update the metadata of an object.
+// Fields omitted in the request are preserved.
+func (s *Server) patchObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.checkBucketWritable(vars["bucketName"], "storage.objects.update"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	if err != nil {
+		errResp := newErrorResponse(http.StatusNotFound, "Not Found", nil)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errResp)
+		return
+	}
+	var data struct {
+		ContentType     *string
+		ContentLanguage *string
+		CacheControl    *string
+		ContentEncoding *string
+		EventBasedHold  *bool
+		Retention       json.RawMessage
+		Metadata        json.RawMessage
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Retention != nil {
+		var retention *ObjectRetention
+		if err := json.Unmarshal(data.Retention, &retention); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := retention.validate(); err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		override := r.URL.Query().Get("overrideUnlockedRetention") == "true"
+		if err := checkRetentionUpdate(obj, retention, override); err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		obj.Retention = retention
+	}
+	if data.ContentType != nil {
+		obj.ContentType = *data.ContentType
+	}
+	if data.ContentLanguage != nil {
+		obj.ContentLanguage = *data.ContentLanguage
+	}
+	if data.CacheControl != nil {
+		obj.CacheControl = *data.CacheControl
+	}
+	if data.ContentEncoding != nil {
+		obj.ContentEncoding = *data.ContentEncoding
+	}
+	if data.EventBasedHold != nil {
+		obj.EventBasedHold = *data.EventBasedHold
+	}
+	if data.Metadata != nil {
+		// null removes all the custom metadata, while a map is merged
+		// into the existing metadata.
+		var metadata map[string]*string
+		if err := json.Unmarshal(data.Metadata, &metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if metadata == nil {
+			obj.Metadata = nil
+		} else {
+			obj.Metadata = patchMetadata(obj.Metadata, metadata)
+		}
+	}
+	obj.Metageneration++
+	obj, err = s.createObject(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(newObjectResponse(obj))
+}
+
+// rewriteState tracks a rewrite that takes more than one call to complete.
+type rewriteState struct {
+	obj     Object
+	conds   objectConditions
+	written int64
+}
+
+// rewriteObject copies an object. When the client sets
+// maxBytesRewrittenPerCall to less than the size of the object, the copy is
+// completed over multiple calls, linked by the rewrite token returned in each
+// response, like gsutil and gcloud expect.
 func (s *Server) rewriteObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	obj, err := s.GetObject(vars["sourceBucket"], vars["sourceObject"])
+	if err := s.checkBucketWritable(vars["destinationBucket"], "storage.objects.create"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	maxBytes, err := parseInt64Param(r, "maxBytesRewrittenPerCall")
 	if err != nil {
-		http.Error(w, "not found", http.StatusNotFound)
+		writeStatusError(w, err)
+		return
+	}
+	conds, err := parseDestinationConditions(r)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	var state *rewriteState
+	if token := r.URL.Query().Get("rewriteToken"); token != "" {
+		value, ok := s.rewrites.Load(token)
+		if !ok {
+			writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: "Invalid rewrite token"})
+			return
+		}
+		s.rewrites.Delete(token)
+		state = value.(*rewriteState)
+	} else {
+		obj, err := s.GetObject(vars["sourceBucket"], vars["sourceObject"])
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		// the content of stored objects is never modified, so the copy can
+		// share it with the source object.
+		newObject := Object{
+			BucketName:      vars["destinationBucket"],
+			Name:            vars["destinationObject"],
+			Content:         obj.Content,
+			Crc32c:          obj.Crc32c,
+			Md5Hash:         obj.Md5Hash,
+			ContentType:     obj.ContentType,
+			ContentLanguage: obj.ContentLanguage,
+			CacheControl:    obj.CacheControl,
+			ContentEncoding: obj.ContentEncoding,
+			StorageClass:    obj.StorageClass,
+			ComponentCount:  obj.ComponentCount,
+			Metadata:        obj.Metadata,
+		}
+		if err := applyRewriteMetadata(r, &newObject); err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		state = &rewriteState{obj: newObject, conds: conds}
+	}
+	size := int64(len(state.obj.Content))
+	if maxBytes > 0 && size-state.written > maxBytes {
+		state.written += maxBytes
+		token, err := s.ids.rewriteToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.rewrites.Store(token, state)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newPartialRewriteResponse(state.written, size, token))
+		return
+	}
+	previous, previousErr := s.GetObject(state.obj.BucketName, state.obj.Name)
+	newObject, err := s.writeObject(state.obj, state.conds)
+	if err != nil {
+		writeStatusError(w, err)
 		return
 	}
-	dstBucket := vars["destinationBucket"]
-	newObject := Object{
-		BucketName: dstBucket,
-		Name:       vars["destinationObject"],
-		Content:    append([]byte(nil), obj.Content...),
-		Crc32c:     obj.Crc32c,
-		Md5Hash:    obj.Md5Hash,
+	inPlace := vars["sourceBucket"] == vars["destinationBucket"] && vars["sourceObject"] == vars["destinationObject"]
+	if inPlace && previousErr == nil && previous.StorageClass != newObject.StorageClass {
+		// rewriting an object in place is how clients change its storage
+		// class, which tooling watching for transitions sees as a metadata
+		// update, on top of the finalize event of the new generation.
+		s.events.publish(ObjectMetadataUpdate, newObject)
 	}
-	s.CreateObject(newObject)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(newObjectRewriteResponse(newObject))
 }
 
+// applyRewriteMetadata applies the metadata of the destination object sent in
+// the body of a rewrite request, if any.
+func applyRewriteMetadata(r *http.Request, obj *Object) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var metadata struct {
+		ContentType     *string `json:"contentType"`
+		ContentLanguage *string `json:"contentLanguage"`
+		CacheControl    *string `json:"cacheControl"`
+		ContentEncoding *string `json:"contentEncoding"`
+		StorageClass    *string `json:"storageClass"`
+
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()}
+	}
+	if metadata.ContentType != nil {
+		obj.ContentType = *metadata.ContentType
+	}
+	if metadata.ContentLanguage != nil {
+		obj.ContentLanguage = *metadata.ContentLanguage
+	}
+	if metadata.CacheControl != nil {
+		obj.CacheControl = *metadata.CacheControl
+	}
+	if metadata.ContentEncoding != nil {
+		obj.ContentEncoding = *metadata.ContentEncoding
+	}
+	if metadata.StorageClass != nil {
+		obj.StorageClass = *metadata.StorageClass
+	}
+	if metadata.Metadata != nil {
+		obj.Metadata = metadata.Metadata
+	}
+	return nil
+}
+
+// downloadObject serves the content of an object. It handles all download
+// paths (XML API, JSON API and the download host path), so they all support
+// the same set of features.
 func (s *Server) downloadObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var generation int64
+	if conds.generation != nil {
+		generation = *conds.generation
+	}
+	obj, file, err := s.openObject(vars["bucketName"], vars["objectName"], generation)
 	if err != nil {
+		if fault := backendFaultError(err); fault != nil {
+			writeStatusError(w, fault)
+			return
+		}
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
+	size := int64(len(obj.Content))
+	if file != nil {
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		size = info.Size()
+	}
+	if status := conds.check(obj, http.StatusNotModified); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
 	status := http.StatusOK
-	start, end, content := s.handleRange(obj, r)
-	if len(content) != len(obj.Content) {
-		status = http.StatusPartialContent
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.Content)))
+	transcodedBody, transcoded := transcodedContent(obj, r)
+	var body io.Reader = bytes.NewReader(transcodedBody)
+	length := int64(len(transcodedBody))
+	partial := false
+	if !transcoded {
+		// ranges are ignored when transcoding, like in Cloud Storage.
+		body, length = bytes.NewReader(obj.Content), size
+		if file != nil {
+			body = file
+		}
+		start, end, ok, satisfiable := parseRange(r.Header.Get("Range"), int(size))
+		if ok && !satisfiable {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ok {
+			partial = true
+			status = http.StatusPartialContent
+			length = int64(end - start + 1)
+			if file != nil {
+				if _, err := file.Seek(int64(start), io.SeekStart); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else {
+				body = bytes.NewReader(obj.Content[start : end+1])
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		}
+	}
+	setObjectHeaders(w.Header(), obj)
+	// streamed objects have no content in memory.
+	w.Header().Set("X-Goog-Stored-Content-Length", strconv.FormatInt(size, 10))
+	setContentHeaders(w.Header(), obj)
+	if partial {
+		// the hashes describe the whole object, so they're omitted from
+		// partial responses, like in Cloud Storage.
+		w.Header().Del("X-Goog-Hash")
+	}
+	if obj.ContentEncoding != "" && !transcoded {
+		w.Header().Set("Content-Encoding", obj.ContentEncoding)
 	}
 	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
 	w.WriteHeader(status)
 	if r.Method == http.MethodGet {
-		w.Write(content)
+		s.recordCacheRead(obj)
+		// io.CopyN wraps the file in an io.LimitedReader, which the
+		// net/http server sends with sendfile(2) on the plain HTTP
+		// listener, where available.
+		s.copyDownload(w, r, obj, body, length)
 	}
 }
 
-func (s *Server) handleRange(obj Object, r *http.Request) (start, end int, content []byte) {
-	if reqRange := r.Header.Get("Range"); reqRange != "" {
-		parts := strings.SplitN(reqRange, "=", 2)
-		if len(parts) == 2 && parts[0] == "bytes" {
-			rangeParts := strings.SplitN(parts[1], "-", 2)
-			if len(rangeParts) == 2 {
-				start, _ = strconv.Atoi(rangeParts[0])
-				end, _ = strconv.Atoi(rangeParts[1])
-				if end < 1 {
-					end = len(obj.Content)
-				}
-				return start, end, obj.Content[start:end]
+// openObject returns the given generation of an object (or the live
+// generation when it's zero), along with a file for streaming its content,
+// when the backend supports it. The file is nil when the content is loaded
+// in the object. Gzip-encoded objects are always loaded, as they may need to
+// be transcoded.
+func (s *Server) openObject(bucketName, objectName string, generation int64) (Object, *os.File, error) {
+	opener, ok := s.backend.(backend.ObjectOpener)
+	if !ok || generation != 0 {
+		obj, _, err := s.getObjectGeneration(bucketName, objectName, generation)
+		return obj, nil, err
+	}
+	backendObj, file, err := opener.OpenObject(bucketName, objectName)
+	if err != nil {
+		return Object{}, nil, err
+	}
+	obj := fromBackendObjects([]backend.Object{backendObj})[0]
+	if file != nil && obj.isGzipEncoded() {
+		obj.Content, err = ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return Object{}, nil, err
+		}
+		file = nil
+	}
+	return obj, file, nil
+}
+
+// setObjectHeaders sets the x-goog-* headers GCS includes in media downloads
+// and in upload responses.
+func setObjectHeaders(h http.Header, obj Object) {
+	h.Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(obj.Metageneration, 10))
+	h.Set("X-Goog-Stored-Content-Length", strconv.Itoa(len(obj.Content)))
+	if obj.ContentEncoding != "" {
+		h.Set("X-Goog-Stored-Content-Encoding", obj.ContentEncoding)
+	} else {
+		h.Set("X-Goog-Stored-Content-Encoding", "identity")
+	}
+	if obj.DecompressedSize > 0 {
+		h.Set("X-Goog-Decompressed-Content-Length", strconv.FormatInt(obj.DecompressedSize, 10))
+	} else {
+		h.Del("X-Goog-Decompressed-Content-Length")
+	}
+	h.Set("X-Goog-Storage-Class", obj.StorageClass)
+	if obj.ComponentCount > 0 {
+		h.Set("X-Goog-Component-Count", strconv.Itoa(obj.ComponentCount))
+	} else {
+		h.Del("X-Goog-Component-Count")
+	}
+	h.Del("X-Goog-Hash")
+	if obj.Crc32c != "" {
+		h.Add("X-Goog-Hash", "crc32c="+obj.Crc32c)
+	}
+	if obj.Md5Hash != "" {
+		h.Add("X-Goog-Hash", "md5="+obj.Md5Hash)
+	}
+	for key, value := range obj.Metadata {
+		h.Set(metadataHeaderPrefix+key, value)
+	}
+}
+
+// metadataHeaderPrefix is the prefix of the headers carrying the custom
+// metadata of objects.
+const metadataHeaderPrefix = "X-Goog-Meta-"
+
+// metadataFromHeaders returns the custom metadata sent in x-goog-meta-*
+// headers, or nil if there's none.
+func metadataFromHeaders(h http.Header) map[string]string {
+	var metadata map[string]string
+	for key := range h {
+		if strings.HasPrefix(key, metadataHeaderPrefix) && len(key) > len(metadataHeaderPrefix) {
+			if metadata == nil {
+				metadata = make(map[string]string)
 			}
+			metadata[strings.ToLower(key[len(metadataHeaderPrefix):])] = h.Get(key)
+		}
+	}
+	return metadata
+}
+
+// patchMetadata merges the custom metadata sent in a patch request into the
+// metadata of an object. Keys set to null are removed.
+func patchMetadata(metadata map[string]string, patch map[string]*string) map[string]string {
+	merged := make(map[string]string, len(metadata)+len(patch))
+	for key, value := range metadata {
+		merged[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
 		}
 	}
-	return 0, 0, obj.Content
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// setContentHeaders sets the headers describing the content of the object in
+// media downloads.
+func setContentHeaders(h http.Header, obj Object) {
+	if obj.ContentType != "" {
+		h.Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentLanguage != "" {
+		h.Set("Content-Language", obj.ContentLanguage)
+	}
+	if obj.CacheControl != "" {
+		h.Set("Cache-Control", obj.CacheControl)
+	}
+}
+
+// parseRange parses the Range header of a download of an object with the given
+// size. Only single byte ranges are supported ("bytes=<start>-<end>",
+// "bytes=<start>-" and "bytes=-<suffix length>"), with inclusive ends, and
+// other values are ignored (ok is false). Ranges that start after the end of
+// the object are not satisfiable.
+func parseRange(header string, size int) (start, end int, ok, satisfiable bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return 0, 0, false, false
+	}
+	parts := strings.SplitN(strings.TrimSpace(header[len(prefix):]), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false, false
+	}
+	if parts[0] == "" {
+		suffix, err := strconv.Atoi(parts[1])
+		if err != nil || suffix < 0 {
+			return 0, 0, false, false
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true, true
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end = size - 1
+	if parts[1] != "" {
+		end, err = strconv.Atoi(parts[1])
+		if err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
 }
@@ -8,12 +8,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"hash/crc32"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -72,7 +79,9 @@ func TestServerClientObjectAttrsAfterCreateObject(t *testing.T) {
 			bucketName = "prod-bucket"
 			objectName = "video/hi-res/best_video_1080p.mp4"
 		)
-		server.CreateObject(Object{BucketName: bucketName, Name: objectName})
+		if err := server.CreateObject(Object{BucketName: bucketName, Name: objectName}); err != nil {
+			t.Fatal(err)
+		}
 		client := server.Client()
 		objHandle := client.Bucket(bucketName).Object(objectName)
 		attrs, err := objHandle.Attrs(context.TODO())
@@ -191,9 +200,9 @@ func TestServerClientObjectRangeReader(t *testing.T) {
 			t.Run(test.testCase, func(t *testing.T) {
 				length := test.length
 				if length == -1 {
-					length = int64(len(content)) - test.offset + 1
+					length = int64(len(content)) - test.offset
 				}
-				expectedData := content[test.offset : test.offset+length-1]
+				expectedData := content[test.offset : test.offset+length]
 				client := server.Client()
 				objHandle := client.Bucket(bucketName).Object(objectName)
 				reader, err := objHandle.NewRangeReader(context.TODO(), test.offset, test.length)
@@ -224,7 +233,9 @@ func TestServerClientObjectReaderAfterCreateObject(t *testing.T) {
 	}
 
 	runServersTest(t, objs, func(t *testing.T, server *Server) {
-		server.CreateObject(Object{BucketName: bucketName, Name: objectName, Content: []byte(content)})
+		if err := server.CreateObject(Object{BucketName: bucketName, Name: objectName, Content: []byte(content)}); err != nil {
+			t.Fatal(err)
+		}
 		client := server.Client()
 		objHandle := client.Bucket(bucketName).Object(objectName)
 		reader, err := objHandle.NewReader(context.TODO())
@@ -294,7 +305,9 @@ func TestServiceClientListObjects(t *testing.T) {
 	}
 
 	runServersTest(t, objs, func(t *testing.T, server *Server) {
-		server.CreateBucket("empty-bucket")
+		if err := server.CreateBucket("empty-bucket"); err != nil {
+			t.Fatal(err)
+		}
 		tests := []struct {
 			testCase         string
 			bucketName       string
@@ -421,7 +434,9 @@ func TestServiceClientRewriteObject(t *testing.T) {
 	}
 
 	runServersTest(t, objs, func(t *testing.T, server *Server) {
-		server.CreateBucket("empty-bucket")
+		if err := server.CreateBucket("empty-bucket"); err != nil {
+			t.Fatal(err)
+		}
 		tests := []struct {
 			testCase   string
 			bucketName string
@@ -487,6 +502,77 @@ func TestServiceClientRewriteObject(t *testing.T) {
 	})
 }
 
+func TestServerRewriteObjectMultipleCalls(t *testing.T) {
+	const content = "some content that takes multiple calls to rewrite"
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "files/some-file.txt", Content: []byte(content), ContentType: "text/plain"},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		client := server.HTTPClient()
+		const rewriteURL = "https://www.googleapis.com/storage/v1/b/some-bucket/o/files/some-file.txt/rewriteTo/b/some-bucket/o/files/copy.txt?maxBytesRewrittenPerCall=20"
+		var calls int
+		token := ""
+		for {
+			calls++
+			url := rewriteURL
+			if token != "" {
+				url += "&rewriteToken=" + token
+			}
+			resp, err := client.Post(url, "application/json", strings.NewReader(`{"contentType":"text/csv"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rewriteResp struct {
+				Done                bool
+				RewriteToken        string
+				TotalBytesRewritten int64 `json:",string"`
+				ObjectSize          int64 `json:",string"`
+				Resource            *struct{ ContentType string }
+			}
+			err = json.NewDecoder(resp.Body).Decode(&rewriteResp)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rewriteResp.ObjectSize != int64(len(content)) {
+				t.Errorf("wrong object size\nwant %d\ngot  %d", len(content), rewriteResp.ObjectSize)
+			}
+			if rewriteResp.Done {
+				if rewriteResp.Resource == nil || rewriteResp.Resource.ContentType != "text/csv" {
+					t.Errorf("wrong resource in the final response: %+v", rewriteResp.Resource)
+				}
+				break
+			}
+			if rewriteResp.Resource != nil {
+				t.Error("unexpected resource in a partial response")
+			}
+			if _, err := server.GetObject("some-bucket", "files/copy.txt"); err == nil {
+				t.Fatal("object created before the rewrite is done")
+			}
+			token = rewriteResp.RewriteToken
+		}
+		if calls != 3 {
+			t.Errorf("wrong number of calls\nwant 3\ngot  %d", calls)
+		}
+		obj, err := server.GetObject("some-bucket", "files/copy.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, obj.Content)
+		}
+
+		resp, err := client.Post(rewriteURL+"&rewriteToken=invalid", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wrong status for invalid token\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
 func TestServerClientObjectDelete(t *testing.T) {
 	const (
 		bucketName = "some-bucket"
@@ -545,3 +631,266 @@ func TestServerClientObjectDeleteErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestServerGetObjectAltParameter(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "files/some-file.txt", Content: []byte("some content"), ContentType: "text/plain"},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		tests := []struct {
+			testCase            string
+			url                 string
+			expectedStatus      int
+			expectedContentType string
+			expectedBody        string
+		}{
+			{
+				"default",
+				"https://www.googleapis.com/storage/v1/b/some-bucket/o/files/some-file.txt",
+				http.StatusOK,
+				"application/json; charset=UTF-8",
+				"",
+			},
+			{
+				"json",
+				"https://storage.googleapis.com/storage/v1/b/some-bucket/o/files/some-file.txt?alt=json",
+				http.StatusOK,
+				"application/json; charset=UTF-8",
+				"",
+			},
+			{
+				"media",
+				"https://storage.googleapis.com/storage/v1/b/some-bucket/o/files/some-file.txt?alt=media",
+				http.StatusOK,
+				"text/plain",
+				"some content",
+			},
+			{
+				"unknown",
+				"https://www.googleapis.com/storage/v1/b/some-bucket/o/files/some-file.txt?alt=proto",
+				http.StatusBadRequest,
+				"application/json; charset=UTF-8",
+				"",
+			},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.testCase, func(t *testing.T) {
+				resp, err := server.HTTPClient().Get(test.url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != test.expectedStatus {
+					t.Errorf("wrong status returned\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+				}
+				if contentType := resp.Header.Get("Content-Type"); contentType != test.expectedContentType {
+					t.Errorf("wrong content type\nwant %q\ngot  %q", test.expectedContentType, contentType)
+				}
+				data, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.expectedBody != "" && string(data) != test.expectedBody {
+					t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, data)
+				}
+				if test.expectedStatus == http.StatusOK && test.expectedBody == "" {
+					var obj objectResponse
+					if err := json.Unmarshal(data, &obj); err != nil {
+						t.Fatal(err)
+					}
+					if obj.Name != "files/some-file.txt" {
+						t.Errorf("wrong object name\nwant %q\ngot  %q", "files/some-file.txt", obj.Name)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestServerObjectRetention(t *testing.T) {
+	const bucketName = "worm-bucket"
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	objs := []Object{
+		{BucketName: bucketName, Name: "locked.txt", Retention: &ObjectRetention{Mode: RetentionModeLocked, RetainUntilTime: future}},
+		{BucketName: bucketName, Name: "unlocked.txt", Retention: &ObjectRetention{Mode: RetentionModeUnlocked, RetainUntilTime: future}},
+		{BucketName: bucketName, Name: "expired.txt", Retention: &ObjectRetention{Mode: RetentionModeLocked, RetainUntilTime: time.Now().Add(-time.Hour)}},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+		for _, name := range []string{"locked.txt", "unlocked.txt"} {
+			err := bucket.Object(name).Delete(ctx)
+			if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusForbidden {
+				t.Errorf("wrong error deleting %s: %v", name, err)
+			}
+			w := bucket.Object(name).NewWriter(ctx)
+			w.Write([]byte("overwritten"))
+			err = w.Close()
+			if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusForbidden {
+				t.Errorf("wrong error overwriting %s: %v", name, err)
+			}
+		}
+		if err := bucket.Object("expired.txt").Delete(ctx); err != nil {
+			t.Errorf("unexpected error deleting object with expired retention: %v", err)
+		}
+
+		patch := func(name, query, body string) (int, objectResponse) {
+			url := "https://www.googleapis.com/storage/v1/b/" + bucketName + "/o/" + name + query
+			req, err := http.NewRequest(http.MethodPatch, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var obj objectResponse
+			json.NewDecoder(resp.Body).Decode(&obj)
+			return resp.StatusCode, obj
+		}
+		tests := []struct {
+			testCase       string
+			objectName     string
+			query          string
+			body           string
+			expectedStatus int
+		}{
+			{"remove locked retention", "locked.txt", "", `{"retention": null}`, http.StatusForbidden},
+			{"shorten locked retention", "locked.txt", "?overrideUnlockedRetention=true", `{"retention": {"mode": "Locked", "retainUntilTime": "2001-01-01T00:00:00Z"}}`, http.StatusForbidden},
+			{"extend locked retention", "locked.txt", "", `{"retention": {"mode": "Locked", "retainUntilTime": "` + future.Add(time.Hour).Format(time.RFC3339) + `"}}`, http.StatusOK},
+			{"invalid mode", "locked.txt", "", `{"retention": {"mode": "Forever", "retainUntilTime": "2001-01-01T00:00:00Z"}}`, http.StatusBadRequest},
+			{"remove unlocked retention without override", "unlocked.txt", "", `{"retention": null}`, http.StatusForbidden},
+			{"remove unlocked retention with override", "unlocked.txt", "?overrideUnlockedRetention=true", `{"retention": null}`, http.StatusOK},
+		}
+		for _, test := range tests {
+			status, _ := patch(test.objectName, test.query, test.body)
+			if status != test.expectedStatus {
+				t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.testCase, test.expectedStatus, status)
+			}
+		}
+
+		status, obj := patch("locked.txt", "", `{"cacheControl": "no-cache"}`)
+		if status != http.StatusOK {
+			t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+		expectedUntil := future.Add(time.Hour).Format(time.RFC3339Nano)
+		if obj.Retention == nil || obj.Retention.Mode != RetentionModeLocked || obj.Retention.RetainUntilTime != expectedUntil {
+			t.Errorf("wrong retention returned\nwant Locked until %s\ngot  %#v", expectedUntil, obj.Retention)
+		}
+		if err := bucket.Object("unlocked.txt").Delete(ctx); err != nil {
+			t.Errorf("unexpected error deleting object after removing its retention: %v", err)
+		}
+	})
+}
+
+func TestServerRangedDownloadHeaders(t *testing.T) {
+	runServersTest(t, rangedDownloadObjects, testRangedDownloadHeaders)
+}
+
+func TestServerRangedDownloadHeadersFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakestorage-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{StorageRoot: dir, InitialObjects: rangedDownloadObjects})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	testRangedDownloadHeaders(t, server)
+}
+
+func TestServerListObjectsSizesFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakestorage-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{StorageRoot: dir, InitialObjects: rangedDownloadObjects, NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := server.Client().Bucket("some-bucket").Objects(context.Background(), nil)
+	attrs, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len(rangedDownloadContent)) {
+		t.Errorf("wrong size of listed object\nwant %d\ngot  %d", len(rangedDownloadContent), attrs.Size)
+	}
+	if attrs.MD5 == nil || attrs.CRC32C == 0 {
+		t.Errorf("missing hashes of listed object: %+v", attrs)
+	}
+}
+
+const rangedDownloadContent = "some really nice content"
+
+var rangedDownloadObjects = []Object{{
+	BucketName: "some-bucket",
+	Name:       "object.txt",
+	Content:    []byte(rangedDownloadContent),
+	Crc32c:     encodedCrc32cChecksum([]byte(rangedDownloadContent)),
+	Md5Hash:    encodedMd5Hash([]byte(rangedDownloadContent)),
+}}
+
+func testRangedDownloadHeaders(t *testing.T, server *Server) {
+	const content = rangedDownloadContent
+	var tests = []struct {
+		rangeHeader          string
+		expectedStatus       int
+		expectedContentRange string
+		expectedContent      string
+	}{
+		{"", http.StatusOK, "", content},
+		{"bytes=5-10", http.StatusPartialContent, "bytes 5-10/24", "really"},
+		{"bytes=20-", http.StatusPartialContent, "bytes 20-23/24", "tent"},
+		{"bytes=-4", http.StatusPartialContent, "bytes 20-23/24", "tent"},
+		{"bytes=0-100", http.StatusPartialContent, "bytes 0-23/24", content},
+		{"bytes=0-", http.StatusPartialContent, "bytes 0-23/24", content},
+		{"bytes=30-40", http.StatusRequestedRangeNotSatisfiable, "bytes */24", ""},
+		{"bytes=10-5", http.StatusOK, "", content},
+		{"items=0-5", http.StatusOK, "", content},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/some-bucket/object.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%q: wrong status code\nwant %d\ngot  %d", test.rangeHeader, test.expectedStatus, resp.StatusCode)
+		}
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != test.expectedContentRange {
+			t.Errorf("%q: wrong Content-Range\nwant %q\ngot  %q", test.rangeHeader, test.expectedContentRange, contentRange)
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		if string(data) != test.expectedContent {
+			t.Errorf("%q: wrong content\nwant %q\ngot  %q", test.rangeHeader, test.expectedContent, string(data))
+		}
+		if contentLength := resp.Header.Get("Content-Length"); contentLength != strconv.Itoa(len(test.expectedContent)) {
+			t.Errorf("%q: wrong Content-Length\nwant %d\ngot  %s", test.rangeHeader, len(test.expectedContent), contentLength)
+		}
+		hashes := resp.Header["X-Goog-Hash"]
+		if partial := resp.StatusCode == http.StatusPartialContent; partial && len(hashes) > 0 {
+			t.Errorf("%q: unexpected hashes in partial response: %v", test.rangeHeader, hashes)
+		} else if !partial && len(hashes) != 2 {
+			t.Errorf("%q: wrong hashes in full response: %v", test.rangeHeader, hashes)
+		}
+	}
+}
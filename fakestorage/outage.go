@@ -0,0 +1,131 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultBucketLocation is the location of buckets created without one, like
+// in Cloud Storage.
+const defaultBucketLocation = "US"
+
+// bucketLocation normalizes the location of a bucket, which is case
+// insensitive.
+func bucketLocation(location string) string {
+	if location == "" {
+		return defaultBucketLocation
+	}
+	return strings.ToUpper(location)
+}
+
+// outageState tracks the locations with simulated outages, and when each
+// outage ends. A zero end time means the outage lasts until it's ended
+// explicitly.
+type outageState struct {
+	mtx       sync.Mutex
+	locations map[string]time.Time
+}
+
+// SimulateOutage makes all requests targeting buckets in the given location
+// fail with 503 for the given duration, or until EndOutage is called when
+// the duration is zero. Locations are case insensitive.
+//
+// The same can be done with a PUT request to /_internal/outages/<location>,
+// optionally with a JSON body such as {"duration": "30s"}, and an outage can
+// be ended with a DELETE request to the same path.
+func (s *Server) SimulateOutage(location string, duration time.Duration) {
+	var end time.Time
+	if duration > 0 {
+		end = time.Now().Add(duration)
+	}
+	s.outages.mtx.Lock()
+	defer s.outages.mtx.Unlock()
+	if s.outages.locations == nil {
+		s.outages.locations = make(map[string]time.Time)
+	}
+	s.outages.locations[strings.ToUpper(location)] = end
+}
+
+// EndOutage ends the simulated outage of the given location, if any.
+func (s *Server) EndOutage(location string) {
+	s.outages.mtx.Lock()
+	defer s.outages.mtx.Unlock()
+	delete(s.outages.locations, strings.ToUpper(location))
+}
+
+func (st *outageState) active(location string) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	end, ok := st.locations[strings.ToUpper(location)]
+	if !ok {
+		return false
+	}
+	if !end.IsZero() && time.Now().After(end) {
+		delete(st.locations, strings.ToUpper(location))
+		return false
+	}
+	return true
+}
+
+func (st *outageState) any() bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return len(st.locations) > 0
+}
+
+func (s *Server) outageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) || !s.outages.any() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, bucketName := range s.requestBuckets(r) {
+			bucket, err := s.backend.GetBucket(bucketName)
+			if err == nil && s.outages.active(bucketLocation(bucket.Location)) {
+				writeStatusError(w, &statusError{
+					code:    http.StatusServiceUnavailable,
+					reason:  "backendError",
+					message: "We encountered an internal error. Please try again.",
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) simulateOutageByPut(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Duration string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if data.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(data.Duration)
+		if err != nil || duration < 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	s.SimulateOutage(mux.Vars(r)["location"], duration)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) endOutageByDelete(w http.ResponseWriter, r *http.Request) {
+	s.EndOutage(mux.Vars(r)["location"])
+	w.WriteHeader(http.StatusNoContent)
+}
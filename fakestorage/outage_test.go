@@ -0,0 +1,119 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerSimulateOutage(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "europe-bucket", Location: "europe-west1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "europe-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "us-bucket", Name: "object.txt", Content: []byte("other content")}); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		get := func(url string) int {
+			t.Helper()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		const europeObject = "https://www.googleapis.com/storage/v1/b/europe-bucket/o/object.txt"
+		const usObject = "https://www.googleapis.com/storage/v1/b/us-bucket/o/object.txt"
+
+		server.SimulateOutage("EUROPE-WEST1", 0)
+		if status := get(europeObject); status != http.StatusServiceUnavailable {
+			t.Errorf("wrong status during outage\nwant %d\ngot  %d", http.StatusServiceUnavailable, status)
+		}
+		if status := get("https://storage.googleapis.com/europe-bucket/object.txt"); status != http.StatusServiceUnavailable {
+			t.Errorf("wrong status downloading during outage\nwant %d\ngot  %d", http.StatusServiceUnavailable, status)
+		}
+		req, _ := http.NewRequest(http.MethodPost, "https://www.googleapis.com/storage/v1/b/europe-bucket/o/object.txt/rewriteTo/b/us-bucket/o/copy.txt", strings.NewReader("{}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("wrong status copying from a bucket in outage\nwant %d\ngot  %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if status := get(usObject); status != http.StatusOK {
+			t.Errorf("wrong status in other location\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+
+		server.EndOutage("europe-west1")
+		if status := get(europeObject); status != http.StatusOK {
+			t.Errorf("wrong status after outage\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+	})
+}
+
+func TestServerSimulateOutageExpires(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	server.SimulateOutage("us", 50*time.Millisecond)
+	if !server.outages.active("US") {
+		t.Fatal("outage not active")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if server.outages.active("US") {
+		t.Error("outage still active after its duration")
+	}
+}
+
+func TestServerOutageAdminEndpoint(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		do := func(method, url, body string) *http.Response {
+			t.Helper()
+			req, err := http.NewRequest(method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+		const adminURL = "https://www.googleapis.com/_internal/outages/us"
+		const bucketURL = "https://www.googleapis.com/storage/v1/b/some-bucket"
+
+		if resp := do(http.MethodPut, adminURL, `{"duration":"1h"}`); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("wrong status starting outage\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+		}
+		if resp := do(http.MethodGet, bucketURL, ""); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("wrong status during outage\nwant %d\ngot  %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if resp := do(http.MethodDelete, adminURL, ""); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("wrong status ending outage\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+		}
+		if resp := do(http.MethodGet, bucketURL, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("wrong status after outage\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp := do(http.MethodPut, adminURL, `{"duration":"soon"}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wrong status for invalid duration\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"sync"
+	"time"
+)
+
+// periodicTask runs a function periodically in a background goroutine,
+// between calls to start and stop. The background work of the server, such
+// as the expiration of objects and the inventory reports, is built on it.
+type periodicTask struct {
+	mtx  sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+// start runs fn every interval, with the time of the tick, until stop is
+// called. It does nothing if the task is already running.
+func (t *periodicTask) start(interval time.Duration, fn func(now time.Time)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.quit != nil {
+		return
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	t.quit = quit
+	t.done = done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				fn(now)
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the task, waiting for the current run of fn to finish. It does
+// nothing if the task isn't running.
+func (t *periodicTask) stop() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.quit == nil {
+		return
+	}
+	close(t.quit)
+	<-t.done
+	t.quit = nil
+	t.done = nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import "time"
+
+// flusher is implemented by backends that keep their state in memory and
+// persist it on demand.
+type flusher interface {
+	Flush() error
+}
+
+// Flush persists the state of the server to Options.PersistenceDir. It's a
+// no-op for servers without a PersistenceDir, and when nothing changed since
+// the last flush.
+func (s *Server) Flush() error {
+	if f, ok := s.backend.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// startPersister starts the periodic flushes of the backend, if the server
+// has a PersistenceDir and a PersistenceInterval.
+func (s *Server) startPersister() {
+	interval := s.options.PersistenceInterval
+	if _, ok := s.backend.(flusher); !ok || interval <= 0 {
+		return
+	}
+	s.persister.start(interval, func(time.Time) {
+		s.Flush()
+	})
+}
+
+// stopPersister stops the periodic flushes, and flushes the backend one last
+// time.
+func (s *Server) stopPersister() error {
+	s.persister.stop()
+	return s.Flush()
+}
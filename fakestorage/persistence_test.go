@@ -0,0 +1,77 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerPersistenceWarmStart(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fakestorage-persistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "state")
+
+	server, err := NewServerWithOptions(Options{PersistenceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	writeObjectContent(t, server.Client().Bucket("some-bucket").Object("object.txt"), "some content")
+	server.Stop()
+
+	restarted, err := NewServerWithOptions(Options{PersistenceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	content := readObjectContent(t, restarted.Client().Bucket("some-bucket").Object("object.txt"))
+	if content != "some content" {
+		t.Errorf("wrong content after restart\nwant %q\ngot  %q", "some content", content)
+	}
+}
+
+func TestServerPersistenceInterval(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fakestorage-persistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "state")
+
+	server, err := NewServerWithOptions(Options{NoListener: true, PersistenceDir: dir, PersistenceInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "some-bucket", "object.txt")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state was not flushed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerPersistenceWithStorageRoot(t *testing.T) {
+	_, err := NewServerWithOptions(Options{NoListener: true, StorageRoot: os.TempDir(), PersistenceDir: os.TempDir()})
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+}
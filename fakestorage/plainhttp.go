@@ -0,0 +1,52 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+)
+
+type plainHTTPKey struct{}
+
+// plainHTTPHandler returns the handler of the plain HTTP listener, marking
+// its requests so responses can point to the same listener.
+func (s *Server) plainHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), plainHTTPKey{}, true)))
+	})
+}
+
+func isPlainHTTPRequest(r *http.Request) bool {
+	plain, _ := r.Context().Value(plainHTTPKey{}).(bool)
+	return plain
+}
+
+// startHTTPListener starts a plain HTTP server for the API on the given host
+// and port.
+func (s *Server) startHTTPListener(host string, port uint16) (*httptest.Server, error) {
+	ts, err := newUnstartedListener(host, port, s.plainHTTPHandler())
+	if err != nil {
+		return nil, err
+	}
+	ts.Start()
+	return ts, nil
+}
+
+// HTTPURL returns the URL of the plain HTTP listener of the server, such as
+// http://127.0.0.1:8080. It's empty when the server doesn't have one (see
+// Options.HTTPPort) or isn't running.
+func (s *Server) HTTPURL() string {
+	if s.parent != nil {
+		return s.parent.HTTPURL()
+	}
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	if s.httpTS != nil {
+		return s.httpTS.URL
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerHTTPListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPort := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	server, err := NewServerWithOptions(Options{Host: "127.0.0.1", HTTPPort: httpPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	expectedURL := fmt.Sprintf("http://127.0.0.1:%d", httpPort)
+	if httpURL := server.HTTPURL(); httpURL != expectedURL {
+		t.Fatalf("wrong http url\nwant %q\ngot  %q", expectedURL, httpURL)
+	}
+
+	// objects uploaded over plain HTTP are visible over HTTPS.
+	resp, err := http.Post(server.HTTPURL()+"/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=object.txt", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, expectedURL+"/upload/resumable/") {
+		t.Fatalf("wrong location for the resumable upload: %q", location)
+	}
+	req, err := http.NewRequest(http.MethodPut, location, strings.NewReader("some content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	reader, err := server.Client().Bucket("some-bucket").Object("object.txt").NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "some content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "some content", data)
+	}
+
+	// resumable uploads started over HTTPS keep pointing to the HTTPS
+	// listener.
+	resp, err = server.HTTPClient().Post(server.URL()+"/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=other.txt", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); !strings.HasPrefix(location, server.URL()+"/") {
+		t.Errorf("wrong location for the resumable upload over https: %q", location)
+	}
+
+	server.Stop()
+	if httpURL := server.HTTPURL(); httpURL != "" {
+		t.Errorf("unexpected http url of stopped server: %q", httpURL)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if httpURL := server.HTTPURL(); httpURL != expectedURL {
+		t.Errorf("wrong http url after restart\nwant %q\ngot  %q", expectedURL, httpURL)
+	}
+}
+
+func TestServerWithoutHTTPListener(t *testing.T) {
+	server, err := NewServerWithOptions(Options{Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if httpURL := server.HTTPURL(); httpURL != "" {
+		t.Errorf("unexpected http url: %q", httpURL)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Quotas define the limits enforced by the server when objects are written
+// through the API. Objects created with the Go helpers (such as CreateObject)
+// are not subject to quotas.
+//
+// The zero value of each field means unlimited.
+type Quotas struct {
+	// MaxObjectSize is the maximum size of a single object, in bytes.
+	MaxObjectSize int64
+
+	// MaxObjectsPerBucket is the maximum number of objects in each bucket.
+	MaxObjectsPerBucket int
+
+	// MaxTotalBytes is the maximum number of bytes stored in the server,
+	// across all buckets. Noncurrent generations and soft-deleted objects
+	// that are still retained count, as they take up storage.
+	MaxTotalBytes int64
+}
+
+func (q Quotas) enabled() bool {
+	return q.MaxObjectSize > 0 || q.MaxObjectsPerBucket > 0 || q.MaxTotalBytes > 0
+}
+
+func (s *Server) checkObjectSize(size int64) error {
+	if s.quotas.MaxObjectSize > 0 && size > s.quotas.MaxObjectSize {
+		return &statusError{
+			code:    http.StatusRequestEntityTooLarge,
+			reason:  "entityTooLarge",
+			message: fmt.Sprintf("object size %d exceeds the maximum object size of %d bytes", size, s.quotas.MaxObjectSize),
+		}
+	}
+	return nil
+}
+
+// checkQuotas verifies that storing obj doesn't exceed the configured quotas,
+// taking into account that obj may replace an existing object. Sizes come
+// from sizeIndex, so objects aren't loaded on each write.
+//
+// Callers must hold writeMtx.
+func (s *Server) checkQuotas(obj Object) error {
+	if err := s.checkObjectSize(int64(len(obj.Content))); err != nil {
+		return err
+	}
+	if s.quotas.MaxObjectsPerBucket == 0 && s.quotas.MaxTotalBytes == 0 {
+		return nil
+	}
+	sizes, err := s.bucketSizes(obj.BucketName)
+	if err != nil {
+		return err
+	}
+	if s.quotas.MaxObjectsPerBucket > 0 {
+		count := len(sizes.live)
+		if _, ok := sizes.live[obj.Name]; ok {
+			count--
+		}
+		if count >= s.quotas.MaxObjectsPerBucket {
+			return &statusError{
+				code:    http.StatusForbidden,
+				reason:  "quotaExceeded",
+				message: fmt.Sprintf("bucket %s exceeds the maximum of %d objects", obj.BucketName, s.quotas.MaxObjectsPerBucket),
+			}
+		}
+	}
+	if s.quotas.MaxTotalBytes > 0 {
+		total, err := s.storedBytes(obj)
+		if err != nil {
+			return err
+		}
+		if total > s.quotas.MaxTotalBytes {
+			return &statusError{
+				code:    http.StatusForbidden,
+				reason:  "quotaExceeded",
+				message: fmt.Sprintf("storing object %s exceeds the storage quota of %d bytes", obj.id(), s.quotas.MaxTotalBytes),
+			}
+		}
+	}
+	return nil
+}
+
+// storedBytes returns the number of bytes stored in the server once obj is
+// written: all the generations of the objects in every bucket, including the
+// soft-deleted ones that are still retained, and obj itself. The generation
+// replaced by obj only stops counting if its bucket discards it, instead of
+// keeping it as a noncurrent or soft-deleted generation.
+//
+// Callers must hold writeMtx.
+func (s *Server) storedBytes(obj Object) (int64, error) {
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	total := int64(len(obj.Content))
+	for _, bucket := range buckets {
+		sizes, err := s.bucketSizes(bucket.Name)
+		if err != nil {
+			return 0, err
+		}
+		total += sizes.storedBytes(now)
+		if bucket.Name != obj.BucketName || bucket.VersioningEnabled || bucket.SoftDeleteRetention > 0 {
+			continue
+		}
+		if replaced, ok := sizes.live[obj.Name]; ok {
+			total -= replaced.size
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientObjectWriterQuotas(t *testing.T) {
+	tests := []struct {
+		testCase       string
+		quotas         Quotas
+		objects        []Object
+		objectName     string
+		content        string
+		expectedStatus int
+	}{
+		{
+			"object within the size limit",
+			Quotas{MaxObjectSize: 10},
+			nil,
+			"small.txt",
+			"small",
+			http.StatusOK,
+		},
+		{
+			"object larger than the size limit",
+			Quotas{MaxObjectSize: 10},
+			nil,
+			"large.txt",
+			"some large content",
+			http.StatusRequestEntityTooLarge,
+		},
+		{
+			"new object beyond the bucket object count",
+			Quotas{MaxObjectsPerBucket: 1},
+			[]Object{{BucketName: "some-bucket", Name: "existing.txt"}},
+			"new.txt",
+			"content",
+			http.StatusForbidden,
+		},
+		{
+			"overwrite within the bucket object count",
+			Quotas{MaxObjectsPerBucket: 1},
+			[]Object{{BucketName: "some-bucket", Name: "existing.txt"}},
+			"existing.txt",
+			"content",
+			http.StatusOK,
+		},
+		{
+			"object count in other buckets",
+			Quotas{MaxObjectsPerBucket: 1},
+			[]Object{{BucketName: "other-bucket", Name: "existing.txt"}},
+			"new.txt",
+			"content",
+			http.StatusOK,
+		},
+		{
+			"object beyond the storage quota",
+			Quotas{MaxTotalBytes: 10},
+			[]Object{{BucketName: "other-bucket", Name: "existing.txt", Content: []byte("12345678")}},
+			"new.txt",
+			"123",
+			http.StatusForbidden,
+		},
+		{
+			"overwrite within the storage quota",
+			Quotas{MaxTotalBytes: 10},
+			[]Object{{BucketName: "some-bucket", Name: "existing.txt", Content: []byte("12345678")}},
+			"existing.txt",
+			"1234567890",
+			http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.testCase, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				InitialObjects: test.objects,
+				Quotas:         test.quotas,
+				NoListener:     true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := server.CreateBucket("some-bucket"); err != nil {
+				t.Fatal(err)
+			}
+			w := server.Client().Bucket("some-bucket").Object(test.objectName).NewWriter(context.Background())
+			w.Write([]byte(test.content))
+			err = w.Close()
+			if test.expectedStatus == http.StatusOK {
+				if err != nil {
+					t.Fatal(err)
+				}
+				obj, err := server.GetObject("some-bucket", test.objectName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(obj.Content) != test.content {
+					t.Errorf("wrong content\nwant %q\ngot  %q", test.content, obj.Content)
+				}
+				return
+			}
+			apiErr, ok := err.(*googleapi.Error)
+			if !ok {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			if apiErr.Code != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, apiErr.Code)
+			}
+			if _, err := server.GetObject("some-bucket", test.objectName); err == nil && !strings.HasPrefix(test.objectName, "existing") {
+				t.Error("rejected object was stored")
+			}
+		})
+	}
+}
+
+func TestServerQuotasMissingBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakestorage-quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{
+		StorageRoot: dir,
+		Quotas:      Quotas{MaxObjectsPerBucket: 1},
+		NoListener:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/missing-bucket/new.txt", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestServerQuotasRetainedGenerations(t *testing.T) {
+	tests := []struct {
+		testCase string
+		opts     CreateBucketOpts
+	}{
+		{"noncurrent generations", CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}},
+		{"soft-deleted objects", CreateBucketOpts{Name: "some-bucket", SoftDeleteRetention: time.Hour}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.testCase, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				Quotas:     Quotas{MaxTotalBytes: 10},
+				NoListener: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := server.CreateBucketWithOpts(test.opts); err != nil {
+				t.Fatal(err)
+			}
+			write := func(content string) error {
+				w := server.Client().Bucket("some-bucket").Object("object.txt").NewWriter(context.Background())
+				w.Write([]byte(content))
+				return w.Close()
+			}
+			if err := write("123456"); err != nil {
+				t.Fatal(err)
+			}
+			err = write("123456")
+			apiErr, ok := err.(*googleapi.Error)
+			if !ok || apiErr.Code != http.StatusForbidden {
+				t.Fatalf("wrong error when the replaced generation is retained\nwant %d\ngot  %v", http.StatusForbidden, err)
+			}
+			if err := write("1234"); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.Client().Bucket("some-bucket").Object("object.txt").Delete(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := write("1"); err == nil {
+				t.Error("unexpected <nil> error when the deleted object is retained")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// SetBucketReadOnly marks a bucket as read-only, or makes it writable again.
+// Writes to read-only buckets through the API (uploads, copies, compose,
+// metadata updates and deletions) fail with 403, like they would for a
+// caller without write permissions. Objects can still be created with the Go
+// helpers, such as CreateObject.
+//
+// The same can be done with PUT and DELETE requests to
+// /_internal/readonly/<bucket>.
+func (s *Server) SetBucketReadOnly(bucketName string, readOnly bool) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return bucketError(err)
+	}
+	bucket.ReadOnly = readOnly
+	return toStatusError(s.backend.UpdateBucket(bucket))
+}
+
+// checkBucketWritable returns a 403 error when the bucket is read-only.
+// permission is the IAM permission the write would require, included in the
+// error message.
+func (s *Server) checkBucketWritable(bucketName, permission string) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil || !bucket.ReadOnly {
+		return nil
+	}
+	return &statusError{
+		code:    http.StatusForbidden,
+		reason:  "forbidden",
+		message: fmt.Sprintf("The caller does not have %s access to the Google Cloud Storage bucket %s, which is read-only.", permission, bucketName),
+	}
+}
+
+func (s *Server) setBucketReadOnlyByPut(w http.ResponseWriter, r *http.Request) {
+	s.setBucketReadOnlyByRequest(w, r, true)
+}
+
+func (s *Server) clearBucketReadOnlyByDelete(w http.ResponseWriter, r *http.Request) {
+	s.setBucketReadOnlyByRequest(w, r, false)
+}
+
+func (s *Server) setBucketReadOnlyByRequest(w http.ResponseWriter, r *http.Request, readOnly bool) {
+	if err := s.SetBucketReadOnly(mux.Vars(r)["bucketName"], readOnly); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientReadOnlyBucket(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "read-only", ReadOnly: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "read-only", Name: "object.txt", Content: []byte("some content")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "writable", Name: "object.txt", Content: []byte("other content")}); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("read-only")
+		obj := bucket.Object("object.txt")
+
+		writes := map[string]func() error{
+			"upload": func() error {
+				w := bucket.Object("new.txt").NewWriter(ctx)
+				w.Write([]byte("new content"))
+				return w.Close()
+			},
+			"update": func() error {
+				_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"})
+				return err
+			},
+			"delete": func() error {
+				return obj.Delete(ctx)
+			},
+			"copy": func() error {
+				src := server.Client().Bucket("writable").Object("object.txt")
+				_, err := bucket.Object("copy.txt").CopierFrom(src).Run(ctx)
+				return err
+			},
+			"compose": func() error {
+				_, err := bucket.Object("composed.txt").ComposerFrom(obj, obj).Run(ctx)
+				return err
+			},
+			"bucket update": func() error {
+				_, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{DefaultEventBasedHold: true})
+				return err
+			},
+		}
+		for name, write := range writes {
+			err := write()
+			if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != http.StatusForbidden {
+				t.Errorf("%s: wrong error returned\nwant status %d\ngot  %v", name, http.StatusForbidden, err)
+			}
+		}
+		if content := readObjectContent(t, obj); content != "some content" {
+			t.Errorf("wrong content after rejected writes\nwant %q\ngot  %q", "some content", content)
+		}
+		_, err := bucket.Object("new.txt").Attrs(ctx)
+		if err != storage.ErrObjectNotExist {
+			t.Errorf("object created in read-only bucket: %v", err)
+		}
+
+		src := bucket.Object("object.txt")
+		if _, err := server.Client().Bucket("writable").Object("copy.txt").CopierFrom(src).Run(ctx); err != nil {
+			t.Errorf("unexpected error copying from a read-only bucket: %v", err)
+		}
+	})
+}
+
+func TestServerReadOnlyBucketAdminEndpoint(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		do := func(method, url string) *http.Response {
+			t.Helper()
+			req, err := http.NewRequest(method, url, strings.NewReader("some content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+		const adminURL = "https://www.googleapis.com/_internal/readonly/some-bucket"
+		const objectURL = "https://storage.googleapis.com/some-bucket/object.txt"
+
+		if resp := do(http.MethodPut, adminURL); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("wrong status marking bucket as read-only\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+		}
+		if resp := do(http.MethodPut, objectURL); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("wrong status writing to read-only bucket\nwant %d\ngot  %d", http.StatusForbidden, resp.StatusCode)
+		}
+		if resp := do(http.MethodDelete, adminURL); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("wrong status making bucket writable\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+		}
+		if resp := do(http.MethodPut, objectURL); resp.StatusCode != http.StatusOK {
+			t.Errorf("wrong status writing to writable bucket\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp := do(http.MethodPut, "https://www.googleapis.com/_internal/readonly/missing-bucket"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("wrong status for missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestIDHeader is the header used by GCS to identify requests in its
+// responses. It's included in all responses, not only in uploads.
+const requestIDHeader = "X-GUploader-UploadID"
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID assigned to the request by the server.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware assigns an ID to every request, returns it in the
+// X-GUploader-UploadID header and in the message of error responses, and
+// writes it to the access log, if there's one.
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id, err := s.ids.requestID()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		w.Header().Set(requestIDHeader, id)
+		rw := &requestIDResponseWriter{ResponseWriter: w, requestID: id}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+		s.accessLog.log(start, id, r, rw.status)
+	})
+}
+
+// requestIDResponseWriter buffers the body of error responses, so the request
+// ID can be included in the error message.
+type requestIDResponseWriter struct {
+	http.ResponseWriter
+	requestID string
+	status    int
+	errorBody *bytes.Buffer
+}
+
+func (w *requestIDResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= http.StatusBadRequest {
+		w.errorBody = new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.errorBody != nil {
+		return w.errorBody.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom lets the underlying writer copy the body from src, so downloads
+// streamed from files can be sent with sendfile(2).
+func (w *requestIDResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok || w.errorBody != nil {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	return rf.ReadFrom(src)
+}
+
+func (w *requestIDResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.errorBody == nil {
+		f.Flush()
+	}
+}
+
+// finish writes the buffered error response, with the request ID appended to
+// the error message.
+func (w *requestIDResponseWriter) finish() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.errorBody == nil {
+		return
+	}
+	body := w.errorBody.Bytes()
+	var errResp errorResponse
+	var xmlErr xmlError
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Code != 0 {
+		errResp.Error.Message = w.withRequestID(errResp.Error.Message)
+		for i := range errResp.Error.Errors {
+			errResp.Error.Errors[i].Message = w.withRequestID(errResp.Error.Errors[i].Message)
+		}
+		body, _ = json.Marshal(errResp)
+	} else if err := xml.Unmarshal(body, &xmlErr); err == nil && xmlErr.Code != "" {
+		xmlErr.Message = w.withRequestID(xmlErr.Message)
+		encoded, _ := xml.Marshal(xmlErr)
+		body = append([]byte(xml.Header), encoded...)
+	} else if len(body) > 0 {
+		body = []byte(w.withRequestID(strings.TrimSuffix(string(body), "\n")) + "\n")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+func (w *requestIDResponseWriter) withRequestID(message string) string {
+	return fmt.Sprintf("%s (request ID: %s)", message, w.requestID)
+}
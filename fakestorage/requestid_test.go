@@ -0,0 +1,92 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerRequestID(t *testing.T) {
+	var accessLog bytes.Buffer
+	server, err := NewServerWithOptions(Options{NoListener: true, AccessLog: &accessLog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+
+	resp, err := client.Get("https://www.googleapis.com/storage/v1/b/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	okID := resp.Header.Get(requestIDHeader)
+	if okID == "" {
+		t.Fatal("missing request ID in successful response")
+	}
+
+	resp, err = client.Get("https://www.googleapis.com/storage/v1/b/some-bucket/o/missing.txt?alt=bananas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	errID := resp.Header.Get(requestIDHeader)
+	if errID == "" || errID == okID {
+		t.Fatalf("invalid request ID in error response: %q", errID)
+	}
+	var errResp errorResponse
+	err = json.NewDecoder(resp.Body).Decode(&errResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errResp.Error.Message, errID) {
+		t.Errorf("request ID %q not found in error message %q", errID, errResp.Error.Message)
+	}
+
+	logLines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	if len(logLines) != 2 {
+		t.Fatalf("wrong number of access log lines\nwant 2\ngot  %d: %q", len(logLines), logLines)
+	}
+	for i, id := range []string{okID, errID} {
+		if !strings.Contains(logLines[i], "request_id="+id) {
+			t.Errorf("request ID %q not found in access log line %q", id, logLines[i])
+		}
+	}
+	if !strings.Contains(logLines[1], "status=400") {
+		t.Errorf("status not found in access log line %q", logLines[1])
+	}
+}
+
+func TestServerRequestIDPlainTextError(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	resp, err := server.HTTPClient().Get(server.URL() + "/not-a-route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Header.Get(requestIDHeader)
+	if id == "" || !strings.Contains(string(body), id) {
+		t.Errorf("request ID %q not found in error body %q", id, body)
+	}
+}
@@ -4,38 +4,118 @@
 
 package fakestorage
 
-import "sort"
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"google.golang.org/api/googleapi"
+)
 
 type listResponse struct {
-	Kind     string        `json:"kind"`
-	Items    []interface{} `json:"items"`
-	Prefixes []string      `json:"prefixes"`
+	Kind          string        `json:"kind"`
+	Items         []interface{} `json:"items"`
+	Prefixes      []string      `json:"prefixes"`
+	NextPageToken string        `json:"nextPageToken,omitempty"`
 }
 
-func newListBucketsResponse(bucketNames []string) listResponse {
+func newListBucketsResponse(buckets []backend.Bucket) listResponse {
 	resp := listResponse{
 		Kind:  "storage#buckets",
-		Items: make([]interface{}, len(bucketNames)),
+		Items: make([]interface{}, len(buckets)),
 	}
-	sort.Strings(bucketNames)
-	for i, name := range bucketNames {
-		resp.Items[i] = newBucketResponse(name)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	for i, bucket := range buckets {
+		resp.Items[i] = newBucketResponse(bucket)
 	}
 	return resp
 }
 
 type bucketResponse struct {
-	Kind string `json:"kind"`
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	Kind                  string                  `json:"kind"`
+	ID                    string                  `json:"id"`
+	Name                  string                  `json:"name"`
+	TimeCreated           string                  `json:"timeCreated,omitempty"`
+	DefaultEventBasedHold bool                    `json:"defaultEventBasedHold,omitempty"`
+	Versioning            *bucketVersioning       `json:"versioning,omitempty"`
+	SoftDeletePolicy      *bucketSoftDeletePolicy `json:"softDeletePolicy,omitempty"`
+	Location              string                  `json:"location,omitempty"`
+	Labels                map[string]string       `json:"labels,omitempty"`
+	Lifecycle             *bucketLifecycle        `json:"lifecycle,omitempty"`
+	Cors                  []backend.CorsRule      `json:"cors,omitempty"`
+	LocationType          string                  `json:"locationType,omitempty"`
+	CustomPlacementConfig *customPlacementConfig  `json:"customPlacementConfig,omitempty"`
+	HierarchicalNamespace *hierarchicalNamespace  `json:"hierarchicalNamespace,omitempty"`
+	Billing               *bucketBilling          `json:"billing,omitempty"`
+	Rpo                   string                  `json:"rpo,omitempty"`
+	Usage                 *BucketUsage            `json:"usage,omitempty"`
+}
+
+type bucketBilling struct {
+	RequesterPays bool `json:"requesterPays"`
+}
+
+type bucketLifecycle struct {
+	Rule []backend.LifecycleRule `json:"rule"`
+}
+
+type bucketVersioning struct {
+	Enabled bool `json:"enabled"`
+}
+
+type bucketSoftDeletePolicy struct {
+	RetentionDurationSeconds int64 `json:"retentionDurationSeconds,string"`
+}
+
+func (p bucketSoftDeletePolicy) retention() time.Duration {
+	return time.Duration(p.RetentionDurationSeconds) * time.Second
+}
+
+func newBucketResponse(bucket backend.Bucket) bucketResponse {
+	resp := bucketResponse{
+		Kind:                  "storage#bucket",
+		ID:                    bucket.Name,
+		Name:                  bucket.Name,
+		TimeCreated:           formatTime(bucket.TimeCreated),
+		DefaultEventBasedHold: bucket.DefaultEventBasedHold,
+		Location:              bucketLocation(bucket.Location),
+		Labels:                bucket.Labels,
+		Cors:                  bucket.CorsRules,
+		LocationType:          bucketLocationType(bucket),
+		Rpo:                   bucketRPO(bucket),
+	}
+	if len(bucket.CustomPlacement) > 0 {
+		resp.CustomPlacementConfig = &customPlacementConfig{DataLocations: bucket.CustomPlacement}
+	}
+	if bucket.HierarchicalNamespace {
+		resp.HierarchicalNamespace = &hierarchicalNamespace{Enabled: true}
+	}
+	if bucket.RequesterPays {
+		resp.Billing = &bucketBilling{RequesterPays: true}
+	}
+	if bucket.VersioningEnabled {
+		resp.Versioning = &bucketVersioning{Enabled: true}
+	}
+	if len(bucket.LifecycleRules) > 0 {
+		resp.Lifecycle = &bucketLifecycle{Rule: bucket.LifecycleRules}
+	}
+	if bucket.SoftDeleteRetention > 0 {
+		resp.SoftDeletePolicy = &bucketSoftDeletePolicy{RetentionDurationSeconds: int64(bucket.SoftDeleteRetention / time.Second)}
+	}
+	return resp
 }
 
-func newBucketResponse(bucketName string) bucketResponse {
-	return bucketResponse{
-		Kind: "storage#bucket",
-		ID:   bucketName,
-		Name: bucketName,
+// formatTime formats timestamps the way the JSON API does, omitting zero
+// values.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
+	return t.UTC().Format(time.RFC3339Nano)
 }
 
 func newListObjectsResponse(objs []Object, prefixes []string) listResponse {
@@ -57,40 +137,169 @@ type objectResponse struct {
 	Bucket string `json:"bucket"`
 	Size   int64  `json:"size,string"`
 	// Crc32c: CRC32c checksum, same as in google storage client code
-	Crc32c  string `json:"crc32c,omitempty"`
-	Md5Hash string `json:"md5hash,omitempty"`
+	Crc32c          string                        `json:"crc32c,omitempty"`
+	Md5Hash         string                        `json:"md5Hash,omitempty"`
+	ContentType     string                        `json:"contentType,omitempty"`
+	ContentLanguage string                        `json:"contentLanguage,omitempty"`
+	CacheControl    string                        `json:"cacheControl,omitempty"`
+	ContentEncoding string                        `json:"contentEncoding,omitempty"`
+	StorageClass    string                        `json:"storageClass,omitempty"`
+	Generation      int64                         `json:"generation,string"`
+	Metageneration  int64                         `json:"metageneration,string"`
+	EventBasedHold  bool                          `json:"eventBasedHold,omitempty"`
+	Retention       *objectRetentionResponse      `json:"retention,omitempty"`
+	ComponentCount  int                           `json:"componentCount,omitempty"`
+	TimeCreated     string                        `json:"timeCreated,omitempty"`
+	TimeDeleted     string                        `json:"timeDeleted,omitempty"`
+	SoftDeleteTime  string                        `json:"softDeleteTime,omitempty"`
+	HardDeleteTime  string                        `json:"hardDeleteTime,omitempty"`
+	ACL             []objectAccessControlResponse `json:"acl,omitempty"`
+	Metadata        map[string]string             `json:"metadata,omitempty"`
+
+	TimeStorageClassUpdated string `json:"timeStorageClassUpdated,omitempty"`
+}
+
+type objectRetentionResponse struct {
+	Mode            string `json:"mode"`
+	RetainUntilTime string `json:"retainUntilTime"`
 }
 
 func newObjectResponse(obj Object) objectResponse {
 	return objectResponse{
-		Kind:    "storage#object",
-		ID:      obj.id(),
-		Bucket:  obj.BucketName,
-		Name:    obj.Name,
-		Size:    int64(len(obj.Content)),
-		Crc32c:  obj.Crc32c,
-		Md5Hash: obj.Md5Hash,
+		Kind:            "storage#object",
+		ID:              obj.id(),
+		Bucket:          obj.BucketName,
+		Name:            obj.Name,
+		Size:            obj.size(),
+		Crc32c:          obj.Crc32c,
+		Md5Hash:         obj.Md5Hash,
+		ContentType:     obj.ContentType,
+		ContentLanguage: obj.ContentLanguage,
+		CacheControl:    obj.CacheControl,
+		ContentEncoding: obj.ContentEncoding,
+		StorageClass:    obj.StorageClass,
+		Generation:      obj.Generation,
+		Metageneration:  obj.Metageneration,
+		EventBasedHold:  obj.EventBasedHold,
+		Retention:       newObjectRetentionResponse(obj.Retention),
+		ComponentCount:  obj.ComponentCount,
+		TimeCreated:     formatTime(obj.TimeCreated),
+		TimeDeleted:     formatTime(obj.TimeDeleted),
+		SoftDeleteTime:  formatTime(obj.SoftDeleteTime),
+		HardDeleteTime:  formatTime(obj.HardDeleteTime),
+		ACL:             newObjectACLResponse(obj),
+		Metadata:        obj.Metadata,
+
+		TimeStorageClassUpdated: formatTime(obj.TimeStorageClassUpdated),
+	}
+}
+
+func newObjectRetentionResponse(retention *ObjectRetention) *objectRetentionResponse {
+	if retention == nil {
+		return nil
+	}
+	return &objectRetentionResponse{
+		Mode:            retention.Mode,
+		RetainUntilTime: formatTime(retention.RetainUntilTime),
 	}
 }
 
 type rewriteResponse struct {
-	Kind                string         `json:"kind"`
-	TotalBytesRewritten int64          `json:"totalBytesRewritten,string"`
-	ObjectSize          int64          `json:"objectSize,string"`
-	Done                bool           `json:"done"`
-	RewriteToken        string         `json:"rewriteToken"`
-	Resource            objectResponse `json:"resource"`
+	Kind                string          `json:"kind"`
+	TotalBytesRewritten int64           `json:"totalBytesRewritten,string"`
+	ObjectSize          int64           `json:"objectSize,string"`
+	Done                bool            `json:"done"`
+	RewriteToken        string          `json:"rewriteToken"`
+	Resource            *objectResponse `json:"resource,omitempty"`
 }
 
 func newObjectRewriteResponse(obj Object) rewriteResponse {
+	resource := newObjectResponse(obj)
 	return rewriteResponse{
 		Kind:                "storage#rewriteResponse",
 		TotalBytesRewritten: int64(len(obj.Content)),
 		ObjectSize:          int64(len(obj.Content)),
 		Done:                true,
 		RewriteToken:        "",
-		Resource:            newObjectResponse(obj),
+		Resource:            &resource,
+	}
+}
+
+// newPartialRewriteResponse describes a rewrite that isn't done yet. The
+// client must repeat the request with the rewrite token to continue.
+func newPartialRewriteResponse(written, size int64, token string) rewriteResponse {
+	return rewriteResponse{
+		Kind:                "storage#rewriteResponse",
+		TotalBytesRewritten: written,
+		ObjectSize:          size,
+		Done:                false,
+		RewriteToken:        token,
+	}
+}
+
+// statusError is an error that's reported to clients with the given HTTP
+// status code and reason, following the format of API errors.
+//
+// Status errors returned by the Go helpers of the server can be handled like
+// the errors of the Go client: errors.As converts them to *googleapi.Error,
+// and errors for missing buckets and objects match storage.ErrBucketNotExist
+// and storage.ErrObjectNotExist with errors.Is.
+type statusError struct {
+	code    int
+	reason  string
+	message string
+
+	// notExist is the error of the Go client matched by errors.Is, if any.
+	notExist error
+
+	// err is the underlying error, if any.
+	err error
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// As converts the error to a *googleapi.Error, with the code, message and
+// reason reported to clients.
+func (e *statusError) As(target interface{}) bool {
+	gErr, ok := target.(**googleapi.Error)
+	if !ok {
+		return false
+	}
+	*gErr = &googleapi.Error{
+		Code:    e.code,
+		Message: e.message,
+		Errors:  []googleapi.ErrorItem{{Reason: e.reason, Message: e.message}},
+	}
+	return true
+}
+
+func (e *statusError) Is(target error) bool {
+	return e.notExist != nil && target == e.notExist
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// writeStatusError writes the API error response for err. Errors other than
+// *statusError are reported as internal errors, in the format of the API for
+// injected backend faults.
+func writeStatusError(w http.ResponseWriter, err error) {
+	sErr, ok := err.(*statusError)
+	if !ok {
+		sErr = backendFaultError(err)
+	}
+	if sErr == nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(sErr.code)
+	json.NewEncoder(w).Encode(newErrorResponse(sErr.code, sErr.message, []apiError{
+		{Domain: "global", Reason: sErr.reason, Message: sErr.message},
+	}))
 }
 
 type errorResponse struct {
@@ -0,0 +1,209 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Scenario is a scripted sequence of failures, used to reproduce the
+// behavior of clients when the API fails in specific ways.
+//
+// Scenarios are usually described in JSON, for example:
+//
+//   {
+//     "rules": [
+//       {
+//         "method": "POST",
+//         "bucket": "some-bucket",
+//         "responses": [{"status": 503}, {"status": 0}]
+//       },
+//       {
+//         "method": "GET",
+//         "prefix": "tmp/",
+//         "responses": [{"status": 404, "times": 2}]
+//       }
+//     ]
+//   }
+//
+// This scenario makes the first POST to "some-bucket" fail with 503 while
+// the second one succeeds, and the first two GET requests for objects under
+// "tmp/" fail with 404. Once the responses of a rule are exhausted, requests
+// matching the rule are processed normally.
+type Scenario struct {
+	Rules []ScenarioRule `json:"rules"`
+}
+
+// ScenarioRule describes the requests affected by the rule and the sequence
+// of responses returned for them.
+type ScenarioRule struct {
+	// Method is the HTTP method of matching requests. Empty matches any
+	// method.
+	Method string `json:"method,omitempty"`
+
+	// Bucket is the name of the bucket of matching requests. Empty matches
+	// any bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Prefix is the prefix of the object name of matching requests. Empty
+	// matches any object, as well as bucket-level requests.
+	Prefix string `json:"prefix,omitempty"`
+
+	Responses []ScenarioResponse `json:"responses"`
+}
+
+// ScenarioResponse is a step in the sequence of responses of a rule.
+type ScenarioResponse struct {
+	// Status is the HTTP status code returned to the client. Zero means that
+	// the request is processed normally.
+	Status int `json:"status"`
+
+	// Times is the number of consecutive matching requests that get this
+	// response. Defaults to 1.
+	Times int `json:"times,omitempty"`
+}
+
+// LoadScenario decodes a JSON scenario from the given reader.
+func LoadScenario(r io.Reader) (Scenario, error) {
+	var scenario Scenario
+	err := json.NewDecoder(r).Decode(&scenario)
+	if err != nil {
+		return scenario, err
+	}
+	for i, rule := range scenario.Rules {
+		for _, resp := range rule.Responses {
+			if resp.Times < 0 {
+				return scenario, fmt.Errorf("rule %d: times can't be negative", i)
+			}
+			if resp.Status != 0 && (resp.Status < 100 || resp.Status > 599) {
+				return scenario, fmt.Errorf("rule %d: invalid status %d", i, resp.Status)
+			}
+		}
+	}
+	return scenario, nil
+}
+
+type scenarioState struct {
+	mtx      sync.Mutex
+	scenario Scenario
+	counters []int
+}
+
+// SetScenario replaces the scenario currently executed by the server. Rules
+// start from their first response.
+func (s *Server) SetScenario(scenario Scenario) {
+	s.scenario.mtx.Lock()
+	defer s.scenario.mtx.Unlock()
+	s.scenario.scenario = scenario
+	s.scenario.counters = make([]int, len(scenario.Rules))
+}
+
+// ClearScenario removes the current scenario, so all requests are processed
+// normally.
+func (s *Server) ClearScenario() {
+	s.SetScenario(Scenario{})
+}
+
+func (rule *ScenarioRule) matches(r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	bucketName, objectName := requestTarget(r)
+	if rule.Bucket != "" && rule.Bucket != bucketName {
+		return false
+	}
+	return rule.Prefix == "" || strings.HasPrefix(objectName, rule.Prefix)
+}
+
+// response returns the response for the n-th matching request (starting at
+// zero) and whether the rule has a response for it.
+func (rule *ScenarioRule) response(n int) (ScenarioResponse, bool) {
+	for _, resp := range rule.Responses {
+		times := resp.Times
+		if times == 0 {
+			times = 1
+		}
+		if n < times {
+			return resp, true
+		}
+		n -= times
+	}
+	return ScenarioResponse{}, false
+}
+
+// next returns the status code the request should fail with, or zero if the
+// request should be processed normally.
+func (st *scenarioState) next(r *http.Request) int {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	for i := range st.scenario.Rules {
+		rule := &st.scenario.Rules[i]
+		if !rule.matches(r) {
+			continue
+		}
+		resp, ok := rule.response(st.counters[i])
+		if !ok {
+			continue
+		}
+		st.counters[i]++
+		return resp.Status
+	}
+	return 0
+}
+
+// requestTarget returns the names of the bucket and object targeted by the
+// request, based on the matched route.
+func requestTarget(r *http.Request) (bucketName, objectName string) {
+	vars := mux.Vars(r)
+	if bucketName = vars["bucketName"]; bucketName == "" {
+		bucketName = vars["sourceBucket"]
+	}
+	if objectName = vars["objectName"]; objectName == "" {
+		objectName = vars["sourceObject"]
+	}
+	if objectName == "" && r.Method == http.MethodPost {
+		objectName = r.URL.Query().Get("name")
+	}
+	return bucketName, objectName
+}
+
+func (s *Server) scenarioMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		status := s.scenario.next(r)
+		if status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(newErrorResponse(status, http.StatusText(status), nil))
+	})
+}
+
+func (s *Server) setScenarioByPut(w http.ResponseWriter, r *http.Request) {
+	scenario, err := LoadScenario(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.SetScenario(scenario)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearScenarioByDelete(w http.ResponseWriter, r *http.Request) {
+	s.ClearScenario()
+	w.WriteHeader(http.StatusNoContent)
+}
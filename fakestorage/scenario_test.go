@@ -0,0 +1,99 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testScenario = `{
+  "rules": [
+    {"method": "POST", "bucket": "some-bucket", "responses": [{"status": 503}, {"status": 0}, {"status": 500}]},
+    {"method": "GET", "prefix": "tmp/", "responses": [{"status": 404, "times": 2}]}
+  ]
+}`
+
+func TestServerScenario(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "tmp/file.txt", Content: []byte("tmp")},
+		{BucketName: "some-bucket", Name: "static/file.txt", Content: []byte("static")},
+	}
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerWithOptions(Options{InitialObjects: objs, NoListener: true, Scenario: scenario})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+	steps := []struct {
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=new.txt", http.StatusServiceUnavailable},
+		{http.MethodGet, "https://storage.googleapis.com/some-bucket/static/file.txt", http.StatusOK},
+		{http.MethodGet, "https://storage.googleapis.com/some-bucket/tmp/file.txt", http.StatusNotFound},
+		{http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=new.txt", http.StatusOK},
+		{http.MethodGet, "https://www.googleapis.com/storage/v1/b/some-bucket/o/tmp/file.txt", http.StatusNotFound},
+		{http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=new.txt", http.StatusInternalServerError},
+		{http.MethodGet, "https://storage.googleapis.com/some-bucket/tmp/file.txt", http.StatusOK},
+		{http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=new.txt", http.StatusOK},
+	}
+	for i, step := range steps {
+		req, err := http.NewRequest(step.method, step.url, strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.expectedStatus {
+			t.Errorf("step %d: wrong status for %s %s\nwant %d\ngot  %d", i, step.method, step.url, step.expectedStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestServerScenarioInternalEndpoint(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "tmp/file.txt"}}
+	server, err := NewServerWithOptions(Options{InitialObjects: objs, NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+	do := func(method, url, body string) int {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	const objectURL = "https://storage.googleapis.com/some-bucket/tmp/file.txt"
+	if status := do(http.MethodPut, "https://www.googleapis.com/_internal/scenario", testScenario); status != http.StatusNoContent {
+		t.Fatalf("wrong status setting scenario\nwant %d\ngot  %d", http.StatusNoContent, status)
+	}
+	if status := do(http.MethodGet, objectURL, ""); status != http.StatusNotFound {
+		t.Errorf("wrong status with scenario\nwant %d\ngot  %d", http.StatusNotFound, status)
+	}
+	if status := do(http.MethodDelete, "https://www.googleapis.com/_internal/scenario", ""); status != http.StatusNoContent {
+		t.Fatalf("wrong status clearing scenario\nwant %d\ngot  %d", http.StatusNoContent, status)
+	}
+	if status := do(http.MethodGet, objectURL, ""); status != http.StatusOK {
+		t.Errorf("wrong status after clearing scenario\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if status := do(http.MethodPut, "https://www.googleapis.com/_internal/scenario", `{"rules": [{"responses": [{"status": 42}]}]}`); status != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid scenario\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+}
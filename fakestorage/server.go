@@ -7,11 +7,17 @@ package fakestorage
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/backend"
@@ -25,11 +31,56 @@ import (
 type Server struct {
 	backend     backend.Storage
 	uploads     sync.Map
+	uploadsMtx  sync.Mutex
+	rewrites    sync.Map
 	transport   http.RoundTripper
 	ts          *httptest.Server
+	uploadTS    *httptest.Server
+	httpTS      *httptest.Server
+	tenantTS    []*httptest.Server
+	faults      *backend.StorageFaults
 	mux         *mux.Router
+	handler     http.Handler
 	externalURL string
+	uploadURL   string
 	publicHost  string
+	quotas      Quotas
+	writeMtx    sync.Mutex
+	sizes       sizeIndex
+	scenario    scenarioState
+	consistency *consistencyTracker
+	accessLog   *accessLogger
+	auditLog    *auditLogger
+	middlewares []Middleware
+	events      eventHub
+	ids         *idGenerator
+	expirer     periodicTask
+	uploadGC    periodicTask
+	persister   periodicTask
+	outages     outageState
+	signedURLs  signedURLState
+	options     Options
+
+	anywhereCaches anywhereCacheState
+	billing        billingLedger
+	tagBindings    tagBindingState
+	folders        folderState
+	interruptions  interruptionState
+	inventory      inventoryState
+	capture        captureState
+
+	namespaceMtx sync.Mutex
+	namespaces   map[string]*Server
+	parent       *Server
+
+	lifecycleMtx sync.Mutex
+	noListener   bool
+	addressFile  string
+	unixSocket   string
+	host         string
+	port         uint16
+	uploadPort   uint16
+	httpPort     uint16
 }
 
 // NewServer creates a new instance of the server, pre-loaded with the given
@@ -57,6 +108,25 @@ type Options struct {
 	Host           string
 	Port           uint16
 
+	// Optional directory where the state of the in-memory backend is
+	// persisted, for long-lived servers that need to survive restarts. The
+	// server loads the state from the directory on creation, and writes it
+	// back with Flush, every PersistenceInterval, and when the server is
+	// stopped. Changes made after the last flush are lost if the process
+	// dies. Namespaces are not persisted. It can't be combined with
+	// StorageRoot.
+	PersistenceDir      string
+	PersistenceInterval time.Duration
+
+	// Optional compression for object files stored under StorageRoot. The
+	// only supported value is "gzip". Existing files are always readable,
+	// regardless of this setting.
+	StorageCompression string
+
+	// Optional AES key (16, 24 or 32 bytes long) used to encrypt object
+	// files stored under StorageRoot.
+	StorageEncryptionKey []byte
+
 	// when set to true, the server will not actually start a TCP listener,
 	// client requests will get processed by an internal mocked transport.
 	NoListener bool
@@ -74,116 +144,561 @@ type Options struct {
 	// https://<bucket>.storage.gcs.127.0.0.1.nip.io:4443>/<bucket>/<object>
 	// If unset, the default is "storage.googleapis.com", the XML API
 	PublicHost string
+
+	// Optional limits enforced on objects written through the API. Writes
+	// exceeding them are rejected with 4xx errors.
+	Quotas Quotas
+
+	// Optional scenario of scripted failures. It can be replaced later with
+	// SetScenario or with a PUT request to /_internal/scenario.
+	Scenario Scenario
+
+	// Optional delay for changes to show up in object listings. When set,
+	// newly created objects are only listed after the delay, and deleted
+	// objects keep being listed until the delay expires. Reads of individual
+	// objects are not affected.
+	ListingPropagationDelay time.Duration
+
+	// Optional port for a separate listener for uploads, mirroring the split
+	// between the JSON API and the upload host in production. The listener
+	// binds to Host and serves the same API with shared state. When set,
+	// resumable upload sessions point to this listener.
+	UploadPort uint16
+
+	// Optional external URL of the upload listener, such as
+	// https://upload.gcs.127.0.0.1.nip.io:4444. Returned in the Location
+	// header for resumable uploads instead of ExternalURL.
+	ExternalUploadURL string
+
+	// Optional port for an additional listener serving the API over plain
+	// HTTP, along with the HTTPS listener and with shared state, for
+	// environments mixing clients that require TLS with clients that can't
+	// use it (such as those configured with STORAGE_EMULATOR_HOST). The
+	// listener binds to Host. Resumable uploads started over plain HTTP
+	// continue on it, unless ExternalUploadURL is set. See HTTPURL.
+	HTTPPort uint16
+
+	// Optional writer for the access log. When set, the server writes a line
+	// for each request, including the ID of the request, and a line with the
+	// URL of the server whenever it starts.
+	AccessLog io.Writer
+
+	// Optional writer for audit logs. When set, the server writes an entry
+	// in the JSON format of Cloud Audit Logs for each data access and admin
+	// operation, one entry per line. Entries of admin operations go to the
+	// cloudaudit.googleapis.com/activity log, other entries go to the
+	// cloudaudit.googleapis.com/data_access log.
+	AuditLog io.Writer
+
+	// Optional URL of a webhook for audit logs. When set, the server POSTs
+	// each audit log entry to it, in the same format used for AuditLog.
+	// Entries are delivered in the background, and the ones still queued
+	// are delivered by Stop and Shutdown. Failures to deliver entries are
+	// ignored.
+	AuditLogWebhook string
+
+	// Optional ID of the project used in the names of audit logs. The
+	// default is "fake-project".
+	AuditLogProject string
+
+	// Optional path of a file where the server writes its URL whenever it
+	// starts. Useful along with Port zero, where the OS picks the port, for
+	// processes that need to discover the address of the server.
+	AddressFile string
+
+	// Optional path of a unix socket for the server to listen on, instead of
+	// a TCP port. Host, Port, UploadPort, HTTPPort and AddressFile are
+	// ignored when it's set, and URL returns an empty string: clients
+	// obtained with Client and HTTPClient dial the socket regardless of the
+	// host in the request.
+	UnixSocket string
+
+	// Optional middlewares wrapping the handling of API requests. See the
+	// documentation of Middleware for details.
+	Middlewares []Middleware
+
+	// When set to true, resumable upload IDs, rewrite tokens and request IDs
+	// are generated from counters instead of random numbers, so the same
+	// sequence of requests always gets the same identifiers. Useful for
+	// golden-file tests that capture HTTP exchanges. Generations and
+	// timestamps are not affected.
+	DeterministicIDs bool
+
+	// Optional maximum age of objects. When set, objects older than this
+	// duration are deleted automatically while the server is running,
+	// regardless of the lifecycle rules of their buckets. See
+	// ExpireObjects for details.
+	ObjectTTL time.Duration
+
+	// Optional maximum idle time of resumable uploads. When set, uploads
+	// that don't receive any content for this long are discarded while the
+	// server is running. See PurgeResumableUploads for details.
+	ResumableUploadTTL time.Duration
+
+	// Optional detection of the Content-Type of objects uploaded without
+	// one. By default they get "application/octet-stream", like in Cloud
+	// Storage.
+	ContentTypeDetection ContentTypeDetection
+
+	// Optional offset applied to the clock of the server when validating
+	// the expiration of signed URLs, for testing the handling of clock skew
+	// by clients. Positive values move the clock of the server forward, so
+	// signed URLs expire earlier. Signatures themselves are never verified.
+	SignedURLClockSkew time.Duration
+
+	// Optional CORS configuration of the API, for browser-based applications
+	// calling the server directly. PermissiveCORS allows any origin. It's
+	// independent of the CORS configuration of buckets, which is stored but
+	// not enforced.
+	CORS CORSOptions
+
+	// Optional multi-tenant configuration, routing requests to isolated
+	// namespaces based on their port or credentials. See TenantOptions.
+	Tenants TenantOptions
+
+	// When set to true, JSON responses of the API are serialized like in
+	// production, for clients sensitive to the details of the format:
+	// fields of resources follow the order of the production API, int64
+	// fields are encoded as strings, timestamps have millisecond precision
+	// and empty fields are omitted.
+	StrictFidelity bool
+
+	// When set to true, bucket resources of the API include the emulated
+	// usage of the bucket (object count and total bytes) in the custom
+	// usage field, for testing dashboards and estimators built on top of
+	// bucket usage. See BucketUsage.
+	EmulateBucketUsage bool
 }
 
-// NewServerWithOptions creates a new server with custom options
+// NewServerWithOptions creates a new server with custom options. Unless
+// NoListener is set, the server is started before being returned.
 func NewServerWithOptions(options Options) (*Server, error) {
-	s, err := newServer(options.InitialObjects, options.StorageRoot, options.ExternalURL, options.PublicHost)
+	s, err := newServer(options)
 	if err != nil {
 		return nil, err
 	}
 	if options.NoListener {
 		s.setTransportToMux()
+		s.auditLog.start()
+		s.startExpirer()
+		s.startUploadCollector()
+		s.startPersister()
 		return s, nil
 	}
+	err = s.Start()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Start starts the listeners of the server. It's a no-op if the server is
+// already running or doesn't use a listener.
+//
+// A server stopped with Stop or Shutdown can be started again, in which case
+// it binds to the same ports it used before, so existing clients keep working.
+func (s *Server) Start() error {
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.auditLog.start()
+	s.startExpirer()
+	s.startUploadCollector()
+	s.startInventoryReports()
+	s.startPersister()
+	return nil
+}
+
+func (s *Server) start() error {
+	if s.noListener || s.ts != nil {
+		return nil
+	}
+	if s.unixSocket != "" {
+		return s.startUnix()
+	}
+	ts, err := s.startListener(s.host, s.port, s.handler)
+	if err != nil {
+		return err
+	}
+	var uploadTS *httptest.Server
+	if s.uploadPort != 0 {
+		uploadTS, err = s.startListener(s.host, s.uploadPort, s.handler)
+		if err != nil {
+			ts.Close()
+			return err
+		}
+	}
+	var httpTS *httptest.Server
+	if s.httpPort != 0 {
+		httpTS, err = s.startHTTPListener(s.host, s.httpPort)
+		if err != nil {
+			ts.Close()
+			if uploadTS != nil {
+				uploadTS.Close()
+			}
+			return err
+		}
+	}
+	tenantTS, err := s.startTenantListeners()
+	if err != nil {
+		for _, started := range []*httptest.Server{ts, uploadTS, httpTS} {
+			if started != nil {
+				started.Close()
+			}
+		}
+		return err
+	}
+	if s.addressFile != "" {
+		if err := writeAddressFile(s.addressFile, ts.URL); err != nil {
+			for _, started := range append([]*httptest.Server{ts, uploadTS, httpTS}, tenantTS...) {
+				if started != nil {
+					started.Close()
+				}
+			}
+			return err
+		}
+	}
+	s.ts = ts
+	s.uploadTS = uploadTS
+	s.httpTS = httpTS
+	s.tenantTS = tenantTS
+	addr := ts.Listener.Addr().String()
+	s.port = listenerPort(ts)
+	if uploadTS != nil {
+		s.uploadPort = listenerPort(uploadTS)
+	}
+	s.setTransportToAddr("tcp", addr)
+	s.accessLog.logStart(ts.URL)
+	if httpTS != nil {
+		s.httpPort = listenerPort(httpTS)
+		s.accessLog.logStart(httpTS.URL)
+	}
+	return nil
+}
+
+// startUnix starts the API on the unix socket, replacing stale socket files
+// left behind by previous processes.
+func (s *Server) startUnix() error {
+	if info, err := os.Stat(s.unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(s.unixSocket)
+	}
+	l, err := net.Listen("unix", s.unixSocket)
+	if err != nil {
+		return err
+	}
+	ts := httptest.NewUnstartedServer(s.handler)
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.StartTLS()
+	s.ts = ts
+	s.setTransportToAddr("unix", s.unixSocket)
+	s.accessLog.logStart("unix:" + s.unixSocket)
+	return nil
+}
 
-	s.ts = httptest.NewUnstartedServer(s.mux)
-	if options.Port != 0 {
-		addr := fmt.Sprintf("%s:%d", options.Host, options.Port)
+// startListener starts a TLS server for the given handler on the given host
+// and port. When port is zero, the server listens on a port picked by the OS.
+func (s *Server) startListener(host string, port uint16, handler http.Handler) (*httptest.Server, error) {
+	ts, err := newUnstartedListener(host, port, handler)
+	if err != nil {
+		return nil, err
+	}
+	ts.StartTLS()
+	return ts, nil
+}
+
+func newUnstartedListener(host string, port uint16, handler http.Handler) (*httptest.Server, error) {
+	ts := httptest.NewUnstartedServer(handler)
+	if host != "" || port != 0 {
+		addr := fmt.Sprintf("%s:%d", host, port)
 		l, err := net.Listen("tcp", addr)
 		if err != nil {
 			return nil, err
 		}
-		s.ts.Listener.Close()
-		s.ts.Listener = l
-		s.ts.StartTLS()
-	} else {
-		s.ts.StartTLS()
+		ts.Listener.Close()
+		ts.Listener = l
 	}
-	s.setTransportToAddr(s.ts.Listener.Addr().String())
-	return s, nil
+	return ts, nil
 }
 
-func newServer(objects []Object, storageRoot, externalURL, publicHost string) (*Server, error) {
-	backendObjects := toBackendObjects(objects)
+// writeAddressFile atomically replaces the content of path with the given
+// URL, so readers never see a partially written file.
+func writeAddressFile(path, url string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".address-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.WriteString(url + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func listenerPort(ts *httptest.Server) uint16 {
+	if addr, ok := ts.Listener.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+func newServer(options Options) (*Server, error) {
+	initialObjects := make([]Object, len(options.InitialObjects))
+	for i, obj := range options.InitialObjects {
+		initialObjects[i] = obj.withDefaults().withDecompressedSize()
+	}
+	backendObjects := toBackendObjects(initialObjects)
 	var backendStorage backend.Storage
 	var err error
-	if storageRoot != "" {
-		backendStorage, err = backend.NewStorageFS(backendObjects, storageRoot)
+	fsOptions := backend.FSOptions{
+		Compression:   backend.Compression(options.StorageCompression),
+		EncryptionKey: options.StorageEncryptionKey,
+	}
+	if options.StorageRoot != "" && options.PersistenceDir != "" {
+		return nil, errors.New("StorageRoot and PersistenceDir are mutually exclusive")
+	}
+	if err := options.Tenants.validate(); err != nil {
+		return nil, err
+	}
+	if options.StorageRoot != "" {
+		backendStorage, err = backend.NewStorageFSWithOptions(backendObjects, options.StorageRoot, fsOptions)
+	} else if options.PersistenceDir != "" {
+		backendStorage, err = backend.NewStorageWriteBehind(backendObjects, options.PersistenceDir, fsOptions)
 	} else {
 		backendStorage = backend.NewStorageMemory(backendObjects)
 	}
 	if err != nil {
 		return nil, err
 	}
+	publicHost := options.PublicHost
 	if publicHost == "" {
 		publicHost = "storage.googleapis.com"
 	}
+	faults := backend.NewStorageFaults(backendStorage)
 	s := Server{
-		backend:     backendStorage,
+		backend:     faults,
+		faults:      faults,
 		uploads:     sync.Map{},
-		externalURL: externalURL,
+		externalURL: options.ExternalURL,
+		uploadURL:   options.ExternalUploadURL,
 		publicHost:  publicHost,
+		quotas:      options.Quotas,
+		consistency: newConsistencyTracker(options.ListingPropagationDelay),
+		accessLog:   &accessLogger{w: options.AccessLog},
+		auditLog:    newAuditLogger(options),
+		middlewares: options.Middlewares,
+		ids:         newIDGenerator(options.DeterministicIDs),
+		noListener:  options.NoListener,
+		addressFile: options.AddressFile,
+		unixSocket:  options.UnixSocket,
+		host:        options.Host,
+		port:        options.Port,
+		uploadPort:  options.UploadPort,
+		httpPort:    options.HTTPPort,
+		options:     options,
 	}
 	s.buildMuxer()
+	s.SetScenario(options.Scenario)
+	s.SetSignedURLClockSkew(options.SignedURLClockSkew)
 	return &s, nil
 }
 
-func (s *Server) setTransportToAddr(addr string) {
+func (s *Server) setTransportToAddr(network, addr string) {
 	// #nosec
 	tlsConfig := tls.Config{InsecureSkipVerify: true}
 	s.transport = &http.Transport{
 		TLSClientConfig: &tlsConfig,
 		DialTLS: func(string, string) (net.Conn, error) {
-			return tls.Dial("tcp", addr, &tlsConfig)
+			return tls.Dial(network, addr, &tlsConfig)
 		},
 	}
 }
 
 func (s *Server) setTransportToMux() {
-	s.transport = &muxTransport{router: s.mux}
+	s.transport = &muxTransport{handler: s.handler}
 }
 
 func (s *Server) buildMuxer() {
 	s.mux = mux.NewRouter()
-	s.mux.Host(s.publicHost).Path("/{bucketName}/{objectName:.+}").Methods("GET", "HEAD").HandlerFunc(s.downloadObject)
-	bucketHost := fmt.Sprintf("{bucketName}.%s", s.publicHost)
-	s.mux.Host(bucketHost).Path("/{objectName:.+}").Methods("GET", "HEAD").HandlerFunc(s.downloadObject)
+	s.mux.Use(s.auditMiddleware)
+	s.mux.Use(s.fidelityMiddleware)
+	for _, mw := range s.middlewares {
+		s.mux.Use(s.userMiddleware(mw))
+	}
+	s.mux.Use(s.signedURLMiddleware)
+	s.mux.Use(s.instructionMiddleware)
+	s.mux.Use(s.scenarioMiddleware)
+	s.mux.Use(s.outageMiddleware)
+	s.mux.Use(s.billingMiddleware)
+	s.buildInternalMuxer()
 	r := s.mux.PathPrefix("/storage/v1").Subrouter()
 	r.Path("/b").Methods("GET").HandlerFunc(s.listBuckets)
 	r.Path("/b").Methods("POST").HandlerFunc(s.createBucketByPost)
 	r.Path("/b/{bucketName}").Methods("GET").HandlerFunc(s.getBucket)
+	r.Path("/b/{bucketName}").Methods("PATCH").HandlerFunc(s.patchBucket)
+	r.Path("/b/{bucketName}/storageLayout").Methods("GET").HandlerFunc(s.getStorageLayout)
+	r.Path("/b/{bucketName}/anywhereCaches").Methods("GET").HandlerFunc(s.listAnywhereCaches)
+	r.Path("/b/{bucketName}/anywhereCaches").Methods("POST").HandlerFunc(s.insertAnywhereCache)
+	r.Path("/b/{bucketName}/anywhereCaches/{anywhereCacheId}").Methods("GET").HandlerFunc(s.getAnywhereCache)
+	r.Path("/b/{bucketName}/anywhereCaches/{anywhereCacheId}").Methods("PATCH").HandlerFunc(s.updateAnywhereCache)
+	r.Path("/b/{bucketName}/anywhereCaches/{anywhereCacheId}/pause").Methods("POST").HandlerFunc(s.setAnywhereCacheState(anywhereCachePaused))
+	r.Path("/b/{bucketName}/anywhereCaches/{anywhereCacheId}/resume").Methods("POST").HandlerFunc(s.setAnywhereCacheState(anywhereCacheRunning))
+	r.Path("/b/{bucketName}/anywhereCaches/{anywhereCacheId}/disable").Methods("POST").HandlerFunc(s.setAnywhereCacheState(anywhereCacheDisabled))
+	r.Path("/b/{bucketName}/folders").Methods("GET").HandlerFunc(s.listFolders)
+	r.Path("/b/{bucketName}/folders").Methods("POST").HandlerFunc(s.insertFolder)
+	r.Path("/b/{bucketName}/folders/{folderName:.+}").Methods("GET").HandlerFunc(s.getFolder)
+	r.Path("/b/{bucketName}/folders/{folderName:.+}").Methods("DELETE").HandlerFunc(s.deleteFolder)
+	r.Path("/b/{bucketName}/operations").Methods("GET").HandlerFunc(s.listOperations)
+	r.Path("/b/{bucketName}/operations/{operationId}").Methods("GET").HandlerFunc(s.getOperation)
 	r.Path("/b/{bucketName}/o").Methods("GET").HandlerFunc(s.listObjects)
 	r.Path("/b/{bucketName}/o").Methods("POST").HandlerFunc(s.insertObject)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/compose").Methods("POST").HandlerFunc(s.composeObject)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods("GET").HandlerFunc(s.listObjectACL)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods("POST").HandlerFunc(s.setObjectACL)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods("GET").HandlerFunc(s.getObjectACL)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods("PUT", "PATCH").HandlerFunc(s.setObjectACL)
+	r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods("DELETE").HandlerFunc(s.deleteObjectACL)
 	r.Path("/b/{bucketName}/o/{objectName:.+}").Methods("GET").HandlerFunc(s.getObject)
+	r.Path("/b/{bucketName}/o/{objectName:.+}").Methods("PATCH").HandlerFunc(s.patchObject)
 	r.Path("/b/{bucketName}/o/{objectName:.+}").Methods("DELETE").HandlerFunc(s.deleteObject)
 	r.Path("/b/{sourceBucket}/o/{sourceObject:.+}/rewriteTo/b/{destinationBucket}/o/{destinationObject:.+}").HandlerFunc(s.rewriteObject)
-	s.mux.Path("/download/storage/v1/b/{bucketName}/o/{objectName:.+}").Methods("GET").HandlerFunc(s.downloadObject)
+	s.mux.Path("/download/storage/v1/b/{bucketName}/o/{objectName:.+}").Methods("GET", "HEAD").HandlerFunc(s.downloadObject)
 	s.mux.Path("/upload/storage/v1/b/{bucketName}/o").Methods("POST").HandlerFunc(s.insertObject)
 	s.mux.Path("/upload/resumable/{uploadId}").Methods("PUT", "POST").HandlerFunc(s.uploadFileContent)
+
+	// The public host also serves the JSON API, so the catch-all download
+	// routes must be registered last.
+	s.mux.Host(s.publicHost).Path("/{bucketName}/{objectName:.+}").Methods("GET", "HEAD").HandlerFunc(s.downloadObject)
+	s.mux.Host(s.publicHost).Path("/{bucketName}/{objectName:.+}").Methods("PUT").HandlerFunc(s.xmlPutObject)
+	bucketHost := fmt.Sprintf("{bucketName}.%s", s.publicHost)
+	s.mux.Host(bucketHost).Path("/{objectName:.+}").Methods("GET", "HEAD").HandlerFunc(s.downloadObject)
+	s.mux.Host(bucketHost).Path("/{objectName:.+}").Methods("PUT").HandlerFunc(s.xmlPutObject)
+
+	s.handler = s.captureMiddleware(s.requestIDMiddleware(s.corsMiddleware(http.HandlerFunc(s.serveNamespace))))
 }
 
 // Stop stops the server, closing all connections.
 func (s *Server) Stop() {
-	if s.ts != nil {
-		if transport, ok := s.transport.(*http.Transport); ok {
-			transport.CloseIdleConnections()
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	s.expirer.stop()
+	s.uploadGC.stop()
+	s.stopInventoryReports()
+	s.closeIdleConnections()
+	for _, ts := range s.listeners() {
+		ts.Close()
+	}
+	s.stopPersister()
+	s.auditLog.stop()
+	s.ts = nil
+	s.uploadTS = nil
+	s.httpTS = nil
+	s.tenantTS = nil
+}
+
+// Shutdown stops the server gracefully: the listeners are closed right away,
+// and in-flight requests are allowed to complete until ctx is done. When ctx
+// expires before all connections are drained, the remaining connections are
+// closed and the error from ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	s.expirer.stop()
+	s.uploadGC.stop()
+	s.stopInventoryReports()
+	s.closeIdleConnections()
+	var shutdownErr error
+	for _, ts := range s.listeners() {
+		err := ts.Config.Shutdown(ctx)
+		if err != nil {
+			ts.CloseClientConnections()
+			shutdownErr = err
+		}
+		ts.Close()
+	}
+	if err := s.stopPersister(); err != nil && shutdownErr == nil {
+		shutdownErr = err
+	}
+	s.auditLog.stop()
+	s.ts = nil
+	s.uploadTS = nil
+	s.httpTS = nil
+	s.tenantTS = nil
+	return shutdownErr
+}
+
+func (s *Server) listeners() []*httptest.Server {
+	var servers []*httptest.Server
+	for _, ts := range append([]*httptest.Server{s.ts, s.uploadTS, s.httpTS}, s.tenantTS...) {
+		if ts != nil {
+			servers = append(servers, ts)
 		}
-		s.ts.Close()
+	}
+	return servers
+}
+
+func (s *Server) closeIdleConnections() {
+	if transport, ok := s.transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
 	}
 }
 
-// URL returns the server URL.
+// URL returns the server URL. It's empty when the server isn't running.
 func (s *Server) URL() string {
+	if s.parent != nil {
+		return s.parent.URL()
+	}
 	if s.externalURL != "" {
 		return s.externalURL
 	}
-	if s.ts != nil {
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	if s.ts != nil && s.unixSocket == "" {
 		return s.ts.URL
 	}
 	return ""
 }
 
+// Port returns the port the server listens on. When the server was created
+// with port zero, it's the port picked when the server started. It's zero
+// for servers created with NoListener or UnixSocket.
+func (s *Server) Port() uint16 {
+	if s.parent != nil {
+		return s.parent.Port()
+	}
+	s.lifecycleMtx.Lock()
+	defer s.lifecycleMtx.Unlock()
+	if s.noListener || s.unixSocket != "" {
+		return 0
+	}
+	return s.port
+}
+
+// UploadURL returns the URL of the server used for resumable uploads. It's the
+// same as URL, unless the server has a separate upload listener or an
+// external upload URL.
+func (s *Server) UploadURL() string {
+	if s.parent != nil {
+		return s.parent.UploadURL()
+	}
+	if s.uploadURL != "" {
+		return s.uploadURL
+	}
+	s.lifecycleMtx.Lock()
+	uploadTS := s.uploadTS
+	s.lifecycleMtx.Unlock()
+	if uploadTS != nil {
+		return uploadTS.URL
+	}
+	return s.URL()
+}
+
 // PublicURL returns the server's public download URL.
 func (s *Server) PublicURL() string {
 	return fmt.Sprintf("https://%s", s.publicHost)
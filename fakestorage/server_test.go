@@ -5,9 +5,21 @@
 package fakestorage
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
 )
 
 func TestNewServer(t *testing.T) {
@@ -238,3 +250,457 @@ func runServersTest(t *testing.T, objs []Object, fn func(*testing.T, *Server)) {
 		fn(t, noListenerServer)
 	})
 }
+
+func TestDownloadObjectMetadataHeaders(t *testing.T) {
+	objs := []Object{
+		{
+			BucketName:      "some-bucket",
+			Name:            "files/txt/text-01.txt",
+			Content:         []byte("something"),
+			ContentType:     "text/plain",
+			ContentLanguage: "en",
+			CacheControl:    "public, max-age=3600",
+			StorageClass:    "NEARLINE",
+			Generation:      1234,
+			Metageneration:  2,
+		},
+		{BucketName: "some-bucket", Name: "files/txt/text-02.txt", Content: []byte("default")},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		tests := []struct {
+			name            string
+			url             string
+			expectedHeaders map[string]string
+		}{
+			{
+				"custom metadata",
+				"https://storage.googleapis.com/some-bucket/files/txt/text-01.txt",
+				map[string]string{
+					"x-goog-generation":              "1234",
+					"x-goog-metageneration":          "2",
+					"x-goog-stored-content-length":   "9",
+					"x-goog-stored-content-encoding": "identity",
+					"x-goog-storage-class":           "NEARLINE",
+					"content-type":                   "text/plain",
+					"content-language":               "en",
+					"cache-control":                  "public, max-age=3600",
+				},
+			},
+			{
+				"default metadata",
+				"https://www.googleapis.com/download/storage/v1/b/some-bucket/o/files/txt/text-02.txt?alt=media",
+				map[string]string{
+					"x-goog-metageneration":        "1",
+					"x-goog-stored-content-length": "7",
+					"x-goog-storage-class":         "STANDARD",
+					"content-language":             "",
+					"cache-control":                "",
+				},
+			},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				resp, err := server.HTTPClient().Get(test.url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+				}
+				for k, expectedV := range test.expectedHeaders {
+					if v := resp.Header.Get(k); v != expectedV {
+						t.Errorf("wrong value for header %q:\nwant %q\ngot  %q", k, expectedV, v)
+					}
+				}
+				if resp.Header.Get("x-goog-generation") == "" {
+					t.Error("missing x-goog-generation header")
+				}
+			})
+		}
+	})
+}
+
+func TestDownloadObjectPathParity(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "files/txt/text-01.txt", Content: []byte("something"), Generation: 1234, Metageneration: 3},
+	}
+	paths := map[string]string{
+		"xml api":       "https://storage.googleapis.com/some-bucket/files/txt/text-01.txt?",
+		"json api":      "https://www.googleapis.com/storage/v1/b/some-bucket/o/files/txt/text-01.txt?alt=media&",
+		"download path": "https://www.googleapis.com/download/storage/v1/b/some-bucket/o/files/txt/text-01.txt?alt=media&",
+	}
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		headers        map[string]string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"full content", http.MethodGet, "", nil, http.StatusOK, "something"},
+		{"head", http.MethodHead, "", nil, http.StatusOK, ""},
+		{"range", http.MethodGet, "", map[string]string{"Range": "bytes=2-5"}, http.StatusPartialContent, ""},
+		{"matching generation", http.MethodGet, "generation=1234", nil, http.StatusOK, "something"},
+		{"other generation", http.MethodGet, "generation=1", nil, http.StatusNotFound, ""},
+		{"ifGenerationMatch", http.MethodGet, "ifGenerationMatch=1234", nil, http.StatusOK, "something"},
+		{"failed ifGenerationMatch", http.MethodGet, "ifGenerationMatch=1", nil, http.StatusPreconditionFailed, ""},
+		{"failed ifGenerationNotMatch", http.MethodGet, "ifGenerationNotMatch=1234", nil, http.StatusNotModified, ""},
+		{"failed ifMetagenerationMatch", http.MethodGet, "ifMetagenerationMatch=1", nil, http.StatusPreconditionFailed, ""},
+		{"failed x-goog-if-generation-match", http.MethodGet, "", map[string]string{"X-Goog-If-Generation-Match": "1"}, http.StatusPreconditionFailed, ""},
+		{"invalid generation", http.MethodGet, "generation=abc", nil, http.StatusBadRequest, ""},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		for pathName, baseURL := range paths {
+			for _, test := range tests {
+				baseURL := baseURL
+				test := test
+				t.Run(pathName+"/"+test.name, func(t *testing.T) {
+					if pathName == "json api" && test.method == http.MethodHead {
+						t.Skip("the JSON API doesn't serve HEAD requests")
+					}
+					req, err := http.NewRequest(test.method, baseURL+test.query, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for k, v := range test.headers {
+						req.Header.Set(k, v)
+					}
+					resp, err := server.HTTPClient().Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer resp.Body.Close()
+					if resp.StatusCode != test.expectedStatus {
+						t.Errorf("wrong status returned\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+					}
+					if test.expectedBody == "" {
+						return
+					}
+					data, err := ioutil.ReadAll(resp.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(data) != test.expectedBody {
+						t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, data)
+					}
+				})
+			}
+		}
+	})
+}
+
+func TestNewServerUploadListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadPort := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	server, err := NewServerWithOptions(Options{Host: "127.0.0.1", UploadPort: uploadPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	expectedUploadURL := fmt.Sprintf("https://127.0.0.1:%d", uploadPort)
+	if uploadURL := server.UploadURL(); uploadURL != expectedUploadURL {
+		t.Fatalf("wrong upload url\nwant %q\ngot  %q", expectedUploadURL, uploadURL)
+	}
+	if server.URL() == server.UploadURL() {
+		t.Fatalf("upload url is the same as the API url: %q", server.URL())
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			// #nosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Post(server.UploadURL()+"/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=some-object.txt", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, expectedUploadURL+"/upload/resumable/") {
+		t.Fatalf("wrong location for the resumable upload: %q", location)
+	}
+	req, err := http.NewRequest(http.MethodPut, location, strings.NewReader("some content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status returned\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL() + "/storage/v1/b/some-bucket/o/some-object.txt?alt=media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "some content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "some content", data)
+	}
+}
+
+func TestNewServerExternalUploadURL(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, ExternalURL: "https://gcs.example.com", ExternalUploadURL: "https://upload.gcs.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadURL := server.UploadURL(); uploadURL != "https://upload.gcs.example.com" {
+		t.Errorf("wrong upload url\nwant %q\ngot  %q", "https://upload.gcs.example.com", uploadURL)
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	t.Parallel()
+	server, err := NewServerWithOptions(Options{Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	port := server.Port()
+	if port == 0 {
+		t.Fatal("unexpected zero port")
+	}
+	expectedURL := fmt.Sprintf("https://127.0.0.1:%d", port)
+	if url := server.URL(); url != expectedURL {
+		t.Errorf("wrong url returned\nwant %q\ngot  %q", expectedURL, url)
+	}
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+
+	err = server.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := server.URL(); url != "" {
+		t.Errorf("unexpected non-empty url after shutdown: %q", url)
+	}
+	_, err = client.Get("https://www.googleapis.com/storage/v1/b/some-bucket")
+	if err == nil {
+		t.Fatal("unexpected <nil> error after shutdown")
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Port() != port {
+		t.Errorf("wrong port after restart\nwant %d\ngot  %d", port, server.Port())
+	}
+	resp, err := client.Get("https://www.googleapis.com/storage/v1/b/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code after restart\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	err = server.Start()
+	if err != nil {
+		t.Fatalf("unexpected error starting a running server: %v", err)
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	t.Parallel()
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+
+	// #nosec
+	conn, err := tls.Dial("tcp", server.ts.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the server only sends "100 Continue" once the handler starts reading
+	// the body, so the request is in flight when shutting down.
+	fmt.Fprint(conn, "POST /upload/storage/v1/b/some-bucket/o?uploadType=media&name=some-object.txt HTTP/1.1\r\n"+
+		"Host: www.googleapis.com\r\nContent-Length: 100\r\nExpect: 100-continue\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status, "100 Continue") {
+		t.Fatalf("unexpected status line: %q", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("wrong error returned\nwant %v\ngot  %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestServerNoListenerPort(t *testing.T) {
+	t.Parallel()
+	server, err := NewServerWithOptions(Options{NoListener: true, Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if port := server.Port(); port != 0 {
+		t.Errorf("unexpected non-zero port: %d", port)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerPortZero(t *testing.T) {
+	t.Parallel()
+	tempDir, err := ioutil.TempDir("", "fakestorage-address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	addressFile := filepath.Join(tempDir, "address")
+	var log bytes.Buffer
+	server, err := NewServerWithOptions(Options{
+		Host:        "127.0.0.1",
+		Port:        0,
+		AddressFile: addressFile,
+		AccessLog:   &log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if server.Port() == 0 {
+		t.Fatal("unexpected zero port")
+	}
+	expectedURL := fmt.Sprintf("https://127.0.0.1:%d", server.Port())
+	if url := server.URL(); url != expectedURL {
+		t.Errorf("wrong url returned\nwant %q\ngot  %q", expectedURL, url)
+	}
+	address, err := ioutil.ReadFile(addressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(address) != expectedURL+"\n" {
+		t.Errorf("wrong address file content\nwant %q\ngot  %q", expectedURL+"\n", address)
+	}
+	if !strings.Contains(log.String(), "server listening on "+expectedURL) {
+		t.Errorf("startup line not found in log %q", log.String())
+	}
+}
+
+func TestServerAddressFileErrorClosesListeners(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	_, err = NewServerWithOptions(Options{
+		Host:        "127.0.0.1",
+		Port:        port,
+		AddressFile: filepath.Join(os.TempDir(), "fakestorage-missing-dir", "address"),
+	})
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("listener wasn't closed: %v", err)
+	}
+	l.Close()
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	t.Parallel()
+	tempDir, err := ioutil.TempDir("", "fakestorage-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	socket := filepath.Join(tempDir, "gcs.sock")
+	server, err := NewServerWithOptions(Options{UnixSocket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if url := server.URL(); url != "" {
+		t.Errorf("unexpected non-empty url: %q", url)
+	}
+	if port := server.Port(); port != 0 {
+		t.Errorf("unexpected non-zero port: %d", port)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("socket not created at %s: %v", socket, err)
+	}
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := server.Client().Bucket("some-bucket").Object("some-object.txt").NewWriter(context.Background())
+	w.ChunkSize = googleapi.MinUploadChunkSize
+	w.Write([]byte("some content"))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := server.GetObject("some-bucket", "some-object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "some content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "some content", obj.Content)
+	}
+
+	server.Stop()
+	err = server.Start()
+	if err != nil {
+		t.Fatalf("failed to restart the server on the same socket: %v", err)
+	}
+	_, err = server.Client().Bucket("some-bucket").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadObjectHashHeaders(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		content := []byte("something")
+		if err := server.CreateObject(Object{
+			BucketName: "some-bucket",
+			Name:       "files/txt/text-01.txt",
+			Content:    content,
+			Crc32c:     encodedCrc32cChecksum(content),
+			Md5Hash:    encodedMd5Hash(content),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/some-bucket/files/txt/text-01.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		expected := []string{"crc32c=" + encodedCrc32cChecksum(content), "md5=" + encodedMd5Hash(content)}
+		if hashes := resp.Header["X-Goog-Hash"]; strings.Join(hashes, ",") != strings.Join(expected, ",") {
+			t.Errorf("wrong x-goog-hash headers\nwant %q\ngot  %q", expected, hashes)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// signedURLDateFormat is the format of the X-Goog-Date parameter of V4
+// signed URLs.
+const signedURLDateFormat = "20060102T150405Z"
+
+// maxSignedURLExpires is the maximum value of the X-Goog-Expires parameter of
+// V4 signed URLs, in seconds (7 days).
+const maxSignedURLExpires = 604800
+
+// signedURLState holds the knobs used to validate the expiration of signed
+// URLs: the skew applied to the clock of the server, and the objects whose
+// signed URLs are rejected as expired regardless of their parameters.
+type signedURLState struct {
+	mtx     sync.Mutex
+	skew    time.Duration
+	expired map[string]bool
+}
+
+// SetSignedURLClockSkew changes the offset applied to the clock of the server
+// when validating the expiration of signed URLs. See
+// Options.SignedURLClockSkew for details.
+//
+// The same can be done with a PUT request to /_internal/signedURLs/clockSkew
+// with a JSON body such as {"skew": "-5m"}.
+func (s *Server) SetSignedURLClockSkew(skew time.Duration) {
+	s.signedURLs.mtx.Lock()
+	defer s.signedURLs.mtx.Unlock()
+	s.signedURLs.skew = skew
+}
+
+// ExpireSignedURLs makes requests to the given object through signed URLs
+// fail as expired, regardless of their expiration parameters, until
+// ClearExpiredSignedURLs is called. Requests without signatures are not
+// affected.
+//
+// The same can be done with a PUT request to
+// /_internal/signedURLs/expired/<bucket>/<object>, and the object can be
+// cleared with a DELETE request to the same path.
+func (s *Server) ExpireSignedURLs(bucketName, objectName string) {
+	s.signedURLs.mtx.Lock()
+	defer s.signedURLs.mtx.Unlock()
+	if s.signedURLs.expired == nil {
+		s.signedURLs.expired = make(map[string]bool)
+	}
+	s.signedURLs.expired[bucketName+"/"+objectName] = true
+}
+
+// ClearExpiredSignedURLs undoes ExpireSignedURLs for the given object.
+func (s *Server) ClearExpiredSignedURLs(bucketName, objectName string) {
+	s.signedURLs.mtx.Lock()
+	defer s.signedURLs.mtx.Unlock()
+	delete(s.signedURLs.expired, bucketName+"/"+objectName)
+}
+
+func (st *signedURLState) now() time.Time {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return time.Now().Add(st.skew)
+}
+
+func (st *signedURLState) forceExpired(bucketName, objectName string) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	return st.expired[bucketName+"/"+objectName]
+}
+
+// signedURLWindow returns the time range where the signed URL with the given
+// query string is valid. ok is false for requests that are not signed.
+//
+// Signatures themselves are not verified, as the server has no access to the
+// keys used to sign URLs.
+func signedURLWindow(query url.Values) (start, end time.Time, ok bool, err error) {
+	if query.Get("X-Goog-Signature") != "" {
+		start, err = time.Parse(signedURLDateFormat, query.Get("X-Goog-Date"))
+		if err != nil {
+			return start, end, true, fmt.Errorf("invalid X-Goog-Date %q", query.Get("X-Goog-Date"))
+		}
+		expires, err := strconv.Atoi(query.Get("X-Goog-Expires"))
+		if err != nil || expires < 1 || expires > maxSignedURLExpires {
+			return start, end, true, fmt.Errorf("invalid X-Goog-Expires %q", query.Get("X-Goog-Expires"))
+		}
+		return start, start.Add(time.Duration(expires) * time.Second), true, nil
+	}
+	if query.Get("Signature") != "" {
+		expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+		if err != nil {
+			return start, end, true, fmt.Errorf("invalid Expires %q", query.Get("Expires"))
+		}
+		return start, time.Unix(expires, 0), true, nil
+	}
+	return start, end, false, nil
+}
+
+func (s *Server) signedURLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start, end, ok, err := signedURLWindow(r.URL.Query())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			writeXMLError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		now := s.signedURLs.now()
+		if now.Before(start) {
+			writeXMLError(w, http.StatusBadRequest, "InvalidArgument", "The request is not yet valid. Request signature is valid from: "+start.UTC().Format(time.RFC3339))
+			return
+		}
+		bucketName, objectName := requestTarget(r)
+		if !now.Before(end) || s.signedURLs.forceExpired(bucketName, objectName) {
+			writeXMLError(w, http.StatusBadRequest, "ExpiredToken", "The provided token has expired. Request signature expired at: "+end.UTC().Format(time.RFC3339))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) setSignedURLClockSkewByPut(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Skew string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var skew time.Duration
+	if data.Skew != "" {
+		var err error
+		skew, err = time.ParseDuration(data.Skew)
+		if err != nil {
+			http.Error(w, "invalid skew", http.StatusBadRequest)
+			return
+		}
+	}
+	s.SetSignedURLClockSkew(skew)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) expireSignedURLsByPut(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.ExpireSignedURLs(vars["bucketName"], vars["objectName"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearExpiredSignedURLsByDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.ClearExpiredSignedURLs(vars["bucketName"], vars["objectName"])
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v4SignedURL(date time.Time, expires int) string {
+	return fmt.Sprintf("https://storage.googleapis.com/some-bucket/object.txt?X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Date=%s&X-Goog-Expires=%d&X-Goog-SignedHeaders=host&X-Goog-Signature=abcdef",
+		date.UTC().Format(signedURLDateFormat), expires)
+}
+
+func v2SignedURL(expires time.Time) string {
+	return "https://storage.googleapis.com/some-bucket/object.txt?GoogleAccessId=someone&Signature=abcdef&Expires=" + strconv.FormatInt(expires.Unix(), 10)
+}
+
+func TestServerSignedURLExpiration(t *testing.T) {
+	now := time.Now()
+	var tests = []struct {
+		name         string
+		skew         time.Duration
+		url          string
+		expectedCode string
+	}{
+		{"v4 valid", 0, v4SignedURL(now.Add(-time.Minute), 600), ""},
+		{"v4 expired", 0, v4SignedURL(now.Add(-time.Hour), 600), "ExpiredToken"},
+		{"v4 expired by skew", 20 * time.Minute, v4SignedURL(now.Add(-time.Minute), 600), "ExpiredToken"},
+		{"v4 not yet valid", -10 * time.Minute, v4SignedURL(now.Add(-time.Minute), 3600), "InvalidArgument"},
+		{"v4 invalid expires", 0, v4SignedURL(now, maxSignedURLExpires+1), "InvalidArgument"},
+		{"v2 valid", 0, v2SignedURL(now.Add(time.Minute)), ""},
+		{"v2 expired", 0, v2SignedURL(now.Add(-time.Minute)), "ExpiredToken"},
+		{"v2 valid with skew", -2 * time.Minute, v2SignedURL(now.Add(-time.Minute)), ""},
+		{"unsigned", time.Hour, "https://storage.googleapis.com/some-bucket/object.txt", ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				NoListener:         true,
+				SignedURLClockSkew: test.skew,
+				InitialObjects:     []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			code := getXMLErrorCode(t, server, test.url)
+			if code != test.expectedCode {
+				t.Errorf("wrong error code\nwant %q\ngot  %q", test.expectedCode, code)
+			}
+		})
+	}
+}
+
+func TestServerForceExpiredSignedURL(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	url := v4SignedURL(time.Now(), 600)
+
+	req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/signedURLs/expired/some-bucket/object.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if code := getXMLErrorCode(t, server, url); code != "ExpiredToken" {
+		t.Errorf("wrong error code\nwant %q\ngot  %q", "ExpiredToken", code)
+	}
+	if code := getXMLErrorCode(t, server, "https://storage.googleapis.com/some-bucket/object.txt"); code != "" {
+		t.Errorf("unexpected error for unsigned request: %q", code)
+	}
+
+	server.ClearExpiredSignedURLs("some-bucket", "object.txt")
+	if code := getXMLErrorCode(t, server, url); code != "" {
+		t.Errorf("unexpected error after clearing: %q", code)
+	}
+}
+
+func TestServerSignedURLClockSkewByPut(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/signedURLs/clockSkew", strings.NewReader(`{"skew":"1h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if code := getXMLErrorCode(t, server, v4SignedURL(time.Now(), 600)); code != "ExpiredToken" {
+		t.Errorf("wrong error code\nwant %q\ngot  %q", "ExpiredToken", code)
+	}
+}
+
+// getXMLErrorCode downloads the given URL and returns the code of the XML
+// error in the response, or an empty string for successful responses.
+func getXMLErrorCode(t *testing.T, server *Server, url string) string {
+	t.Helper()
+	resp, err := server.HTTPClient().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return ""
+	}
+	var xmlErr xmlError
+	if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+		t.Fatalf("invalid error document for status %d: %v", resp.StatusCode, err)
+	}
+	return xmlErr.Code
+}
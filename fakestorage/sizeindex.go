@@ -0,0 +1,167 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"time"
+)
+
+// sizeIndex keeps the sizes of the objects stored in each bucket, be it
+// live, noncurrent or soft-deleted, so quotas, BucketUsage and BucketStats
+// don't need to list (and, with StorageRoot, read) every object of the
+// server.
+//
+// Buckets are loaded from the backend on first use, see Server.bucketSizes,
+// and kept up to date by the writes made through the server afterwards.
+// Callers must hold writeMtx.
+type sizeIndex struct {
+	buckets map[string]*bucketSizes
+}
+
+// bucketSizes is the entry of a bucket in sizeIndex. The bytes of live and
+// noncurrent objects are counted as objects are written and deleted.
+// Soft-deleted objects are kept apart, as they stop counting once their
+// retention expires, even before they're removed from the backend.
+type bucketSizes struct {
+	live            map[string]objectSize
+	noncurrent      map[generationKey]objectSize
+	softDeleted     map[generationKey]objectSize
+	liveBytes       int64
+	noncurrentBytes int64
+}
+
+type generationKey struct {
+	name       string
+	generation int64
+}
+
+type objectSize struct {
+	generation     int64
+	size           int64
+	hardDeleteTime time.Time
+}
+
+func newBucketSizes() *bucketSizes {
+	return &bucketSizes{
+		live:        make(map[string]objectSize),
+		noncurrent:  make(map[generationKey]objectSize),
+		softDeleted: make(map[generationKey]objectSize),
+	}
+}
+
+// bucketSizes returns the entry of the given bucket in the index, loading it
+// from the backend if needed. Callers must hold writeMtx.
+func (s *Server) bucketSizes(bucketName string) (*bucketSizes, error) {
+	if sizes, ok := s.sizes.buckets[bucketName]; ok {
+		return sizes, nil
+	}
+	live, _, err := s.listObjectsMetadata(bucketName, "", "")
+	if err != nil {
+		return nil, err
+	}
+	noncurrent, err := s.backend.ListNoncurrentObjects(bucketName)
+	if err != nil {
+		return nil, bucketError(err)
+	}
+	sizes := newBucketSizes()
+	for _, obj := range live {
+		sizes.setLive(obj)
+	}
+	for _, obj := range fromBackendObjects(noncurrent) {
+		sizes.setNoncurrent(obj)
+	}
+	if s.sizes.buckets == nil {
+		s.sizes.buckets = make(map[string]*bucketSizes)
+	}
+	s.sizes.buckets[bucketName] = sizes
+	return sizes, nil
+}
+
+// retainedSoftDeleted returns the number and size of the soft-deleted objects
+// still retained at the given time.
+func (b *bucketSizes) retainedSoftDeleted(now time.Time) (int64, int64) {
+	var count, bytes int64
+	for _, obj := range b.softDeleted {
+		if now.Before(obj.hardDeleteTime) {
+			count++
+			bytes += obj.size
+		}
+	}
+	return count, bytes
+}
+
+// storedBytes returns the size of all the generations stored in the bucket
+// at the given time.
+func (b *bucketSizes) storedBytes(now time.Time) int64 {
+	_, softDeletedBytes := b.retainedSoftDeleted(now)
+	return b.liveBytes + b.noncurrentBytes + softDeletedBytes
+}
+
+func (b *bucketSizes) setLive(obj Object) {
+	b.deleteLive(obj.Name)
+	size := objectSize{generation: obj.Generation, size: obj.size()}
+	b.live[obj.Name] = size
+	b.liveBytes += size.size
+}
+
+func (b *bucketSizes) deleteLive(name string) {
+	if previous, ok := b.live[name]; ok {
+		b.liveBytes -= previous.size
+		delete(b.live, name)
+	}
+}
+
+func (b *bucketSizes) setNoncurrent(obj Object) {
+	key := generationKey{name: obj.Name, generation: obj.Generation}
+	b.deleteNoncurrent(key)
+	size := objectSize{generation: obj.Generation, size: obj.size(), hardDeleteTime: obj.HardDeleteTime}
+	if !obj.SoftDeleteTime.IsZero() {
+		b.softDeleted[key] = size
+		return
+	}
+	b.noncurrent[key] = size
+	b.noncurrentBytes += size.size
+}
+
+func (b *bucketSizes) deleteNoncurrent(key generationKey) {
+	if previous, ok := b.noncurrent[key]; ok {
+		b.noncurrentBytes -= previous.size
+		delete(b.noncurrent, key)
+	}
+	delete(b.softDeleted, key)
+}
+
+// liveObjectStored updates the index after obj is stored as a live object.
+// Buckets that weren't loaded yet are left alone, as they're loaded with the
+// object.
+func (idx *sizeIndex) liveObjectStored(obj Object) {
+	if sizes, ok := idx.buckets[obj.BucketName]; ok {
+		sizes.setLive(obj)
+	}
+}
+
+// liveObjectDeleted updates the index after the live version of an object is
+// deleted.
+func (idx *sizeIndex) liveObjectDeleted(obj Object) {
+	if sizes, ok := idx.buckets[obj.BucketName]; ok {
+		sizes.deleteLive(obj.Name)
+	}
+}
+
+// noncurrentObjectStored updates the index after obj is stored as a
+// noncurrent or soft-deleted generation.
+func (idx *sizeIndex) noncurrentObjectStored(obj Object) {
+	if sizes, ok := idx.buckets[obj.BucketName]; ok {
+		sizes.setNoncurrent(obj)
+	}
+}
+
+// noncurrentObjectDeleted updates the index after a noncurrent or
+// soft-deleted generation is deleted.
+func (idx *sizeIndex) noncurrentObjectDeleted(obj Object) {
+	if sizes, ok := idx.buckets[obj.BucketName]; ok {
+		sizes.deleteNoncurrent(generationKey{name: obj.Name, generation: obj.Generation})
+	}
+}
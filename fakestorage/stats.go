@@ -0,0 +1,143 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultLargestObjects is the number of objects included in
+// BucketStats.LargestObjects by default.
+const defaultLargestObjects = 10
+
+// BucketStats summarizes the contents of a bucket.
+type BucketStats struct {
+	Bucket string `json:"bucket"`
+
+	// ObjectCount and TotalBytes account for live objects.
+	ObjectCount int   `json:"objectCount"`
+	TotalBytes  int64 `json:"totalBytes"`
+
+	// NoncurrentCount and NoncurrentBytes account for noncurrent
+	// generations, kept in buckets with versioning enabled.
+	NoncurrentCount int   `json:"noncurrentCount"`
+	NoncurrentBytes int64 `json:"noncurrentBytes"`
+
+	// SoftDeletedCount and SoftDeletedBytes account for soft-deleted
+	// objects that are still retained.
+	SoftDeletedCount int   `json:"softDeletedCount"`
+	SoftDeletedBytes int64 `json:"softDeletedBytes"`
+
+	// GenerationCounts maps a number of generations to the number of
+	// objects with that many generations stored, counting the live
+	// generation and the noncurrent ones.
+	GenerationCounts map[int]int `json:"generationCounts"`
+
+	// LargestObjects are the largest live objects in the bucket, sorted by
+	// size in descending order.
+	LargestObjects []ObjectStats `json:"largestObjects"`
+}
+
+// ObjectStats identifies an object in BucketStats.
+type ObjectStats struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation,string"`
+	Size       int64  `json:"size,string"`
+}
+
+// BucketStats returns statistics about the objects in the given bucket, or an
+// error if the bucket doesn't exist.
+func (s *Server) BucketStats(bucketName string) (BucketStats, error) {
+	return s.bucketStats(bucketName, defaultLargestObjects)
+}
+
+// bucketStats computes the statistics of a bucket from sizeIndex, so objects
+// aren't loaded.
+func (s *Server) bucketStats(bucketName string, largest int) (BucketStats, error) {
+	stats := BucketStats{Bucket: bucketName, GenerationCounts: map[int]int{}, LargestObjects: []ObjectStats{}}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	sizes, err := s.bucketSizes(bucketName)
+	if err != nil {
+		return stats, err
+	}
+	stats.ObjectCount = len(sizes.live)
+	stats.TotalBytes = sizes.liveBytes
+	stats.NoncurrentCount = len(sizes.noncurrent)
+	stats.NoncurrentBytes = sizes.noncurrentBytes
+	softDeletedCount, softDeletedBytes := sizes.retainedSoftDeleted(time.Now())
+	stats.SoftDeletedCount = int(softDeletedCount)
+	stats.SoftDeletedBytes = softDeletedBytes
+	generations := make(map[string]int)
+	live := make([]ObjectStats, 0, len(sizes.live))
+	for name, obj := range sizes.live {
+		generations[name]++
+		live = append(live, ObjectStats{Name: name, Generation: obj.generation, Size: obj.size})
+	}
+	for key := range sizes.noncurrent {
+		generations[key.name]++
+	}
+	for _, count := range generations {
+		stats.GenerationCounts[count]++
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Size != live[j].Size {
+			return live[i].Size > live[j].Size
+		}
+		return live[i].Name < live[j].Name
+	})
+	if len(live) > largest {
+		live = live[:largest]
+	}
+	stats.LargestObjects = append(stats.LargestObjects, live...)
+	return stats, nil
+}
+
+// getStats handles a GET request for the statistics of all buckets, or of a
+// single bucket when the path includes its name. The largest parameter
+// controls the number of objects in LargestObjects.
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	largest := defaultLargestObjects
+	if value := r.URL.Query().Get("largest"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid largest", http.StatusBadRequest)
+			return
+		}
+		largest = n
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if bucketName, ok := mux.Vars(r)["bucketName"]; ok {
+		stats, err := s.bucketStats(bucketName, largest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	allStats := []BucketStats{}
+	for _, bucket := range buckets {
+		stats, err := s.bucketStats(bucket.Name, largest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		allStats = append(allStats, stats)
+	}
+	json.NewEncoder(w).Encode(allStats)
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestServerBucketStats(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("some-bucket")
+		writeObjectContent(t, bucket.Object("a.txt"), "a")
+		writeObjectContent(t, bucket.Object("a.txt"), "aaa")
+		writeObjectContent(t, bucket.Object("a.txt"), "aaaa")
+		writeObjectContent(t, bucket.Object("b.txt"), "bbbbbb")
+		writeObjectContent(t, bucket.Object("c.txt"), "cc")
+
+		stats, err := server.BucketStats("some-bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ObjectCount != 3 || stats.TotalBytes != 12 {
+			t.Errorf("wrong live stats\nwant 3 objects, 12 bytes\ngot  %d objects, %d bytes", stats.ObjectCount, stats.TotalBytes)
+		}
+		if stats.NoncurrentCount != 2 || stats.NoncurrentBytes != 4 {
+			t.Errorf("wrong noncurrent stats\nwant 2 objects, 4 bytes\ngot  %d objects, %d bytes", stats.NoncurrentCount, stats.NoncurrentBytes)
+		}
+		if expected := map[int]int{1: 2, 3: 1}; !reflect.DeepEqual(stats.GenerationCounts, expected) {
+			t.Errorf("wrong generation counts\nwant %v\ngot  %v", expected, stats.GenerationCounts)
+		}
+		var largest []string
+		for _, obj := range stats.LargestObjects {
+			largest = append(largest, obj.Name)
+		}
+		if expected := []string{"b.txt", "a.txt", "c.txt"}; !reflect.DeepEqual(largest, expected) {
+			t.Errorf("wrong largest objects\nwant %v\ngot  %v", expected, largest)
+		}
+
+		if _, err := server.BucketStats("missing-bucket"); err == nil {
+			t.Error("unexpected nil error for missing bucket")
+		}
+	})
+}
+
+func TestServerBucketStatsEndpoint(t *testing.T) {
+	objs := []Object{
+		{BucketName: "bucket-1", Name: "small.txt", Content: []byte("s")},
+		{BucketName: "bucket-1", Name: "large.txt", Content: []byte("large")},
+		{BucketName: "bucket-2", Name: "object.txt", Content: []byte("object")},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		resp, err := server.HTTPClient().Get("https://www.googleapis.com/_internal/stats/bucket-1?largest=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var stats BucketStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		expected := []ObjectStats{{Name: "large.txt", Generation: stats.LargestObjects[0].Generation, Size: 5}}
+		if !reflect.DeepEqual(stats.LargestObjects, expected) {
+			t.Errorf("wrong largest objects\nwant %+v\ngot  %+v", expected, stats.LargestObjects)
+		}
+
+		resp, err = server.HTTPClient().Get("https://www.googleapis.com/_internal/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var allStats []BucketStats
+		if err := json.NewDecoder(resp.Body).Decode(&allStats); err != nil {
+			t.Fatal(err)
+		}
+		if len(allStats) != 2 || allStats[0].Bucket != "bucket-1" || allStats[1].Bucket != "bucket-2" {
+			t.Fatalf("wrong buckets in stats: %+v", allStats)
+		}
+		if allStats[1].ObjectCount != 1 || allStats[1].TotalBytes != 6 {
+			t.Errorf("wrong stats for bucket-2: %+v", allStats[1])
+		}
+
+		resp, err = server.HTTPClient().Get("https://www.googleapis.com/_internal/stats/missing-bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("wrong status code for missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
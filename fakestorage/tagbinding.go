@@ -0,0 +1,237 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tagBindingsPath is the path of the collection of tag bindings in the Cloud
+// Resource Manager API (v3).
+const tagBindingsPath = "/v3/tagBindings"
+
+// bucketTagParentPrefix is the prefix of the full resource names of buckets,
+// used as the parent of their tag bindings.
+const bucketTagParentPrefix = "//storage.googleapis.com/projects/_/buckets/"
+
+var tagValuePattern = regexp.MustCompile(`^tagValues/[0-9]+$`)
+
+// TagBinding attaches a resource manager tag value to a bucket.
+type TagBinding struct {
+	BucketName string
+	// TagValue is the name of the tag value, such as tagValues/123.
+	TagValue string
+	// TagValueNamespacedName is the namespaced name of the tag value,
+	// such as my-project/environment/production. It's only set when the
+	// binding was created with it.
+	TagValueNamespacedName string
+}
+
+// name returns the resource name of the binding, with the parent escaped
+// like in Cloud Resource Manager.
+func (b TagBinding) name() string {
+	return "tagBindings/" + url.PathEscape(b.parent()) + "/" + b.tagValueRef()
+}
+
+func (b TagBinding) parent() string {
+	return bucketTagParentPrefix + b.BucketName
+}
+
+func (b TagBinding) tagValueRef() string {
+	if b.TagValue != "" {
+		return b.TagValue
+	}
+	return b.TagValueNamespacedName
+}
+
+type tagBindingState struct {
+	mtx      sync.Mutex
+	bindings map[string][]TagBinding
+}
+
+// TagBindings returns the tag bindings of the given bucket, sorted by tag
+// value.
+func (s *Server) TagBindings(bucketName string) []TagBinding {
+	s.tagBindings.mtx.Lock()
+	defer s.tagBindings.mtx.Unlock()
+	return append([]TagBinding(nil), s.tagBindings.bindings[bucketName]...)
+}
+
+func (st *tagBindingState) add(binding TagBinding) error {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	for _, existing := range st.bindings[binding.BucketName] {
+		if existing.tagValueRef() == binding.tagValueRef() {
+			return &statusError{code: http.StatusConflict, reason: "alreadyExists", message: fmt.Sprintf("A binding already exists between the resource %s and the tag value %s.", binding.parent(), binding.tagValueRef())}
+		}
+	}
+	if st.bindings == nil {
+		st.bindings = make(map[string][]TagBinding)
+	}
+	bindings := append(st.bindings[binding.BucketName], binding)
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].tagValueRef() < bindings[j].tagValueRef() })
+	st.bindings[binding.BucketName] = bindings
+	return nil
+}
+
+func (st *tagBindingState) remove(bucketName, tagValue string) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	bindings := st.bindings[bucketName]
+	for i, binding := range bindings {
+		if binding.tagValueRef() == tagValue {
+			st.bindings[bucketName] = append(bindings[:i:i], bindings[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func isTagBindingsRequest(r *http.Request) bool {
+	return r.URL.Path == tagBindingsPath || strings.HasPrefix(r.URL.Path, tagBindingsPath+"/")
+}
+
+// serveTagBindings handles the tag bindings endpoints of the Cloud Resource
+// Manager API, restricted to buckets. The names of bindings contain escaped
+// slashes, which the router would unescape and clean, so these requests are
+// dispatched before reaching it.
+func (s *Server) serveTagBindings(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == tagBindingsPath && r.Method == http.MethodGet:
+		s.listTagBindings(w, r)
+	case r.URL.Path == tagBindingsPath && r.Method == http.MethodPost:
+		s.createTagBinding(w, r)
+	case r.URL.Path != tagBindingsPath && r.Method == http.MethodDelete:
+		s.deleteTagBinding(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tagBindingBucket returns the name of the bucket in the given parent of a
+// tag binding, or an error if it's not an existing bucket.
+func (s *Server) tagBindingBucket(parent string) (string, error) {
+	if !strings.HasPrefix(parent, bucketTagParentPrefix) || len(parent) == len(bucketTagParentPrefix) {
+		return "", &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid parent %q, only buckets are supported, as %s<bucket>", parent, bucketTagParentPrefix)}
+	}
+	bucketName := parent[len(bucketTagParentPrefix):]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return "", &statusError{code: http.StatusNotFound, reason: "notFound", message: fmt.Sprintf("Resource %s not found.", parent)}
+	}
+	return bucketName, nil
+}
+
+type tagBindingResponse struct {
+	Type                   string `json:"@type,omitempty"`
+	Name                   string `json:"name"`
+	Parent                 string `json:"parent"`
+	TagValue               string `json:"tagValue,omitempty"`
+	TagValueNamespacedName string `json:"tagValueNamespacedName,omitempty"`
+}
+
+func newTagBindingResponse(binding TagBinding) tagBindingResponse {
+	return tagBindingResponse{
+		Name:                   binding.name(),
+		Parent:                 binding.parent(),
+		TagValue:               binding.TagValue,
+		TagValueNamespacedName: binding.TagValueNamespacedName,
+	}
+}
+
+// tagBindingOperation is a long-running operation of Cloud Resource Manager.
+// Operations on tag bindings complete immediately.
+type tagBindingOperation struct {
+	Name     string      `json:"name"`
+	Done     bool        `json:"done"`
+	Response interface{} `json:"response"`
+}
+
+func (s *Server) createTagBinding(w http.ResponseWriter, r *http.Request) {
+	var req tagBindingResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "parseError", message: err.Error()})
+		return
+	}
+	bucketName, err := s.tagBindingBucket(req.Parent)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	switch {
+	case req.TagValue == "" && req.TagValueNamespacedName == "":
+		err = &statusError{code: http.StatusBadRequest, reason: "required", message: "One of tagValue or tagValueNamespacedName is required."}
+	case req.TagValue != "" && !tagValuePattern.MatchString(req.TagValue):
+		err = &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid tag value %q, it must be of the form tagValues/<id>.", req.TagValue)}
+	case req.TagValue == "" && strings.Count(req.TagValueNamespacedName, "/") != 2:
+		err = &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid namespaced tag value %q, it must be of the form <parent>/<key>/<value>.", req.TagValueNamespacedName)}
+	}
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	binding := TagBinding{BucketName: bucketName, TagValue: req.TagValue, TagValueNamespacedName: req.TagValueNamespacedName}
+	if err := s.tagBindings.add(binding); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	id, err := s.ids.operationID()
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	resp := newTagBindingResponse(binding)
+	resp.Type = "type.googleapis.com/google.cloud.resourcemanager.v3.TagBinding"
+	writeJSON(w, tagBindingOperation{Name: "operations/rctb." + id, Done: true, Response: resp})
+}
+
+func (s *Server) listTagBindings(w http.ResponseWriter, r *http.Request) {
+	bucketName, err := s.tagBindingBucket(r.URL.Query().Get("parent"))
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	var resp struct {
+		TagBindings []tagBindingResponse `json:"tagBindings,omitempty"`
+	}
+	for _, binding := range s.TagBindings(bucketName) {
+		resp.TagBindings = append(resp.TagBindings, newTagBindingResponse(binding))
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) deleteTagBinding(w http.ResponseWriter, r *http.Request) {
+	// the name is tagBindings/<escaped parent>/<tag value>, and tag values
+	// have a slash in their names.
+	name := strings.TrimPrefix(r.URL.EscapedPath(), tagBindingsPath+"/")
+	parts := strings.SplitN(name, "/", 2)
+	parent, err := url.PathUnescape(parts[0])
+	if err != nil || len(parts) != 2 {
+		writeStatusError(w, &statusError{code: http.StatusBadRequest, reason: "invalid", message: fmt.Sprintf("Invalid tag binding name %q.", name)})
+		return
+	}
+	tagValue, _ := url.PathUnescape(parts[1])
+	bucketName, err := s.tagBindingBucket(parent)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if !s.tagBindings.remove(bucketName, tagValue) {
+		writeStatusError(w, &statusError{code: http.StatusNotFound, reason: "notFound", message: fmt.Sprintf("Tag binding tagBindings/%s not found.", name)})
+		return
+	}
+	id, err := s.ids.operationID()
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, tagBindingOperation{Name: "operations/rdtb." + id, Done: true, Response: map[string]string{"@type": "type.googleapis.com/google.protobuf.Empty"}})
+}
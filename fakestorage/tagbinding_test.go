@@ -0,0 +1,102 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func doTagBindingRequest(t *testing.T, server *Server, method, path, body string, result interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, "https://cloudresourcemanager.googleapis.com"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServerTagBindings(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		const parent = "//storage.googleapis.com/projects/_/buckets/some-bucket"
+
+		var op struct {
+			Name     string
+			Done     bool
+			Response tagBindingResponse
+		}
+		status := doTagBindingRequest(t, server, http.MethodPost, "/v3/tagBindings", `{"parent":"`+parent+`","tagValue":"tagValues/123"}`, &op)
+		if status != http.StatusOK {
+			t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+		expectedName := "tagBindings/" + url.PathEscape(parent) + "/tagValues/123"
+		if !op.Done || op.Response.Name != expectedName || op.Response.TagValue != "tagValues/123" {
+			t.Errorf("wrong operation: %+v", op)
+		}
+		status = doTagBindingRequest(t, server, http.MethodPost, "/v3/tagBindings", `{"parent":"`+parent+`","tagValueNamespacedName":"my-project/env/prod"}`, nil)
+		if status != http.StatusOK {
+			t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+
+		var errorTests = []struct {
+			name           string
+			body           string
+			expectedStatus int
+		}{
+			{"duplicate", `{"parent":"` + parent + `","tagValue":"tagValues/123"}`, http.StatusConflict},
+			{"missing bucket", `{"parent":"//storage.googleapis.com/projects/_/buckets/missing","tagValue":"tagValues/123"}`, http.StatusNotFound},
+			{"not a bucket", `{"parent":"//cloudresourcemanager.googleapis.com/projects/123","tagValue":"tagValues/123"}`, http.StatusBadRequest},
+			{"invalid tag value", `{"parent":"` + parent + `","tagValue":"123"}`, http.StatusBadRequest},
+			{"missing tag value", `{"parent":"` + parent + `"}`, http.StatusBadRequest},
+		}
+		for _, test := range errorTests {
+			if status := doTagBindingRequest(t, server, http.MethodPost, "/v3/tagBindings", test.body, nil); status != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, status)
+			}
+		}
+
+		var list struct {
+			TagBindings []tagBindingResponse
+		}
+		doTagBindingRequest(t, server, http.MethodGet, "/v3/tagBindings?parent="+url.QueryEscape(parent), "", &list)
+		var values []string
+		for _, binding := range list.TagBindings {
+			values = append(values, binding.TagValue+binding.TagValueNamespacedName)
+		}
+		expectedValues := []string{"my-project/env/prod", "tagValues/123"}
+		if !reflect.DeepEqual(values, expectedValues) {
+			t.Errorf("wrong tag bindings\nwant %v\ngot  %v", expectedValues, values)
+		}
+
+		status = doTagBindingRequest(t, server, http.MethodDelete, "/v3/"+expectedName, "", nil)
+		if status != http.StatusOK {
+			t.Fatalf("wrong status code for delete\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+		if status := doTagBindingRequest(t, server, http.MethodDelete, "/v3/"+expectedName, "", nil); status != http.StatusNotFound {
+			t.Errorf("wrong status code for deleting twice\nwant %d\ngot  %d", http.StatusNotFound, status)
+		}
+		bindings := server.TagBindings("some-bucket")
+		if len(bindings) != 1 || bindings[0].TagValueNamespacedName != "my-project/env/prod" {
+			t.Errorf("wrong tag bindings after delete: %+v", bindings)
+		}
+	})
+}
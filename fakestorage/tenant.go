@@ -0,0 +1,133 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// TenantOptions configures the multi-tenant mode of the server, where a
+// single server is shared by many isolated users, such as the test suites of
+// different teams in CI. Each tenant is a namespace of the server (see
+// Namespace), selected by the port, API key or bearer token of requests,
+// from the most to the least specific. The X-Fake-Gcs-Namespace header is
+// only used for requests that don't identify a tenant otherwise and, in strict
+// mode, only with AllowNamespaceHeader.
+type TenantOptions struct {
+	// Maps API keys to tenants. API keys are sent in the key query
+	// parameter or in the X-Goog-Api-Key header.
+	APIKeys map[string]string
+
+	// Maps OAuth2 access tokens, sent in the Authorization header as
+	// bearer tokens, to tenants.
+	Tokens map[string]string
+
+	// Maps ports to tenants. The server listens on each port, on Host, in
+	// addition to its own port, and all requests received on a port go to
+	// its tenant.
+	Ports map[uint16]string
+
+	// When set, requests must identify a tenant with their port, an API key
+	// or a token. Requests without one, or with unknown API keys or tokens,
+	// are rejected instead of being served from the state shared by all
+	// clients, and so are requests whose namespace header doesn't match the
+	// tenant of their credentials.
+	Strict bool
+
+	// When set in strict mode, requests without credentials may still
+	// select their tenant with the X-Fake-Gcs-Namespace header alone. Any
+	// client can then reach the data of any tenant, so this only makes
+	// sense when tenants trust each other.
+	AllowNamespaceHeader bool
+}
+
+func (o TenantOptions) validate() error {
+	for port, tenant := range o.Ports {
+		if port == 0 {
+			return fmt.Errorf("invalid port 0 for tenant %q", tenant)
+		}
+	}
+	return nil
+}
+
+type tenantPortKey struct{}
+
+// tenantHandler returns the handler of the listener of a tenant.
+func (s *Server) tenantHandler(tenant string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantPortKey{}, tenant)))
+	})
+}
+
+// startTenantListeners starts the listeners of the ports of tenants.
+func (s *Server) startTenantListeners() ([]*httptest.Server, error) {
+	var servers []*httptest.Server
+	for port, tenant := range s.options.Tenants.Ports {
+		ts, err := s.startListener(s.host, port, s.tenantHandler(tenant))
+		if err != nil {
+			for _, ts := range servers {
+				ts.Close()
+			}
+			return nil, err
+		}
+		servers = append(servers, ts)
+	}
+	return servers, nil
+}
+
+// requestNamespace returns the namespace that serves the request, or an
+// error if the request is rejected in strict multi-tenant mode. An empty
+// namespace means the server itself.
+func (s *Server) requestNamespace(r *http.Request) (string, error) {
+	tenants := s.options.Tenants
+	header := r.Header.Get(namespaceHeader)
+	tenant, err := tenants.credentialTenant(r)
+	if err != nil {
+		return "", err
+	}
+	if tenant == "" {
+		if tenants.Strict && (header == "" || !tenants.AllowNamespaceHeader) {
+			return "", &statusError{code: http.StatusUnauthorized, reason: "required", message: "Anonymous caller does not have access to this server, a tenant is required."}
+		}
+		return header, nil
+	}
+	if tenants.Strict && header != "" && header != tenant {
+		return "", &statusError{code: http.StatusForbidden, reason: "forbidden", message: fmt.Sprintf("The caller does not have access to the namespace %q.", header)}
+	}
+	return tenant, nil
+}
+
+// credentialTenant returns the tenant identified by the port or credentials of
+// the request, if any.
+func (o TenantOptions) credentialTenant(r *http.Request) (string, error) {
+	if tenant, ok := r.Context().Value(tenantPortKey{}).(string); ok {
+		return tenant, nil
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		key = r.Header.Get("X-Goog-Api-Key")
+	}
+	if key != "" {
+		if tenant, ok := o.APIKeys[key]; ok {
+			return tenant, nil
+		}
+		if o.Strict {
+			return "", &statusError{code: http.StatusBadRequest, reason: "keyInvalid", message: "API key not valid. Please pass a valid API key."}
+		}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if tenant, ok := o.Tokens[strings.TrimPrefix(auth, "Bearer ")]; ok {
+			return tenant, nil
+		}
+		if o.Strict {
+			return "", &statusError{code: http.StatusUnauthorized, reason: "authError", message: "Invalid Credentials"}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func tenantRequest(t *testing.T, client *http.Client, url string, headers map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServerTenantCredentials(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		strict := strict
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				NoListener: true,
+				Tenants: TenantOptions{
+					APIKeys: map[string]string{"team-a-key": "team-a"},
+					Tokens:  map[string]string{"team-b-token": "team-b"},
+					Strict:  strict,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			teamA, _ := server.Namespace("team-a")
+			if err := teamA.CreateObject(Object{BucketName: "bucket-a", Name: "object.txt", Content: []byte("a")}); err != nil {
+				t.Fatal(err)
+			}
+			teamB, _ := server.Namespace("team-b")
+			if err := teamB.CreateObject(Object{BucketName: "bucket-b", Name: "object.txt", Content: []byte("b")}); err != nil {
+				t.Fatal(err)
+			}
+
+			anonymousStatus := http.StatusNotFound
+			if strict {
+				anonymousStatus = http.StatusUnauthorized
+			}
+			unknownKeyStatus := http.StatusNotFound
+			if strict {
+				unknownKeyStatus = http.StatusBadRequest
+			}
+			mismatchStatus := http.StatusNotFound
+			if strict {
+				mismatchStatus = http.StatusForbidden
+			}
+			headerStatus := http.StatusOK
+			if strict {
+				headerStatus = http.StatusUnauthorized
+			}
+			var tests = []struct {
+				name           string
+				bucket         string
+				query          string
+				headers        map[string]string
+				expectedStatus int
+			}{
+				{"key parameter", "bucket-a", "?key=team-a-key", nil, http.StatusOK},
+				{"key header", "bucket-a", "", map[string]string{"X-Goog-Api-Key": "team-a-key"}, http.StatusOK},
+				{"key of another tenant", "bucket-b", "?key=team-a-key", nil, http.StatusNotFound},
+				{"token", "bucket-b", "", map[string]string{"Authorization": "Bearer team-b-token"}, http.StatusOK},
+				{"token of another tenant", "bucket-a", "", map[string]string{"Authorization": "Bearer team-b-token"}, http.StatusNotFound},
+				{"namespace header", "bucket-a", "", map[string]string{namespaceHeader: "team-a"}, headerStatus},
+				{"namespace header of another tenant", "bucket-b", "", map[string]string{namespaceHeader: "team-b"}, headerStatus},
+				{"anonymous", "bucket-a", "", nil, anonymousStatus},
+				{"unknown key", "bucket-a", "?key=other-key", nil, unknownKeyStatus},
+				{"mismatched namespace", "bucket-b", "?key=team-a-key", map[string]string{namespaceHeader: "team-b"}, mismatchStatus},
+				{"mismatched namespace with key header", "bucket-b", "", map[string]string{"X-Goog-Api-Key": "team-a-key", namespaceHeader: "team-b"}, mismatchStatus},
+			}
+			for _, test := range tests {
+				url := "https://www.googleapis.com/storage/v1/b/" + test.bucket + test.query
+				status := tenantRequest(t, server.HTTPClient(), url, test.headers)
+				if status != test.expectedStatus {
+					t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, status)
+				}
+			}
+		})
+	}
+}
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServerTenantPorts(t *testing.T) {
+	port := freePort(t)
+	server, err := NewServerWithOptions(Options{
+		Host:    "127.0.0.1",
+		Tenants: TenantOptions{Ports: map[uint16]string{port: "team-a"}, Strict: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	teamA, _ := server.Namespace("team-a")
+	if err := teamA.CreateObject(Object{BucketName: "bucket-a", Name: "object.txt", Content: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// #nosec
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	url := fmt.Sprintf("https://127.0.0.1:%d/storage/v1/b/bucket-a", port)
+	if status := tenantRequest(t, client, url, nil); status != http.StatusOK {
+		t.Errorf("wrong status code on the port of the tenant\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	url = fmt.Sprintf("https://127.0.0.1:%d/storage/v1/b/bucket-a", server.Port())
+	if status := tenantRequest(t, client, url, nil); status != http.StatusUnauthorized {
+		t.Errorf("wrong status code on the port of the server\nwant %d\ngot  %d", http.StatusUnauthorized, status)
+	}
+
+	server.Stop()
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		t.Error("listener of the tenant still running after Stop")
+	}
+}
+
+func TestNewServerInvalidTenantPort(t *testing.T) {
+	_, err := NewServerWithOptions(Options{NoListener: true, Tenants: TenantOptions{Ports: map[uint16]string{0: "team-a"}}})
+	if err == nil {
+		t.Error("unexpected <nil> error for tenant on port 0")
+	}
+}
+
+func TestServerTenantAllowNamespaceHeader(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		Tenants: TenantOptions{
+			APIKeys:              map[string]string{"team-a-key": "team-a"},
+			Strict:               true,
+			AllowNamespaceHeader: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	teamB, _ := server.Namespace("team-b")
+	if err := teamB.CreateObject(Object{BucketName: "bucket-b", Name: "object.txt", Content: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "https://www.googleapis.com/storage/v1/b/bucket-b"
+	if status := tenantRequest(t, server.HTTPClient(), url, map[string]string{namespaceHeader: "team-b"}); status != http.StatusOK {
+		t.Errorf("wrong status code for the namespace header\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if status := tenantRequest(t, server.HTTPClient(), url+"?key=team-a-key", map[string]string{namespaceHeader: "team-b"}); status != http.StatusForbidden {
+		t.Errorf("wrong status code for the namespace header of another tenant\nwant %d\ngot  %d", http.StatusForbidden, status)
+	}
+}
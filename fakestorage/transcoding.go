@@ -0,0 +1,81 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isGzipEncoded reports whether the content of the object is stored
+// compressed with gzip, as declared by its Content-Encoding.
+func (obj Object) isGzipEncoded() bool {
+	return strings.EqualFold(obj.ContentEncoding, "gzip")
+}
+
+// decompressedContent returns the logical content of gzip-encoded objects.
+// It fails when the stored content isn't a valid gzip stream, which Cloud
+// Storage accepts on upload anyway.
+func (obj Object) decompressedContent() ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(obj.Content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// withDecompressedSize records the logical size of gzip-encoded objects. It
+// decompresses the whole content, so it's only called when the content or
+// its encoding changes.
+func (obj Object) withDecompressedSize() Object {
+	obj.DecompressedSize = 0
+	if !obj.isGzipEncoded() {
+		return obj
+	}
+	if content, err := obj.decompressedContent(); err == nil {
+		obj.DecompressedSize = int64(len(content))
+	}
+	return obj
+}
+
+// transcodedContent implements decompressive transcoding: gzip-encoded
+// objects are served decompressed to clients that don't accept gzip, unless
+// the object has "Cache-Control: no-transform". It returns false when the
+// stored content should be served as-is.
+func transcodedContent(obj Object, r *http.Request) ([]byte, bool) {
+	if !obj.isGzipEncoded() || acceptsGzip(r) || strings.Contains(strings.ToLower(obj.CacheControl), "no-transform") {
+		return nil, false
+	}
+	content, err := obj.decompressedContent()
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), "gzip") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func gzipContent(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(content))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServerClientGzipUpload(t *testing.T) {
+	const content = "some log line\nsome other log line\nsome log line\n"
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		compressed := gzipContent(t, content)
+		obj := server.Client().Bucket("some-bucket").Object("logs.txt.gz")
+		w := obj.NewWriter(context.Background())
+		w.ContentType = "text/plain"
+		w.ContentEncoding = "gzip"
+		w.Write(compressed)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs := w.Attrs()
+		if attrs.ContentEncoding != "gzip" {
+			t.Errorf("wrong content encoding\nwant %q\ngot  %q", "gzip", attrs.ContentEncoding)
+		}
+		if attrs.Size != int64(len(compressed)) {
+			t.Errorf("wrong size\nwant %d\ngot  %d", len(compressed), attrs.Size)
+		}
+		stored, err := server.GetObject("some-bucket", "logs.txt.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored.Content, compressed) {
+			t.Error("content not stored as sent")
+		}
+		if stored.DecompressedSize != int64(len(content)) {
+			t.Errorf("wrong decompressed size\nwant %d\ngot  %d", len(content), stored.DecompressedSize)
+		}
+		if got := readObjectContent(t, obj); got != content {
+			t.Errorf("wrong content read\nwant %q\ngot  %q", content, got)
+		}
+
+		_, err = obj.Update(context.Background(), storage.ObjectAttrsToUpdate{ContentType: "text/x-log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err = server.GetObject("some-bucket", "logs.txt.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.DecompressedSize != int64(len(content)) {
+			t.Errorf("wrong decompressed size after updating metadata\nwant %d\ngot  %d", len(content), stored.DecompressedSize)
+		}
+		_, err = obj.Update(context.Background(), storage.ObjectAttrsToUpdate{ContentEncoding: ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err = server.GetObject("some-bucket", "logs.txt.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.DecompressedSize != 0 {
+			t.Errorf("decompressed size kept after removing the content encoding: %d", stored.DecompressedSize)
+		}
+	})
+}
+
+func TestServerGzipDownloadTranscoding(t *testing.T) {
+	const content = "some content that is served decompressed"
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		compressed := gzipContent(t, content)
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: compressed, ContentEncoding: "gzip"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "no-transform.txt", Content: compressed, ContentEncoding: "gzip", CacheControl: "no-transform"}); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		// disable the transparent decompression of the http package.
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.DisableCompression = true
+		}
+
+		var tests = []struct {
+			name             string
+			object           string
+			acceptEncoding   string
+			expectedContent  []byte
+			expectedEncoding string
+		}{
+			{"transcoded", "object.txt", "", []byte(content), ""},
+			{"accepts gzip", "object.txt", "gzip, deflate", compressed, "gzip"},
+			{"refuses gzip", "object.txt", "gzip;q=0", []byte(content), ""},
+			{"no-transform", "no-transform.txt", "", compressed, "gzip"},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/some-bucket/"+test.object, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.expectedContent) {
+				t.Errorf("%s: wrong content\nwant %q\ngot  %q", test.name, test.expectedContent, data)
+			}
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != test.expectedEncoding {
+				t.Errorf("%s: wrong Content-Encoding\nwant %q\ngot  %q", test.name, test.expectedEncoding, encoding)
+			}
+			if encoding := resp.Header.Get("X-Goog-Stored-Content-Encoding"); encoding != "gzip" {
+				t.Errorf("%s: wrong X-Goog-Stored-Content-Encoding\nwant %q\ngot  %q", test.name, "gzip", encoding)
+			}
+			if size := resp.Header.Get("X-Goog-Decompressed-Content-Length"); size != strconv.Itoa(len(content)) {
+				t.Errorf("%s: wrong X-Goog-Decompressed-Content-Length\nwant %d\ngot  %q", test.name, len(content), size)
+			}
+		}
+	})
+}
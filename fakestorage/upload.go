@@ -6,7 +6,6 @@ package fakestorage
 
 import (
 	"crypto/md5" // #nosec G501
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -18,12 +17,37 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
 )
 
 type multipartMetadata struct {
-	Name string `json:"name"`
+	Name            string            `json:"name"`
+	ContentType     string            `json:"contentType"`
+	ContentLanguage string            `json:"contentLanguage"`
+	CacheControl    string            `json:"cacheControl"`
+	ContentEncoding string            `json:"contentEncoding"`
+	StorageClass    string            `json:"storageClass"`
+	EventBasedHold  bool              `json:"eventBasedHold"`
+	Retention       *ObjectRetention  `json:"retention"`
+	ACL             []storage.ACLRule `json:"acl"`
+	Metadata        map[string]string `json:"metadata"`
+}
+
+// apply copies the metadata sent by the client to the object.
+func (m *multipartMetadata) apply(obj *Object) {
+	obj.Name = m.Name
+	obj.ContentType = m.ContentType
+	obj.ContentLanguage = m.ContentLanguage
+	obj.CacheControl = m.CacheControl
+	obj.ContentEncoding = m.ContentEncoding
+	obj.StorageClass = m.StorageClass
+	obj.EventBasedHold = m.EventBasedHold
+	obj.Retention = m.Retention
+	obj.ACL = m.ACL
+	obj.Metadata = m.Metadata
 }
 
 type contentRange struct {
@@ -36,26 +60,35 @@ type contentRange struct {
 
 func (s *Server) insertObject(w http.ResponseWriter, r *http.Request) {
 	bucketName := mux.Vars(r)["bucketName"]
-	if err := s.backend.GetBucket(bucketName); err != nil {
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		err := newErrorResponse(http.StatusNotFound, "Not found", nil)
 		json.NewEncoder(w).Encode(err)
 		return
 	}
+	if err := s.checkBucketWritable(bucketName, "storage.objects.create"); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	uploadType := r.URL.Query().Get("uploadType")
 	switch uploadType {
 	case "media":
-		s.simpleUpload(bucketName, w, r)
+		s.simpleUpload(bucketName, conds, w, r)
 	case "multipart":
-		s.multipartUpload(bucketName, w, r)
+		s.multipartUpload(bucketName, conds, w, r)
 	case "resumable":
-		s.resumableUpload(bucketName, w, r)
+		s.resumableUpload(bucketName, conds, w, r)
 	default:
 		http.Error(w, "invalid uploadType", http.StatusBadRequest)
 	}
 }
 
-func (s *Server) simpleUpload(bucketName string, w http.ResponseWriter, r *http.Request) {
+func (s *Server) simpleUpload(bucketName string, conds objectConditions, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	name := r.URL.Query().Get("name")
 	if name == "" {
@@ -67,14 +100,21 @@ func (s *Server) simpleUpload(bucketName string, w http.ResponseWriter, r *http.
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	obj := Object{BucketName: bucketName, Name: name, Content: data, Crc32c: encodedCrc32cChecksum(data), Md5Hash: encodedMd5Hash(data)}
-	err = s.createObject(obj)
+	obj := Object{BucketName: bucketName, Name: name, Content: data, Crc32c: encodedCrc32cChecksum(data), Md5Hash: encodedMd5Hash(data), ContentType: r.Header.Get("Content-Type")}
+	obj.ContentEncoding = r.URL.Query().Get("contentEncoding")
+	if obj.ContentEncoding == "" {
+		obj.ContentEncoding = r.Header.Get("Content-Encoding")
+	}
+	s.setUploadDefaults(&obj)
+	obj, err = s.writeObject(obj, conds)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStatusError(w, err)
 		return
 	}
+	setObjectHeaders(w.Header(), obj)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(obj)
+	json.NewEncoder(w).Encode(newObjectResponse(obj))
 }
 
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
@@ -108,7 +148,7 @@ func encodedMd5Hash(content []byte) string {
 	return encodedHash(md5Hash(content))
 }
 
-func (s *Server) multipartUpload(bucketName string, w http.ResponseWriter, r *http.Request) {
+func (s *Server) multipartUpload(bucketName string, conds objectConditions, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
@@ -116,8 +156,10 @@ func (s *Server) multipartUpload(bucketName string, w http.ResponseWriter, r *ht
 		return
 	}
 	var (
-		metadata *multipartMetadata
-		content  []byte
+		metadata        *multipartMetadata
+		content         []byte
+		contentType     string
+		contentEncoding string
 	)
 	reader := multipart.NewReader(r.Body, params["boundary"])
 	part, err := reader.NextPart()
@@ -125,6 +167,8 @@ func (s *Server) multipartUpload(bucketName string, w http.ResponseWriter, r *ht
 		if metadata == nil {
 			metadata, err = loadMetadata(part)
 		} else {
+			contentType = part.Header.Get("Content-Type")
+			contentEncoding = part.Header.Get("Content-Encoding")
 			content, err = loadContent(part)
 		}
 		if err != nil {
@@ -135,34 +179,77 @@ func (s *Server) multipartUpload(bucketName string, w http.ResponseWriter, r *ht
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	obj := Object{BucketName: bucketName, Name: metadata.Name, Content: content, Crc32c: encodedCrc32cChecksum(content), Md5Hash: encodedMd5Hash(content)}
-	err = s.createObject(obj)
+	if metadata == nil {
+		http.Error(w, "the multipart body must start with the metadata of the object", http.StatusBadRequest)
+		return
+	}
+	obj := Object{BucketName: bucketName, Content: content, Crc32c: encodedCrc32cChecksum(content), Md5Hash: encodedMd5Hash(content)}
+	metadata.apply(&obj)
+	obj.Name, err = uploadObjectName(r, metadata)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStatusError(w, err)
+		return
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = contentType
+	}
+	if obj.ContentEncoding == "" {
+		obj.ContentEncoding = contentEncoding
+	}
+	s.setUploadDefaults(&obj)
+	obj, err = s.writeObject(obj, conds)
+	if err != nil {
+		writeStatusError(w, err)
 		return
 	}
+	setObjectHeaders(w.Header(), obj)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(obj)
+	json.NewEncoder(w).Encode(newObjectResponse(obj))
 }
 
-func (s *Server) resumableUpload(bucketName string, w http.ResponseWriter, r *http.Request) {
-	objName := r.URL.Query().Get("name")
-	if objName == "" {
-		metadata, err := loadMetadata(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		objName = metadata.Name
+// uploadSession is the state of a resumable upload: the object being
+// uploaded, the preconditions sent when the upload was initiated and when
+// the session last received content.
+type uploadSession struct {
+	obj     Object
+	conds   objectConditions
+	updated time.Time
+}
+
+func (s *Server) resumableUpload(bucketName string, conds objectConditions, w http.ResponseWriter, r *http.Request) {
+	obj := Object{BucketName: bucketName}
+	metadata, err := loadOptionalMetadata(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	obj := Object{BucketName: bucketName, Name: objName}
-	uploadID, err := generateUploadID()
+	metadata.apply(&obj)
+	obj.Name, err = uploadObjectName(r, metadata)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = r.Header.Get("X-Upload-Content-Type")
+	}
+	uploadID, err := s.ids.uploadID()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.uploads.Store(uploadID, obj)
-	w.Header().Set("Location", s.URL()+"/upload/resumable/"+uploadID)
+	s.uploads.Store(uploadID, uploadSession{obj: obj, conds: conds, updated: time.Now()})
+	uploadURL := s.UploadURL()
+	if isPlainHTTPRequest(r) && s.uploadURL == "" {
+		// uploads started over plain HTTP continue on the same listener.
+		uploadURL = "http://" + r.Host
+	}
+	if uploadURL == "" {
+		// servers without a TCP address (NoListener or UnixSocket) reply
+		// with the host used in the request.
+		uploadURL = "https://" + r.Host
+	}
+	w.Header().Set("Location", uploadURL+"/upload/resumable/"+uploadID)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(obj)
 }
@@ -198,18 +285,31 @@ func (s *Server) resumableUpload(bucketName string, w http.ResponseWriter, r *ht
 //
 //   Range: bytes 0-2000
 //
+// Chunks may overlap with data that was already received, which is dropped,
+// but they can't leave gaps. When the total is known, the upload is complete
+// once all of the bytes were received.
+//
 // The client (such as the Go client) can send a header "X-Guploader-No-308" if
 // it can't process a native "308 Permanent Redirect". The in-process response
 // then has a status of "200 OK", with a header "X-Http-Status-Code-Override"
 // set to "308".
 func (s *Server) uploadFileContent(w http.ResponseWriter, r *http.Request) {
 	uploadID := mux.Vars(r)["uploadId"]
-	rawObj, ok := s.uploads.Load(uploadID)
+	rawSession, ok := s.uploads.Load(uploadID)
 	if !ok {
 		http.Error(w, "upload not found", http.StatusNotFound)
 		return
 	}
-	obj := rawObj.(Object)
+	session := rawSession.(uploadSession)
+	obj := session.obj
+	if name := r.URL.Query().Get("name"); name != "" && name != obj.Name {
+		writeStatusError(w, &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("The object name in the URL (%s) does not match the object name of the upload session (%s).", name, obj.Name),
+		})
+		return
+	}
 	content, err := loadContent(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -217,9 +317,7 @@ func (s *Server) uploadFileContent(w http.ResponseWriter, r *http.Request) {
 	}
 	commit := true
 	status := http.StatusOK
-	obj.Content = append(obj.Content, content...)
-	obj.Crc32c = encodedCrc32cChecksum(obj.Content)
-	obj.Md5Hash = encodedMd5Hash(obj.Content)
+	total := -1
 	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
 		parsed, err := parseContentRange(contentRange)
 		if err != nil {
@@ -227,22 +325,52 @@ func (s *Server) uploadFileContent(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if parsed.KnownRange {
-			// Middle of streaming request, or any part of chunked request
-			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", parsed.End))
-			// Complete if the range covers the known total
-			commit = parsed.KnownTotal && (parsed.End+1 >= parsed.Total)
+			content, err = resumeContent(parsed, len(obj.Content), content)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if parsed.KnownTotal {
+			total = parsed.Total
 		} else {
-			// End of a streaming request
-			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(obj.Content)))
+			// Middle of a streaming request, the total is sent in the
+			// last chunk, or in a final request with "bytes */<total>"
+			commit = false
 		}
 	}
-	if commit {
+	obj.Content = append(obj.Content, content...)
+	if err := s.checkObjectSize(int64(len(obj.Content))); err != nil {
 		s.uploads.Delete(uploadID)
-		err = s.createObject(obj)
+		writeStatusError(w, err)
+		return
+	}
+	if total >= 0 {
+		if len(obj.Content) > total {
+			s.uploads.Delete(uploadID)
+			http.Error(w, fmt.Sprintf("received %d bytes, more than the total of %d bytes", len(obj.Content), total), http.StatusBadRequest)
+			return
+		}
+		// Complete if the content covers the known total
+		commit = len(obj.Content) == total
+	}
+	obj.Crc32c = encodedCrc32cChecksum(obj.Content)
+	obj.Md5Hash = encodedMd5Hash(obj.Content)
+	if len(obj.Content) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(obj.Content)-1))
+	}
+	if commit {
+		if !s.updateUpload(uploadID, nil) {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		s.setUploadDefaults(&obj)
+		obj, err = s.writeObject(obj, session.conds)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStatusError(w, err)
 			return
 		}
+		setObjectHeaders(w.Header(), obj)
 	} else {
 		if _, no308 := r.Header["X-Guploader-No-308"]; no308 {
 			// Go client
@@ -251,15 +379,57 @@ func (s *Server) uploadFileContent(w http.ResponseWriter, r *http.Request) {
 			// Python client
 			status = http.StatusPermanentRedirect
 		}
-		s.uploads.Store(uploadID, obj)
+		if !s.updateUpload(uploadID, &uploadSession{obj: obj, conds: session.conds, updated: time.Now()}) {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+	}
+	var data []byte
+	if commit {
+		data, _ = json.Marshal(newObjectResponse(obj))
+	} else {
+		data, _ = json.Marshal(obj)
 	}
-	data, _ := json.Marshal(obj)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 	w.WriteHeader(status)
 	w.Write(data)
 }
 
+// updateUpload replaces the session of an upload in progress, or removes it
+// when session is nil. It reports false, leaving the uploads untouched, if the
+// upload was purged after the chunk loaded it, so that the chunk can't revive
+// a discarded session.
+func (s *Server) updateUpload(uploadID string, session *uploadSession) bool {
+	s.uploadsMtx.Lock()
+	defer s.uploadsMtx.Unlock()
+	if _, ok := s.uploads.Load(uploadID); !ok {
+		return false
+	}
+	if session == nil {
+		s.uploads.Delete(uploadID)
+	} else {
+		s.uploads.Store(uploadID, *session)
+	}
+	return true
+}
+
+// resumeContent returns the part of a chunk that wasn't received yet. Clients
+// may resend data that was already received (for example, when retrying a
+// chunk after a timeout), but can't skip data.
+func resumeContent(parsed contentRange, received int, content []byte) ([]byte, error) {
+	if parsed.End-parsed.Start+1 != len(content) {
+		return nil, fmt.Errorf("the Content-Range covers %d bytes, but the chunk has %d bytes", parsed.End-parsed.Start+1, len(content))
+	}
+	if parsed.Start > received {
+		return nil, fmt.Errorf("the chunk starts at byte %d, but only %d bytes were received", parsed.Start, received)
+	}
+	if overlap := received - parsed.Start; overlap < len(content) {
+		return content[overlap:], nil
+	}
+	return nil, nil
+}
+
 // Parse a Content-Range header
 // Some possible valid header values:
 //   bytes 0-1023/4096 (first 1024 bytes of a 4096-byte document)
@@ -325,16 +495,40 @@ func loadMetadata(rc io.ReadCloser) (*multipartMetadata, error) {
 	return &m, err
 }
 
-func loadContent(rc io.ReadCloser) ([]byte, error) {
+// loadOptionalMetadata loads the metadata sent when a resumable upload is
+// initiated, which may be empty.
+func loadOptionalMetadata(rc io.ReadCloser) (*multipartMetadata, error) {
 	defer rc.Close()
-	return ioutil.ReadAll(rc)
+	var m multipartMetadata
+	err := json.NewDecoder(rc).Decode(&m)
+	if err == io.EOF {
+		err = nil
+	}
+	return &m, err
 }
 
-func generateUploadID() (string, error) {
-	var raw [16]byte
-	_, err := rand.Read(raw[:])
-	if err != nil {
-		return "", err
+// uploadObjectName returns the name of the object being uploaded, which may
+// be sent in the query string, in the metadata, or in both, as long as they
+// match.
+func uploadObjectName(r *http.Request, metadata *multipartMetadata) (string, error) {
+	name := r.URL.Query().Get("name")
+	switch {
+	case name == "" && metadata.Name == "":
+		return "", &statusError{code: http.StatusBadRequest, reason: "required", message: "Required"}
+	case name == "":
+		return metadata.Name, nil
+	case metadata.Name != "" && metadata.Name != name:
+		return "", &statusError{
+			code:    http.StatusBadRequest,
+			reason:  "invalid",
+			message: fmt.Sprintf("The object name in the request body (%s) does not match the object name in the URL (%s).", metadata.Name, name),
+		}
 	}
-	return fmt.Sprintf("%x", raw[:]), nil
+	return name, nil
+}
+
+func loadContent(rc io.ReadCloser) ([]byte, error) {
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
 }
+
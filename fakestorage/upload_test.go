@@ -8,10 +8,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
 
+	"cloud.google.com/go/storage"
 	"google.golang.org/api/googleapi"
 )
 
@@ -45,7 +49,9 @@ func TestServerClientObjectWriter(t *testing.T) {
 		for _, test := range tests {
 			test := test
 			t.Run(test.testCase, func(t *testing.T) {
-				server.CreateBucket(test.bucketName)
+				if err := server.CreateBucket(test.bucketName); err != nil {
+					t.Fatal(err)
+				}
 				client := server.Client()
 
 				objHandle := client.Bucket(test.bucketName).Object(test.objectName)
@@ -95,11 +101,13 @@ func checkChecksum(t *testing.T, content []byte, obj Object) {
 func TestServerClientObjectWriterOverwrite(t *testing.T) {
 	runServersTest(t, nil, func(t *testing.T, server *Server) {
 		const content = "other content"
-		server.CreateObject(Object{
+		if err := server.CreateObject(Object{
 			BucketName: "some-bucket",
 			Name:       "some-object.txt",
 			Content:    []byte("some content"),
-		})
+		}); err != nil {
+			t.Fatal(err)
+		}
 		objHandle := server.Client().Bucket("some-bucket").Object("some-object.txt")
 		w := objHandle.NewWriter(context.Background())
 		w.Write([]byte(content))
@@ -118,6 +126,61 @@ func TestServerClientObjectWriterOverwrite(t *testing.T) {
 	})
 }
 
+func TestServerClientObjectWriterMetadata(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		objHandle := server.Client().Bucket("some-bucket").Object("some-object.txt")
+		w := objHandle.NewWriter(context.Background())
+		w.ContentType = "text/plain"
+		w.ContentLanguage = "en"
+		w.CacheControl = "no-cache"
+		w.StorageClass = "COLDLINE"
+		w.Write([]byte("some content"))
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := server.GetObject("some-bucket", "some-object.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := Object{
+			BucketName:      "some-bucket",
+			Name:            "some-object.txt",
+			Content:         []byte("some content"),
+			Crc32c:          obj.Crc32c,
+			Md5Hash:         obj.Md5Hash,
+			ContentType:     "text/plain",
+			ContentLanguage: "en",
+			CacheControl:    "no-cache",
+			StorageClass:    "COLDLINE",
+			Generation:      obj.Generation,
+			Metageneration:  1,
+			TimeCreated:     obj.TimeCreated,
+
+			TimeStorageClassUpdated: obj.TimeCreated,
+		}
+		if !reflect.DeepEqual(obj, expected) {
+			t.Errorf("wrong object stored\nwant %#v\ngot  %#v", expected, obj)
+		}
+		if obj.Generation == 0 {
+			t.Error("generation not assigned to the object")
+		}
+		if obj.TimeCreated.IsZero() {
+			t.Error("creation time not assigned to the object")
+		}
+		attrs := w.Attrs()
+		if attrs.Generation != obj.Generation {
+			t.Errorf("wrong generation returned\nwant %d\ngot  %d", obj.Generation, attrs.Generation)
+		}
+		if attrs.ContentType != obj.ContentType {
+			t.Errorf("wrong content type returned\nwant %q\ngot  %q", obj.ContentType, attrs.ContentType)
+		}
+	})
+}
+
 func TestServerClientObjectWriterBucketNotFound(t *testing.T) {
 	runServersTest(t, nil, func(t *testing.T, server *Server) {
 		client := server.Client()
@@ -134,7 +197,9 @@ func TestServerClientObjectWriterBucketNotFound(t *testing.T) {
 func TestServerClientSimpleUpload(t *testing.T) {
 	server := NewServer(nil)
 	defer server.Stop()
-	server.CreateBucket("other-bucket")
+	if err := server.CreateBucket("other-bucket"); err != nil {
+		t.Fatal(err)
+	}
 
 	const data = "some nice content"
 	req, err := http.NewRequest("POST", server.URL()+"/storage/v1/b/other-bucket/o?uploadType=media&name=some/nice/object.txt", strings.NewReader(data))
@@ -170,7 +235,9 @@ func TestServerClientSimpleUpload(t *testing.T) {
 func TestServerClientSimpleUploadNoName(t *testing.T) {
 	server := NewServer(nil)
 	defer server.Stop()
-	server.CreateBucket("other-bucket")
+	if err := server.CreateBucket("other-bucket"); err != nil {
+		t.Fatal(err)
+	}
 
 	const data = "some nice content"
 	req, err := http.NewRequest("POST", server.URL()+"/storage/v1/b/other-bucket/o?uploadType=media", strings.NewReader(data))
@@ -197,7 +264,9 @@ func TestServerClientSimpleUploadNoName(t *testing.T) {
 func TestServerInvalidUploadType(t *testing.T) {
 	server := NewServer(nil)
 	defer server.Stop()
-	server.CreateBucket("other-bucket")
+	if err := server.CreateBucket("other-bucket"); err != nil {
+		t.Fatal(err)
+	}
 	const data = "some nice content"
 	req, err := http.NewRequest("POST", server.URL()+"/storage/v1/b/other-bucket/o?uploadType=bananas&name=some-object.txt", strings.NewReader(data))
 	if err != nil {
@@ -274,3 +343,252 @@ func TestParseContentRange(t *testing.T) {
 		})
 	}
 }
+
+func TestServerClientObjectWriterPreconditions(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "existing.txt", Content: []byte("some content")}); err != nil {
+			t.Fatal(err)
+		}
+		existing, err := server.GetObject("some-bucket", "existing.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name           string
+			objectName     string
+			conds          storage.Conditions
+			chunkSize      int
+			expectedStatus int
+		}{
+			{"does not exist on existing object", "existing.txt", storage.Conditions{DoesNotExist: true}, 0, http.StatusPreconditionFailed},
+			{"does not exist on existing object (resumable)", "existing.txt", storage.Conditions{DoesNotExist: true}, googleapi.MinUploadChunkSize, http.StatusPreconditionFailed},
+			{"generation mismatch", "existing.txt", storage.Conditions{GenerationMatch: existing.Generation + 1}, 0, http.StatusPreconditionFailed},
+			{"generation match", "existing.txt", storage.Conditions{GenerationMatch: existing.Generation}, 0, http.StatusOK},
+			{"does not exist on new object", "new.txt", storage.Conditions{DoesNotExist: true}, 0, http.StatusOK},
+			{"generation match on new object", "other.txt", storage.Conditions{GenerationMatch: 1234}, 0, http.StatusPreconditionFailed},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				objHandle := server.Client().Bucket("some-bucket").Object(test.objectName).If(test.conds)
+				w := objHandle.NewWriter(context.Background())
+				w.ChunkSize = test.chunkSize
+				w.Write([]byte("other content"))
+				err := w.Close()
+				if test.expectedStatus == http.StatusOK {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != test.expectedStatus {
+					t.Errorf("wrong error returned\nwant status %d\ngot  %v", test.expectedStatus, err)
+				}
+			})
+		}
+	})
+}
+
+func TestServerChunkedSimpleUpload(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		const data = "some content sent without a Content-Length"
+		// the body has an unknown length, so it's sent with chunked
+		// transfer encoding.
+		body := ioutil.NopCloser(strings.NewReader(data))
+		req, err := http.NewRequest(http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=chunked.txt", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		obj, err := server.GetObject("some-bucket", "chunked.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != data {
+			t.Errorf("wrong content\nwant %q\ngot  %q", data, string(obj.Content))
+		}
+	})
+}
+
+func TestServerStreamingResumableUpload(t *testing.T) {
+	type chunk struct {
+		contentRange   string
+		body           string
+		expectedStatus int
+		expectedRange  string
+	}
+	var tests = []struct {
+		name            string
+		chunks          []chunk
+		expectedContent string
+	}{
+		{
+			"finalized with the total",
+			[]chunk{
+				{"bytes 0-4/*", "some ", http.StatusPermanentRedirect, "bytes=0-4"},
+				{"bytes 5-11/*", "content", http.StatusPermanentRedirect, "bytes=0-11"},
+				{"bytes */12", "", http.StatusOK, ""},
+			},
+			"some content",
+		},
+		{
+			"total in the last chunk",
+			[]chunk{
+				{"bytes 0-4/*", "some ", http.StatusPermanentRedirect, "bytes=0-4"},
+				{"bytes 5-11/12", "content", http.StatusOK, ""},
+			},
+			"some content",
+		},
+		{
+			"resent chunk",
+			[]chunk{
+				{"bytes 0-4/*", "some ", http.StatusPermanentRedirect, "bytes=0-4"},
+				{"bytes 3-11/*", "e content", http.StatusPermanentRedirect, "bytes=0-11"},
+				{"bytes */12", "", http.StatusOK, ""},
+			},
+			"some content",
+		},
+		{
+			"missing data",
+			[]chunk{
+				{"bytes 0-4/*", "some ", http.StatusPermanentRedirect, "bytes=0-4"},
+				{"bytes 6-11/*", "ontent", http.StatusBadRequest, ""},
+			},
+			"",
+		},
+		{
+			"wrong total",
+			[]chunk{
+				{"bytes 0-11/*", "some content", http.StatusPermanentRedirect, "bytes=0-11"},
+				{"bytes */10", "", http.StatusBadRequest, ""},
+			},
+			"",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			runServersTest(t, nil, func(t *testing.T, server *Server) {
+				if err := server.CreateBucket("some-bucket"); err != nil {
+					t.Fatal(err)
+				}
+				client := server.HTTPClient()
+				req, err := http.NewRequest(http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=streamed.txt", strings.NewReader("{}"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				location := resp.Header.Get("Location")
+				for i, c := range test.chunks {
+					var body io.Reader
+					if c.body != "" {
+						body = strings.NewReader(c.body)
+					}
+					req, err := http.NewRequest(http.MethodPut, location, body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					req.Header.Set("Content-Range", c.contentRange)
+					resp, err := client.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp.Body.Close()
+					if resp.StatusCode != c.expectedStatus {
+						t.Fatalf("chunk %d: wrong status code\nwant %d\ngot  %d", i, c.expectedStatus, resp.StatusCode)
+					}
+					if c.expectedRange != "" && resp.Header.Get("Range") != c.expectedRange {
+						t.Errorf("chunk %d: wrong Range header\nwant %q\ngot  %q", i, c.expectedRange, resp.Header.Get("Range"))
+					}
+				}
+				obj, err := server.GetObject("some-bucket", "streamed.txt")
+				if test.expectedContent == "" {
+					if err == nil {
+						t.Error("unexpected object created by a failed upload")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(obj.Content) != test.expectedContent {
+					t.Errorf("wrong content\nwant %q\ngot  %q", test.expectedContent, string(obj.Content))
+				}
+				checkChecksum(t, obj.Content, obj)
+			})
+		})
+	}
+}
+
+func TestServerUploadNameMismatch(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		client := server.HTTPClient()
+		post := func(url, contentType, body string) *http.Response {
+			t.Helper()
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+		const multipartBody = "--boundary\r\nContent-Type: application/json\r\n\r\n{\"name\":\"body.txt\"}\r\n--boundary\r\nContent-Type: text/plain\r\n\r\nsome content\r\n--boundary--\r\n"
+		const multipartType = "multipart/related; boundary=boundary"
+		const uploadURL = "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o"
+
+		var tests = []struct {
+			name           string
+			url            string
+			contentType    string
+			body           string
+			expectedStatus int
+		}{
+			{"multipart mismatch", uploadURL + "?uploadType=multipart&name=url.txt", multipartType, multipartBody, http.StatusBadRequest},
+			{"multipart match", uploadURL + "?uploadType=multipart&name=body.txt", multipartType, multipartBody, http.StatusOK},
+			{"resumable mismatch", uploadURL + "?uploadType=resumable&name=url.txt", "application/json", `{"name":"body.txt"}`, http.StatusBadRequest},
+			{"resumable match", uploadURL + "?uploadType=resumable&name=body.txt", "application/json", `{"name":"body.txt"}`, http.StatusOK},
+			{"resumable without name", uploadURL + "?uploadType=resumable", "application/json", `{}`, http.StatusBadRequest},
+		}
+		for _, test := range tests {
+			if resp := post(test.url, test.contentType, test.body); resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+		}
+
+		resp := post(uploadURL+"?uploadType=resumable&name=session.txt", "application/json", "")
+		req, err := http.NewRequest(http.MethodPut, resp.Header.Get("Location")+"?name=other.txt", strings.NewReader("some content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("session mismatch: wrong status code\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
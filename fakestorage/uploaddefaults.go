@@ -0,0 +1,116 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// UploadDefaults are the attributes assigned by the server to objects
+// uploaded to a bucket without them, emulating the upload proxies that some
+// organizations put in front of Cloud Storage. They're not part of the GCS
+// API, and apply to uploads through the API only, not to objects created with
+// the Go helpers, such as CreateObject.
+type UploadDefaults struct {
+	// ContentTypes maps extensions of object names, such as ".log", to the
+	// Content-Type of objects uploaded without one. Extensions are case
+	// insensitive. Objects with other extensions get a Content-Type
+	// according to Options.ContentTypeDetection.
+	ContentTypes map[string]string `json:"contentTypes,omitempty"`
+
+	// CacheControl is the Cache-Control of objects uploaded without one.
+	CacheControl string `json:"cacheControl,omitempty"`
+
+	// Metadata is the default custom metadata. Keys sent in the upload take
+	// precedence over the default values.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (d *UploadDefaults) toBackend() *backend.UploadDefaults {
+	if d == nil {
+		return nil
+	}
+	contentTypes := make(map[string]string, len(d.ContentTypes))
+	for ext, contentType := range d.ContentTypes {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		contentTypes[ext] = contentType
+	}
+	return &backend.UploadDefaults{
+		ContentTypes: contentTypes,
+		CacheControl: d.CacheControl,
+		Metadata:     d.Metadata,
+	}
+}
+
+// SetBucketUploadDefaults sets the defaults of the uploads to the given
+// bucket, replacing the previous ones. A nil value removes them.
+//
+// The same can be done with a PUT request to
+// /_internal/uploadDefaults/<bucket>, with the defaults in the JSON body, as
+// in {"contentTypes": {".log": "text/plain"}, "cacheControl": "no-cache"},
+// and a DELETE request to the same path removes them.
+func (s *Server) SetBucketUploadDefaults(bucketName string, defaults *UploadDefaults) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return bucketError(err)
+	}
+	bucket.UploadDefaults = defaults.toBackend()
+	return toStatusError(s.backend.UpdateBucket(bucket))
+}
+
+// setUploadDefaults assigns the defaults of the bucket and the default
+// Content-Type to objects uploaded without them.
+func (s *Server) setUploadDefaults(obj *Object) {
+	bucket, err := s.backend.GetBucket(obj.BucketName)
+	if err == nil && bucket.UploadDefaults != nil {
+		defaults := bucket.UploadDefaults
+		if obj.ContentType == "" {
+			obj.ContentType = defaults.ContentTypes[strings.ToLower(path.Ext(obj.Name))]
+		}
+		if obj.CacheControl == "" {
+			obj.CacheControl = defaults.CacheControl
+		}
+		for key, value := range defaults.Metadata {
+			if _, ok := obj.Metadata[key]; ok {
+				continue
+			}
+			if obj.Metadata == nil {
+				obj.Metadata = make(map[string]string, len(defaults.Metadata))
+			}
+			obj.Metadata[key] = value
+		}
+	}
+	s.setDefaultContentType(obj)
+}
+
+func (s *Server) setBucketUploadDefaultsByPut(w http.ResponseWriter, r *http.Request) {
+	var defaults UploadDefaults
+	if err := json.NewDecoder(r.Body).Decode(&defaults); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.setBucketUploadDefaultsByRequest(w, r, &defaults)
+}
+
+func (s *Server) clearBucketUploadDefaultsByDelete(w http.ResponseWriter, r *http.Request) {
+	s.setBucketUploadDefaultsByRequest(w, r, nil)
+}
+
+func (s *Server) setBucketUploadDefaultsByRequest(w http.ResponseWriter, r *http.Request, defaults *UploadDefaults) {
+	if err := s.SetBucketUploadDefaults(mux.Vars(r)["bucketName"], defaults); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerUploadDefaults(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{
+			Name: "some-bucket",
+			UploadDefaults: &UploadDefaults{
+				ContentTypes: map[string]string{"LOG": "text/x-log", ".yaml": "application/yaml"},
+				CacheControl: "no-cache",
+				Metadata:     map[string]string{"team": "platform", "env": "dev"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var tests = []struct {
+			name                 string
+			path                 string
+			contentType          string
+			expectedContentType  string
+			expectedCacheControl string
+		}{
+			{
+				"extension with default",
+				"/upload/storage/v1/b/some-bucket/o?uploadType=media&name=app.log",
+				"",
+				"text/x-log",
+				"no-cache",
+			},
+			{
+				"extension case insensitive",
+				"/upload/storage/v1/b/some-bucket/o?uploadType=media&name=CONFIG.YAML",
+				"",
+				"application/yaml",
+				"no-cache",
+			},
+			{
+				"explicit content type",
+				"/upload/storage/v1/b/some-bucket/o?uploadType=media&name=other.log",
+				"text/plain",
+				"text/plain",
+				"no-cache",
+			},
+			{
+				"extension without default",
+				"/upload/storage/v1/b/some-bucket/o?uploadType=media&name=data.bin",
+				"",
+				defaultContentType,
+				"no-cache",
+			},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest(http.MethodPost, "https://www.googleapis.com"+test.path, strings.NewReader("content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s: wrong status code\nwant %d\ngot  %d", test.name, http.StatusOK, resp.StatusCode)
+				continue
+			}
+			name := test.path[strings.Index(test.path, "name=")+len("name="):]
+			obj, err := server.GetObject("some-bucket", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.ContentType != test.expectedContentType {
+				t.Errorf("%s: wrong content type\nwant %q\ngot  %q", test.name, test.expectedContentType, obj.ContentType)
+			}
+			if obj.CacheControl != test.expectedCacheControl {
+				t.Errorf("%s: wrong cache control\nwant %q\ngot  %q", test.name, test.expectedCacheControl, obj.CacheControl)
+			}
+		}
+	})
+}
+
+func TestServerUploadDefaultsMetadata(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucket("some-bucket"); err != nil {
+			t.Fatal(err)
+		}
+		err := server.SetBucketUploadDefaults("some-bucket", &UploadDefaults{
+			CacheControl: "no-cache",
+			Metadata:     map[string]string{"team": "platform", "env": "dev"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		obj := server.Client().Bucket("some-bucket").Object("object.txt")
+		w := obj.NewWriter(ctx)
+		w.ContentType = "text/plain"
+		w.CacheControl = "public, max-age=60"
+		w.Metadata = map[string]string{"team": "storage"}
+		if _, err := w.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedMetadata := map[string]string{"team": "storage", "env": "dev"}
+		if !reflect.DeepEqual(attrs.Metadata, expectedMetadata) {
+			t.Errorf("wrong metadata\nwant %v\ngot  %v", expectedMetadata, attrs.Metadata)
+		}
+		if attrs.CacheControl != "public, max-age=60" {
+			t.Errorf("wrong cache control\nwant %q\ngot  %q", "public, max-age=60", attrs.CacheControl)
+		}
+
+		attrs, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{"env": "prod", "owner": "me"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedMetadata = map[string]string{"team": "storage", "env": "prod", "owner": "me"}
+		if !reflect.DeepEqual(attrs.Metadata, expectedMetadata) {
+			t.Errorf("wrong metadata after update\nwant %v\ngot  %v", expectedMetadata, attrs.Metadata)
+		}
+		attrs, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.Metadata) != 0 {
+			t.Errorf("unexpected metadata after removing it: %v", attrs.Metadata)
+		}
+
+		if err := server.SetBucketUploadDefaults("some-bucket", nil); err != nil {
+			t.Fatal(err)
+		}
+		other := server.Client().Bucket("some-bucket").Object("other.txt")
+		w = other.NewWriter(ctx)
+		w.ContentType = "text/plain"
+		w.Write([]byte("content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err = other.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.Metadata) != 0 || attrs.CacheControl != "" {
+			t.Errorf("unexpected defaults after clearing them: %v, %q", attrs.Metadata, attrs.CacheControl)
+		}
+	})
+}
+
+func TestServerUploadDefaultsInternal(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucket("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, body string, expectedStatus int) *http.Response {
+		t.Helper()
+		host := "https://www.googleapis.com"
+		if !strings.HasPrefix(path, "/_internal/") {
+			host = "https://storage.googleapis.com"
+		}
+		req, err := http.NewRequest(method, host+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, path, expectedStatus, resp.StatusCode)
+		}
+		return resp
+	}
+	do(http.MethodPut, "/_internal/uploadDefaults/missing-bucket", `{}`, http.StatusNotFound)
+	do(http.MethodPut, "/_internal/uploadDefaults/some-bucket", `not json`, http.StatusBadRequest)
+	do(http.MethodPut, "/_internal/uploadDefaults/some-bucket", `{"contentTypes": {".log": "text/x-log"}, "metadata": {"env": "dev"}}`, http.StatusNoContent)
+
+	// XML uploads get the defaults too.
+	do(http.MethodPut, "/some-bucket/app.log", "content", http.StatusOK)
+	resp := do(http.MethodGet, "/some-bucket/app.log", "", http.StatusOK)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/x-log" {
+		t.Errorf("wrong content type\nwant %q\ngot  %q", "text/x-log", contentType)
+	}
+	if env := resp.Header.Get("X-Goog-Meta-Env"); env != "dev" {
+		t.Errorf("wrong metadata header\nwant %q\ngot  %q", "dev", env)
+	}
+
+	do(http.MethodDelete, "/_internal/uploadDefaults/some-bucket", "", http.StatusNoContent)
+	do(http.MethodPut, "/some-bucket/other.log", "content", http.StatusOK)
+	obj, err := server.GetObject("some-bucket", "other.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ContentType != defaultContentType || len(obj.Metadata) != 0 {
+		t.Errorf("unexpected defaults after clearing them: %q, %v", obj.ContentType, obj.Metadata)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ResumableUpload describes a resumable upload in progress.
+type ResumableUpload struct {
+	UploadID   string    `json:"uploadId"`
+	BucketName string    `json:"bucket"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size,string"`
+	Updated    time.Time `json:"updated"`
+}
+
+// ResumableUploads returns the resumable uploads in progress, with the size
+// of the content received so far, sorted by ID. Uploads in namespaces are
+// not included.
+func (s *Server) ResumableUploads() []ResumableUpload {
+	var uploads []ResumableUpload
+	s.uploads.Range(func(key, value interface{}) bool {
+		session := value.(uploadSession)
+		uploads = append(uploads, ResumableUpload{
+			UploadID:   key.(string),
+			BucketName: session.obj.BucketName,
+			Name:       session.obj.Name,
+			Size:       int64(len(session.obj.Content)),
+			Updated:    session.updated,
+		})
+		return true
+	})
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].UploadID < uploads[j].UploadID
+	})
+	return uploads
+}
+
+// PurgeResumableUploads discards the resumable uploads that didn't receive
+// any content for at least the given duration, in all namespaces, and
+// returns how many were discarded. A zero duration discards all uploads in
+// progress. Chunks sent to discarded uploads fail with 404, like chunks sent
+// to expired sessions in Cloud Storage.
+//
+// It's called periodically while the server is running when
+// Options.ResumableUploadTTL is set. The same can be done with a DELETE
+// request to /_internal/resumableUploads, optionally with the duration in the
+// olderThan parameter, such as ?olderThan=1h. A GET request to the same path
+// lists the uploads in progress.
+func (s *Server) PurgeResumableUploads(olderThan time.Duration) int {
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	s.uploadsMtx.Lock()
+	s.uploads.Range(func(key, value interface{}) bool {
+		if session := value.(uploadSession); olderThan == 0 || session.updated.Before(cutoff) {
+			s.uploads.Delete(key)
+			purged++
+		}
+		return true
+	})
+	s.uploadsMtx.Unlock()
+	for _, ns := range s.namespaceServers() {
+		purged += ns.PurgeResumableUploads(olderThan)
+	}
+	return purged
+}
+
+// startUploadCollector starts the periodic purge of abandoned resumable
+// uploads, if the server has a ResumableUploadTTL. Namespaces are handled by
+// the collector of their parent.
+func (s *Server) startUploadCollector() {
+	ttl := s.options.ResumableUploadTTL
+	if ttl <= 0 || s.parent != nil {
+		return
+	}
+	s.uploadGC.start(expiryInterval(ttl), func(time.Time) {
+		s.PurgeResumableUploads(ttl)
+	})
+}
+
+func (s *Server) listResumableUploads(w http.ResponseWriter, r *http.Request) {
+	uploads := s.ResumableUploads()
+	if uploads == nil {
+		uploads = []ResumableUpload{}
+	}
+	writeJSON(w, map[string]interface{}{"uploads": uploads})
+}
+
+func (s *Server) purgeResumableUploadsByDelete(w http.ResponseWriter, r *http.Request) {
+	var olderThan time.Duration
+	if value := r.URL.Query().Get("olderThan"); value != "" {
+		var err error
+		olderThan, err = time.ParseDuration(value)
+		if err != nil || olderThan < 0 {
+			http.Error(w, "invalid olderThan", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, map[string]int{"purged": s.PurgeResumableUploads(olderThan)})
+}
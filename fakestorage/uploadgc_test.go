@@ -0,0 +1,198 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startResumableUpload starts a resumable upload and sends the given chunk,
+// returning the path of the upload session.
+func startResumableUpload(t *testing.T, server *Server, name, chunk string) string {
+	t.Helper()
+	client := server.HTTPClient()
+	resp, err := client.Post("https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name="+name, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != "" {
+		req, err := http.NewRequest(http.MethodPut, "https://www.googleapis.com"+location.Path, strings.NewReader(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Range", "bytes 0-"+strconv.Itoa(len(chunk)-1)+"/*")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	return location.Path
+}
+
+func TestServerPurgeResumableUploads(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "existing.txt"}})
+	defer server.Stop()
+	oldUpload := startResumableUpload(t, server, "old.txt", "some")
+	time.Sleep(50 * time.Millisecond)
+	startResumableUpload(t, server, "new.txt", "")
+
+	uploads := server.ResumableUploads()
+	if len(uploads) != 2 {
+		t.Fatalf("wrong number of uploads\nwant 2\ngot  %d", len(uploads))
+	}
+	for _, upload := range uploads {
+		if upload.Name == "old.txt" && upload.Size != 4 {
+			t.Errorf("wrong size of partial upload\nwant 4\ngot  %d", upload.Size)
+		}
+	}
+
+	if purged := server.PurgeResumableUploads(40 * time.Millisecond); purged != 1 {
+		t.Errorf("wrong number of purged uploads\nwant 1\ngot  %d", purged)
+	}
+	uploads = server.ResumableUploads()
+	if len(uploads) != 1 || uploads[0].Name != "new.txt" {
+		t.Errorf("wrong uploads after purge: %+v", uploads)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "https://www.googleapis.com"+oldUpload, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code for purged upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestServerResumableUploadTTL(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:         true,
+		ResumableUploadTTL: 50 * time.Millisecond,
+		InitialObjects:     []Object{{BucketName: "some-bucket", Name: "existing.txt"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	startResumableUpload(t, server, "abandoned.txt", "some")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.ResumableUploads()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned upload wasn't purged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerResumableUploadsInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "existing.txt"}})
+	defer server.Stop()
+	startResumableUpload(t, server, "first.txt", "some")
+	startResumableUpload(t, server, "second.txt", "")
+	const uploadsURL = "https://www.googleapis.com/_internal/resumableUploads"
+	do := func(method, query string, expectedStatus int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, uploadsURL+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s %s: wrong status code\nwant %d\ngot  %d", method, query, expectedStatus, resp.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var list struct {
+		Uploads []ResumableUpload
+	}
+	do(http.MethodGet, "", http.StatusOK, &list)
+	if len(list.Uploads) != 2 {
+		t.Errorf("wrong number of uploads\nwant 2\ngot  %d", len(list.Uploads))
+	}
+	do(http.MethodDelete, "?olderThan=soon", http.StatusBadRequest, nil)
+	var result struct {
+		Purged int
+	}
+	do(http.MethodDelete, "?olderThan=1h", http.StatusOK, &result)
+	if result.Purged != 0 {
+		t.Errorf("wrong number of purged uploads\nwant 0\ngot  %d", result.Purged)
+	}
+	do(http.MethodDelete, "", http.StatusOK, &result)
+	if result.Purged != 2 {
+		t.Errorf("wrong number of purged uploads\nwant 2\ngot  %d", result.Purged)
+	}
+}
+
+// purgingReader purges the resumable uploads of the server once the chunk
+// it provides is consumed, while the upload handler is processing it.
+type purgingReader struct {
+	server *Server
+	chunk  *strings.Reader
+}
+
+func (r *purgingReader) Read(p []byte) (int, error) {
+	n, err := r.chunk.Read(p)
+	if err == io.EOF {
+		r.server.PurgeResumableUploads(0)
+	}
+	return n, err
+}
+
+func TestServerPurgeResumableUploadsDuringChunk(t *testing.T) {
+	var tests = []struct {
+		name         string
+		contentRange string
+	}{
+		{"partial chunk", "bytes 4-10/*"},
+		{"last chunk", "bytes 4-10/11"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer([]Object{{BucketName: "some-bucket", Name: "existing.txt"}})
+			defer server.Stop()
+			upload := startResumableUpload(t, server, "purged.txt", "some")
+			req := httptest.NewRequest(http.MethodPut, "https://www.googleapis.com"+upload, &purgingReader{server: server, chunk: strings.NewReader("content")})
+			req.Header.Set("Content-Range", test.contentRange)
+			recorder := httptest.NewRecorder()
+			server.handler.ServeHTTP(recorder, req)
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("wrong status code for purged upload\nwant %d\ngot  %d", http.StatusNotFound, recorder.Code)
+			}
+			if uploads := server.ResumableUploads(); len(uploads) != 0 {
+				t.Errorf("purged upload was revived: %+v", uploads)
+			}
+			if _, err := server.GetObject("some-bucket", "purged.txt"); err == nil {
+				t.Error("purged upload was committed")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BucketUsage is the emulated storage usage of a bucket, like the usage
+// metrics Cloud Storage reports for billing and monitoring.
+type BucketUsage struct {
+	Bucket string `json:"bucket"`
+
+	// ObjectCount and TotalBytes account for all the generations stored in
+	// the bucket, as they're all billed: live objects, noncurrent
+	// generations and soft-deleted objects that are still retained.
+	ObjectCount int64 `json:"objectCount,string"`
+	TotalBytes  int64 `json:"totalBytes,string"`
+}
+
+// BucketUsage returns the emulated usage of the given bucket, or an error
+// matching storage.ErrBucketNotExist if the bucket doesn't exist.
+//
+// The usage is read from the sizes the server keeps up to date with each
+// write, while holding the lock of writes, so it always accounts for writes
+// as a whole: an object replaced in a bucket with versioning enabled is never
+// counted without its noncurrent generation, for example.
+//
+// The same data is available with a GET request to
+// /_internal/usage/<bucket>, and in the custom usage field of bucket
+// resources when Options.EmulateBucketUsage is set.
+func (s *Server) BucketUsage(bucketName string) (BucketUsage, error) {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	usage := BucketUsage{Bucket: bucketName}
+	sizes, err := s.bucketSizes(bucketName)
+	if err != nil {
+		return usage, err
+	}
+	softDeletedCount, softDeletedBytes := sizes.retainedSoftDeleted(time.Now())
+	usage.ObjectCount = int64(len(sizes.live)+len(sizes.noncurrent)) + softDeletedCount
+	usage.TotalBytes = sizes.liveBytes + sizes.noncurrentBytes + softDeletedBytes
+	return usage, nil
+}
+
+// addBucketUsage includes the usage of the bucket in the resource, when
+// Options.EmulateBucketUsage is set.
+func (s *Server) addBucketUsage(resp *bucketResponse) {
+	if !s.options.EmulateBucketUsage {
+		return
+	}
+	if usage, err := s.BucketUsage(resp.Name); err == nil {
+		resp.Usage = &usage
+	}
+}
+
+func (s *Server) getBucketUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.BucketUsage(mux.Vars(r)["bucketName"])
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, usage)
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerBucketUsage(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "versioned-bucket", VersioningEnabled: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "soft-delete-bucket", SoftDeleteRetention: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "versioned-bucket", Name: "object.txt", Content: []byte("first")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "versioned-bucket", Name: "object.txt", Content: []byte("second")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "versioned-bucket", Name: "other.txt", Content: []byte("other")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CreateObject(Object{BucketName: "soft-delete-bucket", Name: "deleted.txt", Content: []byte("deleted")}); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodDelete, "https://www.googleapis.com/storage/v1/b/soft-delete-bucket/o/deleted.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var tests = []struct {
+			bucket   string
+			expected BucketUsage
+		}{
+			{"versioned-bucket", BucketUsage{Bucket: "versioned-bucket", ObjectCount: 3, TotalBytes: 16}},
+			{"soft-delete-bucket", BucketUsage{Bucket: "soft-delete-bucket", ObjectCount: 1, TotalBytes: 7}},
+		}
+		for _, test := range tests {
+			usage, err := server.BucketUsage(test.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage != test.expected {
+				t.Errorf("wrong usage of %s\nwant %+v\ngot  %+v", test.bucket, test.expected, usage)
+			}
+		}
+		if _, err := server.BucketUsage("missing-bucket"); !errors.Is(err, storage.ErrBucketNotExist) {
+			t.Errorf("wrong error for missing bucket\nwant %v\ngot  %v", storage.ErrBucketNotExist, err)
+		}
+	})
+}
+
+func TestServerBucketUsageInResource(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:         true,
+		EmulateBucketUsage: true,
+		InitialObjects: []Object{
+			{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")},
+			{BucketName: "some-bucket", Name: "other.txt", Content: []byte("other")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	type usageResponse struct {
+		Usage *struct {
+			ObjectCount string
+			TotalBytes  string
+		}
+	}
+	resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var bucket usageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bucket); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Usage == nil || bucket.Usage.ObjectCount != "2" || bucket.Usage.TotalBytes != "12" {
+		t.Errorf("wrong usage in bucket resource: %+v", bucket.Usage)
+	}
+
+	// usage is updated along with writes.
+	upload, err := http.NewRequest(http.MethodPost, "https://www.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=new.txt", strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadResp, err := server.HTTPClient().Do(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadResp.Body.Close()
+	listResp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listResp.Body.Close()
+	var list struct {
+		Items []usageResponse
+	}
+	if err := json.NewDecoder(listResp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Usage == nil || list.Items[0].Usage.ObjectCount != "3" || list.Items[0].Usage.TotalBytes != "15" {
+		t.Errorf("wrong usage in bucket list: %+v", list.Items)
+	}
+}
+
+func TestServerBucketUsageInternal(t *testing.T) {
+	server := NewServer([]Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}})
+	defer server.Stop()
+	resp, err := server.HTTPClient().Get("https://www.googleapis.com/storage/v1/b/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bucket map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&bucket)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bucket["usage"]; ok {
+		t.Error("unexpected usage in bucket resource without EmulateBucketUsage")
+	}
+
+	resp, err = server.HTTPClient().Get("https://www.googleapis.com/_internal/usage/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var usage BucketUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	expected := BucketUsage{Bucket: "some-bucket", ObjectCount: 1, TotalBytes: 7}
+	if usage != expected {
+		t.Errorf("wrong usage\nwant %+v\ngot  %+v", expected, usage)
+	}
+
+	resp, err = server.HTTPClient().Get("https://www.googleapis.com/_internal/usage/missing-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code for missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestServerBucketUsageTracksWrites(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Stop()
+	if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true, SoftDeleteRetention: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	// loads the sizes of the bucket before the writes.
+	if _, err := server.BucketUsage("some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"first", "second"} {
+		if err := server.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte(content)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noncurrent, err := server.ListNoncurrentObjects("some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{
+		"https://www.googleapis.com/storage/v1/b/some-bucket/o/object.txt",
+		"https://www.googleapis.com/storage/v1/b/some-bucket/o/object.txt?generation=" + strconv.FormatInt(noncurrent[0].Generation, 10),
+	} {
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status code deleting %s\nwant %d\ngot  %d", url, http.StatusOK, resp.StatusCode)
+		}
+	}
+	usage, err := server.BucketUsage("some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BucketUsage{Bucket: "some-bucket", ObjectCount: 2, TotalBytes: 11}
+	if usage != expected {
+		t.Errorf("wrong usage after writes\nwant %+v\ngot  %+v", expected, usage)
+	}
+	server.writeMtx.Lock()
+	server.sizes = sizeIndex{}
+	server.writeMtx.Unlock()
+	reloaded, err := server.BucketUsage("some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded != usage {
+		t.Errorf("usage kept along with writes doesn't match the stored objects\nwant %+v\ngot  %+v", reloaded, usage)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+// GetObjectWithGeneration returns the given generation of an object, be it
+// the live version or a noncurrent one, or an error if the generation doesn't
+// exist.
+func (s *Server) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
+	obj, _, err := s.getObjectGeneration(bucketName, objectName, generation)
+	return obj, s.objectError(bucketName, objectName, err)
+}
+
+// getObjectGeneration returns the given generation of an object, and whether
+// it's the live version. Zero means the live version. Soft-deleted objects
+// are not returned.
+func (s *Server) getObjectGeneration(bucketName, objectName string, generation int64) (Object, bool, error) {
+	obj, err := s.GetObject(bucketName, objectName)
+	if err == nil && (generation == 0 || obj.Generation == generation) {
+		return obj, true, nil
+	}
+	if generation == 0 {
+		return Object{}, false, err
+	}
+	backendObj, err := s.backend.GetNoncurrentObject(bucketName, objectName, generation)
+	if err != nil {
+		return Object{}, false, err
+	}
+	if !backendObj.SoftDeleteTime.IsZero() {
+		return Object{}, false, errors.New("object not found")
+	}
+	return fromBackendObjects([]backend.Object{backendObj})[0], false, nil
+}
+
+// getSoftDeletedObject returns the given generation of a soft-deleted object,
+// or an error if it doesn't exist or its retention expired.
+func (s *Server) getSoftDeletedObject(bucketName, objectName string, generation int64) (Object, error) {
+	backendObj, err := s.backend.GetNoncurrentObject(bucketName, objectName, generation)
+	if err != nil {
+		return Object{}, err
+	}
+	obj := fromBackendObjects([]backend.Object{backendObj})[0]
+	if !obj.softDeleted(time.Now()) {
+		return Object{}, errors.New("object not found")
+	}
+	return obj, nil
+}
+
+// softDeleted returns whether the object is soft-deleted and still retained
+// at the given time.
+func (obj Object) softDeleted(now time.Time) bool {
+	return !obj.SoftDeleteTime.IsZero() && now.Before(obj.HardDeleteTime)
+}
+
+// ListNoncurrentObjects returns the noncurrent generations of the objects in
+// the given bucket, sorted by name and generation. Soft-deleted objects are
+// not included.
+func (s *Server) ListNoncurrentObjects(bucketName string) ([]Object, error) {
+	objs, err := s.listNoncurrentObjects(bucketName)
+	if err != nil {
+		return nil, bucketError(err)
+	}
+	var noncurrent []Object
+	for _, obj := range objs {
+		if obj.SoftDeleteTime.IsZero() {
+			noncurrent = append(noncurrent, obj)
+		}
+	}
+	return noncurrent, nil
+}
+
+// ListSoftDeletedObjects returns the soft-deleted objects in the given bucket
+// that are still retained, sorted by name and generation.
+func (s *Server) ListSoftDeletedObjects(bucketName string) ([]Object, error) {
+	objs, err := s.listNoncurrentObjects(bucketName)
+	if err != nil {
+		return nil, bucketError(err)
+	}
+	now := time.Now()
+	var softDeleted []Object
+	for _, obj := range objs {
+		if obj.softDeleted(now) {
+			softDeleted = append(softDeleted, obj)
+		}
+	}
+	return softDeleted, nil
+}
+
+func (s *Server) listNoncurrentObjects(bucketName string) ([]Object, error) {
+	backendObjects, err := s.backend.ListNoncurrentObjects(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return fromBackendObjects(backendObjects), nil
+}
+
+// listObjectVersions lists the objects matching prefix and delimiter for
+// listings with the versions or softDeleted parameters. The first lists live
+// objects along with their noncurrent generations, the second only
+// soft-deleted objects. Prefixes take all the listed generations into
+// account.
+func (s *Server) listObjectVersions(bucketName, prefix, delimiter string, softDeleted bool) ([]Object, []string, error) {
+	var objs []Object
+	var err error
+	if softDeleted {
+		objs, err = s.ListSoftDeletedObjects(bucketName)
+	} else {
+		objs, err = s.ListNoncurrentObjects(bucketName)
+		if err == nil {
+			var live []Object
+			live, _, err = s.listObjectsMetadata(bucketName, prefix, "")
+			objs = append(objs, live...)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	objs, prefixes := filterObjects(objs, prefix, delimiter)
+	return objs, prefixes, nil
+}
+
+// replaceObject handles a live object that was replaced by a new generation
+// or deleted. In buckets with versioning enabled, it's kept as a noncurrent
+// generation. Otherwise it's discarded.
+func (s *Server) replaceObject(obj Object) error {
+	bucket, err := s.backend.GetBucket(obj.BucketName)
+	if err != nil || !bucket.VersioningEnabled {
+		return s.discardObject(obj)
+	}
+	obj.TimeDeleted = time.Now()
+	err = s.backend.CreateNoncurrentObject(toBackendObjects([]Object{obj})[0])
+	if err != nil {
+		return err
+	}
+	s.sizes.noncurrentObjectStored(obj)
+	s.events.publish(ObjectArchive, obj)
+	return nil
+}
+
+// discardObject handles a generation of an object that was deleted, and
+// that's no longer in the backend as a live object. In buckets with a soft
+// delete policy, it's kept as a soft-deleted object until the retention
+// duration expires.
+func (s *Server) discardObject(obj Object) error {
+	if bucket, err := s.backend.GetBucket(obj.BucketName); err == nil && bucket.SoftDeleteRetention > 0 {
+		now := time.Now()
+		if obj.TimeDeleted.IsZero() {
+			obj.TimeDeleted = now
+		}
+		obj.SoftDeleteTime = now
+		obj.HardDeleteTime = now.Add(bucket.SoftDeleteRetention)
+		err := s.backend.CreateNoncurrentObject(toBackendObjects([]Object{obj})[0])
+		if err != nil {
+			return err
+		}
+		s.sizes.noncurrentObjectStored(obj)
+	}
+	s.events.publish(ObjectDelete, obj)
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+func writeObjectContent(t *testing.T, obj *storage.ObjectHandle, content string) *storage.ObjectAttrs {
+	t.Helper()
+	w := obj.NewWriter(context.Background())
+	w.Write([]byte(content))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Attrs()
+}
+
+func readObjectContent(t *testing.T, obj *storage.ObjectHandle) string {
+	t.Helper()
+	r, err := obj.NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestServerClientObjectVersioning(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		bucket := server.Client().Bucket("some-bucket")
+		attrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.VersioningEnabled {
+			t.Error("versioning not enabled in bucket attributes")
+		}
+		events, stopEvents := server.EventStream()
+		defer stopEvents()
+		objHandle := bucket.Object("some-object.txt")
+		first := writeObjectContent(t, objHandle, "first content")
+		second := writeObjectContent(t, objHandle, "second content")
+
+		if content := readObjectContent(t, objHandle); content != "second content" {
+			t.Errorf("wrong live content\nwant %q\ngot  %q", "second content", content)
+		}
+		if content := readObjectContent(t, objHandle.Generation(first.Generation)); content != "first content" {
+			t.Errorf("wrong noncurrent content\nwant %q\ngot  %q", "first content", content)
+		}
+		noncurrentAttrs, err := objHandle.Generation(first.Generation).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if noncurrentAttrs.Deleted.IsZero() {
+			t.Error("noncurrent generation without timeDeleted")
+		}
+
+		err = objHandle.Delete(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = objHandle.Attrs(ctx)
+		if err != storage.ErrObjectNotExist {
+			t.Errorf("wrong error after deleting live object\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+		}
+		objs, err := server.ListNoncurrentObjects("some-bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 2 || objs[0].Generation != first.Generation || objs[1].Generation != second.Generation {
+			t.Errorf("wrong noncurrent generations: %v", objs)
+		}
+
+		err = objHandle.Generation(first.Generation).Delete(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.GetObjectWithGeneration("some-bucket", "some-object.txt", first.Generation); err == nil {
+			t.Error("noncurrent generation found after being deleted")
+		}
+		if _, err := server.GetObjectWithGeneration("some-bucket", "some-object.txt", second.Generation); err != nil {
+			t.Errorf("unexpected error getting the remaining generation: %v", err)
+		}
+
+		expected := []ObjectEventType{ObjectFinalize, ObjectArchive, ObjectFinalize, ObjectArchive, ObjectDelete}
+		for i, eventType := range expected {
+			select {
+			case event := <-events:
+				if event.Type != eventType {
+					t.Errorf("wrong type for event %d\nwant %s\ngot  %s", i, eventType, event.Type)
+				}
+			default:
+				t.Fatalf("missing event %d: %s", i, eventType)
+			}
+		}
+	})
+}
+
+func TestServerClientDeleteObjectGeneration(t *testing.T) {
+	objs := []Object{
+		{BucketName: "some-bucket", Name: "some-object.txt", Content: []byte("live"), Generation: 30, Metageneration: 2},
+	}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		err := server.backend.CreateNoncurrentObject(toBackendObjects([]Object{
+			{BucketName: "some-bucket", Name: "some-object.txt", Content: []byte("noncurrent"), Generation: 10, Metageneration: 1},
+		})[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		objHandle := server.Client().Bucket("some-bucket").Object("some-object.txt")
+		missingHandle := server.Client().Bucket("some-bucket").Object("missing.txt")
+		tests := []struct {
+			name           string
+			obj            *storage.ObjectHandle
+			expectedStatus int
+		}{
+			{
+				"missing generation",
+				objHandle.Generation(20),
+				http.StatusNotFound,
+			},
+			{
+				"missing object with precondition",
+				missingHandle.If(storage.Conditions{GenerationMatch: 10}),
+				http.StatusNotFound,
+			},
+			{
+				"live object with failed precondition",
+				objHandle.If(storage.Conditions{GenerationMatch: 10}),
+				http.StatusPreconditionFailed,
+			},
+			{
+				"noncurrent generation with failed precondition",
+				objHandle.Generation(10).If(storage.Conditions{MetagenerationMatch: 2}),
+				http.StatusPreconditionFailed,
+			},
+			{
+				"noncurrent generation",
+				objHandle.Generation(10).If(storage.Conditions{MetagenerationMatch: 1}),
+				http.StatusOK,
+			},
+			{
+				"live generation",
+				objHandle.Generation(30).If(storage.Conditions{GenerationMatch: 30}),
+				http.StatusOK,
+			},
+		}
+		for _, test := range tests {
+			err := test.obj.Delete(context.Background())
+			if test.expectedStatus == http.StatusOK {
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", test.name, err)
+				}
+				continue
+			}
+			if err == storage.ErrObjectNotExist {
+				err = &googleapi.Error{Code: http.StatusNotFound}
+			}
+			if gErr, ok := err.(*googleapi.Error); !ok || gErr.Code != test.expectedStatus {
+				t.Errorf("%s: wrong error returned\nwant status %d\ngot  %v", test.name, test.expectedStatus, err)
+			}
+		}
+		if _, err := server.GetObject("some-bucket", "some-object.txt"); err == nil {
+			t.Error("live object found after deleting its generation")
+		}
+		if objs, _ := server.ListNoncurrentObjects("some-bucket"); len(objs) != 0 {
+			t.Errorf("unexpected noncurrent generations after deleting the live generation: %v", objs)
+		}
+	})
+}
+
+func TestServerClientListObjectVersions(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true}); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("some-bucket")
+		var generations []int64
+		for _, name := range []string{"logs/a.txt", "logs/a.txt", "logs/old/b.txt", "other.txt"} {
+			attrs := writeObjectContent(t, bucket.Object(name), "some content")
+			generations = append(generations, attrs.Generation)
+		}
+		err := bucket.Object("logs/old/b.txt").Delete(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		it := bucket.Objects(context.Background(), &storage.Query{Prefix: "logs/", Delimiter: "/", Versions: true})
+		var got []string
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.Prefix != "" {
+				got = append(got, attrs.Prefix)
+				continue
+			}
+			got = append(got, fmt.Sprintf("%s#%d", attrs.Name, attrs.Generation))
+		}
+		expected := []string{
+			fmt.Sprintf("logs/a.txt#%d", generations[0]),
+			fmt.Sprintf("logs/a.txt#%d", generations[1]),
+			"logs/old/",
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("wrong listing\nwant %v\ngot  %v", expected, got)
+		}
+
+		resp := listObjectsJSON(t, server, "some-bucket", "prefix=logs/old/&versions=true")
+		if len(resp.Items) != 1 {
+			t.Fatalf("wrong number of items\nwant 1\ngot  %d", len(resp.Items))
+		}
+		if resp.Items[0].Generation != generations[2] {
+			t.Errorf("wrong generation\nwant %d\ngot  %d", generations[2], resp.Items[0].Generation)
+		}
+		if resp.Items[0].TimeDeleted == "" {
+			t.Error("noncurrent item without timeDeleted")
+		}
+		if resp := listObjectsJSON(t, server, "some-bucket", "prefix=logs/old/"); len(resp.Items) != 0 {
+			t.Errorf("noncurrent generations listed without versions=true: %v", resp.Items)
+		}
+	})
+}
+
+func TestServerClientListSoftDeletedObjects(t *testing.T) {
+	runServersTest(t, nil, func(t *testing.T, server *Server) {
+		if err := server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", SoftDeleteRetention: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		bucket := server.Client().Bucket("some-bucket")
+		first := writeObjectContent(t, bucket.Object("dir/object.txt"), "first content")
+		second := writeObjectContent(t, bucket.Object("dir/object.txt"), "second content")
+		writeObjectContent(t, bucket.Object("dir/live.txt"), "live content")
+		err := bucket.Object("dir/object.txt").Delete(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp := listObjectsJSON(t, server, "some-bucket", "versions=true"); len(resp.Items) != 1 || resp.Items[0].Name != "dir/live.txt" {
+			t.Errorf("wrong versions listing in bucket without versioning: %v", resp.Items)
+		}
+		resp := listObjectsJSON(t, server, "some-bucket", "softDeleted=true&prefix=dir/")
+		if len(resp.Items) != 2 {
+			t.Fatalf("wrong number of soft-deleted items\nwant 2\ngot  %d", len(resp.Items))
+		}
+		for i, generation := range []int64{first.Generation, second.Generation} {
+			item := resp.Items[i]
+			if item.Name != "dir/object.txt" || item.Generation != generation {
+				t.Errorf("wrong soft-deleted item %d\nwant dir/object.txt#%d\ngot  %s#%d", i, generation, item.Name, item.Generation)
+			}
+			if item.TimeDeleted == "" || item.SoftDeleteTime == "" || item.HardDeleteTime == "" {
+				t.Errorf("soft-deleted item %d without deletion times: %+v", i, item)
+			}
+		}
+
+		url := fmt.Sprintf("https://www.googleapis.com/storage/v1/b/some-bucket/o/dir%%2Fobject.txt?softDeleted=true&generation=%d", first.Generation)
+		getResp, err := server.HTTPClient().Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		getResp.Body.Close()
+		if getResp.StatusCode != http.StatusOK {
+			t.Errorf("wrong status getting soft-deleted object\nwant %d\ngot  %d", http.StatusOK, getResp.StatusCode)
+		}
+		_, err = bucket.Object("dir/object.txt").Generation(first.Generation).Attrs(context.Background())
+		if err != storage.ErrObjectNotExist {
+			t.Errorf("wrong error getting soft-deleted object without softDeleted\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+		}
+	})
+}
+
+type listObjectsJSONResponse struct {
+	Items    []objectResponse `json:"items"`
+	Prefixes []string         `json:"prefixes"`
+}
+
+func listObjectsJSON(t *testing.T, server *Server, bucketName, query string) listObjectsJSONResponse {
+	t.Helper()
+	resp, err := server.HTTPClient().Get(fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o?%s", bucketName, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var listResp listObjectsJSONResponse
+	err = json.NewDecoder(resp.Body).Decode(&listResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listResp
+}
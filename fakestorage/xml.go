@@ -0,0 +1,175 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// xmlError is the error document returned by the XML API.
+type xmlError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeXMLError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(xmlError{Code: code, Message: message})
+}
+
+// writeXMLStatusError writes the XML API equivalent of the JSON API error
+// err.
+func writeXMLStatusError(w http.ResponseWriter, err error) {
+	sErr, ok := err.(*statusError)
+	if !ok {
+		writeXMLError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	code := sErr.reason
+	switch sErr.code {
+	case http.StatusNotFound:
+		code = "NoSuchKey"
+	case http.StatusPreconditionFailed:
+		code = "PreconditionFailed"
+	case http.StatusRequestEntityTooLarge:
+		code = "EntityTooLarge"
+	case http.StatusForbidden:
+		code = "AccessDenied"
+	}
+	writeXMLError(w, sErr.code, code, sErr.message)
+}
+
+// xmlPutObject handles object uploads through the XML API, which are plain
+// PUT requests with the content of the object in the body.
+//
+// Clients may send the checksums of the content in the x-goog-hash header
+// (and the MD5 hash in the Content-MD5 header), which are validated like in
+// Cloud Storage: malformed values are rejected with InvalidDigest, and values
+// that don't match the content with BadDigest.
+func (s *Server) xmlPutObject(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	hashes, err := parseHashHeaders(r.Header)
+	if err != nil {
+		writeXMLError(w, http.StatusBadRequest, "InvalidDigest", err.Error())
+		return
+	}
+	conds, err := parseObjectConditions(r)
+	if err != nil {
+		writeXMLError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeXMLError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	if err := hashes.verify(data); err != nil {
+		writeXMLError(w, http.StatusBadRequest, "BadDigest", err.Error())
+		return
+	}
+	obj := Object{
+		BucketName:      vars["bucketName"],
+		Name:            vars["objectName"],
+		Content:         data,
+		Crc32c:          encodedCrc32cChecksum(data),
+		Md5Hash:         encodedMd5Hash(data),
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		CacheControl:    r.Header.Get("Cache-Control"),
+		Metadata:        metadataFromHeaders(r.Header),
+	}
+	s.setUploadDefaults(&obj)
+	obj, err = s.writeObject(obj, conds)
+	if err != nil {
+		writeXMLStatusError(w, err)
+		return
+	}
+	setObjectHeaders(w.Header(), obj)
+	w.Header().Set("ETag", fmt.Sprintf("%q", hex.EncodeToString(md5Hash(data))))
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestHashes are the checksums of the content sent by the client.
+type requestHashes struct {
+	crc32c []byte
+	md5    []byte
+}
+
+// parseHashHeaders parses the x-goog-hash and Content-MD5 headers. The
+// x-goog-hash header may be repeated, and each value may contain multiple
+// comma-separated hashes, in the form "crc32c=<base64>,md5=<base64>".
+func parseHashHeaders(h http.Header) (requestHashes, error) {
+	var hashes requestHashes
+	for _, value := range h["X-Goog-Hash"] {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				return hashes, fmt.Errorf("invalid x-goog-hash value %q", entry)
+			}
+			var err error
+			switch strings.ToLower(parts[0]) {
+			case "crc32c":
+				hashes.crc32c, err = decodeHash(parts[1], 4)
+			case "md5":
+				hashes.md5, err = decodeHash(parts[1], 16)
+			default:
+				err = fmt.Errorf("unsupported hash algorithm %q", parts[0])
+			}
+			if err != nil {
+				return hashes, fmt.Errorf("invalid x-goog-hash value %q: %v", entry, err)
+			}
+		}
+	}
+	if value := h.Get("Content-MD5"); value != "" {
+		hash, err := decodeHash(value, 16)
+		if err != nil {
+			return hashes, fmt.Errorf("invalid Content-MD5 value %q: %v", value, err)
+		}
+		if hashes.md5 != nil && !bytes.Equal(hash, hashes.md5) {
+			return hashes, fmt.Errorf("the Content-MD5 and x-goog-hash headers don't match")
+		}
+		hashes.md5 = hash
+	}
+	return hashes, nil
+}
+
+func decodeHash(value string, size int) ([]byte, error) {
+	hash, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64")
+	}
+	if len(hash) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(hash))
+	}
+	return hash, nil
+}
+
+// verify checks that the hashes match the given content.
+func (h requestHashes) verify(content []byte) error {
+	if h.crc32c != nil && !bytes.Equal(h.crc32c, crc32cChecksum(content)) {
+		return fmt.Errorf("the CRC32C you specified did not match what we received")
+	}
+	if h.md5 != nil && !bytes.Equal(h.md5, md5Hash(content)) {
+		return fmt.Errorf("the MD5 you specified did not match what we received")
+	}
+	return nil
+}
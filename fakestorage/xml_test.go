@@ -0,0 +1,173 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerXMLPutObject(t *testing.T) {
+	const content = "some nice content"
+	validCrc32c := encodedCrc32cChecksum([]byte(content))
+	validMd5 := encodedMd5Hash([]byte(content))
+	otherMd5 := encodedMd5Hash([]byte("other content"))
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			"no hashes",
+			nil,
+			http.StatusOK,
+			"",
+		},
+		{
+			"valid hashes in a single header",
+			map[string][]string{"X-Goog-Hash": {"crc32c=" + validCrc32c + ",md5=" + validMd5}},
+			http.StatusOK,
+			"",
+		},
+		{
+			"valid hashes in multiple headers",
+			map[string][]string{"X-Goog-Hash": {"crc32c=" + validCrc32c, "md5=" + validMd5}},
+			http.StatusOK,
+			"",
+		},
+		{
+			"valid Content-MD5",
+			map[string][]string{"Content-MD5": {validMd5}},
+			http.StatusOK,
+			"",
+		},
+		{
+			"invalid base64",
+			map[string][]string{"X-Goog-Hash": {"md5=not base64!"}},
+			http.StatusBadRequest,
+			"InvalidDigest",
+		},
+		{
+			"wrong hash size",
+			map[string][]string{"X-Goog-Hash": {"crc32c=" + validMd5}},
+			http.StatusBadRequest,
+			"InvalidDigest",
+		},
+		{
+			"unknown algorithm",
+			map[string][]string{"X-Goog-Hash": {"sha1=" + validMd5}},
+			http.StatusBadRequest,
+			"InvalidDigest",
+		},
+		{
+			"missing value",
+			map[string][]string{"X-Goog-Hash": {"md5"}},
+			http.StatusBadRequest,
+			"InvalidDigest",
+		},
+		{
+			"conflicting Content-MD5",
+			map[string][]string{"X-Goog-Hash": {"md5=" + validMd5}, "Content-MD5": {otherMd5}},
+			http.StatusBadRequest,
+			"InvalidDigest",
+		},
+		{
+			"md5 mismatch",
+			map[string][]string{"X-Goog-Hash": {"md5=" + otherMd5}},
+			http.StatusBadRequest,
+			"BadDigest",
+		},
+		{
+			"crc32c mismatch",
+			map[string][]string{"X-Goog-Hash": {"crc32c=AAAAAA=="}},
+			http.StatusBadRequest,
+			"BadDigest",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			runServersTest(t, nil, func(t *testing.T, server *Server) {
+				if err := server.CreateBucket("some-bucket"); err != nil {
+					t.Fatal(err)
+				}
+				req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/some-bucket/files/object.txt", strings.NewReader(content))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", "text/plain")
+				for name, values := range test.headers {
+					for _, value := range values {
+						req.Header.Add(name, value)
+					}
+				}
+				resp, err := server.HTTPClient().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != test.expectedStatus {
+					t.Fatalf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+				}
+				obj, err := server.GetObject("some-bucket", "files/object.txt")
+				if test.expectedStatus != http.StatusOK {
+					var xmlErr xmlError
+					if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+						t.Fatal(err)
+					}
+					if xmlErr.Code != test.expectedCode {
+						t.Errorf("wrong error code\nwant %q\ngot  %q", test.expectedCode, xmlErr.Code)
+					}
+					if err == nil {
+						t.Error("unexpected object stored after failed upload")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(obj.Content) != content {
+					t.Errorf("wrong content\nwant %q\ngot  %q", content, obj.Content)
+				}
+				if obj.ContentType != "text/plain" {
+					t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", obj.ContentType)
+				}
+				checkChecksum(t, []byte(content), obj)
+			})
+		})
+	}
+}
+
+func TestServerXMLPutObjectPrecondition(t *testing.T) {
+	objs := []Object{{BucketName: "some-bucket", Name: "object.txt", Content: []byte("existing")}}
+	runServersTest(t, objs, func(t *testing.T, server *Server) {
+		req, err := http.NewRequest(http.MethodPut, "https://some-bucket.storage.googleapis.com/object.txt", strings.NewReader("new content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Goog-If-Generation-Match", "0")
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+		var xmlErr xmlError
+		if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+			t.Fatal(err)
+		}
+		if xmlErr.Code != "PreconditionFailed" {
+			t.Errorf("wrong error code\nwant %q\ngot  %q", "PreconditionFailed", xmlErr.Code)
+		}
+		if !strings.Contains(xmlErr.Message, resp.Header.Get(requestIDHeader)) {
+			t.Errorf("request ID missing in error message: %q", xmlErr.Message)
+		}
+	})
+}
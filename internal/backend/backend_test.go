@@ -6,9 +6,16 @@ package backend
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -21,11 +28,37 @@ func makeStorageBackends(t *testing.T) (map[string]Storage, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	gzipDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageFSGzip, err := NewStorageFSWithOptions(nil, gzipDir, FSOptions{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBehindDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageWriteBehind, err := NewStorageWriteBehind(nil, filepath.Join(writeBehindDir, "snapshot"), FSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	return map[string]Storage{
-			"memory":     NewStorageMemory(nil),
-			"filesystem": storageFS,
+			"memory":          NewStorageMemory(nil),
+			"filesystem":      storageFS,
+			"filesystem-gzip": storageFSGzip,
+			"write-behind":    storageWriteBehind,
 		}, func() {
-			err := os.RemoveAll(tempDir)
+			err := os.RemoveAll(writeBehindDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.RemoveAll(gzipDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.RemoveAll(tempDir)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -120,10 +153,156 @@ func TestObjectCRUD(t *testing.T) {
 	})
 }
 
+func TestNoncurrentObjectCRUD(t *testing.T) {
+	const bucketName = "some-bucket"
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		noError(t, storage.CreateBucket(Bucket{Name: bucketName}))
+		_, err := storage.GetNoncurrentObject(bucketName, "some/object", 1)
+		shouldError(t, err, "noncurrent object found before being created")
+		err = storage.DeleteNoncurrentObject(bucketName, "some/object", 1)
+		shouldError(t, err, "noncurrent object successfully deleted before being created")
+
+		objs := []Object{
+			{BucketName: bucketName, Name: "some/object", Generation: 20, Content: []byte("second")},
+			{BucketName: bucketName, Name: "other", Generation: 30, Content: []byte("other")},
+			{BucketName: bucketName, Name: "some/object", Generation: 10, Content: []byte("first")},
+		}
+		for _, obj := range objs {
+			noError(t, storage.CreateNoncurrentObject(obj))
+		}
+		obj, err := storage.GetNoncurrentObject(bucketName, "some/object", 10)
+		noError(t, err)
+		if string(obj.Content) != "first" {
+			t.Errorf("wrong object content\nwant %q\ngot  %q", "first", obj.Content)
+		}
+		if live, err := storage.ListObjects(bucketName); err != nil || len(live) != 0 {
+			t.Errorf("noncurrent objects shouldn't be listed as live objects: %v, %v", live, err)
+		}
+
+		listed, err := storage.ListNoncurrentObjects(bucketName)
+		noError(t, err)
+		var ids []string
+		for _, obj := range listed {
+			ids = append(ids, fmt.Sprintf("%s#%d", obj.Name, obj.Generation))
+		}
+		expected := []string{"other#30", "some/object#10", "some/object#20"}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("wrong noncurrent objects listed\nwant %v\ngot  %v", expected, ids)
+		}
+
+		noError(t, storage.DeleteNoncurrentObject(bucketName, "some/object", 10))
+		_, err = storage.GetNoncurrentObject(bucketName, "some/object", 10)
+		shouldError(t, err, "noncurrent object found after being deleted")
+		_, err = storage.GetNoncurrentObject(bucketName, "some/object", 20)
+		noError(t, err)
+	})
+}
+
+func TestListObjectsWithPrefix(t *testing.T) {
+	const bucketName = "some-bucket"
+	names := []string{
+		"img/hi-res/party-02.jpg",
+		"img/low-res/party-01.jpg",
+		"img/hi-res/party-01.jpg",
+		"img.txt",
+		"static/css/style.css",
+		"img/brand.jpg",
+		"imgs/brand.jpg",
+	}
+	tests := []struct {
+		prefix           string
+		delimiter        string
+		expectedNames    []string
+		expectedPrefixes []string
+	}{
+		{
+			"",
+			"",
+			[]string{"img.txt", "img/brand.jpg", "img/hi-res/party-01.jpg", "img/hi-res/party-02.jpg", "img/low-res/party-01.jpg", "imgs/brand.jpg", "static/css/style.css"},
+			nil,
+		},
+		{
+			"",
+			"/",
+			[]string{"img.txt"},
+			[]string{"img/", "imgs/", "static/"},
+		},
+		{
+			"img/",
+			"/",
+			[]string{"img/brand.jpg"},
+			[]string{"img/hi-res/", "img/low-res/"},
+		},
+		{
+			"img",
+			"",
+			[]string{"img.txt", "img/brand.jpg", "img/hi-res/party-01.jpg", "img/hi-res/party-02.jpg", "img/low-res/party-01.jpg", "imgs/brand.jpg"},
+			nil,
+		},
+		{
+			"img/",
+			"-res/",
+			[]string{"img/brand.jpg"},
+			[]string{"img/hi-res/", "img/low-res/"},
+		},
+		{
+			"video/",
+			"/",
+			nil,
+			nil,
+		},
+	}
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		for _, name := range names {
+			noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: name, Content: []byte(name)}))
+		}
+		for _, test := range tests {
+			objs, prefixes, err := storage.ListObjectsWithPrefix(bucketName, test.prefix, test.delimiter)
+			noError(t, err)
+			var gotNames []string
+			for _, obj := range objs {
+				gotNames = append(gotNames, obj.Name)
+				if string(obj.Content) != obj.Name {
+					t.Errorf("wrong content for %s: %q", obj.Name, obj.Content)
+				}
+			}
+			if fmt.Sprint(gotNames) != fmt.Sprint(test.expectedNames) {
+				t.Errorf("wrong objects for prefix %q and delimiter %q\nwant %q\ngot  %q", test.prefix, test.delimiter, test.expectedNames, gotNames)
+			}
+			if fmt.Sprint(prefixes) != fmt.Sprint(test.expectedPrefixes) {
+				t.Errorf("wrong prefixes for prefix %q and delimiter %q\nwant %q\ngot  %q", test.prefix, test.delimiter, test.expectedPrefixes, prefixes)
+			}
+		}
+		noError(t, storage.DeleteObject(bucketName, "img/brand.jpg"))
+		objs, _, err := storage.ListObjectsWithPrefix(bucketName, "img/", "/")
+		noError(t, err)
+		if len(objs) != 0 {
+			t.Errorf("unexpected objects after delete: %v", objs)
+		}
+		_, _, err = storage.ListObjectsWithPrefix("missing-bucket", "", "")
+		shouldError(t, err, "listing succeeded in a missing bucket")
+	})
+}
+
+func BenchmarkStorageMemoryListObjectsWithPrefix(b *testing.B) {
+	var objects []Object
+	for i := 0; i < 200000; i++ {
+		objects = append(objects, Object{BucketName: "some-bucket", Name: fmt.Sprintf("dir-%03d/object-%06d", i%500, i)})
+	}
+	storage := NewStorageMemory(objects)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := storage.ListObjectsWithPrefix("some-bucket", "dir-250/", "/")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestBucketCreateGetList(t *testing.T) {
 	const bucketName = "prod-bucket"
 	testForStorageBackends(t, func(t *testing.T, storage Storage) {
-		err := storage.GetBucket(bucketName)
+		_, err := storage.GetBucket(bucketName)
 		if err == nil {
 			t.Fatal("bucket exists before being created")
 		}
@@ -134,14 +313,33 @@ func TestBucketCreateGetList(t *testing.T) {
 		if len(buckets) != 0 {
 			t.Fatalf("more than zero buckets found: %d", len(buckets))
 		}
-		err = storage.CreateBucket(bucketName)
+		err = storage.CreateBucket(Bucket{Name: bucketName, DefaultEventBasedHold: true})
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = storage.GetBucket(bucketName)
+		bucket, err := storage.GetBucket(bucketName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket.Name != bucketName || !bucket.DefaultEventBasedHold {
+			t.Fatalf("wrong bucket returned: %#v", bucket)
+		}
+		bucket.DefaultEventBasedHold = false
+		err = storage.UpdateBucket(bucket)
 		if err != nil {
 			t.Fatal(err)
 		}
+		bucket, err = storage.GetBucket(bucketName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket.DefaultEventBasedHold {
+			t.Fatalf("bucket not updated: %#v", bucket)
+		}
+		err = storage.UpdateBucket(Bucket{Name: "other-bucket"})
+		if err == nil {
+			t.Fatal("unexpected <nil> error updating non-existent bucket")
+		}
 		buckets, err = storage.ListBuckets()
 		if err != nil {
 			t.Fatal(err)
@@ -149,8 +347,542 @@ func TestBucketCreateGetList(t *testing.T) {
 		if len(buckets) != 1 {
 			t.Fatalf("one bucket not found after creating it, found: %d", len(buckets))
 		}
-		if buckets[0] != bucketName {
-			t.Fatalf("wrong bucket name; expected %s, got %s", bucketName, buckets[0])
+		if buckets[0].Name != bucketName {
+			t.Fatalf("wrong bucket name; expected %s, got %s", bucketName, buckets[0].Name)
 		}
 	})
 }
+
+func TestStorageFSCompression(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const bucketName = "prod-bucket"
+	content := bytes.Repeat([]byte("some highly compressible content\n"), 1024)
+
+	plain, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	noError(t, plain.CreateObject(Object{BucketName: bucketName, Name: "plain.txt", Content: content}))
+	compressed, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{Compression: CompressionGzip})
+	noError(t, err)
+	noError(t, compressed.CreateObject(Object{BucketName: bucketName, Name: "compressed.txt", Content: content}))
+
+	raw, err := ioutil.ReadFile(filepath.Join(tempDir, bucketName, "compressed.txt"))
+	noError(t, err)
+	if !bytes.HasPrefix(raw, gzipMagic) {
+		t.Errorf("object file is not gzip compressed: %q", raw[:10])
+	}
+	if len(raw) >= len(content) {
+		t.Errorf("compressed file is not smaller than the content: %d >= %d", len(raw), len(content))
+	}
+	for _, name := range []string{"plain.txt", "compressed.txt"} {
+		for _, storage := range []Storage{plain, compressed} {
+			obj, err := storage.GetObject(bucketName, name)
+			noError(t, err)
+			if !bytes.Equal(obj.Content, content) {
+				t.Errorf("wrong content for %s", name)
+			}
+		}
+	}
+}
+
+func TestStorageFSListObjectsMetadata(t *testing.T) {
+	var tests = []struct {
+		name        string
+		compression Compression
+	}{
+		{"content files", CompressionNone},
+		{"compressed object files", CompressionGzip},
+	}
+	for _, test := range tests {
+		compression := test.compression
+		t.Run(test.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+			storage, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{Compression: compression})
+			noError(t, err)
+			noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "dir/object.txt", Content: []byte("some content")}))
+			noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "other.txt", Content: []byte("other")}))
+			objs, prefixes, err := storage.(MetadataLister).ListObjectsMetadata("some-bucket", "", "/")
+			noError(t, err)
+			if len(objs) != 1 || objs[0].Name != "other.txt" || objs[0].Size != 5 || objs[0].Content != nil {
+				t.Errorf("wrong objects listed without content: %+v", objs)
+			}
+			if !reflect.DeepEqual(prefixes, []string{"dir/"}) {
+				t.Errorf("wrong prefixes\nwant %q\ngot  %q", []string{"dir/"}, prefixes)
+			}
+		})
+	}
+}
+
+func TestStorageFSInvalidCompression(t *testing.T) {
+	_, err := NewStorageFSWithOptions(nil, os.TempDir(), FSOptions{Compression: "lz4"})
+	shouldError(t, err, "unexpected <nil> error for unsupported compression")
+}
+
+func TestStorageFSEncryption(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const bucketName = "prod-bucket"
+	const objectName = "secret.txt"
+	content := []byte("some semi-sensitive fixture data")
+	key := bytes.Repeat([]byte("k"), 32)
+
+	storage, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{Compression: CompressionGzip, EncryptionKey: key})
+	noError(t, err)
+	noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: objectName, Content: content}))
+
+	raw, err := ioutil.ReadFile(filepath.Join(tempDir, bucketName, objectName))
+	noError(t, err)
+	if bytes.Contains(raw, content) || bytes.Contains(raw, []byte(base64.StdEncoding.EncodeToString(content))) {
+		t.Errorf("object file contains the plain content: %q", raw)
+	}
+	obj, err := storage.GetObject(bucketName, objectName)
+	noError(t, err)
+	if !bytes.Equal(obj.Content, content) {
+		t.Errorf("wrong object content\nwant %q\ngot  %q", content, obj.Content)
+	}
+
+	noKey, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	_, err = noKey.GetObject(bucketName, objectName)
+	shouldError(t, err, "read encrypted object without a key")
+
+	wrongKey, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{EncryptionKey: bytes.Repeat([]byte("w"), 32)})
+	noError(t, err)
+	_, err = wrongKey.GetObject(bucketName, objectName)
+	shouldError(t, err, "read encrypted object with the wrong key")
+}
+
+func TestStorageFSInvalidEncryptionKey(t *testing.T) {
+	_, err := NewStorageFSWithOptions(nil, os.TempDir(), FSOptions{EncryptionKey: []byte("short")})
+	shouldError(t, err, "unexpected <nil> error for invalid key size")
+}
+
+func TestStorageFSSharedRootDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const bucketName = "prod-bucket"
+	const objectName = "shared.txt"
+	contents := [][]byte{
+		bytes.Repeat([]byte("a"), 64*1024),
+		bytes.Repeat([]byte("b"), 128*1024),
+	}
+	writer, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	reader, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	noError(t, writer.CreateObject(Object{BucketName: bucketName, Name: objectName, Content: contents[0]}))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- writer.CreateObject(Object{BucketName: bucketName, Name: objectName, Content: contents[i%2]})
+		}(i)
+		go func() {
+			defer wg.Done()
+			obj, err := reader.GetObject(bucketName, objectName)
+			if err == nil && !bytes.Equal(obj.Content, contents[0]) && !bytes.Equal(obj.Content, contents[1]) {
+				err = fmt.Errorf("read partially written object with %d bytes", len(obj.Content))
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		noError(t, err)
+	}
+
+	buckets, err := reader.ListBuckets()
+	noError(t, err)
+	if len(buckets) != 1 || buckets[0].Name != bucketName {
+		t.Errorf("wrong buckets returned\nwant [%s]\ngot  %v", bucketName, buckets)
+	}
+	objs, err := reader.ListObjects(bucketName)
+	noError(t, err)
+	if len(objs) != 1 {
+		t.Errorf("wrong number of objects returned\nwant 1\ngot  %d", len(objs))
+	}
+}
+
+func TestStorageMemorySharedContent(t *testing.T) {
+	content := bytes.Repeat([]byte("some content"), 1024)
+	storage := NewStorageMemory([]Object{
+		{BucketName: "some-bucket", Name: "fixture.txt", Content: content},
+	}).(*StorageMemory)
+	for _, name := range []string{"copy-1.txt", "copy-2.txt"} {
+		noError(t, storage.CreateObject(Object{BucketName: "other-bucket", Name: name, Content: append([]byte(nil), content...)}))
+	}
+	original := storage.buckets["some-bucket"][0]
+	for _, obj := range storage.buckets["other-bucket"] {
+		if &obj.Content[0] != &original.Content[0] {
+			t.Errorf("content of %s not shared with the original object", obj.Name)
+		}
+	}
+	if len(storage.blobs.blobs) != 1 {
+		t.Errorf("wrong number of blobs\nwant 1\ngot  %d", len(storage.blobs.blobs))
+	}
+
+	noError(t, storage.CreateObject(Object{BucketName: "other-bucket", Name: "copy-1.txt", Content: []byte("other content")}))
+	noError(t, storage.DeleteObject("other-bucket", "copy-2.txt"))
+	noError(t, storage.DeleteObject("some-bucket", "fixture.txt"))
+	if len(storage.blobs.blobs) != 1 {
+		t.Errorf("blobs not released\nwant 1 blob\ngot  %d", len(storage.blobs.blobs))
+	}
+	noError(t, storage.DeleteObject("other-bucket", "copy-1.txt"))
+	if len(storage.blobs.blobs) != 0 {
+		t.Errorf("blobs not released\nwant 0 blobs\ngot  %d", len(storage.blobs.blobs))
+	}
+}
+
+func TestStorageMemoryContentCopied(t *testing.T) {
+	content := []byte("some content")
+	storage := NewStorageMemory(nil).(*StorageMemory)
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "some-object.txt", Content: content}))
+	copy(content, "XXXX")
+	obj, err := storage.GetObject("some-bucket", "some-object.txt")
+	noError(t, err)
+	if string(obj.Content) != "some content" {
+		t.Errorf("content modified through the buffer of the caller\nwant %q\ngot  %q", "some content", obj.Content)
+	}
+
+	obj.ContentType = "text/plain"
+	noError(t, storage.CreateObject(obj))
+	if len(storage.blobs.blobs) != 1 {
+		t.Errorf("wrong number of blobs after updating metadata\nwant 1\ngot  %d", len(storage.blobs.blobs))
+	}
+	noError(t, storage.DeleteObject("some-bucket", "some-object.txt"))
+	if len(storage.blobs.blobs) != 0 || len(storage.blobs.byData) != 0 {
+		t.Errorf("blobs not released\nwant 0 blobs\ngot  %d", len(storage.blobs.blobs))
+	}
+}
+
+func TestStorageMemorySharedContentNotModified(t *testing.T) {
+	storage := NewStorageMemory(nil).(*StorageMemory)
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "a.txt", Content: []byte("hello")}))
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "b.txt", Content: []byte("hello")}))
+	noError(t, storage.CreateNoncurrentObject(Object{BucketName: "some-bucket", Name: "b.txt", Generation: 1, Content: []byte("hello")}))
+	a, err := storage.GetObject("some-bucket", "a.txt")
+	noError(t, err)
+	a.Content[0] = 'J'
+	objs, err := storage.ListObjects("some-bucket")
+	noError(t, err)
+	objs[0].Content[1] = 'E'
+	noncurrent, err := storage.ListNoncurrentObjects("some-bucket")
+	noError(t, err)
+	noncurrent[0].Content[2] = 'L'
+	for _, name := range []string{"a.txt", "b.txt"} {
+		obj, err := storage.GetObject("some-bucket", name)
+		noError(t, err)
+		if string(obj.Content) != "hello" {
+			t.Errorf("content of %s modified through another object\nwant %q\ngot  %q", name, "hello", obj.Content)
+		}
+	}
+
+	noError(t, storage.CreateObject(a))
+	noError(t, storage.DeleteObject("some-bucket", "b.txt"))
+	noError(t, storage.DeleteNoncurrentObject("some-bucket", "b.txt", 1))
+	if len(storage.blobs.blobs) != 1 {
+		t.Fatalf("wrong number of blobs\nwant 1\ngot  %d", len(storage.blobs.blobs))
+	}
+	for key, b := range storage.blobs.blobs {
+		if key != sha256.Sum256(b.data) || string(b.data) != "Jello" {
+			t.Errorf("blob stored under a stale key: %q", b.data)
+		}
+	}
+}
+
+func TestStorageWriteBehindWarmStart(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "snapshot")
+
+	storage, err := NewStorageWriteBehind(nil, dir, FSOptions{})
+	noError(t, err)
+	noError(t, storage.CreateBucket(Bucket{Name: "some-bucket", VersioningEnabled: true}))
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("some content"), Generation: 2}))
+	noError(t, storage.CreateNoncurrentObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("old content"), Generation: 1}))
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("snapshot written before flushing: %v", err)
+	}
+	noError(t, storage.Flush())
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "unflushed.txt", Content: []byte("lost content")}))
+
+	restarted, err := NewStorageWriteBehind(nil, dir, FSOptions{})
+	noError(t, err)
+	bucket, err := restarted.GetBucket("some-bucket")
+	noError(t, err)
+	if !bucket.VersioningEnabled {
+		t.Errorf("bucket attributes were not restored: %+v", bucket)
+	}
+	obj, err := restarted.GetObject("some-bucket", "object.txt")
+	noError(t, err)
+	if string(obj.Content) != "some content" || obj.Generation != 2 {
+		t.Errorf("wrong object after restart: %+v", obj)
+	}
+	noncurrent, err := restarted.GetNoncurrentObject("some-bucket", "object.txt", 1)
+	noError(t, err)
+	if string(noncurrent.Content) != "old content" {
+		t.Errorf("wrong noncurrent content\nwant %q\ngot  %q", "old content", noncurrent.Content)
+	}
+	_, err = restarted.GetObject("some-bucket", "unflushed.txt")
+	shouldError(t, err, "object created after the last flush was restored")
+
+	noError(t, restarted.DeleteObject("some-bucket", "object.txt"))
+	noError(t, restarted.Flush())
+	entries, err := ioutil.ReadDir(tempDir)
+	noError(t, err)
+	if len(entries) != 1 {
+		t.Errorf("leftover directories after flushing: %v", entries)
+	}
+	again, err := NewStorageWriteBehind(nil, dir, FSOptions{})
+	noError(t, err)
+	_, err = again.GetObject("some-bucket", "object.txt")
+	shouldError(t, err, "deleted object was restored")
+}
+
+func TestStorageWriteBehindInterruptedSwap(t *testing.T) {
+	var tests = []struct {
+		name            string
+		keepNewSnapshot bool
+		expectedContent string
+	}{
+		{"interrupted before moving the new snapshot", false, "old content"},
+		{"interrupted after moving the old snapshot", true, "new content"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+			dir := filepath.Join(tempDir, "snapshot")
+			for _, snapshot := range []struct{ dir, content string }{
+				{dir, "old content"},
+				{dir + ".tmp123", "new content"},
+			} {
+				storage, err := NewStorageWriteBehind(nil, snapshot.dir, FSOptions{})
+				noError(t, err)
+				noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte(snapshot.content)}))
+				noError(t, storage.Flush())
+			}
+			noError(t, os.Rename(dir, dir+".tmp123.old"))
+			if !test.keepNewSnapshot {
+				noError(t, os.RemoveAll(dir+".tmp123"))
+			}
+
+			restarted, err := NewStorageWriteBehind(nil, dir, FSOptions{})
+			noError(t, err)
+			obj, err := restarted.GetObject("some-bucket", "object.txt")
+			noError(t, err)
+			if string(obj.Content) != test.expectedContent {
+				t.Errorf("wrong content after recovering the snapshot\nwant %q\ngot  %q", test.expectedContent, obj.Content)
+			}
+			names, err := readDirNames(tempDir)
+			noError(t, err)
+			if len(names) != 1 || names[0] != "snapshot" {
+				t.Errorf("wrong directories after recovering the snapshot\nwant [snapshot]\ngot  %v", names)
+			}
+		})
+	}
+}
+
+func TestStorageFSConcurrentListing(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	storage, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{ListWorkers: 4})
+	noError(t, err)
+	const bucketName = "some-bucket"
+	var expectedNames []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("dir/object-%03d", i)
+		expectedNames = append(expectedNames, name)
+		noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: name, Content: []byte(name)}))
+		noError(t, storage.CreateNoncurrentObject(Object{BucketName: bucketName, Name: name, Generation: int64(100 - i), Content: []byte(name)}))
+	}
+	noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: "other.txt"}))
+
+	objects, prefixes, err := storage.ListObjectsWithPrefix(bucketName, "dir/", "")
+	noError(t, err)
+	if len(prefixes) != 0 {
+		t.Errorf("unexpected prefixes: %v", prefixes)
+	}
+	var names []string
+	for _, obj := range objects {
+		if string(obj.Content) != obj.Name {
+			t.Errorf("wrong content for %s: %q", obj.Name, obj.Content)
+		}
+		names = append(names, obj.Name)
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("wrong names\nwant %v\ngot  %v", expectedNames, names)
+	}
+	noncurrent, err := storage.ListNoncurrentObjects(bucketName)
+	noError(t, err)
+	if len(noncurrent) != 100 || noncurrent[0].Name != expectedNames[0] || noncurrent[99].Generation != 1 {
+		t.Errorf("wrong noncurrent objects: %d objects", len(noncurrent))
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, bucketName, "dir%2Fobject-050"), []byte("not json"), 0600)
+	noError(t, err)
+	_, _, err = storage.ListObjectsWithPrefix(bucketName, "dir/", "")
+	shouldError(t, err, "listing with a corrupted object file")
+}
+
+func TestStorageFSOpenObject(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const bucketName = "some-bucket"
+	storage, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: "dir/object.txt", Content: []byte("some content"), ContentType: "text/plain"}))
+
+	obj, f, err := storage.(ObjectOpener).OpenObject(bucketName, "dir/object.txt")
+	noError(t, err)
+	if f == nil {
+		t.Fatal("no content file for uncompressed object")
+	}
+	defer f.Close()
+	if obj.Content != nil || obj.ContentType != "text/plain" {
+		t.Errorf("wrong object: %+v", obj)
+	}
+	noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: "dir/object.txt", Content: []byte("new content")}))
+	content, err := ioutil.ReadAll(f)
+	noError(t, err)
+	if string(content) != "some content" {
+		t.Errorf("wrong content from file opened before replacing the object\nwant %q\ngot  %q", "some content", content)
+	}
+
+	compressed, err := NewStorageFSWithOptions(nil, tempDir, FSOptions{Compression: CompressionGzip})
+	noError(t, err)
+	noError(t, compressed.CreateObject(Object{BucketName: bucketName, Name: "compressed.txt", Content: []byte("compressed content")}))
+	obj, f, err = compressed.(ObjectOpener).OpenObject(bucketName, "compressed.txt")
+	noError(t, err)
+	if f != nil {
+		f.Close()
+		t.Error("unexpected content file for compressed object")
+	}
+	if string(obj.Content) != "compressed content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "compressed content", obj.Content)
+	}
+
+	noError(t, storage.DeleteObject(bucketName, "dir/object.txt"))
+	if names, _ := readDirNames(filepath.Join(tempDir, contentDir, bucketName)); len(names) != 0 {
+		t.Errorf("content files not removed with the object: %v", names)
+	}
+}
+
+func TestStorageFSMetadataUpdate(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const bucketName = "some-bucket"
+	storage, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	obj := Object{BucketName: bucketName, Name: "object.txt", Content: []byte("some content"), Generation: 1, Md5Hash: "hash", Crc32c: "crc"}
+	noError(t, storage.CreateObject(obj))
+	contentFile := filepath.Join(tempDir, contentDir, bucketName, "object.txt#1")
+	info, err := os.Stat(contentFile)
+	noError(t, err)
+
+	obj.ContentType = "text/plain"
+	obj.Metageneration = 2
+	noError(t, storage.CreateObject(obj))
+	updatedInfo, err := os.Stat(contentFile)
+	noError(t, err)
+	if !os.SameFile(info, updatedInfo) {
+		t.Error("content file rewritten on a metadata update")
+	}
+
+	noError(t, storage.CreateObject(Object{BucketName: bucketName, Name: "object.txt", Content: []byte("new content"), Generation: 2}))
+	names, err := readDirNames(filepath.Join(tempDir, contentDir, bucketName))
+	noError(t, err)
+	if len(names) != 1 || names[0] != "object.txt#2" {
+		t.Errorf("wrong content files after replacing the object\nwant [object.txt#2]\ngot  %v", names)
+	}
+	stored, err := storage.GetObject(bucketName, "object.txt")
+	noError(t, err)
+	if string(stored.Content) != "new content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "new content", stored.Content)
+	}
+}
+
+func TestStorageFSOverwriteWithoutHashes(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	storage, err := NewStorageFS(nil, tempDir)
+	noError(t, err)
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("aaaa"), Generation: 42}))
+	noError(t, storage.CreateObject(Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("bbbb"), Generation: 42}))
+	stored, err := storage.GetObject("some-bucket", "object.txt")
+	noError(t, err)
+	if string(stored.Content) != "bbbb" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "bbbb", stored.Content)
+	}
+}
+
+func TestStorageFaults(t *testing.T) {
+	storage := NewStorageFaults(NewStorageMemory(nil))
+	noError(t, storage.CreateBucket(Bucket{Name: "some-bucket"}))
+	noError(t, storage.CreateBucket(Bucket{Name: "other-bucket"}))
+	obj := Object{BucketName: "some-bucket", Name: "object.txt", Content: []byte("content")}
+
+	storage.Inject(Fault{Kind: FaultDiskFull, BucketName: "some-bucket"})
+	err := storage.CreateObject(obj)
+	var faultErr *FaultError
+	if !errors.As(err, &faultErr) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("wrong error for disk full\nwant %v\ngot  %v", syscall.ENOSPC, err)
+	}
+	noError(t, storage.CreateObject(Object{BucketName: "other-bucket", Name: "object.txt"}))
+	_, err = storage.GetBucket("some-bucket")
+	noError(t, err)
+	storage.Clear()
+	noError(t, storage.CreateObject(obj))
+
+	storage.Inject(Fault{Kind: FaultCorruptedMetadata, Operation: "GetObject", Times: 2})
+	for i := 0; i < 2; i++ {
+		_, err = storage.GetObject("some-bucket", "object.txt")
+		shouldError(t, err, "unexpected <nil> error for corrupted metadata")
+	}
+	_, err = storage.GetObject("some-bucket", "object.txt")
+	noError(t, err)
+
+	storage.Inject(Fault{Kind: FaultPermissionDenied, Operation: "ListObjects"})
+	_, err = storage.ListObjects("some-bucket")
+	if !errors.Is(err, syscall.EACCES) {
+		t.Errorf("wrong error for permission denied\nwant %v\ngot  %v", syscall.EACCES, err)
+	}
+	_, _, err = storage.ListObjectsWithPrefix("some-bucket", "", "")
+	shouldError(t, err, "unexpected <nil> error listing with prefix")
+}
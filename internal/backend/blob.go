@@ -0,0 +1,100 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "crypto/sha256"
+
+// blobStore deduplicates the content of objects stored in memory, so objects
+// with the same content (copies, rewrites or repeated uploads of the same
+// fixture) share a single byte slice.
+//
+// Blobs are reference counted and dropped once no object points to them.
+// The content of a blob is copied from the first object that registers it,
+// so callers may reuse their buffers, and StorageMemory hands out copies of
+// it, see ownContent, so changes made by callers to the content they read
+// never reach the blob or the other objects that share it.
+//
+// It's not safe for concurrent use, callers must synchronize access.
+type blobStore struct {
+	blobs map[[sha256.Size]byte]*blob
+
+	// byData indexes blobs by the address of their content, so releasing
+	// the content of a stored object doesn't need to hash it again.
+	byData map[*byte]*blob
+}
+
+type blob struct {
+	key  [sha256.Size]byte
+	data []byte
+	refs int
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{
+		blobs:  make(map[[sha256.Size]byte]*blob),
+		byData: make(map[*byte]*blob),
+	}
+}
+
+// acquire returns the shared copy of data, registering a new reference to it.
+func (s *blobStore) acquire(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	key := sha256.Sum256(data)
+	b, ok := s.blobs[key]
+	if !ok {
+		b = &blob{key: key, data: append([]byte(nil), data...)}
+		s.blobs[key] = b
+		s.byData[&b.data[0]] = b
+	}
+	b.refs++
+	return b.data
+}
+
+// release drops a reference to data, previously returned by acquire.
+func (s *blobStore) release(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b := s.lookup(data)
+	if b == nil {
+		return
+	}
+	b.refs--
+	if b.refs <= 0 {
+		delete(s.blobs, b.key)
+		delete(s.byData, &b.data[0])
+	}
+}
+
+// lookup returns the blob whose content is data itself, as returned by
+// acquire, if any.
+func (s *blobStore) lookup(data []byte) *blob {
+	b, ok := s.byData[&data[0]]
+	if !ok || len(b.data) != len(data) {
+		return nil
+	}
+	return b
+}
+
+// ownContent returns obj with a copy of its content, so the shared blob can't
+// be modified through it.
+func ownContent(obj Object) Object {
+	if len(obj.Content) > 0 {
+		obj.Content = append([]byte(nil), obj.Content...)
+	}
+	return obj
+}
+
+// ownContents works like ownContent, for a list of objects, returning a new
+// slice.
+func ownContents(objects []Object) []Object {
+	result := make([]Object, len(objects))
+	for i, obj := range objects {
+		result[i] = ownContent(obj)
+	}
+	return result
+}
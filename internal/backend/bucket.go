@@ -0,0 +1,70 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "time"
+
+// Bucket represents the bucket that is stored within the fake server.
+type Bucket struct {
+	Name                  string            `json:"-"`
+	TimeCreated           time.Time         `json:",omitempty"`
+	DefaultEventBasedHold bool              `json:",omitempty"`
+	VersioningEnabled     bool              `json:",omitempty"`
+	SoftDeleteRetention   time.Duration     `json:",omitempty"`
+	ReadOnly              bool              `json:",omitempty"`
+	Location              string            `json:",omitempty"`
+	Labels                map[string]string `json:",omitempty"`
+	LifecycleRules        []LifecycleRule   `json:",omitempty"`
+	CorsRules             []CorsRule        `json:",omitempty"`
+	CustomPlacement       []string          `json:",omitempty"`
+	HierarchicalNamespace bool              `json:",omitempty"`
+	RequesterPays         bool              `json:",omitempty"`
+	RPO                   string            `json:",omitempty"`
+	UploadDefaults        *UploadDefaults   `json:",omitempty"`
+}
+
+// UploadDefaults are the attributes assigned to objects uploaded to a bucket
+// without them.
+type UploadDefaults struct {
+	ContentTypes map[string]string `json:",omitempty"`
+	CacheControl string            `json:",omitempty"`
+	Metadata     map[string]string `json:",omitempty"`
+}
+
+// LifecycleRule is a rule of the lifecycle configuration of a bucket, in the
+// format of the JSON API.
+type LifecycleRule struct {
+	Action    LifecycleAction    `json:"action"`
+	Condition LifecycleCondition `json:"condition"`
+}
+
+// LifecycleAction is the action taken by a lifecycle rule.
+type LifecycleAction struct {
+	Type         string `json:"type"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// LifecycleCondition is the condition that objects must match for the action
+// of a lifecycle rule to be taken.
+type LifecycleCondition struct {
+	Age                     *int64   `json:"age,omitempty"`
+	CreatedBefore           string   `json:"createdBefore,omitempty"`
+	IsLive                  *bool    `json:"isLive,omitempty"`
+	MatchesStorageClass     []string `json:"matchesStorageClass,omitempty"`
+	MatchesPrefix           []string `json:"matchesPrefix,omitempty"`
+	MatchesSuffix           []string `json:"matchesSuffix,omitempty"`
+	NumNewerVersions        int64    `json:"numNewerVersions,omitempty"`
+	DaysSinceNoncurrentTime int64    `json:"daysSinceNoncurrentTime,omitempty"`
+	NoncurrentTimeBefore    string   `json:"noncurrentTimeBefore,omitempty"`
+}
+
+// CorsRule is an entry of the CORS configuration of a bucket, in the format
+// of the JSON API.
+type CorsRule struct {
+	Origin         []string `json:"origin,omitempty"`
+	Method         []string `json:"method,omitempty"`
+	ResponseHeader []string `json:"responseHeader,omitempty"`
+	MaxAgeSeconds  int64    `json:"maxAgeSeconds,omitempty"`
+}
@@ -0,0 +1,306 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Kinds of simulated failures of the storage.
+const (
+	FaultDiskFull          = "disk-full"
+	FaultPermissionDenied  = "permission-denied"
+	FaultCorruptedMetadata = "corrupted-metadata"
+)
+
+// Fault is a simulated failure of the storage, injected with
+// StorageFaults.Inject.
+type Fault struct {
+	// Kind is one of FaultDiskFull, FaultPermissionDenied and
+	// FaultCorruptedMetadata. Disks getting full only affect writes, and
+	// corrupted metadata only affects reads.
+	Kind string
+
+	// Operation is the name of the method of Storage that fails, such as
+	// CreateObject. Empty matches any operation.
+	Operation string
+
+	// BucketName is the bucket affected by the fault. Empty matches any
+	// bucket.
+	BucketName string
+
+	// Times is the number of failures before the fault is cleared. Zero
+	// means that the fault lasts until Clear is called.
+	Times int
+}
+
+// ValidFaultKind reports whether the given kind of fault is supported.
+func ValidFaultKind(kind string) bool {
+	return kind == FaultDiskFull || kind == FaultPermissionDenied || kind == FaultCorruptedMetadata
+}
+
+// FaultError is the error returned by operations failing because of an
+// injected fault. Err is the error that the failure would cause in a real
+// file system.
+type FaultError struct {
+	Kind string
+	Err  error
+}
+
+func (e *FaultError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error, such as syscall.ENOSPC.
+func (e *FaultError) Unwrap() error {
+	return e.Err
+}
+
+var writeOperations = map[string]bool{
+	"CreateBucket":           true,
+	"UpdateBucket":           true,
+	"CreateObject":           true,
+	"DeleteObject":           true,
+	"CreateNoncurrentObject": true,
+	"DeleteNoncurrentObject": true,
+}
+
+func (f *Fault) matches(operation, bucketName string) bool {
+	if f.Operation != "" && f.Operation != operation {
+		return false
+	}
+	if f.BucketName != "" && bucketName != "" && f.BucketName != bucketName {
+		return false
+	}
+	switch f.Kind {
+	case FaultDiskFull:
+		return writeOperations[operation]
+	case FaultCorruptedMetadata:
+		return !writeOperations[operation]
+	}
+	return true
+}
+
+func (f *Fault) err(operation, target string) error {
+	switch f.Kind {
+	case FaultDiskFull:
+		return &FaultError{Kind: f.Kind, Err: &os.PathError{Op: "write", Path: target, Err: syscall.ENOSPC}}
+	case FaultPermissionDenied:
+		op := "open"
+		if writeOperations[operation] {
+			op = "write"
+		}
+		return &FaultError{Kind: f.Kind, Err: &os.PathError{Op: op, Path: target, Err: syscall.EACCES}}
+	default:
+		return &FaultError{Kind: f.Kind, Err: fmt.Errorf("invalid metadata in %s: %w", target, errors.New("unexpected end of JSON input"))}
+	}
+}
+
+// StorageFaults wraps a storage, making its operations fail with the faults
+// injected with Inject. Operations without a matching fault are delegated to
+// the wrapped storage.
+type StorageFaults struct {
+	Storage
+	mtx    sync.Mutex
+	count  int32
+	faults []*Fault
+}
+
+// NewStorageFaults wraps the given storage in a StorageFaults, without any
+// faults.
+func NewStorageFaults(storage Storage) *StorageFaults {
+	return &StorageFaults{Storage: storage}
+}
+
+// Inject adds a fault. Faults are matched in the order they were injected.
+func (s *StorageFaults) Inject(fault Fault) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = append(s.faults, &fault)
+	atomic.StoreInt32(&s.count, int32(len(s.faults)))
+}
+
+// Clear removes all faults.
+func (s *StorageFaults) Clear() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = nil
+	atomic.StoreInt32(&s.count, 0)
+}
+
+// check returns the error of the first fault matching the operation, if any.
+func (s *StorageFaults) check(operation, bucketName, objectName string) error {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, fault := range s.faults {
+		if !fault.matches(operation, bucketName) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+				atomic.StoreInt32(&s.count, int32(len(s.faults)))
+			}
+		}
+		return fault.err(operation, path.Join(bucketName, objectName))
+	}
+	return nil
+}
+
+// CreateBucket creates a bucket, unless a fault makes it fail.
+func (s *StorageFaults) CreateBucket(bucket Bucket) error {
+	if err := s.check("CreateBucket", bucket.Name, ""); err != nil {
+		return err
+	}
+	return s.Storage.CreateBucket(bucket)
+}
+
+// UpdateBucket updates a bucket, unless a fault makes it fail.
+func (s *StorageFaults) UpdateBucket(bucket Bucket) error {
+	if err := s.check("UpdateBucket", bucket.Name, ""); err != nil {
+		return err
+	}
+	return s.Storage.UpdateBucket(bucket)
+}
+
+// ListBuckets lists buckets, unless a fault makes it fail.
+func (s *StorageFaults) ListBuckets() ([]Bucket, error) {
+	if err := s.check("ListBuckets", "", ""); err != nil {
+		return nil, err
+	}
+	return s.Storage.ListBuckets()
+}
+
+// GetBucket returns a bucket, unless a fault makes it fail.
+func (s *StorageFaults) GetBucket(name string) (Bucket, error) {
+	if err := s.check("GetBucket", name, ""); err != nil {
+		return Bucket{}, err
+	}
+	return s.Storage.GetBucket(name)
+}
+
+// CreateObject stores an object, unless a fault makes it fail.
+func (s *StorageFaults) CreateObject(obj Object) error {
+	if err := s.check("CreateObject", obj.BucketName, obj.Name); err != nil {
+		return err
+	}
+	return s.Storage.CreateObject(obj)
+}
+
+// ListObjects lists the objects of a bucket, unless a fault makes it fail.
+func (s *StorageFaults) ListObjects(bucketName string) ([]Object, error) {
+	if err := s.check("ListObjects", bucketName, ""); err != nil {
+		return nil, err
+	}
+	return s.Storage.ListObjects(bucketName)
+}
+
+// ListObjectsWithPrefix lists the objects of a bucket, unless a fault makes
+// it fail. Faults for ListObjects also apply to it.
+func (s *StorageFaults) ListObjectsWithPrefix(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	if err := s.check("ListObjects", bucketName, ""); err != nil {
+		return nil, nil, err
+	}
+	return s.Storage.ListObjectsWithPrefix(bucketName, prefix, delimiter)
+}
+
+// ListObjectsMetadata lists the objects of a bucket without their content,
+// when the wrapped storage is a MetadataLister, unless a fault for
+// ListObjects makes it fail. With other storages, the content of the listed
+// objects is loaded.
+func (s *StorageFaults) ListObjectsMetadata(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	if err := s.check("ListObjects", bucketName, ""); err != nil {
+		return nil, nil, err
+	}
+	if lister, ok := s.Storage.(MetadataLister); ok {
+		return lister.ListObjectsMetadata(bucketName, prefix, delimiter)
+	}
+	return s.Storage.ListObjectsWithPrefix(bucketName, prefix, delimiter)
+}
+
+// GetObject returns an object, unless a fault makes it fail.
+func (s *StorageFaults) GetObject(bucketName, objectName string) (Object, error) {
+	if err := s.check("GetObject", bucketName, objectName); err != nil {
+		return Object{}, err
+	}
+	return s.Storage.GetObject(bucketName, objectName)
+}
+
+// DeleteObject deletes an object, unless a fault makes it fail.
+func (s *StorageFaults) DeleteObject(bucketName, objectName string) error {
+	if err := s.check("DeleteObject", bucketName, objectName); err != nil {
+		return err
+	}
+	return s.Storage.DeleteObject(bucketName, objectName)
+}
+
+// CreateNoncurrentObject stores a noncurrent generation of an object, unless
+// a fault makes it fail.
+func (s *StorageFaults) CreateNoncurrentObject(obj Object) error {
+	if err := s.check("CreateNoncurrentObject", obj.BucketName, obj.Name); err != nil {
+		return err
+	}
+	return s.Storage.CreateNoncurrentObject(obj)
+}
+
+// ListNoncurrentObjects lists the noncurrent generations of the objects of a
+// bucket, unless a fault makes it fail.
+func (s *StorageFaults) ListNoncurrentObjects(bucketName string) ([]Object, error) {
+	if err := s.check("ListNoncurrentObjects", bucketName, ""); err != nil {
+		return nil, err
+	}
+	return s.Storage.ListNoncurrentObjects(bucketName)
+}
+
+// GetNoncurrentObject returns a noncurrent generation of an object, unless a
+// fault makes it fail.
+func (s *StorageFaults) GetNoncurrentObject(bucketName, objectName string, generation int64) (Object, error) {
+	if err := s.check("GetNoncurrentObject", bucketName, objectName); err != nil {
+		return Object{}, err
+	}
+	return s.Storage.GetNoncurrentObject(bucketName, objectName, generation)
+}
+
+// DeleteNoncurrentObject deletes a noncurrent generation of an object, unless
+// a fault makes it fail.
+func (s *StorageFaults) DeleteNoncurrentObject(bucketName, objectName string, generation int64) error {
+	if err := s.check("DeleteNoncurrentObject", bucketName, objectName); err != nil {
+		return err
+	}
+	return s.Storage.DeleteNoncurrentObject(bucketName, objectName, generation)
+}
+
+// OpenObject opens an object for streaming, when the wrapped storage is an
+// ObjectOpener, unless a fault for GetObject makes it fail. With other
+// storages, the content of the returned object is loaded in memory, and the
+// returned file is nil.
+func (s *StorageFaults) OpenObject(bucketName, objectName string) (Object, *os.File, error) {
+	if err := s.check("GetObject", bucketName, objectName); err != nil {
+		return Object{}, nil, err
+	}
+	if opener, ok := s.Storage.(ObjectOpener); ok {
+		return opener.OpenObject(bucketName, objectName)
+	}
+	obj, err := s.Storage.GetObject(bucketName, objectName)
+	return obj, nil, err
+}
+
+// Flush flushes the wrapped storage, if it supports flushing.
+func (s *StorageFaults) Flush() error {
+	if f, ok := s.Storage.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -5,13 +5,22 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -24,18 +33,85 @@ import (
 //     |- object1
 //     \- object2
 // Bucket and object names are url path escaped, so there's no special meaning of forward slashes.
+// Bucket attributes are stored in rootDir/.buckets, noncurrent generations
+// of objects in rootDir/.noncurrent/bucket/object#generation, and the raw
+// content of objects in rootDir/.content/bucket/object#generation, see
+// CreateObject.
+// Access to rootDir is coordinated with flock(2) on rootDir/.lock, so multiple
+// processes can share the same root directory.
 type StorageFS struct {
-	rootDir string
-	mtx     sync.RWMutex
+	rootDir     string
+	compression Compression
+	aead        cipher.AEAD
+	listWorkers int
+	mtx         sync.RWMutex
 }
 
-// NewStorageFS creates an instance of StorageMemory
+// Compression identifies the algorithm used to compress object files on disk.
+type Compression string
+
+const (
+	// CompressionNone stores object files as plain JSON.
+	CompressionNone Compression = ""
+
+	// CompressionGzip stores object files compressed with gzip.
+	CompressionGzip Compression = "gzip"
+)
+
+// FSOptions are used to configure the filesystem backend.
+type FSOptions struct {
+	// Compression defines how object files are written to disk. Reads are
+	// transparent: compressed and uncompressed files can coexist in the same
+	// root directory.
+	Compression Compression
+
+	// EncryptionKey is an optional AES key (16, 24 or 32 bytes long) used to
+	// encrypt object files with AES-GCM. Files written without a key remain
+	// readable, but encrypted files can only be read with the same key.
+	EncryptionKey []byte
+
+	// ListWorkers is the number of object files read concurrently when
+	// listing objects. The default is defaultListWorkers.
+	ListWorkers int
+}
+
+// defaultListWorkers is the default number of object files read
+// concurrently when listing objects. Reads are mostly waiting on disk I/O, so
+// it's not tied to the number of CPUs.
+const defaultListWorkers = 16
+
+// NewStorageFS creates an instance of StorageFS
 func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
+	return NewStorageFSWithOptions(objects, rootDir, FSOptions{})
+}
+
+// NewStorageFSWithOptions creates an instance of StorageFS with custom options
+func NewStorageFSWithOptions(objects []Object, rootDir string, options FSOptions) (Storage, error) {
 	if !strings.HasSuffix(rootDir, "/") {
 		rootDir += "/"
 	}
+	switch options.Compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", options.Compression)
+	}
 	s := &StorageFS{
-		rootDir: rootDir,
+		rootDir:     rootDir,
+		compression: options.Compression,
+		listWorkers: options.ListWorkers,
+	}
+	if s.listWorkers <= 0 {
+		s.listWorkers = defaultListWorkers
+	}
+	if len(options.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(options.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		s.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
 	}
 	for _, o := range objects {
 		err := s.CreateObject(o)
@@ -46,112 +122,694 @@ func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
 	return s, nil
 }
 
-// CreateBucket creates a bucket
-func (s *StorageFS) CreateBucket(name string) error {
+// lockFileName is the name of the file, within the root directory, used to
+// coordinate access between processes sharing the same root directory.
+const lockFileName = ".lock"
+
+// lock acquires exclusive access to the root directory, both within this
+// process and across processes. The returned function releases the lock.
+func (s *StorageFS) lock() (func(), error) {
 	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	return s.createBucket(name)
+	unlock, err := s.flock(true)
+	if err != nil {
+		s.mtx.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mtx.Unlock()
+	}, nil
+}
+
+// rlock acquires shared access to the root directory, both within this
+// process and across processes. The returned function releases the lock.
+func (s *StorageFS) rlock() (func(), error) {
+	s.mtx.RLock()
+	unlock, err := s.flock(false)
+	if err != nil {
+		s.mtx.RUnlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mtx.RUnlock()
+	}, nil
+}
+
+// flock opens the lock file and locks it. Each call uses its own file
+// descriptor, as flock(2) locks are tied to the open file description.
+func (s *StorageFS) flock(exclusive bool) (func(), error) {
+	err := os.MkdirAll(s.rootDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.rootDir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// CreateBucket creates a bucket. If the bucket already exists, this method
+// does nothing.
+func (s *StorageFS) CreateBucket(bucket Bucket) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(s.bucketDir(bucket.Name)); err == nil {
+		return nil
+	}
+	err = s.createBucket(bucket.Name)
+	if err != nil {
+		return err
+	}
+	return s.writeBucketAttrs(bucket)
 }
 
 func (s *StorageFS) createBucket(name string) error {
-	return os.MkdirAll(filepath.Join(s.rootDir, url.PathEscape(name)), 0700)
+	return os.MkdirAll(s.bucketDir(name), 0700)
+}
+
+func (s *StorageFS) bucketDir(name string) string {
+	return filepath.Join(s.rootDir, url.PathEscape(name))
+}
+
+// bucketAttrsDir is the directory, within the root directory, that stores
+// the attributes of buckets. Bucket names can't start with a dot, so it's never
+// listed as a bucket.
+const bucketAttrsDir = ".buckets"
+
+func (s *StorageFS) bucketAttrsFile(name string) string {
+	return filepath.Join(s.rootDir, bucketAttrsDir, url.PathEscape(name))
+}
+
+func (s *StorageFS) writeBucketAttrs(bucket Bucket) error {
+	encoded, err := json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(s.rootDir, bucketAttrsDir), 0700)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(s.bucketAttrsFile(bucket.Name), encoded)
+}
+
+// UpdateBucket replaces the attributes of an existing bucket
+func (s *StorageFS) UpdateBucket(bucket Bucket) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(s.bucketDir(bucket.Name)); err != nil {
+		return err
+	}
+	return s.writeBucketAttrs(bucket)
 }
 
 // ListBuckets lists buckets
-func (s *StorageFS) ListBuckets() ([]string, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
+func (s *StorageFS) ListBuckets() ([]Bucket, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	infos, err := ioutil.ReadDir(s.rootDir)
 	if err != nil {
 		return nil, err
 	}
-	buckets := []string{}
+	buckets := []Bucket{}
 	for _, info := range infos {
-		if info.IsDir() {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
 			unescaped, err := url.PathUnescape(info.Name())
 			if err != nil {
 				return nil, fmt.Errorf("failed to unescape object name %s: %s", info.Name(), err)
 			}
-			buckets = append(buckets, unescaped)
+			bucket, err := s.getBucket(unescaped, info)
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, bucket)
 		}
 	}
 	return buckets, nil
 }
 
-// GetBucket checks if a bucket exists
-func (s *StorageFS) GetBucket(name string) error {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-	_, err := os.Stat(filepath.Join(s.rootDir, url.PathEscape(name)))
-	return err
+// GetBucket returns the attributes of a bucket, or an error if it doesn't
+// exist
+func (s *StorageFS) GetBucket(name string) (Bucket, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return Bucket{}, err
+	}
+	defer unlock()
+	info, err := os.Stat(s.bucketDir(name))
+	if err != nil {
+		return Bucket{}, err
+	}
+	return s.getBucket(name, info)
+}
+
+// getBucket reads the attributes of an existing bucket. Buckets created
+// implicitly, along with their objects, don't have an attributes file.
+func (s *StorageFS) getBucket(name string, info os.FileInfo) (Bucket, error) {
+	bucket := Bucket{TimeCreated: info.ModTime()}
+	encoded, err := s.readFile(s.bucketAttrsFile(name))
+	if err == nil {
+		err = json.Unmarshal(encoded, &bucket)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return Bucket{}, err
+	}
+	bucket.Name = name
+	return bucket, nil
 }
 
 // CreateObject stores an object
+//
+// When object files are neither compressed nor encrypted, the content is
+// stored raw in a separate file under rootDir/.content, so it can be streamed
+// with OpenObject. Otherwise it's stored in the object file, along with the
+// metadata.
+//
+// Content files are named after the generation of the object, and the object
+// file is only replaced once the new content file is complete, so an
+// interrupted write never pairs the metadata of an object with the content of
+// another generation. Updates that keep the generation and the content of the
+// object, such as metadata patches, only rewrite the object file.
 func (s *StorageFS) CreateObject(obj Object) error {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	err := s.createBucket(obj.BucketName)
+	unlock, err := s.lock()
 	if err != nil {
 		return err
 	}
-	encoded, err := json.Marshal(obj)
+	defer unlock()
+	err = s.createBucket(obj.BucketName)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filepath.Join(s.rootDir, url.PathEscape(obj.BucketName), url.PathEscape(obj.Name)), encoded, 0664)
+	var previousContentFile string
+	var unchanged bool
+	if previous, contentFile, err := s.getObjectMetadata(obj.BucketName, obj.Name); err == nil && contentFile {
+		previousContentFile = s.contentFile(obj.BucketName, obj.Name, previous.Generation)
+		unchanged = sameContent(previous, obj, previousContentFile)
+	}
+	file := objectFile{Object: obj}
+	var contentFile string
+	if s.compression == CompressionNone && s.aead == nil {
+		contentFile = s.contentFile(obj.BucketName, obj.Name, obj.Generation)
+		if !unchanged {
+			err = os.MkdirAll(filepath.Dir(contentFile), 0700)
+			if err != nil {
+				return err
+			}
+			err = s.writeFileAtomic(contentFile, obj.Content)
+			if err != nil {
+				return err
+			}
+		}
+		file.Content = nil
+		file.ContentFile = true
+	}
+	encoded, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	err = s.writeFile(filepath.Join(s.rootDir, url.PathEscape(obj.BucketName), url.PathEscape(obj.Name)), encoded)
+	if err != nil {
+		return err
+	}
+	if previousContentFile != "" && previousContentFile != contentFile {
+		os.Remove(previousContentFile)
+	}
+	return nil
 }
 
-// ListObjects lists the objects in a given bucket with a given prefix and delimeter
-func (s *StorageFS) ListObjects(bucketName string) ([]Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-	infos, err := ioutil.ReadDir(path.Join(s.rootDir, url.PathEscape(bucketName)))
+// sameContent reports whether obj, about to replace previous, has the content
+// already stored in the given content file of previous. Objects without
+// hashes are never considered the same, as there's nothing to compare their
+// content with.
+func sameContent(previous, obj Object, contentFile string) bool {
+	if obj.Md5Hash == "" || obj.Crc32c == "" {
+		return false
+	}
+	if previous.Generation != obj.Generation || previous.Md5Hash != obj.Md5Hash || previous.Crc32c != obj.Crc32c {
+		return false
+	}
+	info, err := os.Stat(contentFile)
+	return err == nil && info.Size() == int64(len(obj.Content))
+}
+
+// objectFile is the document stored in object files. ContentFile is set when
+// the content is stored in a separate file.
+type objectFile struct {
+	Object
+	ContentFile bool `json:",omitempty"`
+}
+
+// contentDir is the directory, within the root directory, that stores the
+// raw content of objects.
+const contentDir = ".content"
+
+func (s *StorageFS) contentFile(bucketName, objectName string, generation int64) string {
+	return filepath.Join(s.rootDir, contentDir, url.PathEscape(bucketName), url.PathEscape(objectName)+"#"+strconv.FormatInt(generation, 10))
+}
+
+// gzipMagic is the header of every gzip stream. Object files are otherwise
+// JSON documents, so the header is enough to tell them apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encryptedMagic prefixes object files encrypted with AES-GCM. It's followed
+// by the nonce and the sealed content.
+var encryptedMagic = []byte("fakegcs-aesgcm:")
+
+var errMissingEncryptionKey = errors.New("object file is encrypted, but no encryption key was provided")
+
+func (s *StorageFS) writeFile(filename string, data []byte) error {
+	if s.compression == CompressionGzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		sealed := append(append([]byte(nil), encryptedMagic...), nonce...)
+		data = s.aead.Seal(sealed, nonce, data, nil)
+	}
+	return s.writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the root directory and
+// renames it to filename, so readers in other processes never observe a
+// partially written file. Temporary files aren't directories, so they never
+// show up as buckets.
+func (s *StorageFS) writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(s.rootDir, ".object-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0664)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+func (s *StorageFS) readFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	objects := []Object{}
-	for _, info := range infos {
-		unescaped, err := url.PathUnescape(info.Name())
+	if bytes.HasPrefix(data, encryptedMagic) {
+		if s.aead == nil {
+			return nil, errMissingEncryptionKey
+		}
+		data = data[len(encryptedMagic):]
+		if len(data) < s.aead.NonceSize() {
+			return nil, fmt.Errorf("invalid encrypted object file %s", filename)
+		}
+		nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+		data, err = s.aead.Open(nil, nonce, sealed, nil)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unescape object name %s: %s", info.Name(), err)
+			return nil, fmt.Errorf("failed to decrypt object file %s: %s", filename, err)
 		}
-		object, err := s.getObject(bucketName, unescaped)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// ListObjects lists the objects in a given bucket, sorted by name
+func (s *StorageFS) ListObjects(bucketName string) ([]Object, error) {
+	objects, _, err := s.ListObjectsWithPrefix(bucketName, "", "")
+	return objects, err
+}
+
+// ListObjectsWithPrefix lists the objects in a given bucket whose names start
+// with prefix, sorted by name. When delimiter isn't empty, objects with the
+// delimiter in their names after prefix are grouped in the returned prefixes.
+//
+// Names are filtered before reading the files, so only the matching objects
+// are loaded, and they're loaded concurrently, see loadObjects.
+func (s *StorageFS) ListObjectsWithPrefix(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	return s.listObjects(bucketName, prefix, delimiter, s.getObject)
+}
+
+// ListObjectsMetadata works like ListObjectsWithPrefix, without loading the
+// content of the objects: only object files are read, and the size of
+// content files comes from their file info. Listed objects have no content,
+// and their size in Size.
+func (s *StorageFS) ListObjectsMetadata(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	return s.listObjects(bucketName, prefix, delimiter, s.getObjectWithoutContent)
+}
+
+func (s *StorageFS) listObjects(bucketName, prefix, delimiter string, load func(bucketName, objectName string) (Object, error)) ([]Object, []string, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+	entries, err := readDirNames(path.Join(s.rootDir, url.PathEscape(bucketName)))
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		unescaped, err := url.PathUnescape(entry)
 		if err != nil {
-			return nil, err
+			return nil, nil, fmt.Errorf("failed to unescape object name %s: %s", entry, err)
 		}
-		objects = append(objects, object)
+		names = append(names, unescaped)
+	}
+	sort.Strings(names)
+	indexes, prefixes := listSorted(len(names), func(i int) string { return names[i] }, prefix, delimiter)
+	objects, err := s.loadObjects(len(indexes), func(i int) (Object, error) {
+		return load(bucketName, names[indexes[i]])
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return objects, prefixes, nil
+}
+
+// readDirNames returns the names of the entries in a directory. Unlike
+// ioutil.ReadDir, it doesn't stat every entry, which dominates the cost of
+// reading large directories.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// loadObjects calls load for the indexes from 0 to n-1 using a bounded pool
+// of workers, and returns the loaded objects in the order of the indexes. It
+// stops at the first error.
+func (s *StorageFS) loadObjects(n int, load func(int) (Object, error)) ([]Object, error) {
+	objects := make([]Object, n)
+	workers := s.listWorkers
+	if workers > n {
+		workers = n
+	}
+	indexes := make(chan int)
+	done := make(chan struct{})
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				obj, err := load(i)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						close(done)
+					})
+					return
+				}
+				objects[i] = obj
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-done:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
 	}
 	return objects, nil
 }
 
 // GetObject get an object by bucket and name
 func (s *StorageFS) GetObject(bucketName, objectName string) (Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
+	unlock, err := s.rlock()
+	if err != nil {
+		return Object{}, err
+	}
+	defer unlock()
 	return s.getObject(bucketName, objectName)
 }
 
 func (s *StorageFS) getObject(bucketName, objectName string) (Object, error) {
-	encoded, err := ioutil.ReadFile(filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName)))
+	obj, contentFile, err := s.getObjectMetadata(bucketName, objectName)
+	if err != nil || !contentFile {
+		return obj, err
+	}
+	// content files are raw, they don't go through readFile.
+	obj.Content, err = ioutil.ReadFile(s.contentFile(bucketName, objectName, obj.Generation))
 	if err != nil {
 		return Object{}, err
 	}
-	var obj Object
-	err = json.Unmarshal(encoded, &obj)
+	return obj, nil
+}
+
+// getObjectWithoutContent returns an object with the size of its content in
+// Size, instead of the content itself.
+func (s *StorageFS) getObjectWithoutContent(bucketName, objectName string) (Object, error) {
+	obj, contentFile, err := s.getObjectMetadata(bucketName, objectName)
+	if err != nil {
+		return obj, err
+	}
+	if !contentFile {
+		obj.Size = int64(len(obj.Content))
+		obj.Content = nil
+		return obj, nil
+	}
+	info, err := os.Stat(s.contentFile(bucketName, objectName, obj.Generation))
 	if err != nil {
 		return Object{}, err
 	}
-	obj.Name = objectName
-	obj.BucketName = bucketName
+	obj.Size = info.Size()
 	return obj, nil
 }
 
+// getObjectMetadata reads an object file. contentFile is true when the
+// content of the object is in a separate file, in which case the returned
+// object has no content.
+func (s *StorageFS) getObjectMetadata(bucketName, objectName string) (obj Object, contentFile bool, err error) {
+	encoded, err := s.readFile(filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName)))
+	if err != nil {
+		return Object{}, false, err
+	}
+	var file objectFile
+	err = json.Unmarshal(encoded, &file)
+	if err != nil {
+		return Object{}, false, err
+	}
+	file.Name = objectName
+	file.BucketName = bucketName
+	return file.Object, file.ContentFile, nil
+}
+
+// OpenObject returns an object along with a file for reading its content,
+// without loading the content in memory. The file is nil for objects whose
+// content is stored in the object file, in which case the content is
+// returned in the object. Callers must close the file.
+//
+// The file keeps pointing to the same content even if the object is
+// replaced or deleted before it's closed.
+func (s *StorageFS) OpenObject(bucketName, objectName string) (Object, *os.File, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return Object{}, nil, err
+	}
+	defer unlock()
+	obj, contentFile, err := s.getObjectMetadata(bucketName, objectName)
+	if err != nil {
+		return Object{}, nil, err
+	}
+	if !contentFile {
+		obj, err = s.getObject(bucketName, objectName)
+		return obj, nil, err
+	}
+	f, err := os.Open(s.contentFile(bucketName, objectName, obj.Generation))
+	if err != nil {
+		return Object{}, nil, err
+	}
+	return obj, f, nil
+}
+
 // DeleteObject deletes an object by bucket and name
 func (s *StorageFS) DeleteObject(bucketName, objectName string) error {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if objectName == "" {
 		return fmt.Errorf("can't delete object with empty name")
 	}
-	return os.Remove(filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName)))
+	obj, contentFile, metadataErr := s.getObjectMetadata(bucketName, objectName)
+	err = os.Remove(filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName)))
+	if err != nil {
+		return err
+	}
+	if metadataErr == nil && contentFile {
+		if err := os.Remove(s.contentFile(bucketName, objectName, obj.Generation)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// noncurrentDir is the directory, within the root directory, that stores
+// noncurrent generations of objects.
+const noncurrentDir = ".noncurrent"
+
+func (s *StorageFS) noncurrentFile(bucketName, objectName string, generation int64) string {
+	return filepath.Join(s.rootDir, noncurrentDir, url.PathEscape(bucketName), url.PathEscape(objectName)+"#"+strconv.FormatInt(generation, 10))
+}
+
+// CreateNoncurrentObject stores a noncurrent generation of an object
+func (s *StorageFS) CreateNoncurrentObject(obj Object) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.MkdirAll(filepath.Join(s.rootDir, noncurrentDir, url.PathEscape(obj.BucketName)), 0700)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(s.noncurrentFile(obj.BucketName, obj.Name, obj.Generation), encoded)
+}
+
+// ListNoncurrentObjects lists the noncurrent generations of objects in a
+// given bucket, sorted by name and generation
+func (s *StorageFS) ListNoncurrentObjects(bucketName string) ([]Object, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, err := os.Stat(s.bucketDir(bucketName)); err != nil {
+		return nil, err
+	}
+	entries, err := readDirNames(filepath.Join(s.rootDir, noncurrentDir, url.PathEscape(bucketName)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	var generations []int64
+	for _, entry := range entries {
+		// PathEscape escapes '#', so the last one separates the name
+		// from the generation.
+		sep := strings.LastIndex(entry, "#")
+		if sep < 0 {
+			continue
+		}
+		name, err := url.PathUnescape(entry[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("failed to unescape object name %s: %s", entry, err)
+		}
+		generation, err := strconv.ParseInt(entry[sep+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid noncurrent object file %s: %s", entry, err)
+		}
+		names = append(names, name)
+		generations = append(generations, generation)
+	}
+	objects, err := s.loadObjects(len(names), func(i int) (Object, error) {
+		return s.getNoncurrentObject(bucketName, names[i], generations[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Name != objects[j].Name {
+			return objects[i].Name < objects[j].Name
+		}
+		return objects[i].Generation < objects[j].Generation
+	})
+	return objects, nil
+}
+
+// GetNoncurrentObject gets a noncurrent generation of an object
+func (s *StorageFS) GetNoncurrentObject(bucketName, objectName string, generation int64) (Object, error) {
+	unlock, err := s.rlock()
+	if err != nil {
+		return Object{}, err
+	}
+	defer unlock()
+	return s.getNoncurrentObject(bucketName, objectName, generation)
+}
+
+func (s *StorageFS) getNoncurrentObject(bucketName, objectName string, generation int64) (Object, error) {
+	encoded, err := s.readFile(s.noncurrentFile(bucketName, objectName, generation))
+	if err != nil {
+		return Object{}, err
+	}
+	var obj Object
+	err = json.Unmarshal(encoded, &obj)
+	if err != nil {
+		return Object{}, err
+	}
+	obj.Name = objectName
+	obj.BucketName = bucketName
+	return obj, nil
+}
+
+// DeleteNoncurrentObject deletes a noncurrent generation of an object
+func (s *StorageFS) DeleteNoncurrentObject(bucketName, objectName string, generation int64) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.Remove(s.noncurrentFile(bucketName, objectName, generation))
 }
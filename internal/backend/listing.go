@@ -0,0 +1,38 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sort"
+	"strings"
+)
+
+// listSorted walks a list of n names sorted in ascending order, returning the
+// indexes of the names that start with prefix and the prefixes that group
+// names containing the delimiter after prefix.
+//
+// It uses binary search to find where prefix starts in the list and to skip
+// over the names grouped in each prefix, so listing with a delimiter doesn't
+// visit every name in the bucket.
+func listSorted(n int, name func(int) string, prefix, delimiter string) ([]int, []string) {
+	var indexes []int
+	var prefixes []string
+	i := sort.Search(n, func(i int) bool { return name(i) >= prefix })
+	for i < n && strings.HasPrefix(name(i), prefix) {
+		objName := name(i)
+		if delimiter != "" {
+			if pos := strings.Index(objName[len(prefix):], delimiter); pos > -1 {
+				p := objName[:len(prefix)+pos+len(delimiter)]
+				prefixes = append(prefixes, p)
+				start := i
+				i += sort.Search(n-start, func(j int) bool { return !strings.HasPrefix(name(start+j), p) })
+				continue
+			}
+		}
+		indexes = append(indexes, i)
+		i++
+	}
+	return indexes, prefixes
+}
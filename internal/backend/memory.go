@@ -7,56 +7,100 @@ package backend
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
 // StorageMemory is an implementation of the backend storage that stores data in memory
+//
+// Objects in each bucket are kept sorted by name, so lookups and listings
+// by prefix don't need to scan the whole bucket. Objects with the same
+// content share it, see blobStore.
+//
+// Noncurrent generations are kept sorted by name and generation.
 type StorageMemory struct {
-	buckets map[string][]Object
-	mtx     sync.RWMutex
+	buckets     map[string][]Object
+	noncurrent  map[string][]Object
+	bucketAttrs map[string]Bucket
+	blobs       *blobStore
+	mtx         sync.RWMutex
 }
 
 // NewStorageMemory creates an instance of StorageMemory
 func NewStorageMemory(objects []Object) Storage {
 	s := &StorageMemory{
-		buckets: make(map[string][]Object),
+		buckets:     make(map[string][]Object),
+		noncurrent:  make(map[string][]Object),
+		bucketAttrs: make(map[string]Bucket),
+		blobs:       newBlobStore(),
 	}
 	for _, o := range objects {
+		o.Content = s.blobs.acquire(o.Content)
 		s.buckets[o.BucketName] = append(s.buckets[o.BucketName], o)
 	}
+	for _, objs := range s.buckets {
+		sort.SliceStable(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	}
 	return s
 }
 
-// CreateBucket creates a bucket
-func (s *StorageMemory) CreateBucket(name string) error {
+// CreateBucket creates a bucket. If the bucket already exists, this method
+// does nothing.
+func (s *StorageMemory) CreateBucket(bucket Bucket) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	if _, ok := s.buckets[name]; !ok {
-		s.buckets[name] = nil
+	if _, ok := s.buckets[bucket.Name]; !ok {
+		s.buckets[bucket.Name] = nil
+		s.bucketAttrs[bucket.Name] = bucket
 	}
 	return nil
 }
 
+// UpdateBucket replaces the attributes of an existing bucket
+func (s *StorageMemory) UpdateBucket(bucket Bucket) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.buckets[bucket.Name]; !ok {
+		return fmt.Errorf("no bucket named %s", bucket.Name)
+	}
+	s.bucketAttrs[bucket.Name] = bucket
+	return nil
+}
+
 // ListBuckets lists buckets
-func (s *StorageMemory) ListBuckets() ([]string, error) {
+func (s *StorageMemory) ListBuckets() ([]Bucket, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	buckets := []string{}
-	for bucket := range s.buckets {
-		buckets = append(buckets, bucket)
+	buckets := []Bucket{}
+	for name := range s.buckets {
+		buckets = append(buckets, s.getBucket(name))
 	}
 	return buckets, nil
 }
 
-// GetBucket checks if a bucket exists
-func (s *StorageMemory) GetBucket(name string) error {
+// GetBucket returns the attributes of a bucket, or an error if it doesn't
+// exist
+func (s *StorageMemory) GetBucket(name string) (Bucket, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	if _, ok := s.buckets[name]; !ok {
-		return fmt.Errorf("no bucket named %s", name)
+		return Bucket{}, fmt.Errorf("no bucket named %s", name)
 	}
-	return nil
+	return s.getBucket(name), nil
+}
+
+// getBucket returns the attributes of an existing bucket. Buckets created
+// implicitly, along with their objects, only have a name.
+//
+// It doesn't lock the mutex, callers must lock the mutex before calling this
+// method.
+func (s *StorageMemory) getBucket(name string) Bucket {
+	bucket, ok := s.bucketAttrs[name]
+	if !ok {
+		bucket = Bucket{Name: name}
+	}
+	return bucket
 }
 
 // CreateObject stores an object
@@ -64,30 +108,33 @@ func (s *StorageMemory) CreateObject(obj Object) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	index := s.findObject(obj)
-	if index < 0 {
-		s.buckets[obj.BucketName] = append(s.buckets[obj.BucketName], obj)
-	} else {
+	obj.Content = s.blobs.acquire(obj.Content)
+	index, found := s.findObject(obj)
+	if found {
+		s.blobs.release(s.buckets[obj.BucketName][index].Content)
 		s.buckets[obj.BucketName][index] = obj
+		return nil
 	}
+	objects := append(s.buckets[obj.BucketName], Object{})
+	copy(objects[index+1:], objects[index:])
+	objects[index] = obj
+	s.buckets[obj.BucketName] = objects
 	return nil
 }
 
-// findObject looks for an object in its bucket and return the index where it
-// was found, or -1 if the object doesn't exist.
+// findObject looks for an object in its bucket and returns the index where it
+// was found, or the index where it should be inserted along with false if the
+// object doesn't exist.
 //
 // It doesn't lock the mutex, callers must lock the mutex before calling this
 // method.
-func (s *StorageMemory) findObject(obj Object) int {
-	for i, o := range s.buckets[obj.BucketName] {
-		if obj.ID() == o.ID() {
-			return i
-		}
-	}
-	return -1
+func (s *StorageMemory) findObject(obj Object) (int, bool) {
+	objects := s.buckets[obj.BucketName]
+	index := sort.Search(len(objects), func(i int) bool { return objects[i].Name >= obj.Name })
+	return index, index < len(objects) && objects[index].Name == obj.Name
 }
 
-// ListObjects lists the objects in a given bucket with a given prefix and delimeter
+// ListObjects lists the objects in a given bucket, sorted by name
 func (s *StorageMemory) ListObjects(bucketName string) ([]Object, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -95,7 +142,25 @@ func (s *StorageMemory) ListObjects(bucketName string) ([]Object, error) {
 	if !ok {
 		return nil, errors.New("bucket not found")
 	}
-	return objects, nil
+	return ownContents(objects), nil
+}
+
+// ListObjectsWithPrefix lists the objects in a given bucket whose names start
+// with prefix, sorted by name. When delimiter isn't empty, objects with the
+// delimiter in their names after prefix are grouped in the returned prefixes.
+func (s *StorageMemory) ListObjectsWithPrefix(bucketName, prefix, delimiter string) ([]Object, []string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	objects, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, nil, errors.New("bucket not found")
+	}
+	indexes, prefixes := listSorted(len(objects), func(i int) string { return objects[i].Name }, prefix, delimiter)
+	result := make([]Object, len(indexes))
+	for i, index := range indexes {
+		result[i] = ownContent(objects[index])
+	}
+	return result, prefixes, nil
 }
 
 // GetObject get an object by bucket and name
@@ -103,22 +168,97 @@ func (s *StorageMemory) GetObject(bucketName, objectName string) (Object, error)
 	obj := Object{BucketName: bucketName, Name: objectName}
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	index := s.findObject(obj)
-	if index < 0 {
+	index, found := s.findObject(obj)
+	if !found {
 		return obj, errors.New("object not found")
 	}
-	return s.buckets[bucketName][index], nil
+	return ownContent(s.buckets[bucketName][index]), nil
 }
 
 // DeleteObject deletes an object by bucket and name
 func (s *StorageMemory) DeleteObject(bucketName, objectName string) error {
 	obj := Object{BucketName: bucketName, Name: objectName}
-	index := s.findObject(obj)
-	if index < 0 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	index, found := s.findObject(obj)
+	if !found {
 		return fmt.Errorf("no such object in bucket %s: %s", bucketName, objectName)
 	}
 	bucket := s.buckets[obj.BucketName]
-	bucket[index] = bucket[len(bucket)-1]
+	s.blobs.release(bucket[index].Content)
+	copy(bucket[index:], bucket[index+1:])
 	s.buckets[obj.BucketName] = bucket[:len(bucket)-1]
 	return nil
 }
+
+// CreateNoncurrentObject stores a noncurrent generation of an object,
+// replacing any existing object with the same name and generation.
+func (s *StorageMemory) CreateNoncurrentObject(obj Object) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	obj.Content = s.blobs.acquire(obj.Content)
+	index, found := s.findNoncurrentObject(obj.BucketName, obj.Name, obj.Generation)
+	if found {
+		s.blobs.release(s.noncurrent[obj.BucketName][index].Content)
+		s.noncurrent[obj.BucketName][index] = obj
+		return nil
+	}
+	objects := append(s.noncurrent[obj.BucketName], Object{})
+	copy(objects[index+1:], objects[index:])
+	objects[index] = obj
+	s.noncurrent[obj.BucketName] = objects
+	return nil
+}
+
+// findNoncurrentObject works like findObject, for noncurrent generations.
+//
+// It doesn't lock the mutex, callers must lock the mutex before calling this
+// method.
+func (s *StorageMemory) findNoncurrentObject(bucketName, objectName string, generation int64) (int, bool) {
+	objects := s.noncurrent[bucketName]
+	index := sort.Search(len(objects), func(i int) bool {
+		if objects[i].Name != objectName {
+			return objects[i].Name > objectName
+		}
+		return objects[i].Generation >= generation
+	})
+	found := index < len(objects) && objects[index].Name == objectName && objects[index].Generation == generation
+	return index, found
+}
+
+// ListNoncurrentObjects lists the noncurrent generations of objects in a
+// given bucket, sorted by name and generation
+func (s *StorageMemory) ListNoncurrentObjects(bucketName string) ([]Object, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if _, ok := s.buckets[bucketName]; !ok {
+		return nil, errors.New("bucket not found")
+	}
+	return ownContents(s.noncurrent[bucketName]), nil
+}
+
+// GetNoncurrentObject gets a noncurrent generation of an object
+func (s *StorageMemory) GetNoncurrentObject(bucketName, objectName string, generation int64) (Object, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	index, found := s.findNoncurrentObject(bucketName, objectName, generation)
+	if !found {
+		return Object{BucketName: bucketName, Name: objectName}, errors.New("object not found")
+	}
+	return ownContent(s.noncurrent[bucketName][index]), nil
+}
+
+// DeleteNoncurrentObject deletes a noncurrent generation of an object
+func (s *StorageMemory) DeleteNoncurrentObject(bucketName, objectName string, generation int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	index, found := s.findNoncurrentObject(bucketName, objectName, generation)
+	if !found {
+		return fmt.Errorf("no such object in bucket %s: %s#%d", bucketName, objectName, generation)
+	}
+	objects := s.noncurrent[bucketName]
+	s.blobs.release(objects[index].Content)
+	copy(objects[index:], objects[index+1:])
+	s.noncurrent[bucketName] = objects[:len(objects)-1]
+	return nil
+}
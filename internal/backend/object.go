@@ -4,13 +4,46 @@
 
 package backend
 
+import "time"
+
 // Object represents the object that is stored within the fake server.
 type Object struct {
-	BucketName string `json:"-"`
-	Name       string `json:"-"`
-	Content    []byte
-	Crc32c     string
-	Md5Hash    string
+	BucketName       string `json:"-"`
+	Name             string `json:"-"`
+	Content          []byte
+	Crc32c           string
+	Md5Hash          string
+	ContentType      string
+	ContentLanguage  string
+	CacheControl     string
+	ContentEncoding  string `json:",omitempty"`
+	DecompressedSize int64  `json:",omitempty"`
+	StorageClass     string
+	Generation       int64
+	Metageneration   int64
+	EventBasedHold   bool
+	RetentionMode    string    `json:",omitempty"`
+	RetainUntilTime  time.Time `json:",omitempty"`
+	ComponentCount   int       `json:",omitempty"`
+	TimeCreated      time.Time `json:",omitempty"`
+	TimeDeleted      time.Time `json:",omitempty"`
+	SoftDeleteTime   time.Time `json:",omitempty"`
+	HardDeleteTime   time.Time `json:",omitempty"`
+	ACL              []ACLRule `json:",omitempty"`
+
+	Metadata map[string]string `json:",omitempty"`
+
+	TimeStorageClassUpdated time.Time `json:",omitempty"`
+
+	// Size is the size of the content of objects listed without it, see
+	// MetadataLister. It's zero in objects with their content loaded.
+	Size int64 `json:"-"`
+}
+
+// ACLRule is an entry of the access control list of an object.
+type ACLRule struct {
+	Entity string
+	Role   string
 }
 
 // ID is useful for comparing objects
@@ -4,13 +4,38 @@
 
 package backend
 
+import "os"
+
 // Storage is the generic interface for implementing the backend storage of the server
 type Storage interface {
-	CreateBucket(name string) error
-	ListBuckets() ([]string, error)
-	GetBucket(name string) error
+	CreateBucket(bucket Bucket) error
+	UpdateBucket(bucket Bucket) error
+	ListBuckets() ([]Bucket, error)
+	GetBucket(name string) (Bucket, error)
 	CreateObject(obj Object) error
 	ListObjects(bucketName string) ([]Object, error)
+	ListObjectsWithPrefix(bucketName, prefix, delimiter string) ([]Object, []string, error)
 	GetObject(bucketName, objectName string) (Object, error)
 	DeleteObject(bucketName, objectName string) error
+
+	// Noncurrent generations of objects, replaced or deleted in buckets
+	// with versioning enabled, and soft-deleted objects. They're stored
+	// apart from live objects, and identified by name and generation.
+	CreateNoncurrentObject(obj Object) error
+	ListNoncurrentObjects(bucketName string) ([]Object, error)
+	GetNoncurrentObject(bucketName, objectName string, generation int64) (Object, error)
+	DeleteNoncurrentObject(bucketName, objectName string, generation int64) error
+}
+
+// MetadataLister is implemented by backends that can list objects without
+// loading their content, such as StorageFS, which stores it in files. Listed
+// objects have no content, and their size in Object.Size.
+type MetadataLister interface {
+	ListObjectsMetadata(bucketName, prefix, delimiter string) ([]Object, []string, error)
+}
+
+// ObjectOpener is implemented by backends that can stream the content of
+// objects from files, without loading it in memory. See StorageFS.OpenObject.
+type ObjectOpener interface {
+	OpenObject(bucketName, objectName string) (Object, *os.File, error)
 }
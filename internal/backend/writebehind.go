@@ -0,0 +1,249 @@
+// Copyright 2019 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// StorageWriteBehind is an implementation of the backend storage that serves
+// all operations from memory, like StorageMemory, and persists its state to a
+// directory when Flush is called. The directory holds a snapshot in the
+// layout of StorageFS, which is loaded when the storage is created, so the
+// state survives restarts.
+//
+// Snapshots are written to a sibling directory of dir and swapped in place
+// once complete, so an interrupted flush never leaves a partial snapshot. A
+// flush interrupted in the middle of the swap leaves no dir, and the snapshot
+// is recovered from the sibling directories when the storage is loaded, see
+// recoverSnapshot.
+type StorageWriteBehind struct {
+	*StorageMemory
+	dir      string
+	options  FSOptions
+	dirty    int32
+	flushMtx sync.Mutex
+}
+
+// NewStorageWriteBehind creates an instance of StorageWriteBehind, loading
+// the snapshot in dir, if any. The given objects are added on top of the
+// snapshot.
+func NewStorageWriteBehind(objects []Object, dir string, options FSOptions) (*StorageWriteBehind, error) {
+	snapshot, err := loadSnapshot(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	s := &StorageWriteBehind{
+		StorageMemory: NewStorageMemory(append(snapshot.objects, objects...)).(*StorageMemory),
+		dir:           dir,
+		options:       options,
+	}
+	for _, bucket := range snapshot.buckets {
+		s.StorageMemory.CreateBucket(bucket)
+		s.StorageMemory.UpdateBucket(bucket)
+	}
+	for _, obj := range snapshot.noncurrent {
+		s.StorageMemory.CreateNoncurrentObject(obj)
+	}
+	if len(objects) > 0 {
+		s.markDirty()
+	}
+	return s, nil
+}
+
+type snapshot struct {
+	buckets    []Bucket
+	objects    []Object
+	noncurrent []Object
+}
+
+func loadSnapshot(dir string, options FSOptions) (snapshot, error) {
+	var snap snapshot
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		recovered, err := recoverSnapshot(dir)
+		if err != nil || !recovered {
+			return snap, err
+		}
+	}
+	fs, err := NewStorageFSWithOptions(nil, dir, options)
+	if err != nil {
+		return snap, err
+	}
+	snap.buckets, err = fs.ListBuckets()
+	if err != nil {
+		return snap, err
+	}
+	for _, bucket := range snap.buckets {
+		objects, err := fs.ListObjects(bucket.Name)
+		if err != nil {
+			return snap, err
+		}
+		snap.objects = append(snap.objects, objects...)
+		noncurrent, err := fs.ListNoncurrentObjects(bucket.Name)
+		if err != nil {
+			return snap, err
+		}
+		snap.noncurrent = append(snap.noncurrent, noncurrent...)
+	}
+	return snap, nil
+}
+
+// recoverSnapshot restores dir from the directories left behind by a flush
+// interrupted while swapping snapshots, reporting whether there was one.
+//
+// The swap moves dir to <tmp>.old and then <tmp> to dir, where <tmp> holds a
+// complete snapshot, so <tmp> is preferred when both are present, and <tmp>.old
+// is restored otherwise. Temporary directories without a matching .old are
+// flushes interrupted before the swap, which are possibly partial, so they're
+// ignored.
+func recoverSnapshot(dir string) (bool, error) {
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+	names, err := readDirNames(parent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	prefix := filepath.Base(dir) + ".tmp"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".old") {
+			continue
+		}
+		oldDir := filepath.Join(parent, name)
+		tmpDir := strings.TrimSuffix(oldDir, ".old")
+		if err := os.Rename(tmpDir, dir); err == nil {
+			return true, os.RemoveAll(oldDir)
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		return true, os.Rename(oldDir, dir)
+	}
+	return false, nil
+}
+
+// takeSnapshot copies the state of the storage. Contents are immutable, so
+// they're shared with the copy.
+func (s *StorageWriteBehind) takeSnapshot() snapshot {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var snap snapshot
+	for name, objects := range s.buckets {
+		snap.buckets = append(snap.buckets, s.getBucket(name))
+		snap.objects = append(snap.objects, objects...)
+		snap.noncurrent = append(snap.noncurrent, s.noncurrent[name]...)
+	}
+	return snap
+}
+
+func (s *StorageWriteBehind) markDirty() {
+	atomic.StoreInt32(&s.dirty, 1)
+}
+
+// Flush writes the state of the storage to its directory. It's a no-op when
+// nothing changed since the last flush.
+func (s *StorageWriteBehind) Flush() error {
+	s.flushMtx.Lock()
+	defer s.flushMtx.Unlock()
+	if !atomic.CompareAndSwapInt32(&s.dirty, 1, 0) {
+		return nil
+	}
+	err := s.writeSnapshot(s.takeSnapshot())
+	if err != nil {
+		s.markDirty()
+	}
+	return err
+}
+
+func (s *StorageWriteBehind) writeSnapshot(snap snapshot) error {
+	dir := filepath.Clean(s.dir)
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(parent, filepath.Base(dir)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	fs, err := NewStorageFSWithOptions(nil, tmpDir, s.options)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range snap.buckets {
+		if err := fs.CreateBucket(bucket); err != nil {
+			return err
+		}
+	}
+	for _, obj := range snap.objects {
+		if err := fs.CreateObject(obj); err != nil {
+			return err
+		}
+	}
+	for _, obj := range snap.noncurrent {
+		if err := fs.CreateNoncurrentObject(obj); err != nil {
+			return err
+		}
+	}
+	oldDir := tmpDir + ".old"
+	if err := os.Rename(dir, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.Rename(oldDir, dir)
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// CreateBucket creates a bucket. If the bucket already exists, this method
+// does nothing.
+func (s *StorageWriteBehind) CreateBucket(bucket Bucket) error {
+	err := s.StorageMemory.CreateBucket(bucket)
+	s.markDirty()
+	return err
+}
+
+// UpdateBucket replaces the attributes of an existing bucket
+func (s *StorageWriteBehind) UpdateBucket(bucket Bucket) error {
+	err := s.StorageMemory.UpdateBucket(bucket)
+	s.markDirty()
+	return err
+}
+
+// CreateObject stores an object
+func (s *StorageWriteBehind) CreateObject(obj Object) error {
+	err := s.StorageMemory.CreateObject(obj)
+	s.markDirty()
+	return err
+}
+
+// DeleteObject deletes an object by bucket and name
+func (s *StorageWriteBehind) DeleteObject(bucketName, objectName string) error {
+	err := s.StorageMemory.DeleteObject(bucketName, objectName)
+	s.markDirty()
+	return err
+}
+
+// CreateNoncurrentObject stores a noncurrent generation of an object,
+// replacing any existing object with the same name and generation.
+func (s *StorageWriteBehind) CreateNoncurrentObject(obj Object) error {
+	err := s.StorageMemory.CreateNoncurrentObject(obj)
+	s.markDirty()
+	return err
+}
+
+// DeleteNoncurrentObject deletes a noncurrent generation of an object
+func (s *StorageWriteBehind) DeleteNoncurrentObject(bucketName, objectName string, generation int64) error {
+	err := s.StorageMemory.DeleteNoncurrentObject(bucketName, objectName, generation)
+	s.markDirty()
+	return err
+}